@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Aggregate queries summarise the documents they match rather than returning
+// them. They are evaluated as the documents stream past, keeping only a running
+// total for each aggregate of each group, so memory grows with the number of
+// groups, and the number of distinct values for distinct, but not with the
+// number of documents.
+//
+//	count(*)     Number of documents
+//	count(path)  Number of documents with a value other than null at the path
+//	sum(path)    Sum of the numbers at the path, or 0
+//	avg(path)    Mean of the numbers at the path, or null if there are none
+//	min(path)    Least string, number or boolean at the path, or null
+//	max(path)    Greatest string, number or boolean at the path, or null
+//	distinct(path) Distinct strings, numbers and booleans at the path, in order
+//
+// The values of an array at the path are aggregated one by one. Documents are
+// grouped by the whole value at the GROUP BY path, and those without one are
+// grouped under null.
+
+// Functions that can be used as aggregates
+var aggregateFuncs = map[string]bool{
+	"count": true, "sum": true, "avg": true, "min": true, "max": true, "distinct": true,
+}
+
+// queryAggregate is an aggregate function of the values at a path.
+type queryAggregate struct {
+	fn    string
+	field *queryField // Field to aggregate, or nil for count(*)
+	alias string
+}
+
+func (a queryAggregate) String() string {
+	if a.field == nil {
+		return a.fn + "(*)"
+	}
+	return fmt.Sprintf("%s(%s)", a.fn, a.field)
+}
+
+// name returns the name of the aggregate's column in the rows.
+func (a queryAggregate) name() string {
+	if a.alias != "" {
+		return a.alias
+	}
+	return a.String()
+}
+
+// checkAggregate checks that an aggregate query only selects the GROUP BY
+// field besides aggregates, and orders by one of its columns.
+func (q *Query) checkAggregate() error {
+	columns := make(map[string]bool)
+	if q.GroupBy != nil {
+		columns[q.GroupBy.String()] = true
+	}
+	for _, field := range q.Fields {
+		if q.GroupBy == nil || !sameField(field, *q.GroupBy) {
+			return fmt.Errorf("%w: %s must be in GROUP BY or an aggregate", ErrBadQuery, field)
+		}
+	}
+	for _, agg := range q.Aggregates {
+		if columns[agg.name()] {
+			return fmt.Errorf("%w: more than one column is named %s", ErrBadQuery, agg.name())
+		}
+		columns[agg.name()] = true
+		columns[agg.String()] = true
+	}
+
+	if q.orderColumn != "" && !columns[q.orderColumn] {
+		if q.OrderBy != nil && q.GroupBy != nil && sameField(*q.OrderBy, *q.GroupBy) {
+			// The GROUP BY field written another way
+			q.orderColumn = q.GroupBy.String()
+		} else {
+			return fmt.Errorf("%w: cannot order by %s, which is not a column", ErrBadQuery, q.orderColumn)
+		}
+	}
+	return nil
+}
+
+// aggregateState is the running total of an aggregate for a group.
+type aggregateState struct {
+	count    int // Documents, or numbers for sum and avg
+	sum      float64
+	min, max string // Encoded least and greatest values
+	distinct map[string]interface{}
+}
+
+// add adds a document's value at the aggregate's field to the state.
+func (st *aggregateState) add(agg queryAggregate, key string, doc interface{}) {
+	if agg.field == nil {
+		st.count++
+		return
+	}
+	value, ok := agg.field.value(key, doc)
+	if !ok || value == nil {
+		return
+	}
+	if agg.fn == "count" {
+		st.count++
+		return
+	}
+
+	anyElement(value, func(v interface{}) bool {
+		switch agg.fn {
+		case "sum", "avg":
+			if n, ok := v.(float64); ok {
+				st.sum += n
+				st.count++
+			}
+		case "min", "max", "distinct":
+			encoded, ok := encodeIndexValue(v)
+			if !ok {
+				break
+			}
+			if st.min == "" || encoded < st.min {
+				st.min = encoded
+			}
+			if encoded > st.max {
+				st.max = encoded
+			}
+			if agg.fn == "distinct" {
+				if st.distinct == nil {
+					st.distinct = make(map[string]interface{})
+				}
+				st.distinct[encoded] = v
+			}
+		}
+		return false
+	})
+}
+
+// result returns the value of the aggregate.
+func (st *aggregateState) result(agg queryAggregate) interface{} {
+	switch agg.fn {
+	case "count":
+		return float64(st.count)
+	case "sum":
+		return st.sum
+	case "avg":
+		if st.count == 0 {
+			return nil
+		}
+		return st.sum / float64(st.count)
+	case "min", "max":
+		encoded := st.min
+		if agg.fn == "max" {
+			encoded = st.max
+		}
+		if encoded == "" {
+			return nil
+		}
+		return decodeIndexValue(encoded)
+	}
+
+	encoded := make([]string, 0, len(st.distinct))
+	for e := range st.distinct {
+		encoded = append(encoded, e)
+	}
+	sort.Strings(encoded)
+	values := make([]interface{}, len(encoded))
+	for i, e := range encoded {
+		values[i] = st.distinct[e]
+	}
+	return values
+}
+
+// decodeIndexValue decodes a value encoded by encodeIndexValue.
+func decodeIndexValue(encoded string) interface{} {
+	switch encoded[0] {
+	case indexBool:
+		return encoded[1] == 1
+	case indexNumber:
+		bits := binary.BigEndian.Uint64([]byte(encoded[1:9]))
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits)
+	}
+	s := strings.TrimSuffix(encoded[1:], "\x00\x01")
+	return strings.ReplaceAll(s, "\x00\xff", "\x00")
+}
+
+// queryGroup is the documents that have the same value at the GROUP BY path.
+type queryGroup struct {
+	value  interface{}
+	order  string // Value of the column the rows are ordered by, encoded
+	states []aggregateState
+}
+
+// executeAggregate runs an aggregate query with the plan, returning a row for
+// each group. The rows have no key.
+func (s *Store) executeAggregate(q *Query, plan *QueryPlan) ([]QueryRow, error) {
+	groups := make(map[string]*queryGroup)
+
+	err := s.candidates(plan, func(key string, value json.RawMessage) bool {
+		var doc interface{}
+		if err := json.Unmarshal(value, &doc); err != nil {
+			doc = nil
+		}
+		if q.Where != nil && !q.Where.matches(key, doc) {
+			return true
+		}
+
+		var groupValue interface{}
+		if q.GroupBy != nil {
+			groupValue, _ = q.GroupBy.value(key, doc)
+		}
+		// Objects are marshalled with their keys sorted, so equal values
+		// always have the same JSON
+		id, _ := json.Marshal(groupValue)
+		group, ok := groups[string(id)]
+		if !ok {
+			group = &queryGroup{value: groupValue, states: make([]aggregateState, len(q.Aggregates))}
+			groups[string(id)] = group
+		}
+		for i, agg := range q.Aggregates {
+			group.states[i].add(agg, key, doc)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without GROUP BY there is always a row, even if no documents matched
+	if q.GroupBy == nil && len(groups) == 0 {
+		groups["null"] = &queryGroup{states: make([]aggregateState, len(q.Aggregates))}
+	}
+
+	type groupRow struct {
+		id    string
+		group *queryGroup
+		row   map[string]interface{}
+	}
+	rows := make([]groupRow, 0, len(groups))
+	for id, group := range groups {
+		row := make(map[string]interface{}, len(q.Aggregates)+1)
+		if q.GroupBy != nil {
+			row[q.GroupBy.String()] = group.value
+		}
+		// Groups are in order of their values unless ordered by an aggregate
+		orderValue := group.value
+		for i, agg := range q.Aggregates {
+			result := group.states[i].result(agg)
+			row[agg.name()] = result
+			if q.orderColumn == agg.name() || q.orderColumn == agg.String() {
+				orderValue = result
+			}
+		}
+
+		// Values that cannot be ordered come first
+		group.order, _ = encodeIndexValue(orderValue)
+		rows = append(rows, groupRow{id: id, group: group, row: row})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.group.order != b.group.order {
+			return (a.group.order < b.group.order) != q.Desc
+		}
+		return a.id < b.id
+	})
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+	}
+
+	result := make([]QueryRow, len(rows))
+	for i, r := range rows {
+		value, err := json.Marshal(r.row)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = QueryRow{Value: value}
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateQuery(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+
+	orders := map[string]string{
+		"o1": `{"city": "paris", "total": 10, "items": ["a", "b"]}`,
+		"o2": `{"city": "paris", "total": 30, "items": ["b"]}`,
+		"o3": `{"city": "rome", "total": 5}`,
+		"o4": `{"city": "rome", "total": "n/a", "items": ["c"]}`,
+		"o5": `{"total": 100}`,
+	}
+	for key, value := range orders {
+		assert.NoError(t, kv.Set(key, json.RawMessage(value)))
+	}
+
+	tests := []struct {
+		query string
+		want  string // Rows as JSON
+	}{
+		{"SELECT count(*), sum(total), avg(total), min(total), max(total)",
+			`[{"count(*)": 5, "sum(total)": 145, "avg(total)": 36.25, "min(total)": 5, "max(total)": "n/a"}]`},
+		{"SELECT count(city), count(items), distinct(items)",
+			`[{"count(city)": 4, "count(items)": 3, "distinct(items)": ["a", "b", "c"]}]`},
+		{"SELECT count(*) AS n, avg(total) WHERE city = 'nowhere'",
+			`[{"n": 0, "avg(total)": null}]`},
+		{"SELECT city, count(*) AS n, sum(total) GROUP BY city",
+			`[{"city": null, "n": 1, "sum(total)": 100}, {"city": "paris", "n": 2, "sum(total)": 40}, {"city": "rome", "n": 2, "sum(total)": 5}]`},
+		{"SELECT sum(total) WHERE total > 5 GROUP BY city ORDER BY sum(total) DESC LIMIT 2",
+			`[{"city": null, "sum(total)": 100}, {"city": "paris", "sum(total)": 40}]`},
+		{"SELECT max(total) AS top GROUP BY $.city ORDER BY top",
+			`[{"$.city": "paris", "top": 30}, {"$.city": null, "top": 100}, {"$.city": "rome", "top": "n/a"}]`},
+		{"SELECT city GROUP BY city ORDER BY city DESC",
+			`[{"city": "rome"}, {"city": "paris"}, {"city": null}]`},
+	}
+
+	check := func() {
+		t.Helper()
+		for _, test := range tests {
+			result, err := kv.Query(test.query)
+			if !assert.NoError(t, err, test.query) {
+				continue
+			}
+			rows, _ := json.Marshal(result.Rows)
+			var values []json.RawMessage
+			for _, row := range result.Rows {
+				assert.Empty(t, row.Key, test.query)
+				values = append(values, row.Value)
+			}
+			got, _ := json.Marshal(values)
+			assert.JSONEq(t, test.want, string(got), "%s: %s", test.query, rows)
+		}
+	}
+
+	// The same results with a full scan, and with a secondary index
+	check()
+	assert.NoError(t, kv.CreateIndex("total", "total"))
+	check()
+
+	for _, query := range []string{
+		"SELECT * GROUP BY city",
+		"SELECT total, count(*)",
+		"SELECT total, count(*) GROUP BY city",
+		"SELECT sum(*)",
+		"SELECT count(*) ORDER BY total",
+		"SELECT count(*) AS n, sum(total) AS n",
+		"SELECT * ORDER BY count(*)",
+	} {
+		_, err := kv.Query(query)
+		assert.ErrorIs(t, err, ErrBadQuery, query)
+	}
+
+	result, err := kv.Query("EXPLAIN SELECT count(*) WHERE total >= 10 GROUP BY city ORDER BY count(*) DESC")
+	assert.NoError(t, err)
+	assert.Equal(t, "index range on total [>= 10], filter total >= 10, aggregate count(*), group by city, order by count(*) DESC", result.Plan.String())
+}
+
+func TestDecodeIndexValue(t *testing.T) {
+	for _, value := range []interface{}{false, true, -1e10, -1.5, 0.0, 0.5, 1e10, "", "a\x00b", "héllo"} {
+		encoded, ok := encodeIndexValue(value)
+		assert.True(t, ok)
+		assert.Equal(t, value, decodeIndexValue(encoded))
+	}
+}
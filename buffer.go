@@ -3,136 +3,404 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
 type Entry struct {
-	key   uint32
-	value json.RawMessage
+	key     string
+	value   json.RawMessage
+	deleted bool   // Tombstone for a key deleted since the last flush
+	version uint64 // Version of the key the value is from
+	expires int64  // When the value expires, in nanoseconds since the epoch, or 0 if it never does
 }
 
 type Buffer struct {
-	cacheSize      int
-	cache          map[uint32]*Entry // Simple cahe
-	cacheQueue     []*Entry          // Most recent at the front
-	WriteBatch     []Operation       // Write buffer
+	cacheMu        sync.Mutex // Readers share the store's lock, so the cache needs its own
+	cache          Cache
+	WriteBatch     []Operation // Write buffer, holding the latest operation for each key
 	WriteBatchSize int
-	BatchTimer     *time.Timer
+	FlushInterval  time.Duration // Longest a write waits in the write batch before it is flushed
 	Disk           *Disk
+	Checkpoint     func(upto uint64) error // Called once a flush has been synced to disk
+
+	// Locker guards the write batch and the disk. BatchPut must be called with
+	// it held; the background flusher, Flush and Close take it themselves.
+	Locker sync.Locker
+
+	pending    map[string]int         // Index in WriteBatch of each key's operation
+	superseded map[string][]Operation // Operations replaced in WriteBatch, oldest first
+	batchOps   int                    // Operations added since the last flush, including coalesced ones
+	batchSeq   uint64                 // Highest sequence number in the write batch
+
+	batchStarted chan struct{} // Tells the flusher a write has gone into an empty batch
+	stop         chan struct{} // Closed to stop the flusher
+	stopped      chan struct{} // Closed once the flusher has stopped
+	closeOnce    sync.Once
 }
 
 type Operation struct {
-	Key   uint32
-	Value json.RawMessage
+	Seq     uint64 // Sequence number in the write-ahead log, which is also the version it writes
+	Key     string
+	Value   json.RawMessage
+	Deleted bool  // Tombstone, the key is removed from disk when flushed
+	Time    int64 // When the operation was applied, in nanoseconds since the epoch
+	Expires int64 // When the value expires, in nanoseconds since the epoch, or 0 if it never does
+}
+
+// entry returns the cache entry for the operation.
+func (op Operation) entry() Entry {
+	return Entry{key: op.Key, value: op.Value, deleted: op.Deleted, version: op.Seq, expires: op.Expires}
 }
 
-func NewBuffer(cacheSize int, writeBatchSize int, disk *Disk) *Buffer {
-	return &Buffer{
-		cacheSize:      cacheSize,
-		cache:          make(map[uint32]*Entry),
-		cacheQueue:     make([]*Entry, 0, cacheSize),
+// NewBuffer creates a buffer in front of the disk, reading through the cache,
+// and starts its background flusher. The buffer is guarded by its own mutex
+// unless Locker is replaced before the first write.
+func NewBuffer(cache Cache, writeBatchSize int, disk *Disk) *Buffer {
+	b := &Buffer{
+		cache:          cache,
 		WriteBatch:     make([]Operation, 0, writeBatchSize),
 		WriteBatchSize: writeBatchSize,
+		pending:        make(map[string]int),
+		superseded:     make(map[string][]Operation),
+		FlushInterval:  FlushDuration,
 		Disk:           disk,
+		Locker:         &sync.Mutex{},
+		batchStarted:   make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
 	}
-}
 
-// Timer for batch operations
-var BatchTimer *time.Timer
+	go b.flusher()
+
+	return b
+}
 
-// Duration after which the buffer is flushed to disk
+// Default duration after which the buffer is flushed to disk
 const FlushDuration = 1 * time.Minute
 
-func (b *Buffer) UpdateCache(key uint32, value json.RawMessage) {
-	if entry, ok := b.cache[key]; ok {
-		entry.value = value
-		b.moveToFront(entry)
-		return
-	}
+// UpdateCache caches the entry, replacing what was cached for its key.
+func (b *Buffer) UpdateCache(entry Entry) {
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
 
-	if len(b.cacheQueue) == b.cacheSize {
-		delete(b.cache, b.cacheQueue[b.cacheSize-1].key)
-		b.cacheQueue = b.cacheQueue[:b.cacheSize-1]
-	}
+	b.cache.Put(entry)
+}
+
+// CacheStats returns the cache's hit, miss and eviction counts and its current size.
+func (b *Buffer) CacheStats() CacheStats {
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
 
-	entry := &Entry{key, value}
-	b.cache[key] = entry
-	b.cacheQueue = append([]*Entry{entry}, b.cacheQueue...)
+	return b.cache.Stats()
 }
 
+// BatchPut applies the operations to the cache and adds them to the write batch.
+// Deletes are recorded as tombstones, which remove the key from disk on the next
+// flush. An operation on a key already in the batch replaces the earlier one, so
+// each key is written to disk once per flush, unless the versions it replaces
+// are still needed by snapshots or the retention window.
 func (b *Buffer) BatchPut(ops []Operation) {
 	if len(b.WriteBatch) == 0 && len(ops) > 0 {
-		b.BatchTimer = time.AfterFunc(FlushDuration, b.flushBuffer)
+		// Start the clock on flushing this batch
+		select {
+		case b.batchStarted <- struct{}{}:
+		default:
+		}
+	}
+
+	for _, op := range ops {
+		b.UpdateCache(op.entry())
 	}
 
 	for _, op := range ops {
-		b.UpdateCache(op.Key, op.Value)
+		if i, ok := b.pending[op.Key]; ok {
+			b.superseded[op.Key] = append(b.superseded[op.Key], b.WriteBatch[i])
+			b.WriteBatch[i] = op
+		} else {
+			b.pending[op.Key] = len(b.WriteBatch)
+			b.WriteBatch = append(b.WriteBatch, op)
+		}
+		if op.Seq > b.batchSeq {
+			b.batchSeq = op.Seq
+		}
+	}
+	b.batchOps += len(ops)
+
+	// Coalesced operations still count, so the log never has more than a
+	// batch's worth of operations to replay
+	if b.batchOps >= b.WriteBatchSize {
+		if err := b.flushBuffer(); err != nil {
+			fmt.Println("Error flushing buffer:", err)
+		}
 	}
+}
 
-	b.WriteBatch = append(b.WriteBatch, ops...)
+// flusher runs in the background, flushing each write batch once it has
+// waited FlushInterval, unless it filled up and was flushed before then.
+func (b *Buffer) flusher() {
+	defer close(b.stopped)
 
-	if len(b.WriteBatch) >= b.WriteBatchSize {
-		b.flushBuffer()
+	// The timer only runs while there is a batch waiting to be flushed
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-b.batchStarted:
+			timer.Reset(b.FlushInterval)
+		case <-timer.C:
+			if err := b.Flush(); err != nil {
+				fmt.Println("Error flushing buffer:", err)
+			}
+		case <-b.stop:
+			timer.Stop()
+			return
+		}
 	}
 }
 
-func (b *Buffer) Put(key uint32, value json.RawMessage) {
-	b.UpdateCache(key, value)
+// Flush writes the write batch to disk now, rather than waiting for it to fill up or time out.
+func (b *Buffer) Flush() error {
+	b.Locker.Lock()
+	defer b.Locker.Unlock()
+
+	return b.flushBuffer()
+}
+
+// Close stops the background flusher, flushes whatever is left in the write
+// batch and waits for a compaction running in the background to finish.
+func (b *Buffer) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+	})
+	<-b.stopped
+
+	err := b.Flush()
+	b.waitForCompaction()
+	return err
+}
+
+// Compact rewrites the data file as Disk.Compact does, once a compaction
+// already running has finished. Locker is only held while it starts and while
+// it finishes, so reads and writes carry on while the records are copied.
+func (b *Buffer) Compact() (CompactionStats, error) {
+	b.Locker.Lock()
+	for b.Disk.compaction != nil {
+		b.Locker.Unlock()
+		b.waitForCompaction()
+		b.Locker.Lock()
+	}
+	c, err := b.Disk.startCompaction()
+	b.Locker.Unlock()
+	if err != nil {
+		return CompactionStats{}, err
+	}
+
+	return b.runCompaction(c)
+}
 
-	// Add operation to batch buffer
-	b.WriteBatch = append(b.WriteBatch, Operation{Key: key, Value: value})
+// runCompaction copies the records of a compaction started with Locker held,
+// then takes Locker to finish it.
+func (b *Buffer) runCompaction(c *compaction) (CompactionStats, error) {
+	err := c.copy()
 
-	// If this is the first operation in the buffer, start the timer
-	if len(b.WriteBatch) == 1 {
-		b.BatchTimer = time.AfterFunc(FlushDuration, b.flushBuffer)
+	b.Locker.Lock()
+	defer b.Locker.Unlock()
+	if err != nil {
+		c.abort()
+		return c.stats, err
 	}
+	return c.finish()
+}
 
-	// If buffer size has reached the maximum, flush to disk
-	if len(b.WriteBatch) >= b.WriteBatchSize {
-		b.flushBuffer()
+// waitForCompaction waits for the compaction running, if there is one, to finish.
+func (b *Buffer) waitForCompaction() {
+	b.Locker.Lock()
+	c := b.Disk.compaction
+	b.Locker.Unlock()
+	if c != nil {
+		<-c.done
 	}
 }
 
-func (b *Buffer) flushBuffer() {
-	// Flush the write buffer to disk
+// flushBuffer writes the write batch to disk. It must be called with Locker
+// held. If it fails, the batch is kept so the next flush tries it again.
+func (b *Buffer) flushBuffer() error {
+	if len(b.WriteBatch) == 0 {
+		return nil
+	}
+
+	// Flush the write buffer to disk, along with the replaced versions that
+	// are still needed, oldest first
+	retention := b.Disk.retention()
 	for _, op := range b.WriteBatch {
-		err := b.Disk.Put(op.Key, op.Value)
-		if err != nil {
-			fmt.Println("Error writing to disk:", err)
-			return
+		for _, old := range retention.keep(b.superseded[op.Key], op) {
+			if err := b.Disk.Write(old); err != nil {
+				return fmt.Errorf("writing to disk: %w", err)
+			}
+		}
+		if err := b.Disk.Write(op); err != nil {
+			return fmt.Errorf("writing to disk: %w", err)
+		}
+	}
+
+	// The batch must be durable before the log is told it can skip it
+	if err := b.Disk.Sync(); err != nil {
+		return fmt.Errorf("syncing disk: %w", err)
+	}
+	if b.Checkpoint != nil {
+		// Operations replaced by later ones in the batch are covered too
+		if err := b.Checkpoint(b.batchSeq); err != nil {
+			return fmt.Errorf("writing checkpoint: %w", err)
 		}
 	}
 
-	// Clear the buffer and stop the timer after flushing
+	// Clear the buffer after flushing
 	b.WriteBatch = []Operation{}
-	if b.BatchTimer != nil {
-		b.BatchTimer.Stop()
-		b.BatchTimer = nil
+	b.pending = make(map[string]int)
+	b.superseded = make(map[string][]Operation)
+	b.batchOps = 0
+	b.batchSeq = 0
+
+	// Reclaim the space taken by overwritten and deleted records, copying them
+	// in the background so writes are not held up
+	if b.Disk.compaction == nil && b.Disk.NeedsCompaction() {
+		c, err := b.Disk.startCompaction()
+		if err != nil {
+			fmt.Println("Error compacting data file:", err)
+			return nil
+		}
+		go func() {
+			if _, err := b.runCompaction(c); err != nil {
+				fmt.Println("Error compacting data file:", err)
+			}
+		}()
 	}
+
+	return nil
 }
 
-func (b *Buffer) Get(key uint32) (json.RawMessage, bool) {
-	if entry, ok := b.cache[key]; ok {
-		b.moveToFront(entry)
-		return entry.value, true
+// pendingOp returns the operation waiting in the write batch for the key, if
+// there is one. It must be called with Locker or the store's read lock held.
+func (b *Buffer) pendingOp(key string) (Operation, bool) {
+	i, ok := b.pending[key]
+	if !ok {
+		return Operation{}, false
 	}
+	return b.WriteBatch[i], true
+}
 
-	value, ok := b.Disk.Get(key)
+// pendingRange returns the operations waiting in the write batch for keys from
+// start up to but not including end, sorted by key. An empty end leaves the
+// range open. It must be called with Locker or the store's read lock held.
+func (b *Buffer) pendingRange(start string, end string) []Operation {
+	var ops []Operation
+	for _, op := range b.WriteBatch {
+		if op.Key >= start && (end == "" || op.Key < end) {
+			ops = append(ops, op)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Key < ops[j].Key
+	})
+	return ops
+}
 
-	// Update the cache with the value from disk
-	if ok {
-		b.UpdateCache(key, value)
+// GetAt returns the value the key had at the version: the value of the latest
+// write to it with that version or an earlier one. Values that have expired
+// since read as missing.
+func (b *Buffer) GetAt(key string, version uint64) (json.RawMessage, bool) {
+	op, ok, err := b.versionAt(key, version)
+	if err != nil {
+		fmt.Println("Error reading history:", err)
+		return nil, false
+	}
+	if !ok || op.Deleted || op.expired(time.Now().UnixNano()) {
+		return nil, false
 	}
+	return op.Value, true
+}
 
-	return value, ok
+// versionAt returns the write that gave the key its value at the version,
+// looking in the write batch before the disk.
+func (b *Buffer) versionAt(key string, version uint64) (Operation, bool, error) {
+	if op, ok := b.pendingOp(key); ok {
+		// The batch holds the latest write to the key and the ones it replaced
+		ops := append(append([]Operation(nil), b.superseded[key]...), op)
+		for i := len(ops) - 1; i >= 0; i-- {
+			if ops[i].Seq <= version {
+				return ops[i], true, nil
+			}
+		}
+	}
+
+	return b.Disk.versionAt(key, version)
 }
 
-func (b *Buffer) moveToFront(entry *Entry) {
-	for i, e := range b.cacheQueue {
-		if e == entry {
-			b.cacheQueue = append(b.cacheQueue[:i], b.cacheQueue[i+1:]...)
-			b.cacheQueue = append([]*Entry{entry}, b.cacheQueue...)
-			break
+// History returns the versions of the key, newest first, starting with those
+// still in the write batch.
+func (b *Buffer) History(key string) ([]KeyVersion, error) {
+	var versions []KeyVersion
+	if op, ok := b.pendingOp(key); ok {
+		versions = append(versions, op.keyVersion())
+		for i := len(b.superseded[key]) - 1; i >= 0; i-- {
+			versions = append(versions, b.superseded[key][i].keyVersion())
 		}
 	}
+
+	onDisk, err := b.Disk.History(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(versions, onDisk...), nil
+}
+
+// Get returns the value of the key from the cache, the write batch or the
+// disk, in that order. The disk is only read for keys with no pending write,
+// since it does not have them yet.
+func (b *Buffer) Get(key string) (json.RawMessage, bool) {
+	value, _, ok := b.GetVersion(key)
+	return value, ok
+}
+
+// GetVersion returns the value of the key along with the version that wrote
+// it, reading it the same way as Get.
+func (b *Buffer) GetVersion(key string) (json.RawMessage, uint64, bool) {
+	entry, ok := b.lookup(key)
+	if !ok || entry.expired(time.Now().UnixNano()) {
+		return nil, 0, false
+	}
+	return entry.value, entry.version, true
+}
+
+// lookup returns the latest entry for the key, expired or not, from the cache,
+// the write batch or the disk, in that order. Deleted keys are not found.
+func (b *Buffer) lookup(key string) (Entry, bool) {
+	b.cacheMu.Lock()
+	if entry, ok := b.cache.Get(key); ok {
+		found := *entry
+		b.cacheMu.Unlock()
+		return found, !found.deleted
+	}
+	b.cacheMu.Unlock()
+
+	// The write was evicted from the cache before it was flushed
+	if op, ok := b.pendingOp(key); ok {
+		b.UpdateCache(op.entry())
+		return op.entry(), !op.Deleted
+	}
+
+	record, ok := b.Disk.latest(key)
+	if !ok {
+		return Entry{}, false
+	}
+
+	// Update the cache with the value from disk
+	entry := record.entry()
+	b.UpdateCache(entry)
+	return entry, true
 }
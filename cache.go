@@ -0,0 +1,251 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+)
+
+// Cache is the buffer's read cache. Implementations differ in which entries
+// they evict once they are full; see CachePolicy.
+type Cache interface {
+	// Get returns the cached entry for the key, counting a hit or a miss.
+	Get(key string) (*Entry, bool)
+	// Put caches the entry, evicting other entries if the cache is full.
+	Put(entry Entry)
+	// Remove drops the key from the cache, if it is there.
+	Remove(key string)
+	// Stats returns the counters along with the current size of the cache.
+	Stats() CacheStats
+}
+
+// CacheStats counts how well the read cache is doing.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// CachePolicy selects how the read cache chooses entries to evict.
+type CachePolicy string
+
+const (
+	// CacheLRU evicts the least recently used entry.
+	CacheLRU CachePolicy = "lru"
+	// Cache2Q keeps entries seen once in a small FIFO queue, and only promotes
+	// them to the main LRU queue when they are seen again, so a scan cannot
+	// flush the main queue.
+	Cache2Q CachePolicy = "2q"
+	// CacheARC balances recency and frequency like 2Q, but adapts the split
+	// between them to the workload using the keys it has recently evicted.
+	CacheARC CachePolicy = "arc"
+	// CacheTinyLFU admits new entries into the main cache only if they are
+	// estimated to be used more often than the entry they would replace.
+	CacheTinyLFU CachePolicy = "tinylfu"
+)
+
+// ParseCachePolicy parses the name of a cache policy: lru, 2q, arc or tinylfu.
+func ParseCachePolicy(name string) (CachePolicy, error) {
+	switch policy := CachePolicy(name); policy {
+	case CacheLRU, Cache2Q, CacheARC, CacheTinyLFU:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown cache policy %q", name)
+	}
+}
+
+// newCache creates a cache with the policy that holds at most maxEntries
+// entries and maxBytes bytes of keys and values. Either limit is ignored when
+// it is 0. Policies other than LRU size their queues by maxEntries, so without
+// it they size them by the number of entries cached so far.
+func newCache(policy CachePolicy, maxEntries int, maxBytes int64) Cache {
+	limits := cacheLimits{maxEntries: maxEntries, maxBytes: maxBytes}
+	switch policy {
+	case Cache2Q:
+		return new2QCache(limits)
+	case CacheARC:
+		return newARCCache(limits)
+	case CacheTinyLFU:
+		return newTinyLFUCache(limits)
+	default:
+		return newLRUCache(maxEntries, maxBytes)
+	}
+}
+
+// cacheLimits holds the bounds shared by every policy.
+type cacheLimits struct {
+	maxEntries int
+	maxBytes   int64
+}
+
+// over reports whether the entries and bytes are over either limit.
+func (l cacheLimits) over(entries int, bytes int64) bool {
+	return (l.maxEntries > 0 && entries > l.maxEntries) || (l.maxBytes > 0 && bytes > l.maxBytes)
+}
+
+// tooLarge reports whether an entry of the size could never fit.
+func (l cacheLimits) tooLarge(size int64) bool {
+	return l.maxBytes > 0 && size > l.maxBytes
+}
+
+// capacity returns the number of entries the cache is sized for.
+func (l cacheLimits) capacity(entries int) int {
+	if l.maxEntries > 0 {
+		return l.maxEntries
+	}
+	if entries < 1 {
+		return 1
+	}
+	return entries
+}
+
+// entrySize returns the number of bytes the entry counts for against maxBytes.
+func entrySize(key string, value json.RawMessage) int64 {
+	return int64(len(key) + len(value))
+}
+
+// entryList is a queue of entries in a doubly-linked list, most recently used
+// at the front, alongside a map from key to list element so that lookups,
+// moves and removals are all O(1). It is the building block of every policy.
+type entryList struct {
+	items map[string]*list.Element
+	order *list.List
+	bytes int64
+}
+
+func newEntryList() *entryList {
+	return &entryList{
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (l *entryList) len() int {
+	return l.order.Len()
+}
+
+func (l *entryList) get(key string) (*Entry, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*Entry), true
+}
+
+func (l *entryList) contains(key string) bool {
+	_, ok := l.items[key]
+	return ok
+}
+
+// touch moves the key to the front of the list.
+func (l *entryList) touch(key string) {
+	if element, ok := l.items[key]; ok {
+		l.order.MoveToFront(element)
+	}
+}
+
+func (l *entryList) pushFront(entry *Entry) {
+	l.items[entry.key] = l.order.PushFront(entry)
+	l.bytes += entrySize(entry.key, entry.value)
+}
+
+// update replaces the value of an entry in the list with that of another entry for the same key.
+func (l *entryList) update(cached *Entry, entry Entry) {
+	l.bytes += entrySize(entry.key, entry.value) - entrySize(cached.key, cached.value)
+	*cached = entry
+}
+
+func (l *entryList) remove(key string) (*Entry, bool) {
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := l.order.Remove(element).(*Entry)
+	delete(l.items, key)
+	l.bytes -= entrySize(entry.key, entry.value)
+	return entry, true
+}
+
+// removeBack removes and returns the least recently used entry.
+func (l *entryList) removeBack() (*Entry, bool) {
+	element := l.order.Back()
+	if element == nil {
+		return nil, false
+	}
+	return l.remove(element.Value.(*Entry).key)
+}
+
+// back returns the least recently used entry without removing it.
+func (l *entryList) back() (*Entry, bool) {
+	element := l.order.Back()
+	if element == nil {
+		return nil, false
+	}
+	return element.Value.(*Entry), true
+}
+
+// lruCache is a least recently used cache of entries.
+type lruCache struct {
+	limits  cacheLimits
+	entries *entryList
+	stats   CacheStats
+}
+
+func newLRUCache(maxEntries int, maxBytes int64) *lruCache {
+	return &lruCache{
+		limits:  cacheLimits{maxEntries: maxEntries, maxBytes: maxBytes},
+		entries: newEntryList(),
+	}
+}
+
+// Get returns the cached entry for the key and marks it as most recently used.
+func (c *lruCache) Get(key string) (*Entry, bool) {
+	entry, ok := c.entries.get(key)
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.entries.touch(key)
+	return entry, true
+}
+
+// Put caches the entry as the most recently used one, evicting the least
+// recently used entries if the cache is over its limits. An entry bigger than
+// the whole cache is not cached at all.
+func (c *lruCache) Put(entry Entry) {
+	key := entry.key
+	if c.limits.tooLarge(entrySize(key, entry.value)) {
+		// Drop the old entry too, so it is not mistaken for the current value
+		c.Remove(key)
+		return
+	}
+
+	if cached, ok := c.entries.get(key); ok {
+		c.entries.update(cached, entry)
+		c.entries.touch(key)
+	} else {
+		c.entries.pushFront(&entry)
+	}
+
+	for c.limits.over(c.entries.len(), c.entries.bytes) {
+		c.entries.removeBack()
+		c.stats.Evictions++
+	}
+}
+
+// Remove drops the key from the cache, if it is there.
+func (c *lruCache) Remove(key string) {
+	c.entries.remove(key)
+}
+
+// Stats returns the counters along with the current size of the cache.
+func (c *lruCache) Stats() CacheStats {
+	stats := c.stats
+	stats.Entries = c.entries.len()
+	stats.Bytes = c.entries.bytes
+	return stats
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRUCache(3, 0)
+	cache.Put(Entry{key: "a", value: json.RawMessage("1")})
+	cache.Put(Entry{key: "b", value: json.RawMessage("2")})
+	cache.Put(Entry{key: "c", value: json.RawMessage("3")})
+
+	// Using a makes b the least recently used
+	cache.Get("a")
+	cache.Put(Entry{key: "d", value: json.RawMessage("4")})
+
+	tests := []struct {
+		key    string
+		cached bool
+	}{
+		{"a", true},
+		{"b", false},
+		{"c", true},
+		{"d", true},
+	}
+	for _, test := range tests {
+		_, ok := cache.Get(test.key)
+		assert.Equal(t, test.cached, ok, test.key)
+	}
+
+	stats := cache.Stats()
+	assert.Equal(t, CacheStats{Hits: 4, Misses: 1, Evictions: 1, Entries: 3, Bytes: 6}, stats)
+}
+
+func TestLRUCacheByteLimit(t *testing.T) {
+	cache := newLRUCache(0, 100)
+
+	// Each entry is 10 bytes of key and value
+	for i := 0; i < 20; i++ {
+		cache.Put(Entry{key: fmt.Sprintf("key%02d", i), value: json.RawMessage(fmt.Sprintf(`"%03d"`, i))})
+	}
+	stats := cache.Stats()
+	assert.Equal(t, 10, stats.Entries)
+	assert.Equal(t, int64(100), stats.Bytes)
+	assert.Equal(t, uint64(10), stats.Evictions)
+
+	// Growing an entry evicts others to make room
+	cache.Put(Entry{key: "key19", value: json.RawMessage(strings.Repeat("x", 50))})
+	assert.LessOrEqual(t, cache.Stats().Bytes, int64(100))
+	_, ok := cache.Get("key19")
+	assert.True(t, ok)
+
+	// An entry bigger than the whole cache is not cached, and its old value is dropped
+	cache.Put(Entry{key: "key19", value: json.RawMessage(strings.Repeat("x", 200))})
+	_, ok = cache.Get("key19")
+	assert.False(t, ok)
+	assert.LessOrEqual(t, cache.Stats().Bytes, int64(100))
+}
+
+func TestBufferCacheStats(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithCacheBytes(1<<20))
+
+	// A 1 MiB value does not fit alongside its key, so it is read from disk every time
+	large := json.RawMessage(`"` + strings.Repeat("a", 1<<20) + `"`)
+	assert.NoError(t, kv.Set("large", large))
+	assert.NoError(t, kv.Flush())
+	assert.NoError(t, kv.Set("small", json.RawMessage("1")))
+
+	got, ok := kv.Get("large")
+	assert.True(t, ok)
+	assert.Equal(t, len(large), len(got))
+	kv.Get("small")
+	kv.Get("small")
+
+	stats := kv.Buffer.CacheStats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+}
+
+var cachePolicies = []CachePolicy{CacheLRU, Cache2Q, CacheARC, CacheTinyLFU}
+
+func TestCachePolicies(t *testing.T) {
+	for _, policy := range cachePolicies {
+		t.Run(string(policy), func(t *testing.T) {
+			cache := newCache(policy, 50, 2000)
+
+			// Values written are read back, including tombstones and updates
+			cache.Put(Entry{key: "a", value: json.RawMessage("1")})
+			cache.Put(Entry{key: "b", deleted: true})
+			cache.Put(Entry{key: "a", value: json.RawMessage("2")})
+			entry, ok := cache.Get("a")
+			assert.True(t, ok)
+			assert.Equal(t, "2", string(entry.value))
+			entry, ok = cache.Get("b")
+			assert.True(t, ok)
+			assert.True(t, entry.deleted)
+
+			cache.Remove("a")
+			_, ok = cache.Get("a")
+			assert.False(t, ok)
+
+			// A random workload never takes the cache over either limit
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 5000; i++ {
+				key := fmt.Sprintf("key%d", rng.Intn(200))
+				if _, ok := cache.Get(key); !ok {
+					cache.Put(Entry{key: key, value: json.RawMessage(strings.Repeat("v", rng.Intn(100)))})
+				}
+
+				stats := cache.Stats()
+				if stats.Entries > 50 || stats.Bytes > 2000 {
+					t.Fatalf("Cache holds %d entries and %d bytes", stats.Entries, stats.Bytes)
+				}
+			}
+
+			stats := cache.Stats()
+			assert.Equal(t, uint64(5003), stats.Hits+stats.Misses)
+			assert.NotZero(t, stats.Evictions)
+		})
+	}
+}
+
+// cacheWorkload returns a deterministic sequence of keys to read.
+func cacheWorkload(name string, n int) []string {
+	rng := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(rng, 1.1, 1, 9999)
+
+	keys := make([]string, 0, n)
+	switch name {
+	case "zipf":
+		// Popular keys are read far more often than the rest
+		for len(keys) < n {
+			keys = append(keys, fmt.Sprintf("key%d", zipf.Uint64()))
+		}
+	case "scan":
+		// Reads of popular keys, interrupted by scans of keys that are only read once
+		scans := 0
+		for len(keys) < n {
+			for i := 0; i < 500 && len(keys) < n; i++ {
+				keys = append(keys, fmt.Sprintf("key%d", zipf.Uint64()))
+			}
+			for i := 0; i < 1000 && len(keys) < n; i++ {
+				keys = append(keys, fmt.Sprintf("scan%d-%d", scans, i))
+			}
+			scans++
+		}
+	}
+	return keys
+}
+
+// replayWorkload reads each key through the cache, caching it on a miss, and
+// returns the fraction of reads that hit.
+func replayWorkload(cache Cache, keys []string) float64 {
+	value := json.RawMessage(`"value"`)
+	for _, key := range keys {
+		if _, ok := cache.Get(key); !ok {
+			cache.Put(Entry{key: key, value: value})
+		}
+	}
+
+	stats := cache.Stats()
+	return float64(stats.Hits) / float64(stats.Hits+stats.Misses)
+}
+
+func TestCachePoliciesResistScans(t *testing.T) {
+	keys := cacheWorkload("scan", 50000)
+	lru := replayWorkload(newCache(CacheLRU, 1000, 0), keys)
+
+	for _, policy := range []CachePolicy{Cache2Q, CacheARC, CacheTinyLFU} {
+		ratio := replayWorkload(newCache(policy, 1000, 0), keys)
+		assert.Greater(t, ratio, lru, "%s hit ratio %.3f, LRU %.3f", policy, ratio, lru)
+	}
+}
+
+// BenchmarkCachePolicies compares the hit ratio of each policy on each
+// workload, reported as the hit% metric.
+func BenchmarkCachePolicies(b *testing.B) {
+	for _, workload := range []string{"zipf", "scan"} {
+		keys := cacheWorkload(workload, 200000)
+		for _, policy := range cachePolicies {
+			b.Run(workload+"/"+string(policy), func(b *testing.B) {
+				var ratio float64
+				for i := 0; i < b.N; i++ {
+					ratio = replayWorkload(newCache(policy, 1000, 0), keys)
+				}
+				b.ReportMetric(100*ratio, "hit%")
+			})
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ErrVersionMismatch is returned by a conditional write when the key is not
+// at the version the writer expected, because another write got there first.
+var ErrVersionMismatch = errors.New("key is not at the expected version")
+
+// ErrKeyExists is returned by SetIfNotExists when the key already exists.
+var ErrKeyExists = errors.New("key already exists")
+
+// GetVersion returns the value of the key along with its version, the
+// sequence number of the write that set it. Pass the version to
+// CompareAndSwap to write the key only if nothing else has since.
+func (s *Store) GetVersion(key string) (json.RawMessage, uint64, bool) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return s.Buffer.GetVersion(key)
+}
+
+// CompareAndSwap sets the value of the key, but only if it exists and is still
+// at the expected version, and returns the version it wrote. Otherwise it
+// writes nothing and returns ErrVersionMismatch.
+func (s *Store) CompareAndSwap(key string, expectedVersion uint64, value json.RawMessage) (uint64, error) {
+	return s.writeIf(Operation{Key: key, Value: value}, []writeCondition{{Kind: conditionVersion, Key: key, Version: expectedVersion}})
+}
+
+// CompareAndDelete removes the key, but only if it is still at the expected
+// version. Otherwise it returns ErrVersionMismatch.
+func (s *Store) CompareAndDelete(key string, expectedVersion uint64) error {
+	_, err := s.writeIf(Operation{Key: key, Deleted: true}, []writeCondition{{Kind: conditionVersion, Key: key, Version: expectedVersion}})
+	return err
+}
+
+// SetIfNotExists sets the value of the key, but only if it does not exist,
+// and returns the version it wrote. Otherwise it returns ErrKeyExists.
+func (s *Store) SetIfNotExists(key string, value json.RawMessage) (uint64, error) {
+	return s.writeIf(Operation{Key: key, Value: value}, []writeCondition{{Kind: conditionMissing, Key: key}})
+}
+
+// writeIf applies the operation if the conditions on the key's current
+// version hold, and returns the version it wrote. The check and the write
+// happen under the same lock, so no other write can come between them.
+func (s *Store) writeIf(op Operation, conditions []writeCondition) (uint64, error) {
+	ops := []Operation{op}
+	err := s.apply(ops, conditions)
+	if err != nil {
+		return 0, err
+	}
+
+	return ops[0].Seq, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	_, err := kv.CompareAndSwap("key", 0, json.RawMessage("1"))
+	assert.Equal(t, ErrVersionMismatch, err)
+
+	created, err := kv.SetIfNotExists("key", json.RawMessage("1"))
+	assert.NoError(t, err)
+	_, err = kv.SetIfNotExists("key", json.RawMessage("2"))
+	assert.Equal(t, ErrKeyExists, err)
+
+	// Two writers read the same version, and only the first to write it wins
+	value, version, ok := kv.GetVersion("key")
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+	assert.Equal(t, created, version)
+
+	swapped, err := kv.CompareAndSwap("key", version, json.RawMessage("2"))
+	assert.NoError(t, err)
+	assert.Greater(t, swapped, version)
+	_, err = kv.CompareAndSwap("key", version, json.RawMessage("3"))
+	assert.Equal(t, ErrVersionMismatch, err)
+
+	// Versions are the same once the key has been flushed and evicted from the cache
+	assert.NoError(t, kv.Flush())
+	kv.Buffer.cache.Remove("key")
+	value, version, _ = kv.GetVersion("key")
+	assert.Equal(t, "2", string(value))
+	assert.Equal(t, swapped, version)
+
+	assert.Equal(t, ErrVersionMismatch, kv.CompareAndDelete("key", created))
+	assert.NoError(t, kv.CompareAndDelete("key", swapped))
+	_, _, ok = kv.GetVersion("key")
+	assert.False(t, ok)
+
+	// A deleted key can be created again
+	_, err = kv.SetIfNotExists("key", json.RawMessage("4"))
+	assert.NoError(t, err)
+}
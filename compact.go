@@ -0,0 +1,353 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Compact once half of the data file is dead
+const DefaultCompactRatio = 0.5
+
+// Do not bother compacting data files smaller than this
+const DefaultCompactMinSize = 1 << 20
+
+// Suffix of the files a compaction writes before swapping them in
+const compactSuffix = ".compact"
+
+// CompactionStats describes the outcome of a compaction.
+type CompactionStats struct {
+	Keys        int   `json:"keys"`
+	Records     int   `json:"records"` // Versions kept, including the latest of each key
+	BytesBefore int64 `json:"bytesBefore"`
+	BytesAfter  int64 `json:"bytesAfter"`
+}
+
+// DeadRatio returns the fraction of the data file taken up by records that
+// have been overwritten or deleted.
+func (d *Disk) DeadRatio() float64 {
+	size := d.fileSize()
+	if size == 0 {
+		return 0
+	}
+	return float64(size-d.liveBytes) / float64(size)
+}
+
+func (d *Disk) fileSize() int64 {
+	stat, err := d.File.Stat()
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// NeedsCompaction reports whether enough of the data file is dead to compact it.
+func (d *Disk) NeedsCompaction() bool {
+	return d.CompactRatio > 0 && d.fileSize() >= d.CompactMinSize && d.DeadRatio() >= d.CompactRatio
+}
+
+// Number of keys copied under each hold of the index lock, or between commits
+// of the new index
+const compactChunkSize = 1000
+
+// compaction is a compaction in progress. Its records are copied in three
+// steps: startCompaction creates the new files, copy copies the live records
+// into them without blocking reads or writes, and finish copies the keys
+// written in the meantime and swaps the new files in. Only copy may run
+// alongside other uses of the disk.
+type compaction struct {
+	disk      *Disk
+	file      *os.File
+	index     *IndexTree
+	filename  string
+	indexName string
+	stats     CompactionStats
+
+	liveBytes   int64
+	compression CompressionStats
+
+	// Keys written since the compaction started, which finish copies again
+	written map[string]bool
+	done    chan struct{} // Closed once the compaction has finished or been abandoned
+}
+
+// Compact rewrites the live records into a new data file and swaps it in,
+// compressing their values afresh with the disk's codec. The new data file and
+// index are written alongside the current ones and renamed into place, data
+// file first, so a crash part way through leaves either the old files or files
+// that recoverCompaction can finish swapping in.
+func (d *Disk) Compact() (CompactionStats, error) {
+	c, err := d.startCompaction()
+	if err != nil {
+		return CompactionStats{}, err
+	}
+	if err := c.copy(); err != nil {
+		c.abort()
+		return c.stats, err
+	}
+	return c.finish()
+}
+
+// startCompaction creates the files for a new compaction. From now until it
+// finishes, the disk notes the keys written to it.
+func (d *Disk) startCompaction() (*compaction, error) {
+	c := &compaction{
+		disk:      d,
+		filename:  d.Filename + compactSuffix,
+		indexName: d.IndexFilename + compactSuffix,
+		stats:     CompactionStats{BytesBefore: d.fileSize()},
+		written:   make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+
+	var err error
+	if c.file, err = os.OpenFile(c.filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666); err != nil {
+		return nil, err
+	}
+	if c.index, err = createIndexTree(c.indexName, d.keys); err != nil {
+		c.file.Close()
+		os.Remove(c.filename)
+		return nil, err
+	}
+
+	d.compaction = c
+	return c, nil
+}
+
+// copy copies the versions of every key that are still needed, in key order,
+// building the new index as it goes. The index is only locked while reading
+// the keys of each chunk, and records are never changed once written, so
+// reads and writes carry on while it runs.
+func (c *compaction) copy() error {
+	retention := c.disk.retention()
+	from := ""
+	for {
+		var keys []string
+		err := c.disk.Index.WalkFrom(from, func(value IndexValue) bool {
+			keys = append(keys, value.Key)
+			return len(keys) < compactChunkSize
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := c.copyKey(key, retention); err != nil {
+				return err
+			}
+		}
+
+		// The new index is not in use yet, so commit it now and then to keep
+		// its modified pages from piling up in memory
+		if err := c.index.Commit(); err != nil {
+			return err
+		}
+		if len(keys) < compactChunkSize {
+			return nil
+		}
+		from = keyAfter(keys[len(keys)-1])
+	}
+}
+
+// copyKey copies the versions of the key that are still needed into the new
+// data file, and points the new index at them, replacing any copied before.
+func (c *compaction) copyKey(key string, retention retentionPolicy) error {
+	records, err := c.disk.neededVersions(key, retention)
+	if err != nil {
+		return err
+	}
+
+	// Versions of the key copied before are dead now
+	hash := hashKey(key)
+	if old, ok, err := c.index.Get(hash, key); err != nil {
+		return err
+	} else if ok {
+		size, n, err := c.versionsSize(old)
+		if err != nil {
+			return err
+		}
+		c.liveBytes -= size
+		c.stats.Records -= n
+		c.stats.Keys--
+		if len(records) == 0 {
+			if _, _, err := c.index.Delete(hash, key); err != nil {
+				return err
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	// Write the oldest first so each can point back to the one before it
+	var prevPos, prevSize int64
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		record.PrevPos, record.PrevSize = prevPos, prevSize
+		stored, err := compressRecord(record, c.disk.Codec, c.disk.CompressMinSize, &c.compression)
+		if err != nil {
+			return err
+		}
+		if prevPos, prevSize, err = writeRecord(c.file, stored, c.disk.keys); err != nil {
+			return err
+		}
+		c.liveBytes += prevSize
+		c.stats.Records++
+	}
+
+	if _, _, err := c.index.Put(IndexValue{Hash: hash, Key: key, Pos: prevPos, Size: prevSize}); err != nil {
+		return err
+	}
+	c.stats.Keys++
+	return nil
+}
+
+// versionsSize returns the total size and number of the records copied for a
+// key: the one the new index value points to and the versions before it.
+func (c *compaction) versionsSize(value IndexValue) (int64, int, error) {
+	copied := &Disk{File: c.file, keys: c.disk.keys}
+	var size int64
+	var records int
+	for {
+		record, err := copied.readRecord(value)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += value.Size
+		records++
+		if record.PrevSize == 0 {
+			return size, records, nil
+		}
+		value = IndexValue{Pos: record.PrevPos, Size: record.PrevSize}
+	}
+}
+
+// finish copies the keys written since the compaction started again, then
+// swaps the new files in. Writes must be held off while it runs.
+func (c *compaction) finish() (CompactionStats, error) {
+	defer c.end()
+
+	d := c.disk
+	retention := d.retention()
+	for key := range c.written {
+		if err := c.copyKey(key, retention); err != nil {
+			c.remove()
+			return c.stats, err
+		}
+	}
+	if err := c.file.Sync(); err != nil {
+		c.remove()
+		return c.stats, err
+	}
+	if err := c.index.Commit(); err != nil {
+		c.remove()
+		return c.stats, err
+	}
+	c.close()
+
+	// Swap the new files in. Once the data file has been renamed the compaction
+	// is committed, and recovery will finish renaming the index if we crash.
+	if err := renameAndSync(c.filename, d.Filename); err != nil {
+		return c.stats, err
+	}
+	if err := renameAndSync(c.indexName, d.IndexFilename); err != nil {
+		return c.stats, err
+	}
+
+	// Move the open handles over to the new files. Changes to the old index that
+	// were not committed are already part of the new one.
+	d.File.Close()
+	d.Index.Close()
+	var err error
+	if d.File, err = os.OpenFile(d.Filename, os.O_RDWR, 0666); err != nil {
+		return c.stats, err
+	}
+	if d.Index, err = OpenIndexTree(d.IndexFilename, DefaultIndexCachePages, d.keys); err != nil {
+		return c.stats, err
+	}
+	d.liveBytes = c.liveBytes
+	d.compression = c.compression
+
+	c.stats.BytesAfter = d.fileSize()
+	return c.stats, nil
+}
+
+// abort gives up on the compaction and removes its files. Writes must be held
+// off while it runs.
+func (c *compaction) abort() {
+	c.remove()
+	c.end()
+}
+
+// remove closes and removes the new files.
+func (c *compaction) remove() {
+	c.close()
+	os.Remove(c.filename)
+	os.Remove(c.indexName)
+}
+
+// end stops the disk noting writes for the compaction, and lets those waiting
+// for it know it is over.
+func (c *compaction) end() {
+	c.disk.compaction = nil
+	close(c.done)
+}
+
+// close closes the new files.
+func (c *compaction) close() {
+	c.index.Close()
+	c.file.Close()
+}
+
+// neededVersions returns the records of the key's versions that are still
+// needed, newest first. It returns none for a key deleted long enough ago that
+// no reader can see it before its deletion.
+func (d *Disk) neededVersions(key string, retention retentionPolicy) ([]*Record, error) {
+	var records []*Record
+	err := d.walkVersions(key, func(record *Record) bool {
+		records = append(records, record)
+		return retention.needsPrevious(record.Version, record.Time)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 1 && records[0].Deleted {
+		return nil, nil
+	}
+	return records, nil
+}
+
+// renameAndSync renames a file and syncs the directory so the rename is durable.
+func renameAndSync(from string, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// recoverCompaction cleans up after a compaction that was interrupted by a
+// crash. If the new data file was not swapped in yet, the compaction is
+// abandoned. If it was, only the index remains to be renamed into place.
+func recoverCompaction(filename string, indexFilename string) error {
+	compactFilename := filename + compactSuffix
+	compactIndexFilename := indexFilename + compactSuffix
+
+	if _, err := os.Stat(compactFilename); err == nil {
+		os.Remove(compactIndexFilename)
+		os.Remove(compactIndexFilename + journalSuffix)
+		return os.Remove(compactFilename)
+	}
+
+	if _, err := os.Stat(compactIndexFilename); err == nil {
+		return renameAndSync(compactIndexFilename, indexFilename)
+	}
+
+	return nil
+}
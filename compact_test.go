@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDisk opens a disk in a temporary directory with automatic compaction turned off.
+func newTestDisk(t *testing.T) *Disk {
+	dir := t.TempDir()
+	disk, err := NewDisk(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.CompactRatio = 0
+	return disk
+}
+
+func TestCompact(t *testing.T) {
+	disk := newTestDisk(t)
+
+	// Overwrite every key a few times and delete some of them
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, disk.Put(fmt.Sprintf("key%d", i), json.RawMessage(fmt.Sprintf(`"value%d-%d"`, i, round))))
+		}
+	}
+	for i := 0; i < 20; i += 5 {
+		assert.NoError(t, disk.Delete(fmt.Sprintf("key%d", i)))
+	}
+	assert.Greater(t, disk.DeadRatio(), 0.7)
+
+	stats, err := disk.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 16, stats.Records)
+	assert.Less(t, stats.BytesAfter, stats.BytesBefore/3)
+	assert.Equal(t, 0.0, disk.DeadRatio())
+
+	check := func(disk *Disk) {
+		for i := 0; i < 20; i++ {
+			got, ok := disk.Get(fmt.Sprintf("key%d", i))
+			if i%5 == 0 {
+				assert.False(t, ok, "key%d", i)
+			} else {
+				assert.True(t, ok, "key%d", i)
+				assert.Equal(t, fmt.Sprintf(`"value%d-3"`, i), string(got))
+			}
+		}
+	}
+	check(disk)
+
+	// Writes carry on in the compacted file
+	assert.NoError(t, disk.Put("key1", json.RawMessage(`"value1-3"`)))
+	assert.NoError(t, disk.Sync())
+
+	// The compacted files are in place after reopening
+	disk, err = NewDisk(disk.Filename, disk.IndexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(disk)
+	assert.Less(t, disk.DeadRatio(), 0.1)
+}
+
+func TestRecoverInterruptedCompaction(t *testing.T) {
+	disk := newTestDisk(t)
+	assert.NoError(t, disk.Put("key", json.RawMessage(`"old"`)))
+	assert.NoError(t, disk.Put("key", json.RawMessage(`"new"`)))
+	assert.NoError(t, disk.Sync())
+
+	// A crash before the data file was swapped in leaves the old files in use
+	os.WriteFile(disk.Filename+compactSuffix, []byte("partial"), 0666)
+	os.WriteFile(disk.IndexFilename+compactSuffix, []byte("partial"), 0666)
+
+	reopened, err := NewDisk(disk.Filename, disk.IndexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := reopened.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, `"new"`, string(got))
+	assert.NoFileExists(t, disk.Filename+compactSuffix)
+	assert.NoFileExists(t, disk.IndexFilename+compactSuffix)
+
+	// A crash after the data file was swapped in, but before the index was, is
+	// finished off by renaming the new index into place
+	_, err = reopened.Compact()
+	assert.NoError(t, err)
+	index, _ := os.ReadFile(reopened.IndexFilename)
+	os.WriteFile(reopened.IndexFilename+compactSuffix, index, 0666)
+	os.WriteFile(reopened.IndexFilename, []byte("stale"), 0666)
+
+	reopened, err = NewDisk(disk.Filename, disk.IndexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok = reopened.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, `"new"`, string(got))
+}
+
+func TestAutomaticCompaction(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithCompaction(0.5, 1))
+	defer kv.Close()
+
+	// Keep rewriting the same keys, so most of the data file is dead after each flush
+	for round := 0; round < 5; round++ {
+		entries := make([]StoreEntry, MaxBufferSize)
+		for i := range entries {
+			entries[i] = StoreEntry{Key: fmt.Sprintf("key%d", i%10), Value: json.RawMessage(fmt.Sprint(round))}
+		}
+		assert.NoError(t, kv.BatchSet(entries))
+
+		// Compactions started by a flush run in the background
+		kv.Buffer.waitForCompaction()
+	}
+
+	assert.Less(t, kv.Buffer.Disk.DeadRatio(), 0.5)
+	got, ok := kv.Buffer.Disk.Get("key3")
+	assert.True(t, ok)
+	assert.Equal(t, "4", string(got))
+}
+
+func TestCompactCatchesUpWithWrites(t *testing.T) {
+	disk := newTestDisk(t)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, disk.Put(fmt.Sprintf("key%d", i), json.RawMessage(fmt.Sprint(round))))
+		}
+	}
+
+	// Writes made before the records are copied, and after, are both in the
+	// compacted files
+	c, err := disk.startCompaction()
+	assert.NoError(t, err)
+	assert.NoError(t, disk.Put("key1", json.RawMessage("10")))
+	assert.NoError(t, disk.Delete("key2"))
+	assert.NoError(t, disk.Put("new1", json.RawMessage("11")))
+	assert.NoError(t, c.copy())
+	assert.NoError(t, disk.Put("key3", json.RawMessage("12")))
+	assert.NoError(t, disk.Delete("key4"))
+	assert.NoError(t, disk.Put("new2", json.RawMessage("13")))
+	stats, err := c.finish()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, stats.Keys)
+	assert.Equal(t, 10, stats.Records)
+
+	want := map[string]string{"key1": "10", "key3": "12", "new1": "11", "new2": "13"}
+	for i := 0; i < 10; i++ {
+		if key := fmt.Sprintf("key%d", i); want[key] == "" && i != 2 && i != 4 {
+			want[key] = "2"
+		}
+	}
+	check := func(disk *Disk) {
+		var keys int
+		assert.NoError(t, disk.Scan("", "", func(key string, value json.RawMessage) bool {
+			assert.Equal(t, want[key], string(value), key)
+			keys++
+			return true
+		}))
+		assert.Equal(t, len(want), keys)
+	}
+	check(disk)
+	assert.NoError(t, disk.Sync())
+
+	reopened, err := NewDisk(disk.Filename, disk.IndexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(reopened)
+	assert.Equal(t, reopened.liveBytes, disk.liveBytes)
+}
+
+func TestCompactAlongsideWrites(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithCompaction(0, 0))
+	defer kv.Close()
+
+	for i := 0; i < 3000; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("key%04d", i%1000), json.RawMessage(fmt.Sprint(i))))
+	}
+	assert.NoError(t, kv.Flush())
+
+	// Writes and reads carry on while the store is compacted
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 3000; i < 5000; i++ {
+			assert.NoError(t, kv.Set(fmt.Sprintf("key%04d", i%1000), json.RawMessage(fmt.Sprint(i))))
+			kv.Get(fmt.Sprintf("key%04d", i%997))
+		}
+		assert.NoError(t, kv.Flush())
+	}()
+	for i := 0; i < 3; i++ {
+		_, err := kv.Compact()
+		assert.NoError(t, err)
+	}
+	<-done
+	_, err := kv.Compact()
+	assert.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		got, ok := kv.Get(fmt.Sprintf("key%04d", i))
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprint(4000+i), string(got))
+	}
+	assert.Equal(t, 0.0, kv.Buffer.Disk.DeadRatio())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Values are compressed as they are written to the data file, once they are
+// at least the disk's CompressMinSize, and decompressed as they are read back.
+// Each record is tagged with the codec its value was compressed with, so
+// records written with different codecs, or before compression was turned on,
+// can sit side by side in the same file. Compaction rewrites every record it
+// keeps with the current codec, which is how existing records are recompressed.
+
+// Codec is a way of compressing the values in the data file.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecFlate
+	CodecGzip
+)
+
+// Do not bother compressing values smaller than this by default
+const DefaultCompressMinSize = 256
+
+// ErrUnknownCodec is returned when reading a record compressed with a codec
+// this version does not know, or choosing one by a name it does not know.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+var codecNames = map[Codec]string{
+	CodecNone:  "none",
+	CodecFlate: "flate",
+	CodecGzip:  "gzip",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", c)
+}
+
+// ParseCodec returns the codec with the name: none, flate or gzip.
+func ParseCodec(name string) (Codec, error) {
+	for codec, codecName := range codecNames {
+		if codecName == name {
+			return codec, nil
+		}
+	}
+	return CodecNone, fmt.Errorf("%w %q", ErrUnknownCodec, name)
+}
+
+// compress returns the data compressed with the codec.
+func (c Codec) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	case CodecGzip:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownCodec, c)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns the data decompressed with the codec.
+func (c Codec) decompress(data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(data))
+	case CodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	default:
+		return nil, fmt.Errorf("%w %d", ErrUnknownCodec, c)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// CompressionStats describes how well the values written to the data file
+// compressed. It covers the records written since the disk was opened or last
+// compacted; after a compaction, that is every record in the file.
+type CompressionStats struct {
+	Codec       string  `json:"codec"`
+	Records     int64   `json:"records"`     // Records written with a value
+	Compressed  int64   `json:"compressed"`  // Records whose value was stored compressed
+	RawBytes    int64   `json:"rawBytes"`    // Size of the values before compression
+	StoredBytes int64   `json:"storedBytes"` // Size of the values as stored
+	Ratio       float64 `json:"ratio"`       // RawBytes over StoredBytes
+}
+
+// add counts a value written to the data file.
+func (s *CompressionStats) add(raw int, stored int, compressed bool) {
+	s.Records++
+	if compressed {
+		s.Compressed++
+	}
+	s.RawBytes += int64(raw)
+	s.StoredBytes += int64(stored)
+}
+
+// compressRecord returns a copy of the record to write to the data file, with
+// its value compressed with the codec if it is at least minSize bytes and
+// compressing it makes it smaller, and counts it in the stats.
+func compressRecord(record *Record, codec Codec, minSize int, stats *CompressionStats) (*Record, error) {
+	if record.Deleted {
+		return record, nil
+	}
+
+	stored := *record
+	stored.Codec = CodecNone
+	if codec != CodecNone && len(record.Data) >= minSize {
+		data, err := codec.compress(record.Data)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < len(record.Data) {
+			stored.Data, stored.Codec = data, codec
+		}
+	}
+
+	stats.add(len(record.Data), len(stored.Data), stored.Codec != CodecNone)
+	return &stored, nil
+}
+
+// decompress replaces the record's value as stored with its value.
+func (r *Record) decompress() error {
+	if r.Codec == CodecNone {
+		return nil
+	}
+	data, err := r.Codec.decompress(r.Data)
+	if err != nil {
+		return fmt.Errorf("decompressing record for %q: %w", r.Key, err)
+	}
+	r.Data, r.Codec = data, CodecNone
+	return nil
+}
+
+// CompressionStats returns how well the values written to the data file compressed.
+func (d *Disk) CompressionStats() CompressionStats {
+	stats := d.compression
+	stats.Codec = d.Codec.String()
+	if stats.StoredBytes > 0 {
+		stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+	}
+	return stats
+}
+
+// CompressionStats returns how well the values written to the data file compressed.
+func (s *Store) CompressionStats() CompressionStats {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return s.Buffer.Disk.CompressionStats()
+}
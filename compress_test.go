@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	data := []byte(strings.Repeat(`{"name": "alice", "age": 30}`, 20))
+
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecGzip} {
+		parsed, err := ParseCodec(codec.String())
+		assert.NoError(t, err)
+		assert.Equal(t, codec, parsed)
+
+		compressed, err := codec.compress(data)
+		assert.NoError(t, err, codec)
+		if codec != CodecNone {
+			assert.Less(t, len(compressed), len(data), codec)
+		}
+		decompressed, err := codec.decompress(compressed)
+		assert.NoError(t, err, codec)
+		assert.Equal(t, data, decompressed, codec)
+	}
+
+	_, err := ParseCodec("zip")
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+	_, err = Codec(99).decompress(data)
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	large := func(i int) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"id": %d, "text": %q}`, i, strings.Repeat("compressible ", 20)))
+	}
+
+	// Records written before compression was turned on
+	kv := NewStore(100, filename, indexFilename, WithCompaction(0, 0))
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("old%d", i), large(i)))
+	}
+	assert.NoError(t, kv.Close())
+	assert.Zero(t, kv.CompressionStats().Compressed)
+
+	kv = NewStore(100, filename, indexFilename, WithCompression(CodecGzip, 64), WithCompaction(0, 0))
+	defer kv.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("new%d", i), large(i)))
+	}
+	assert.NoError(t, kv.Set("small", json.RawMessage(`{"id": 1}`)))
+	assert.NoError(t, kv.Flush())
+
+	stats := kv.CompressionStats()
+	assert.Equal(t, "gzip", stats.Codec)
+	assert.Equal(t, int64(11), stats.Records)
+	assert.Equal(t, int64(10), stats.Compressed)
+	assert.Greater(t, stats.Ratio, 2.0)
+
+	// Records with and without compression read back the same, from disk
+	check := func() {
+		t.Helper()
+		for i := 0; i < 10; i++ {
+			for _, prefix := range []string{"old", "new"} {
+				value, ok := kv.Buffer.Disk.Get(fmt.Sprintf("%s%d", prefix, i))
+				assert.True(t, ok)
+				assert.JSONEq(t, string(large(i)), string(value))
+			}
+		}
+		value, ok := kv.Buffer.Disk.Get("small")
+		assert.True(t, ok)
+		assert.JSONEq(t, `{"id": 1}`, string(value))
+	}
+	check()
+
+	// Compaction recompresses the records written before
+	compaction, err := kv.Compact()
+	assert.NoError(t, err)
+	assert.Less(t, compaction.BytesAfter, compaction.BytesBefore)
+	stats = kv.CompressionStats()
+	assert.Equal(t, int64(21), stats.Records)
+	assert.Equal(t, int64(20), stats.Compressed)
+	check()
+}
@@ -1,117 +1,366 @@
 package main
 
 import (
+	"bytes"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"time"
 )
 
 type Disk struct {
-	Index     *IndexTree
-	IndexFile *os.File
-	File      *os.File
+	Index         *IndexTree
+	File          *os.File
+	Filename      string
+	IndexFilename string
+
+	// The data file is append-only, so overwritten and deleted records stay in
+	// it until it is compacted. liveBytes is the size of the records the index
+	// still points to; the rest of the file is dead.
+	liveBytes int64
+
+	// Compact automatically once this fraction of the data file is dead, as long
+	// as the file is at least CompactMinSize bytes. A ratio of 0 disables it.
+	CompactRatio   float64
+	CompactMinSize int64
+
+	// Versions superseded within Retention of now are kept for reads at older
+	// versions, as are those Pinned says an open snapshot may read. The rest
+	// are dropped when the data file is compacted.
+	Retention time.Duration
+	Pinned    func() (version uint64, ok bool)
+
+	// Values of at least CompressMinSize bytes are compressed with Codec as
+	// they are written
+	Codec           Codec
+	CompressMinSize int
+	compression     CompressionStats
+
+	keys *Keyring // Keys records and index pages are sealed with, or nil
+
+	secondary map[string]*SecondaryIndex // Secondary indexes, by name
+
+	compaction *compaction // Compaction in progress, or nil
 }
 
+// Record is the unit written to the data file. It carries the full key as
+// well as its hash so that reads can verify they found the right record. Each
+// record is one version of its key, and points to the record of the version
+// before it, if that has not been garbage collected.
 type Record struct {
-	Key  uint32
-	Data json.RawMessage
+	Hash     uint32
+	Key      string
+	Data     json.RawMessage
+	Version  uint64 // Sequence number of the write in the write-ahead log
+	Time     int64  // When the write was made, in nanoseconds since the epoch
+	Deleted  bool   // Tombstone, the key was deleted at this version
+	Expires  int64  // When the value expires, in nanoseconds since the epoch, or 0 if it never does
+	Codec    Codec  // Codec Data is compressed with in the data file
+	PrevPos  int64
+	PrevSize int64 // Size of the previous version's record, or 0 if there is none
+
+	// An encrypted record is written as a record with only this field set,
+	// holding the sealed encoding of the record
+	Sealed []byte
+}
+
+// NewDisk opens the data file and index, creating them if needed. With keys,
+// records and index pages are encrypted, and the index files must have been
+// created with encryption.
+func NewDisk(filename string, indexFilename string, keys *Keyring) (*Disk, error) {
+	return openDisk(filename, indexFilename, keys, false)
 }
 
-func NewDisk(filename string, indexFilename string) (*Disk, error) {
+// openDisk opens the disk as NewDisk does, but if allowPlaintext is set, also
+// accepts index files written without encryption when given keys.
+func openDisk(filename string, indexFilename string, keys *Keyring, allowPlaintext bool) (*Disk, error) {
+	// Finish or discard a compaction that was interrupted by a crash
+	if err := recoverCompaction(filename, indexFilename); err != nil {
+		fmt.Println("Error recovering compaction:", err)
+		return nil, err
+	}
+
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		fmt.Println("Error opening file:", err)
 		return nil, err
 	}
 
-	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE, 0666)
+	// Index files written by earlier versions are converted to the paged format
+	if err := migrateIndex(filename, indexFilename, file); err != nil {
+		fmt.Println("Error migrating index:", err)
+		return nil, err
+	}
+
+	index, err := OpenIndexTree(indexFilename, DefaultIndexCachePages, keys)
 	if err != nil {
 		fmt.Println("Error opening index file:", err)
 		return nil, err
 	}
 
-	var index *IndexTree
-	stat, err := indexFile.Stat()
+	disk := &Disk{
+		Index:           index,
+		File:            file,
+		Filename:        filename,
+		IndexFilename:   indexFilename,
+		CompactRatio:    DefaultCompactRatio,
+		CompactMinSize:  DefaultCompactMinSize,
+		CompressMinSize: DefaultCompressMinSize,
+		keys:            keys,
+	}
+
+	err = disk.Index.Walk(func(value IndexValue) bool {
+		disk.liveBytes += value.Size
+		return true
+	})
 	if err != nil {
-		fmt.Println("Error getting index file info:", err)
+		fmt.Println("Error reading index:", err)
 		return nil, err
 	}
 
-	if stat.Size() == 0 {
-		index = createIndexTree([]IndexValue{}, 3)
-	} else {
-		indexFile.Seek(0, 0)
-		index = new(IndexTree)
-		decoder := gob.NewDecoder(indexFile)
-		if err := decoder.Decode(index); err != nil {
-			fmt.Println("Error decoding index:", err)
+	if err := disk.openSecondaryIndexes(); err != nil {
+		fmt.Println("Error opening secondary indexes:", err)
+		return nil, err
+	}
+
+	if keys != nil && !allowPlaintext {
+		if err := disk.checkEncrypted(); err != nil {
 			return nil, err
 		}
 	}
 
-	return &Disk{
-		Index:     index,
-		IndexFile: indexFile,
-		File:      file,
-	}, nil
+	return disk, nil
+}
+
+func (d *Disk) Get(key string) (json.RawMessage, bool) {
+	value, _, ok := d.GetVersion(key)
+	return value, ok
+}
+
+// GetVersion returns the value of the key along with the version that wrote it.
+func (d *Disk) GetVersion(key string) (json.RawMessage, uint64, bool) {
+	record, ok := d.latest(key)
+	if !ok || record.expired(time.Now().UnixNano()) {
+		return nil, 0, false
+	}
+	return record.Data, record.Version, true
 }
 
-func (d *Disk) Get(key uint32) (json.RawMessage, bool) {
-	pos, success := d.Index.Get(key)
-	if !success {
+// latest returns the record of the latest version of the key, unless it was
+// deleted. The value may have expired.
+func (d *Disk) latest(key string) (*Record, bool) {
+	hash := hashKey(key)
+	value, ok, err := d.Index.Get(hash, key)
+	if err != nil {
+		fmt.Println("Error reading index:", err)
+		return nil, false
+	} else if !ok {
 		return nil, false
 	}
 
-	d.File.Seek(pos, 0)
+	record, err := d.readRecord(value)
+	if err != nil {
+		return nil, false
+	}
 
-	record := &Record{}
-	decoder := gob.NewDecoder(d.File)
-	if err := decoder.Decode(record); err != nil {
+	// Guard against the index pointing at a record for a different key
+	if record.Hash != hash || record.Key != key || record.Deleted {
 		return nil, false
 	}
 
-	return record.Data, true
+	return record, true
 }
 
-func (d *Disk) Put(key uint32, data json.RawMessage) error {
-	record := &Record{
-		Key:  key,
-		Data: data,
+// Scan calls fn in key order for every key from start up to but not including
+// end, until fn returns false. An empty end leaves the range open. Keys that
+// have been deleted or have expired are skipped.
+func (d *Disk) Scan(start string, end string, fn func(key string, value json.RawMessage) bool) error {
+	now := time.Now().UnixNano()
+	var readErr error
+	err := d.Index.WalkFrom(start, func(value IndexValue) bool {
+		if end != "" && value.Key >= end {
+			return false
+		}
+		record, err := d.readRecord(value)
+		if err != nil {
+			readErr = fmt.Errorf("reading record for %q: %w", value.Key, err)
+			return false
+		}
+		if record.Deleted || record.expired(now) {
+			return true
+		}
+		return fn(value.Key, record.Data)
+	})
+	if err != nil {
+		return err
 	}
+	return readErr
+}
 
-	position, _ := d.File.Seek(0, 2)
-	encoder := gob.NewEncoder(d.File)
-	if err := encoder.Encode(record); err != nil {
-		fmt.Println("Error encoding record:", err)
-		return err
+// readRecord decodes the record the index entry points to.
+func (d *Disk) readRecord(value IndexValue) (*Record, error) {
+	// Indexes written before sizes were tracked do not know where the record ends
+	size := value.Size
+	if size == 0 {
+		size = 1<<63 - 1 - value.Pos
 	}
 
-	d.Index.Insert(&IndexValue{
-		Key: key,
-		Pos: position,
-	})
+	record := &Record{}
+	decoder := gob.NewDecoder(io.NewSectionReader(d.File, value.Pos, size))
+	if err := decoder.Decode(record); err != nil {
+		return nil, err
+	}
+	if record.Sealed != nil {
+		var err error
+		if record, err = d.unseal(record.Sealed); err != nil {
+			return nil, err
+		}
+	}
+	if err := record.decompress(); err != nil {
+		return nil, err
+	}
 
-	d.Index.Print()
+	return record, nil
+}
 
-	// Seek to the beginning of the file
-	_, err := d.IndexFile.Seek(0, 0)
+func (d *Disk) Put(key string, data json.RawMessage) error {
+	return d.Write(Operation{Key: key, Value: data})
+}
+
+// Delete removes the key by writing a tombstone, which hides the versions
+// before it. The records themselves stay in the data file until it is compacted.
+func (d *Disk) Delete(key string) error {
+	return d.Write(Operation{Key: key, Deleted: true})
+}
+
+// Write appends a record for the operation as the newest version of its key,
+// stamped with the operation's sequence number and time, or the current time
+// if it has none.
+func (d *Disk) Write(op Operation) error {
+	if len(op.Key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	hash := hashKey(op.Key)
+	old, exists, err := d.Index.Get(hash, op.Key)
 	if err != nil {
 		return err
 	}
+	// There is nothing to hide from a key that was never written
+	if op.Deleted && !exists {
+		return nil
+	}
+	if d.compaction != nil {
+		d.compaction.written[op.Key] = true
+	}
+
+	record := &Record{
+		Hash:    hash,
+		Key:     op.Key,
+		Data:    op.Value,
+		Version: op.Seq,
+		Time:    op.Time,
+		Deleted: op.Deleted,
+		Expires: op.Expires,
+	}
+	if record.Time == 0 {
+		record.Time = time.Now().UnixNano()
+	}
+	if exists {
+		record.PrevPos, record.PrevSize = old.Pos, old.Size
+	}
 
-	// Truncate the file to 0 length
-	err = d.IndexFile.Truncate(0)
+	position, size, err := d.appendRecord(record)
 	if err != nil {
 		return err
 	}
 
-	// Create a new encoder and encode the index
-	encoder = gob.NewEncoder(d.IndexFile)
-	if err := encoder.Encode(d.Index); err != nil {
-		fmt.Println("Error encoding index:", err)
+	if _, _, err := d.Index.Put(IndexValue{
+		Hash: hash,
+		Key:  op.Key,
+		Pos:  position,
+		Size: size,
+	}); err != nil {
+		return err
+	}
+	if err := d.updateSecondaryIndexes(old, exists, op); err != nil {
 		return err
 	}
 
+	// The record this one replaces is now dead, unless it is kept as history
+	if exists {
+		d.liveBytes -= old.Size
+	}
+	d.liveBytes += size
+
 	return nil
 }
+
+// Sync commits the data file to stable storage, then the changes made to the
+// secondary indexes and the index since the last Sync. Until then the index
+// file keeps pointing at records from before, so it never refers to a record
+// that was not synced.
+func (d *Disk) Sync() error {
+	if err := d.File.Sync(); err != nil {
+		return err
+	}
+	if err := d.commitSecondaryIndexes(); err != nil {
+		return err
+	}
+	return d.Index.Commit()
+}
+
+// Close syncs and closes the data and index files.
+func (d *Disk) Close() error {
+	if err := d.Sync(); err != nil {
+		return err
+	}
+	if err := d.closeSecondaryIndexes(); err != nil {
+		return err
+	}
+	if err := d.Index.Close(); err != nil {
+		return err
+	}
+	return d.File.Close()
+}
+
+// appendRecord writes the record to the end of the data file, compressing
+// its value if it is large enough, and returns its position and size.
+func (d *Disk) appendRecord(record *Record) (int64, int64, error) {
+	stored, err := compressRecord(record, d.Codec, d.CompressMinSize, &d.compression)
+	if err != nil {
+		return -1, 0, err
+	}
+	return writeRecord(d.File, stored, d.keys)
+}
+
+// writeRecord encodes the record, sealed with the keys if they are not nil,
+// and appends it to the file in a single write.
+func writeRecord(file *os.File, record *Record, keys *Keyring) (int64, int64, error) {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(record); err != nil {
+		fmt.Println("Error encoding record:", err)
+		return -1, 0, err
+	}
+	if keys != nil {
+		sealed := &Record{Sealed: keys.seal(buf.Bytes(), nil)}
+		buf.Reset()
+		if err := gob.NewEncoder(&buf).Encode(sealed); err != nil {
+			fmt.Println("Error encoding record:", err)
+			return -1, 0, err
+		}
+	}
+
+	position, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1, 0, err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return -1, 0, err
+	}
+
+	return position, int64(buf.Len()), nil
+}
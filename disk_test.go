@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// These two keys have the same 32-bit FNV-1a hash
+const collidingKey1, collidingKey2 = "key583084", "key1092000"
+
+func TestDiskHashCollision(t *testing.T) {
+	assert.Equal(t, hashKey(collidingKey1), hashKey(collidingKey2))
+
+	dir := t.TempDir()
+	disk, err := NewDisk(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, disk.Put(collidingKey1, json.RawMessage(`"value1"`)))
+	assert.NoError(t, disk.Put(collidingKey2, json.RawMessage(`"value2"`)))
+	assert.NoError(t, disk.Sync())
+
+	got, ok := disk.Get(collidingKey1)
+	assert.True(t, ok)
+	assert.Equal(t, `"value1"`, string(got))
+
+	got, ok = disk.Get(collidingKey2)
+	assert.True(t, ok)
+	assert.Equal(t, `"value2"`, string(got))
+
+	// Reopen to check both keys survive a round trip through the index file
+	disk, err = NewDisk(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok = disk.Get(collidingKey2)
+	assert.True(t, ok)
+	assert.Equal(t, `"value2"`, string(got))
+}
+
+func TestStoreHashCollision(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	kv.Set(collidingKey1, json.RawMessage(`"value1"`))
+	kv.Set(collidingKey2, json.RawMessage(`"value2"`))
+
+	got, _ := kv.Get(collidingKey1)
+	assert.Equal(t, `"value1"`, string(got))
+
+	got, _ = kv.Get(collidingKey2)
+	assert.Equal(t, `"value2"`, string(got))
+}
+
+// writeLegacyFiles writes a data and index file in the hash-only format.
+func writeLegacyFiles(t *testing.T, filename string, indexFilename string, key string, value string) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if err := gob.NewEncoder(file).Encode(&legacyRecord{Key: hashKey(key), Data: json.RawMessage(value)}); err != nil {
+		t.Fatal(err)
+	}
+
+	indexFile, err := os.Create(indexFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+
+	index := &legacyIndexTree{
+		Root: &legacyIndexTreeNode{
+			IsLeaf: true,
+			Keys:   []legacyIndexValue{{Key: hashKey(key), Pos: 0}},
+		},
+		MinDegree: 3,
+	}
+	if err := gob.NewEncoder(indexFile).Encode(index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	// This key never appears in the write-ahead log, so it cannot be recovered
+	key := "legacy-migration-unrecoverable"
+	writeLegacyFiles(t, filename, indexFilename, key, `"legacy"`)
+
+	disk, err := NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := disk.Get(fmt.Sprintf("legacy:%08x", hashKey(key)))
+	assert.True(t, ok)
+	assert.Equal(t, `"legacy"`, string(got))
+
+	// The migrated index is written in the new format
+	disk, err = NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = disk.Get(fmt.Sprintf("legacy:%08x", hashKey(key)))
+	assert.True(t, ok)
+}
+
+func TestMigrateLegacyRecoversKeysFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+	walFilename := filepath.Join(dir, "wa.log")
+
+	key := "key with spaces"
+	writeLegacyFiles(t, filename, indexFilename, key, `"legacy"`)
+	os.WriteFile(walFilename, []byte("Set other 1\nSet key with spaces \"legacy\"\n"), 0644)
+
+	disk, err := NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := disk.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, `"legacy"`, string(got))
+}
+
+func TestMigrateGobIndex(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	// Write records and an index the way versions before the paged index did
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &gobIndexTree{Root: &gobIndexTreeNode{IsLeaf: true}, MinDegree: 3}
+	for _, key := range []string{collidingKey1, collidingKey2, "other"} {
+		record := &Record{Hash: hashKey(key), Key: key, Data: json.RawMessage(fmt.Sprintf("%q", key))}
+		pos, size, err := writeRecord(file, record, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Root.Keys = append(index.Root.Keys, IndexValue{Hash: record.Hash, Key: key, Pos: pos, Size: size})
+	}
+	file.Close()
+	sort.Slice(index.Root.Keys, func(i, j int) bool {
+		return index.Root.Keys[i].less(index.Root.Keys[j].Hash, index.Root.Keys[j].Key)
+	})
+
+	indexFile, err := os.Create(indexFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(indexFile).Encode(index); err != nil {
+		t.Fatal(err)
+	}
+	indexFile.Close()
+
+	disk, err := NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{collidingKey1, collidingKey2, "other"} {
+		got, ok := disk.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("%q", key), string(got))
+	}
+
+	paged, err := isPagedIndex(indexFilename)
+	assert.NoError(t, err)
+	assert.True(t, paged)
+}
+
+func TestMigrateHashOrderedIndex(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	disk, err := NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		assert.NoError(t, disk.Put(fmt.Sprintf("key%d", i), json.RawMessage(fmt.Sprint(i))))
+	}
+	assert.NoError(t, disk.Close())
+
+	// Mark the index as written by the version that ordered keys by hash
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, 1)
+	indexFile.WriteAt(version, 4)
+	indexFile.Close()
+
+	_, err = OpenIndexTree(indexFilename, DefaultIndexCachePages, nil)
+	assert.Error(t, err)
+
+	disk, err = NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	assert.Equal(t, uint32(indexVersion), disk.Index.pager.meta.version)
+	for i := 0; i < 500; i++ {
+		got, ok := disk.Get(fmt.Sprintf("key%d", i))
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprint(i), string(got))
+	}
+}
+
+func TestDiskDelete(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDisk(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, disk.Put(collidingKey1, json.RawMessage(`"value1"`)))
+	assert.NoError(t, disk.Put(collidingKey2, json.RawMessage(`"value2"`)))
+	assert.NoError(t, disk.Delete(collidingKey1))
+	assert.NoError(t, disk.Sync())
+
+	// Deleting one key must not affect the other key with the same hash
+	_, ok := disk.Get(collidingKey1)
+	assert.False(t, ok)
+	_, ok = disk.Get(collidingKey2)
+	assert.True(t, ok)
+
+	disk, err = NewDisk(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok = disk.Get(collidingKey1)
+	assert.False(t, ok)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// With encryption at rest, every record in the data file, every node page of
+// the index files and every write-ahead log record is sealed with AES-GCM
+// before it is written. Each sealed block starts with the ID of the key it was
+// sealed with, so a keyring holding old keys as well as the active one can
+// read blocks written before a key rotation:
+//
+//	keyID      uint32
+//	nonce      [12]byte
+//	ciphertext []byte   including the 16 byte authentication tag
+//
+// Keys are listed one per line, or separated by commas, as "id:hex key", with
+// 16, 24 or 32 byte keys for AES-128, AES-192 or AES-256. The last key listed
+// is the active one, which new blocks are sealed with. To rotate keys, add a
+// new key at the end and run the store with -reencrypt, which rewrites
+// everything with it; the old key can be removed afterwards.
+
+// Environment variable the keys are read from when no key file is given
+const EncryptionKeysEnv = "KVSTORE_ENCRYPTION_KEYS"
+
+// Bytes sealing adds to a block: the key ID, nonce and authentication tag
+const sealOverhead = 4 + 12 + 16
+
+// ErrUnknownKey is returned when reading a block sealed with a key that is
+// not in the keyring.
+var ErrUnknownKey = errors.New("block is sealed with a key not in the keyring")
+
+// ErrEncrypted is returned when reading encrypted files without a keyring.
+var ErrEncrypted = errors.New("file is encrypted, but no encryption keys were given")
+
+// ErrNotEncrypted is returned when opening files written without encryption
+// with a keyring. Run the store with -reencrypt to encrypt them.
+var ErrNotEncrypted = errors.New("file is not encrypted; re-encrypt the store to encrypt it")
+
+// errDecrypt is returned when a sealed block fails authentication.
+var errDecrypt = errors.New("decrypting block failed")
+
+// Keyring holds the keys blocks are sealed with, by ID.
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// ParseKeyring parses keys written as described above. Blank lines and lines
+// starting with # are ignored.
+func ParseKeyring(text string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idText, keyText, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad encryption key %q: expected id:hex key", line)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idText), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key ID %q", idText)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(keyText))
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key %d: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key %d: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("encryption key %d is listed twice", id)
+		}
+
+		k.keys[uint32(id)] = aead
+		k.active = uint32(id)
+	}
+
+	if len(k.keys) == 0 {
+		return nil, errors.New("no encryption keys given")
+	}
+	return k, nil
+}
+
+// LoadKeyring reads the keys from a key file.
+func LoadKeyring(filename string) (*Keyring, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+// ActiveKey returns the ID of the key new blocks are sealed with.
+func (k *Keyring) ActiveKey() uint32 {
+	return k.active
+}
+
+// seal encrypts the plaintext with the active key, binding it to the
+// additional data, which must be given again to open it.
+func (k *Keyring) seal(plaintext []byte, additionalData []byte) []byte {
+	aead := k.keys[k.active]
+	sealed := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(sealed[0:4], k.active)
+	nonce := sealed[4:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(fmt.Sprintf("reading random nonce: %v", err))
+	}
+	return aead.Seal(sealed, nonce, plaintext, additionalData)
+}
+
+// open decrypts a block written by seal.
+func (k *Keyring) open(sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < sealOverhead {
+		return nil, errDecrypt
+	}
+	id := binary.BigEndian.Uint32(sealed[0:4])
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: key %d", ErrUnknownKey, id)
+	}
+
+	nonce := sealed[4 : 4+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[4+aead.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w with key %d", errDecrypt, id)
+	}
+	return plaintext, nil
+}
+
+// unseal decrypts and decodes a record sealed by writeRecord.
+func (d *Disk) unseal(sealed []byte) (*Record, error) {
+	if d.keys == nil {
+		return nil, ErrEncrypted
+	}
+	data, err := d.keys.open(sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Record{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// checkEncrypted returns ErrNotEncrypted if the index or any secondary index
+// was written without encryption.
+func (d *Disk) checkEncrypted() error {
+	if !d.Index.pager.encrypted() {
+		return fmt.Errorf("index %s: %w", d.IndexFilename, ErrNotEncrypted)
+	}
+	for _, idx := range d.secondary {
+		if !idx.tree.pager.encrypted() {
+			return fmt.Errorf("secondary index %s: %w", idx.Name, ErrNotEncrypted)
+		}
+	}
+	return nil
+}
+
+// Reencrypt rewrites a store's write-ahead log, raft log, data file and
+// indexes with the active key of the keyring, which must also hold every key
+// they were written with. It encrypts a store written without encryption, and
+// finishes a key rotation so the old keys can be removed. The store must not
+// be open. Every version of every key is kept, and values are recompressed
+// with the codec given in the options.
+func Reencrypt(filename string, indexFilename string, keys *Keyring, options ...StoreOption) error {
+	opts := storeOptions{
+		walDir:         filename + ".wal",
+		walSegmentSize: DefaultWALSegmentSize,
+		compressMin:    DefaultCompressMinSize,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	if err := reencryptWAL(opts.walDir, keys); err != nil {
+		return fmt.Errorf("re-encrypting write-ahead log: %w", err)
+	}
+	raftDir := filename + ".raft"
+	if opts.raft != nil && opts.raft.Dir != "" {
+		raftDir = opts.raft.Dir
+	}
+	if err := reencryptRaftLog(raftDir, keys); err != nil {
+		return fmt.Errorf("re-encrypting raft log: %w", err)
+	}
+
+	disk, err := openDisk(filename, indexFilename, keys, true)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	disk.Codec = opts.codec
+	disk.CompressMinSize = opts.compressMin
+	// Keep every version, as a running store with the default retention would
+	disk.Pinned = func() (uint64, bool) { return 0, true }
+
+	if _, err := replayLegacyWAL(legacyWALPath(filename), disk); err != nil {
+		return err
+	}
+	wal, err := NewWAL(opts.walDir, opts.walSegmentSize, DurabilityNone, opts.syncInterval, keys)
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+	if _, err := wal.Replay(disk); err != nil {
+		return err
+	}
+
+	// Compaction writes a new data file and index with the disk's keys
+	if _, err := disk.Compact(); err != nil {
+		return fmt.Errorf("re-encrypting data file: %w", err)
+	}
+
+	// Secondary indexes are rebuilt from scratch
+	for _, idx := range disk.Indexes() {
+		name, path := idx.Name, idx.Path
+		if err := disk.DropIndex(name); err != nil {
+			return err
+		}
+		if err := disk.CreateIndex(name, path); err != nil {
+			return fmt.Errorf("re-encrypting secondary index %s: %w", name, err)
+		}
+	}
+	return disk.Sync()
+}
+
+// reencryptWAL rewrites every segment of the write-ahead log in dir with the
+// active key, dropping any torn record at the end of the last one.
+func reencryptWAL(dir string, keys *Keyring) error {
+	segments, err := listWALSegments(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	w := &WAL{dir: dir}
+	for _, first := range segments {
+		path := w.segmentPath(first)
+		records, _, err := readWALSegment(path, keys)
+		if err != nil && err != errWALTorn {
+			return err
+		}
+
+		var buf bytes.Buffer
+		for _, record := range records {
+			encodeWALRecord(&buf, record, keys)
+		}
+		if err := writeFileAndSync(path+compactSuffix, buf.Bytes()); err != nil {
+			return err
+		}
+		if err := renameAndSync(path+compactSuffix, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptRaftLog rewrites the log of the raft node whose state is in dir
+// with the active key, if the store is a raft node.
+func reencryptRaftLog(dir string, keys *Keyring) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	s, err := openRaftStorage(dir, keys, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.reset(s.snapshot, s.entries); err != nil {
+		s.close()
+		return err
+	}
+	return s.close()
+}
+
+// writeFileAndSync writes the data to a new file and syncs it.
+func writeFileAndSync(filename string, data []byte) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey1 = "1:000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "2:f0e0d0c0b0a090807060504030201000f0e0d0c0b0a090807060504030201000"
+)
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		text   string
+		active uint32
+		err    string
+	}{
+		{text: testKey1, active: 1},
+		{text: testKey1 + "," + testKey2, active: 2},
+		{text: "# old key\n" + testKey2 + "\n\n" + testKey1 + "\n", active: 1},
+		{text: "3:00112233445566778899aabbccddeeff", active: 3},
+		{text: "", err: "no encryption keys"},
+		{text: "000102030405060708090a0b0c0d0e0f", err: "expected id:hex key"},
+		{text: "x:000102030405060708090a0b0c0d0e0f", err: "bad encryption key ID"},
+		{text: "1:zz", err: "bad encryption key 1"},
+		{text: "1:0001020304", err: "bad encryption key 1"},
+		{text: testKey1 + "," + testKey1, err: "listed twice"},
+	}
+
+	for _, tt := range tests {
+		keys, err := ParseKeyring(tt.text)
+		if tt.err != "" {
+			assert.ErrorContains(t, err, tt.err, tt.text)
+			continue
+		}
+		if assert.NoError(t, err, tt.text) {
+			assert.Equal(t, tt.active, keys.ActiveKey(), tt.text)
+		}
+	}
+}
+
+func TestSeal(t *testing.T) {
+	keys, err := ParseKeyring(testKey1)
+	assert.NoError(t, err)
+
+	sealed := keys.seal([]byte("secret"), []byte("page 1"))
+	assert.Equal(t, len("secret")+sealOverhead, len(sealed))
+	assert.NotContains(t, string(sealed), "secret")
+
+	opened, err := keys.open(sealed, []byte("page 1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(opened))
+
+	// Blocks cannot be moved elsewhere or tampered with
+	_, err = keys.open(sealed, []byte("page 2"))
+	assert.ErrorIs(t, err, errDecrypt)
+	sealed[len(sealed)-1] ^= 1
+	_, err = keys.open(sealed, []byte("page 1"))
+	assert.ErrorIs(t, err, errDecrypt)
+
+	// A block sealed with a key that has since been removed
+	other, err := ParseKeyring(testKey2)
+	assert.NoError(t, err)
+	_, err = other.open(keys.seal([]byte("secret"), nil), nil)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+// assertNoPlaintext checks that none of the files in dir contain any of the
+// strings, from the data file and indexes to the logs, including wa.log.
+func assertNoPlaintext(t *testing.T, dir string, plaintext []string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, s := range plaintext {
+			assert.False(t, bytes.Contains(data, []byte(s)), "%s contains %q", path, s)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	keys, err := ParseKeyring(testKey1)
+	assert.NoError(t, err)
+
+	// Writes left in the text log of an earlier version are applied, and the
+	// log removed
+	legacy := "Set \"legacy\" \"\\\"secret-legacy\\\"\"\n"
+	assert.NoError(t, os.WriteFile(legacyWALPath(filename), []byte(legacy), 0644))
+	plaintext := []string{"secret-legacy"}
+
+	// Some writes are flushed to the data file and some are left in the log
+	kv := NewStore(100, filename, indexFilename, WithEncryption(keys), WithCompaction(0, 0))
+	assert.NoError(t, kv.CreateIndex("by_colour", "$.colour"))
+	for i := 0; i < 150; i++ {
+		key := fmt.Sprintf("secret-key-%03d", i)
+		colour := fmt.Sprintf("secret-colour-%03d", i)
+		assert.NoError(t, kv.Set(key, json.RawMessage(fmt.Sprintf(`{"colour": %q}`, colour))))
+		plaintext = append(plaintext, key, colour)
+	}
+	assert.NoError(t, kv.Flush())
+	assert.NoError(t, kv.Set("unflushed", json.RawMessage(`{"colour": "secret-unflushed"}`)))
+	plaintext = append(plaintext, "secret-unflushed")
+	assert.NoError(t, kv.WAL.Sync())
+
+	assertNoPlaintext(t, dir, plaintext)
+	assert.NoError(t, kv.Close())
+	assertNoPlaintext(t, dir, plaintext)
+
+	// The encrypted files cannot be opened without the keys
+	_, err = NewDisk(filename, indexFilename, nil)
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	kv = NewStore(100, filename, indexFilename, WithEncryption(keys), WithCompaction(0, 0))
+	value, ok := kv.Get("secret-key-042")
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"colour": "secret-colour-042"}`, string(value))
+	entries, err := kv.QueryIndex("by_colour", IndexRange{Min: "secret-colour-100", Max: "secret-colour-102"}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.NoError(t, kv.Set("unflushed", json.RawMessage(`{"colour": "secret-replaced"}`)))
+	plaintext = append(plaintext, "secret-replaced")
+	assert.NoError(t, kv.Close())
+
+	// Rotate to a new key: records written before are still read with the old one
+	rotated, err := ParseKeyring(testKey1 + "," + testKey2)
+	assert.NoError(t, err)
+	kv = NewStore(100, filename, indexFilename, WithEncryption(rotated), WithCompaction(0, 0))
+	assert.NoError(t, kv.Set("rotated", json.RawMessage(`{"colour": "secret-rotated"}`)))
+	plaintext = append(plaintext, "secret-rotated")
+	assert.NoError(t, kv.Close())
+
+	// Until the store is re-encrypted, it cannot be opened without the old key
+	newKey, err := ParseKeyring(testKey2)
+	assert.NoError(t, err)
+	_, err = NewDisk(filename, indexFilename, newKey)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	assert.NoError(t, Reencrypt(filename, indexFilename, rotated))
+	assertNoPlaintext(t, dir, plaintext)
+
+	kv = NewStore(100, filename, indexFilename, WithEncryption(newKey), WithCompaction(0, 0))
+	defer kv.Close()
+	for _, key := range []string{"secret-key-000", "secret-key-149", "unflushed", "rotated", "legacy"} {
+		_, ok := kv.Get(key)
+		assert.True(t, ok, key)
+	}
+	value, ok = kv.Get("unflushed")
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"colour": "secret-replaced"}`, string(value))
+	versions, err := kv.History("unflushed")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	entries, err = kv.QueryIndex("by_colour", IndexRange{Min: "secret-colour-100", Max: "secret-colour-102"}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestReencryptPlaintextStore(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	kv := NewStore(100, filename, indexFilename, WithCompaction(0, 0))
+	var plaintext []string
+	for i := 0; i < 120; i++ {
+		key := fmt.Sprintf("plain-key-%03d", i)
+		value := strings.Repeat(fmt.Sprintf("plain-value-%03d ", i), 30)
+		assert.NoError(t, kv.Set(key, json.RawMessage(fmt.Sprintf("%q", value))))
+		plaintext = append(plaintext, key, fmt.Sprintf("plain-value-%03d", i))
+	}
+	assert.NoError(t, kv.Close())
+
+	// A store written without encryption has to be re-encrypted first
+	keys, err := ParseKeyring(testKey1)
+	assert.NoError(t, err)
+	_, err = NewDisk(filename, indexFilename, keys)
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	// The text log of an earlier version, with writes before and after its
+	// last checkpoint, is not left behind in plaintext
+	legacy := "Set \"legacy-flushed\" \"1\"\nCheckpoint\nSet \"legacy-pending\" \"\\\"plain-legacy-value\\\"\"\n"
+	assert.NoError(t, os.WriteFile(legacyWALPath(filename), []byte(legacy), 0644))
+	plaintext = append(plaintext, "legacy-flushed", "legacy-pending", "plain-legacy-value")
+
+	// Values are recompressed on the way
+	before, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.NoError(t, Reencrypt(filename, indexFilename, keys, WithCompression(CodecGzip, 64)))
+	assertNoPlaintext(t, dir, plaintext)
+	after, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+
+	kv = NewStore(100, filename, indexFilename, WithEncryption(keys), WithCompaction(0, 0))
+	defer kv.Close()
+	for i := 0; i < 120; i += 7 {
+		value, ok := kv.Get(fmt.Sprintf("plain-key-%03d", i))
+		assert.True(t, ok)
+		assert.Contains(t, string(value), fmt.Sprintf("plain-value-%03d", i))
+	}
+	value, ok := kv.Get("legacy-pending")
+	assert.True(t, ok)
+	assert.Equal(t, `"plain-legacy-value"`, string(value))
+}
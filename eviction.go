@@ -0,0 +1,482 @@
+package main
+
+import (
+	"hash/fnv"
+)
+
+// Share of the cache 2Q gives to entries seen once, and how many evicted keys it remembers
+const (
+	twoQInShare  = 0.25
+	twoQOutShare = 0.5
+)
+
+// twoQCache implements the full 2Q policy. Entries seen once go into a FIFO
+// queue; if they are seen again after being evicted from it, while their key
+// is still remembered, they go into the main LRU queue. A scan only ever
+// churns the FIFO queue, leaving the main queue alone.
+type twoQCache struct {
+	limits cacheLimits
+	in     *entryList // Entries seen once, first in first out
+	out    *entryList // Keys recently evicted from in, without their values
+	main   *entryList // Entries seen more than once, least recently used out
+	stats  CacheStats
+}
+
+func new2QCache(limits cacheLimits) *twoQCache {
+	return &twoQCache{
+		limits: limits,
+		in:     newEntryList(),
+		out:    newEntryList(),
+		main:   newEntryList(),
+	}
+}
+
+func (c *twoQCache) Get(key string) (*Entry, bool) {
+	if entry, ok := c.main.get(key); ok {
+		c.stats.Hits++
+		c.main.touch(key)
+		return entry, true
+	}
+	if entry, ok := c.in.get(key); ok {
+		// The FIFO queue is not reordered on a hit
+		c.stats.Hits++
+		return entry, true
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *twoQCache) Put(entry Entry) {
+	key := entry.key
+	if c.limits.tooLarge(entrySize(key, entry.value)) {
+		c.Remove(key)
+		return
+	}
+
+	if cached, ok := c.main.get(key); ok {
+		c.main.update(cached, entry)
+		c.main.touch(key)
+	} else if cached, ok := c.in.get(key); ok {
+		c.in.update(cached, entry)
+	} else if c.out.contains(key) {
+		// Seen again soon after being evicted, so it is worth keeping
+		c.out.remove(key)
+		c.main.pushFront(&entry)
+	} else {
+		c.in.pushFront(&entry)
+	}
+
+	for c.limits.over(c.in.len()+c.main.len(), c.in.bytes+c.main.bytes) {
+		c.evict()
+	}
+}
+
+// evict drops an entry from the FIFO queue if it is over its share of the
+// cache, remembering its key, and otherwise the least recently used entry of
+// the main queue.
+func (c *twoQCache) evict() {
+	capacity := c.limits.capacity(c.in.len() + c.main.len())
+	inFull := c.in.len() > int(twoQInShare*float64(capacity)) ||
+		(c.limits.maxBytes > 0 && c.in.bytes > int64(twoQInShare*float64(c.limits.maxBytes)))
+
+	if c.in.len() > 0 && (inFull || c.main.len() == 0) {
+		entry, _ := c.in.removeBack()
+		c.out.pushFront(&Entry{key: entry.key})
+		for c.out.len() > int(twoQOutShare*float64(capacity)) {
+			c.out.removeBack()
+		}
+	} else {
+		c.main.removeBack()
+	}
+	c.stats.Evictions++
+}
+
+func (c *twoQCache) Remove(key string) {
+	c.in.remove(key)
+	c.main.remove(key)
+}
+
+func (c *twoQCache) Stats() CacheStats {
+	stats := c.stats
+	stats.Entries = c.in.len() + c.main.len()
+	stats.Bytes = c.in.bytes + c.main.bytes
+	return stats
+}
+
+// arcCache implements the Adaptive Replacement Cache. Entries seen once are
+// kept in t1 and entries seen more than once in t2. The keys most recently
+// evicted from each are remembered in b1 and b2; a miss on a key in b1 means
+// t1 was too small, and one in b2 that t2 was, so the target size p of t1 is
+// moved towards whichever would have turned the miss into a hit.
+type arcCache struct {
+	limits cacheLimits
+	t1, t2 *entryList // Cached entries seen once, and more than once
+	b1, b2 *entryList // Keys recently evicted from t1 and t2
+	p      int        // Target number of entries in t1
+	stats  CacheStats
+}
+
+func newARCCache(limits cacheLimits) *arcCache {
+	return &arcCache{
+		limits: limits,
+		t1:     newEntryList(),
+		t2:     newEntryList(),
+		b1:     newEntryList(),
+		b2:     newEntryList(),
+	}
+}
+
+func (c *arcCache) Get(key string) (*Entry, bool) {
+	if entry, ok := c.t1.get(key); ok {
+		// Seen a second time, so it moves to the frequency side
+		c.stats.Hits++
+		c.t1.remove(key)
+		c.t2.pushFront(entry)
+		return entry, true
+	}
+	if entry, ok := c.t2.get(key); ok {
+		c.stats.Hits++
+		c.t2.touch(key)
+		return entry, true
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *arcCache) Put(entry Entry) {
+	key := entry.key
+	if c.limits.tooLarge(entrySize(key, entry.value)) {
+		c.Remove(key)
+		return
+	}
+
+	capacity := c.limits.capacity(c.t1.len() + c.t2.len())
+	full := c.t1.len()+c.t2.len() >= capacity
+
+	if cached, ok := c.t1.get(key); ok {
+		c.t1.update(cached, entry)
+		c.t1.remove(key)
+		c.t2.pushFront(cached)
+	} else if cached, ok := c.t2.get(key); ok {
+		c.t2.update(cached, entry)
+		c.t2.touch(key)
+	} else if c.b1.contains(key) {
+		c.p = minInt(c.p+maxInt(c.b2.len()/c.b1.len(), 1), capacity)
+		c.b1.remove(key)
+		if full {
+			c.replace(false)
+		}
+		c.t2.pushFront(&entry)
+	} else if c.b2.contains(key) {
+		c.p = maxInt(c.p-maxInt(c.b1.len()/c.b2.len(), 1), 0)
+		c.b2.remove(key)
+		if full {
+			c.replace(true)
+		}
+		c.t2.pushFront(&entry)
+	} else {
+		if c.t1.len()+c.b1.len() >= capacity {
+			if c.t1.len() < capacity {
+				c.b1.removeBack()
+				if full {
+					c.replace(false)
+				}
+			} else {
+				c.t1.removeBack()
+				c.stats.Evictions++
+			}
+		} else if total := c.t1.len() + c.t2.len() + c.b1.len() + c.b2.len(); total >= capacity {
+			if total >= 2*capacity {
+				c.b2.removeBack()
+			}
+			if full {
+				c.replace(false)
+			}
+		}
+		c.t1.pushFront(&entry)
+	}
+
+	for c.limits.over(c.t1.len()+c.t2.len(), c.t1.bytes+c.t2.bytes) {
+		c.replace(false)
+	}
+}
+
+// replace evicts an entry from t1 if it is over its target size, and from t2
+// otherwise, remembering its key in b1 or b2.
+func (c *arcCache) replace(inB2 bool) {
+	fromT1 := c.t1.len() > 0 && (c.t1.len() > c.p || (inB2 && c.t1.len() == c.p) || c.t2.len() == 0)
+	if fromT1 {
+		entry, _ := c.t1.removeBack()
+		c.b1.pushFront(&Entry{key: entry.key})
+	} else if entry, ok := c.t2.removeBack(); ok {
+		c.b2.pushFront(&Entry{key: entry.key})
+	} else {
+		return
+	}
+	c.stats.Evictions++
+}
+
+func (c *arcCache) Remove(key string) {
+	c.t1.remove(key)
+	c.t2.remove(key)
+}
+
+func (c *arcCache) Stats() CacheStats {
+	stats := c.stats
+	stats.Entries = c.t1.len() + c.t2.len()
+	stats.Bytes = c.t1.bytes + c.t2.bytes
+	return stats
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Shares of the W-TinyLFU cache taken by the admission window, and by the
+// protected segment of the main cache
+const (
+	tinyLFUWindowShare    = 0.01
+	tinyLFUProtectedShare = 0.8
+)
+
+// tinyLFUCache implements W-TinyLFU. New entries go into a small LRU window.
+// Entries leaving the window are only admitted to the main cache if a sketch
+// of how often keys are read rates them above the entry the main cache would
+// evict for them, so one-off reads cannot push out popular entries. The main
+// cache is a segmented LRU: entries start out on probation and are protected
+// once they are read again.
+type tinyLFUCache struct {
+	limits    cacheLimits
+	window    *entryList
+	probation *entryList
+	protected *entryList
+	sketch    *countMinSketch
+	stats     CacheStats
+}
+
+func newTinyLFUCache(limits cacheLimits) *tinyLFUCache {
+	width := limits.maxEntries
+	if width <= 0 {
+		width = 1024
+	}
+
+	return &tinyLFUCache{
+		limits:    limits,
+		window:    newEntryList(),
+		probation: newEntryList(),
+		protected: newEntryList(),
+		sketch:    newCountMinSketch(width),
+	}
+}
+
+func (c *tinyLFUCache) Get(key string) (*Entry, bool) {
+	c.sketch.increment(key)
+
+	if entry, ok := c.window.get(key); ok {
+		c.stats.Hits++
+		c.window.touch(key)
+		return entry, true
+	}
+	if entry, ok := c.probation.get(key); ok {
+		c.stats.Hits++
+		c.probation.remove(key)
+		c.protected.pushFront(entry)
+		c.trimProtected()
+		return entry, true
+	}
+	if entry, ok := c.protected.get(key); ok {
+		c.stats.Hits++
+		c.protected.touch(key)
+		return entry, true
+	}
+
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *tinyLFUCache) Put(entry Entry) {
+	key := entry.key
+	if c.limits.tooLarge(entrySize(key, entry.value)) {
+		c.Remove(key)
+		return
+	}
+
+	updated := false
+	for _, segment := range []*entryList{c.window, c.probation, c.protected} {
+		if cached, ok := segment.get(key); ok {
+			segment.update(cached, entry)
+			segment.touch(key)
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		c.window.pushFront(&entry)
+	}
+
+	c.evict()
+}
+
+func (c *tinyLFUCache) entries() int {
+	return c.window.len() + c.probation.len() + c.protected.len()
+}
+
+func (c *tinyLFUCache) bytes() int64 {
+	return c.window.bytes + c.probation.bytes + c.protected.bytes
+}
+
+// windowCapacity returns the number of entries the window holds before
+// entries move on to the main cache.
+func (c *tinyLFUCache) windowCapacity() int {
+	return maxInt(1, int(tinyLFUWindowShare*float64(c.limits.capacity(c.entries()))))
+}
+
+// trimProtected demotes the least recently used protected entries to
+// probation while the protected segment is over its share of the main cache.
+func (c *tinyLFUCache) trimProtected() {
+	main := c.limits.capacity(c.entries()) - c.windowCapacity()
+	for c.protected.len() > int(tinyLFUProtectedShare*float64(main)) {
+		entry, _ := c.protected.removeBack()
+		c.probation.pushFront(entry)
+	}
+}
+
+// evict moves entries out of the window once it is full, each of which either
+// takes the place of the main cache's victim or is evicted itself, depending
+// on which is read more often. Whatever is still over the limits after that is
+// evicted from probation first, then from the protected segment, then from the window.
+func (c *tinyLFUCache) evict() {
+	for c.window.len() > c.windowCapacity() {
+		candidate, _ := c.window.removeBack()
+		c.probation.pushFront(candidate)
+
+		for c.limits.over(c.entries(), c.bytes()) {
+			victim, ok := c.probation.back()
+			if !ok || victim == candidate {
+				if victim, ok = c.protected.back(); !ok {
+					break
+				}
+			}
+
+			if c.sketch.estimate(candidate.key) > c.sketch.estimate(victim.key) {
+				c.probation.remove(victim.key)
+				c.protected.remove(victim.key)
+				c.stats.Evictions++
+			} else {
+				c.probation.remove(candidate.key)
+				c.stats.Evictions++
+				break
+			}
+		}
+	}
+
+	for c.limits.over(c.entries(), c.bytes()) {
+		if _, ok := c.probation.removeBack(); !ok {
+			if _, ok := c.protected.removeBack(); !ok {
+				c.window.removeBack()
+			}
+		}
+		c.stats.Evictions++
+	}
+}
+
+func (c *tinyLFUCache) Remove(key string) {
+	c.window.remove(key)
+	c.probation.remove(key)
+	c.protected.remove(key)
+}
+
+func (c *tinyLFUCache) Stats() CacheStats {
+	stats := c.stats
+	stats.Entries = c.entries()
+	stats.Bytes = c.bytes()
+	return stats
+}
+
+// countMinSketch estimates how often each key has been seen, in a fixed
+// amount of memory. Each key increments one 4-bit counter in each row, and its
+// estimate is the smallest of those counters, which overcounts only when every
+// one of them is shared with other keys. All counters are halved once enough
+// keys have been counted, so the estimates follow changes in popularity.
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+// Largest value of a counter
+const sketchMaxCount = 15
+
+func newCountMinSketch(width int) *countMinSketch {
+	size := 16
+	for size < width {
+		size *= 2
+	}
+
+	s := &countMinSketch{mask: uint64(size - 1), sampleSize: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+	return s
+}
+
+// indexes returns the counter for the key in each row, derived from two
+// halves of its 64-bit hash.
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+
+	var indexes [4]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return indexes
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < sketchMaxCount {
+			s.rows[i][index]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	estimate := uint8(sketchMaxCount)
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < estimate {
+			estimate = s.rows[i][index]
+		}
+	}
+	return estimate
+}
+
+// reset halves every counter, so that old reads count for less than new ones.
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,12 +20,91 @@ import (
 
 var srv *http.Server
 
+// Number of keys GET /api/keys returns by default, and the most it returns at once
+const DefaultListLimit = 100
+const MaxListLimit = 1000
+
+// Routes that write to the store, which followers turn away and raft nodes
+// other than the leader redirect to it
+var writeRoutes = map[string]bool{
+	"POST /api/keys/:key":          true,
+	"DELETE /api/keys/:key":        true,
+	"POST /api/keys":               true,
+	"POST /api/txn":                true,
+	"POST /api/batch":              true,
+	"POST /api/raft/members":       true,
+	"DELETE /api/raft/members/:id": true,
+	"POST /console/keys":           true,
+	"DELETE /console/keys":         true,
+}
+
 func startServer(kv *Store) {
+	startServerAt(":8080", kv)
+}
+
+// startServerAt starts the server listening on the address.
+func startServerAt(addr string, kv *Store) {
+	serveAt(addr, newRouter(kv))
+}
+
+// serveAt starts the server listening on the address, serving requests with
+// the handler.
+func serveAt(addr string, handler http.Handler) {
+	srv = &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	// Requests are cancelled when the server shuts down, which ends the
+	// replication streams that would otherwise hold it up
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context { return ctx }
+	srv.RegisterOnShutdown(cancel)
+
+	// Listen before returning so the server is ready to accept connections
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		// service connections
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+}
+
+func newRouter(kv *Store) *gin.Engine {
 	r := gin.Default()
 
 	// Load HTML templates
 	r.LoadHTMLGlob("templates/*")
 
+	// Followers only take writes from their leader
+	if kv.follower != nil {
+		r.Use(func(c *gin.Context) {
+			if writeRoutes[c.Request.Method+" "+c.FullPath()] {
+				c.AbortWithStatusJSON(403, gin.H{"error": "Read-only follower", "leader": kv.follower.leader})
+			}
+		})
+	}
+
+	// Raft nodes send writes on to the leader, keeping the method and body
+	if kv.raft != nil {
+		r.Use(func(c *gin.Context) {
+			if !writeRoutes[c.Request.Method+" "+c.FullPath()] || kv.raft.isLeader() {
+				return
+			}
+			if addr, ok := kv.raft.leaderAddr(); ok {
+				c.Redirect(http.StatusTemporaryRedirect, addr+c.Request.URL.RequestURI())
+				c.Abort()
+			} else {
+				c.AbortWithStatusJSON(503, gin.H{"error": "No raft leader"})
+			}
+		})
+	}
+
 	// Root path should re-direct to console
 	r.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusMovedPermanently, "/console/")
@@ -26,9 +113,80 @@ func startServer(kv *Store) {
 	// Create a route group for the API
 	api := r.Group("/api")
 	{
+		// Lists keys in order, a page at a time. Pass the cursor from one page
+		// to get the next.
+		api.GET("/keys", func(c *gin.Context) {
+			prefix := c.Query("prefix")
+			start := c.Query("start")
+			if start < prefix {
+				start = prefix
+			}
+
+			limit := DefaultListLimit
+			if value := c.Query("limit"); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 || n > MaxListLimit {
+					c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxListLimit)})
+					return
+				}
+				limit = n
+			}
+
+			if cursor := c.Query("cursor"); cursor != "" {
+				last, err := base64.RawURLEncoding.DecodeString(cursor)
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Bad cursor"})
+					return
+				}
+				if after := keyAfter(string(last)); start < after {
+					start = after
+				}
+			}
+
+			// Read one entry past the page to tell whether there is another
+			it := kv.Scan(start, prefixEnd(prefix), limit+1)
+			entries := []gin.H{}
+			var next string
+			for it.Next() {
+				if len(entries) == limit {
+					next = base64.RawURLEncoding.EncodeToString([]byte(entries[limit-1]["key"].(string)))
+					break
+				}
+				entries = append(entries, gin.H{"key": it.Key(), "value": it.Value()})
+			}
+			if err := it.Err(); err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.JSON(200, gin.H{"entries": entries, "cursor": next})
+		})
+
+		// Pass a version to read the value the key had then
 		api.GET("/keys/:key", func(c *gin.Context) {
 			key := c.Param("key")
-			value, ok := kv.Get(key)
+			var value json.RawMessage
+			var ok bool
+			if version := c.Query("version"); version != "" {
+				v, err := strconv.ParseUint(version, 10, 64)
+				if err != nil {
+					c.JSON(400, gin.H{"error": "Bad version"})
+					return
+				}
+				value, ok = kv.GetAt(key, v)
+			} else {
+				// The current value is tagged with its version, so clients can
+				// make later writes conditional on it
+				var current uint64
+				value, current, ok = kv.GetVersion(key)
+				if ok {
+					c.Header("ETag", formatETag(current))
+					if matchETags(c.GetHeader("If-None-Match"), current, true, true) {
+						c.Status(304)
+						return
+					}
+				}
+			}
 			if ok {
 				c.JSON(200, gin.H{"value": value})
 			} else {
@@ -36,6 +194,33 @@ func startServer(kv *Store) {
 			}
 		})
 
+		// Lists the versions of the key that are still kept, newest first
+		api.GET("/keys/:key/history", func(c *gin.Context) {
+			versions, err := kv.History(c.Param("key"))
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			} else if len(versions) == 0 {
+				c.JSON(404, gin.H{"error": "Key not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"versions": versions})
+		})
+
+		// Returns the seconds left until the key expires, or -1 if it never does
+		api.GET("/keys/:key/ttl", func(c *gin.Context) {
+			ttl, ok := kv.TTL(c.Param("key"))
+			if !ok {
+				c.JSON(404, gin.H{"error": "Key not found"})
+			} else if ttl == 0 {
+				c.JSON(200, gin.H{"ttl": -1})
+			} else {
+				c.JSON(200, gin.H{"ttl": ttl.Seconds()})
+			}
+		})
+
+		// Pass a ttl in seconds for the key to expire after
 		api.POST("/keys/:key", func(c *gin.Context) {
 			var body json.RawMessage
 			err := c.BindJSON(&body)
@@ -45,21 +230,62 @@ func startServer(kv *Store) {
 				return
 			}
 
-			err = kv.Set(c.Param("key"), body)
+			op := Operation{Key: c.Param("key"), Value: body}
+			if ttl := c.Query("ttl"); ttl != "" {
+				seconds, err := strconv.ParseFloat(ttl, 64)
+				if err == nil {
+					op.Expires, err = expiresAfter(seconds)
+				}
+				if err != nil {
+					c.JSON(400, gin.H{"error": "TTL must be a positive number of seconds"})
+					return
+				}
+			}
 
-			if err != nil {
+			// If-Match and If-None-Match make the write conditional on the
+			// version of the key the client last read
+			version, err := kv.writeIf(op, writePreconditions(c, op.Key))
+
+			if err == ErrKeyTooLarge {
+				c.JSON(400, gin.H{"error": "Key too large"})
+				return
+			} else if err == ErrVersionMismatch {
+				c.JSON(412, gin.H{"error": "Precondition failed"})
+				return
+			} else if err != nil {
 				c.JSON(500, gin.H{"error": "Internal server error"})
 				return
 			} else {
+				c.Header("ETag", formatETag(version))
 				c.JSON(200, gin.H{"status": "success"})
 			}
 		})
 
+		api.DELETE("/keys/:key", func(c *gin.Context) {
+			key := c.Param("key")
+			conditions := append(writePreconditions(c, key), writeCondition{Kind: conditionExists, Key: key})
+			_, err := kv.writeIf(Operation{Key: key, Deleted: true}, conditions)
+
+			if err == ErrVersionMismatch {
+				c.JSON(412, gin.H{"error": "Precondition failed"})
+				return
+			} else if err == ErrKeyNotFound {
+				c.JSON(404, gin.H{"error": "Key not found"})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success"})
+		})
+
 		// Variant of POST keys where the key is in the body instead of path
 		api.POST("/keys", func(c *gin.Context) {
 			var body struct {
 				Key   string          `json:"key"`
 				Value json.RawMessage `json:"value"`
+				TTL   *float64        `json:"ttl"` // Seconds until the key expires
 			}
 			err := c.BindJSON(&body)
 
@@ -68,15 +294,366 @@ func startServer(kv *Store) {
 				return
 			}
 
-			err = kv.Set(body.Key, body.Value)
+			op := Operation{Key: body.Key, Value: body.Value}
+			if body.TTL != nil {
+				if op.Expires, err = expiresAfter(*body.TTL); err != nil {
+					c.JSON(400, gin.H{"error": "TTL must be a positive number of seconds"})
+					return
+				}
+			}
 
-			if err != nil {
+			version, err := kv.writeIf(op, writePreconditions(c, op.Key))
+
+			if err == ErrKeyTooLarge {
+				c.JSON(400, gin.H{"error": "Key too large"})
+				return
+			} else if err == ErrVersionMismatch {
+				c.JSON(412, gin.H{"error": "Precondition failed"})
+				return
+			} else if err != nil {
 				c.JSON(500, gin.H{"error": "Internal server error"})
 				return
 			} else {
+				c.Header("ETag", formatETag(version))
 				c.JSON(200, gin.H{"status": "success"})
 			}
 		})
+
+		// Sets many keys at once, atomically
+		api.POST("/batch", func(c *gin.Context) {
+			var body struct {
+				Entries []StoreEntry `json:"entries"`
+			}
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+
+			err := kv.BatchSet(body.Entries)
+
+			if err == ErrKeyTooLarge {
+				c.JSON(400, gin.H{"error": "Key too large"})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+			c.JSON(200, gin.H{"status": "success"})
+		})
+
+		// Applies a list of operations atomically, once every precondition holds
+		api.POST("/txn", func(c *gin.Context) {
+			var body struct {
+				Preconditions []struct {
+					Key    string          `json:"key"`
+					Exists *bool           `json:"exists"`
+					Value  json.RawMessage `json:"value"`
+				} `json:"preconditions"`
+				Operations []struct {
+					Op    string          `json:"op"`
+					Key   string          `json:"key"`
+					Value json.RawMessage `json:"value"`
+				} `json:"operations"`
+			}
+			err := c.BindJSON(&body)
+
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+
+			txn := kv.Begin()
+			defer txn.Rollback()
+
+			// Preconditions are checked against the transaction's snapshot, and
+			// the keys watched so a write to them before the commit conflicts
+			for _, precondition := range body.Preconditions {
+				if err := txn.Watch(precondition.Key); err != nil {
+					c.JSON(500, gin.H{"error": "Internal server error"})
+					return
+				}
+				value, ok, err := txn.Get(precondition.Key)
+				if err == ErrTxnConflict {
+					c.JSON(409, gin.H{"error": "Conflict"})
+					return
+				} else if err != nil {
+					c.JSON(500, gin.H{"error": "Internal server error"})
+					return
+				}
+
+				if (precondition.Exists != nil && *precondition.Exists != ok) ||
+					(precondition.Value != nil && (!ok || !jsonEqual(precondition.Value, value))) {
+					c.JSON(412, gin.H{"error": "Precondition failed", "key": precondition.Key})
+					return
+				}
+			}
+
+			for _, op := range body.Operations {
+				switch op.Op {
+				case "set":
+					err = txn.Set(op.Key, op.Value)
+				case "delete":
+					err = txn.Delete(op.Key)
+				default:
+					c.JSON(400, gin.H{"error": fmt.Sprintf("Unknown operation %q", op.Op)})
+					return
+				}
+
+				if err == ErrKeyTooLarge {
+					c.JSON(400, gin.H{"error": "Key too large"})
+					return
+				} else if err != nil {
+					c.JSON(500, gin.H{"error": "Internal server error"})
+					return
+				}
+			}
+
+			err = txn.Commit()
+
+			if err == ErrTxnConflict {
+				c.JSON(409, gin.H{"error": "Conflict"})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success"})
+		})
+	}
+
+	// Create a route group for secondary indexes
+	indexes := r.Group("/api/indexes")
+	{
+		indexes.GET("", func(c *gin.Context) {
+			c.JSON(200, gin.H{"indexes": kv.Indexes()})
+		})
+
+		// Creates an index on the value at a JSON path in each document
+		indexes.POST("", func(c *gin.Context) {
+			var body struct {
+				Name string `json:"name"`
+				Path string `json:"path"`
+			}
+			err := c.BindJSON(&body)
+
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+
+			err = kv.CreateIndex(body.Name, body.Path)
+
+			if err == ErrIndexExists {
+				c.JSON(409, gin.H{"error": "Index already exists"})
+				return
+			} else if err == ErrBadIndexName || errors.Is(err, ErrBadJSONPath) {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success"})
+		})
+
+		// Finds documents by the indexed value, either equal to eq or between
+		// gte and lte. Values are parsed as JSON, or taken as strings if they
+		// are not valid JSON.
+		indexes.GET("/:name", func(c *gin.Context) {
+			var r IndexRange
+			if eq := c.Query("eq"); eq != "" {
+				r.Min = queryValue(eq)
+				r.Max = r.Min
+			}
+			if gte := c.Query("gte"); gte != "" {
+				r.Min = queryValue(gte)
+			}
+			if lte := c.Query("lte"); lte != "" {
+				r.Max = queryValue(lte)
+			}
+
+			limit := DefaultListLimit
+			if value := c.Query("limit"); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 || n > MaxListLimit {
+					c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxListLimit)})
+					return
+				}
+				limit = n
+			}
+
+			entries, err := kv.QueryIndex(c.Param("name"), r, limit)
+
+			if err == ErrIndexNotFound {
+				c.JSON(404, gin.H{"error": "Index not found"})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			results := make([]gin.H, len(entries))
+			for i, entry := range entries {
+				results[i] = gin.H{"key": entry.Key, "value": entry.Value}
+			}
+			c.JSON(200, gin.H{"entries": results})
+		})
+
+		indexes.DELETE("/:name", func(c *gin.Context) {
+			err := kv.DropIndex(c.Param("name"))
+
+			if err == ErrIndexNotFound {
+				c.JSON(404, gin.H{"error": "Index not found"})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success"})
+		})
+	}
+
+	// Runs a query in the query language, returning the rows it selects, or
+	// the plan it would run with for EXPLAIN queries
+	r.POST("/api/query", func(c *gin.Context) {
+		var body struct {
+			Query string `json:"query"`
+		}
+		err := c.BindJSON(&body)
+
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Bad request"})
+			return
+		}
+
+		result, err := kv.Query(body.Query)
+
+		if errors.Is(err, ErrBadQuery) {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		if result.Rows == nil {
+			c.JSON(200, gin.H{"plan": result.Plan})
+			return
+		}
+		c.JSON(200, gin.H{"rows": result.Rows})
+	})
+
+	// Create a route group for administrative tasks
+	admin := r.Group("/api/admin")
+	{
+		admin.POST("/compact", func(c *gin.Context) {
+			stats, err := kv.Compact()
+
+			if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+
+			c.JSON(200, stats)
+		})
+
+		admin.GET("/compression", func(c *gin.Context) {
+			c.JSON(200, kv.CompressionStats())
+		})
+	}
+
+	// Create a route group for replication
+	replication := r.Group("/api/replication")
+	{
+		// Streams the write-ahead log from a sequence number as JSON lines,
+		// starting with a snapshot of the store if it is 0
+		replication.GET("/stream", func(c *gin.Context) {
+			from, err := strconv.ParseUint(c.DefaultQuery("from", "0"), 10, 64)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Bad sequence number"})
+				return
+			}
+
+			started := false
+			encoder := json.NewEncoder(c.Writer)
+			err = kv.replicate(c.Request.Context(), from, c.ClientIP(), func(msg *replicationMessage) error {
+				if !started {
+					c.Header("Content-Type", "application/x-ndjson")
+					c.Status(200)
+					started = true
+				}
+				if err := encoder.Encode(msg); err != nil {
+					return err
+				}
+				c.Writer.Flush()
+				return nil
+			})
+
+			if started {
+				// The stream ends when the follower goes away
+				if err != nil && c.Request.Context().Err() == nil {
+					fmt.Println("Error streaming write-ahead log:", err)
+				}
+				return
+			} else if errors.Is(err, ErrReplicationGap) {
+				c.JSON(410, gin.H{"error": err.Error()})
+			} else if errors.Is(err, errLeaderBehind) {
+				c.JSON(409, gin.H{"error": err.Error()})
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+			}
+		})
+
+		replication.GET("/status", func(c *gin.Context) {
+			c.JSON(200, kv.ReplicationStatus())
+		})
+	}
+
+	// Create a route group for raft
+	raft := r.Group("/api/raft")
+	{
+		// Messages from the other nodes, as a gob encoded batch
+		raft.POST("/messages", func(c *gin.Context) {
+			var msgs []RaftMessage
+			if err := gob.NewDecoder(c.Request.Body).Decode(&msgs); err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+
+			if err := kv.receiveRaftMessages(msgs); err == ErrNotRaft {
+				c.JSON(404, gin.H{"error": "Not a raft node"})
+				return
+			}
+			c.Status(204)
+		})
+
+		raft.GET("/status", func(c *gin.Context) {
+			status, ok := kv.RaftStatus()
+			if !ok {
+				c.JSON(404, gin.H{"error": "Not a raft node"})
+				return
+			}
+			c.JSON(200, status)
+		})
+
+		raft.POST("/members", func(c *gin.Context) {
+			var body struct {
+				ID   string `json:"id"`
+				Addr string `json:"addr"`
+			}
+			if err := c.BindJSON(&body); err != nil || body.ID == "" || body.Addr == "" {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+			raftMemberResponse(c, kv.AddMember(body.ID, body.Addr))
+		})
+
+		raft.DELETE("/members/:id", func(c *gin.Context) {
+			raftMemberResponse(c, kv.RemoveMember(c.Param("id")))
+		})
 	}
 
 	// Create a route group for the console
@@ -101,7 +678,10 @@ func startServer(kv *Store) {
 
 			err := kv.Set(key, jsonValue)
 
-			if err != nil {
+			if err == ErrKeyTooLarge {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Key too large"})
+				return
+			} else if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 				return
 			}
@@ -118,19 +698,139 @@ func startServer(kv *Store) {
 				c.Data(http.StatusNotFound, "text/html; charset=utf-8", []byte("<div>Key not found</div>"))
 			}
 		})
+
+		console.DELETE("/keys", func(c *gin.Context) {
+			key := c.Query("key")
+			err := kv.Delete(key)
+
+			if err == ErrKeyNotFound {
+				c.Data(http.StatusNotFound, "text/html; charset=utf-8", []byte("<div>Key not found</div>"))
+				return
+			} else if err != nil {
+				c.Data(http.StatusInternalServerError, "text/html; charset=utf-8", []byte("<div>Internal server error</div>"))
+				return
+			}
+
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf("<div>Deleted %s</div>", html.EscapeString(key))))
+		})
+
+		console.POST("/query", func(c *gin.Context) {
+			result, err := kv.Query(c.PostForm("query"))
+
+			if errors.Is(err, ErrBadQuery) {
+				c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte(fmt.Sprintf("<div>%s</div>", html.EscapeString(err.Error()))))
+				return
+			} else if err != nil {
+				c.Data(http.StatusInternalServerError, "text/html; charset=utf-8", []byte("<div>Internal server error</div>"))
+				return
+			}
+
+			if result.Rows == nil {
+				c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf("<div>Plan: %s</div>", html.EscapeString(result.Plan.String()))))
+				return
+			}
+			rows, err := json.MarshalIndent(result.Rows, "", "  ")
+			if err != nil {
+				c.Data(http.StatusInternalServerError, "text/html; charset=utf-8", []byte("<div>Internal server error</div>"))
+				return
+			}
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf("<div>%d rows, plan: %s</div><pre>%s</pre>",
+				len(result.Rows), html.EscapeString(result.Plan.String()), html.EscapeString(string(rows)))))
+		})
 	}
 
-	srv = &http.Server{
-		Addr:    ":8080",
-		Handler: r,
+	return r
+}
+
+// expiresAfter returns when a key written now with a TTL of the given seconds
+// expires, in nanoseconds since the epoch. It fails if the TTL is not positive
+// or is longer than MaxTTL.
+func expiresAfter(seconds float64) (int64, error) {
+	if !(seconds > 0 && seconds <= MaxTTL.Seconds()) {
+		return 0, ErrInvalidTTL
 	}
+	return time.Now().Add(time.Duration(seconds * float64(time.Second))).UnixNano(), nil
+}
 
-	go func() {
-		// service connections
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			panic(err)
+// queryValue parses a value given in a query string as JSON, or takes it as a
+// string if it is not valid JSON, so that both ?eq=42 and ?eq=alice work.
+func queryValue(raw string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return raw
+	}
+	return value
+}
+
+// formatETag returns the entity tag for a version of a key.
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchETags reports whether an If-Match or If-None-Match header matches the
+// key's current version: "*" matches any version of a key that exists, and a
+// list of entity tags matches if the version is one of them. Weak tags only
+// match if weak is set, as only If-None-Match compares them.
+func matchETags(header string, version uint64, exists bool, weak bool) bool {
+	if !exists {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
 		}
-	}()
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		n, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+		if err == nil && n == version {
+			return true
+		}
+	}
+	return false
+}
+
+// writePreconditions returns the conditions that fail a write to the key
+// with ErrVersionMismatch unless it matches the request's If-Match header and
+// does not match its If-None-Match header, where either is given.
+func writePreconditions(c *gin.Context, key string) []writeCondition {
+	var conditions []writeCondition
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		conditions = append(conditions, writeCondition{Kind: conditionIfMatch, Key: key, Tags: ifMatch})
+	}
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		conditions = append(conditions, writeCondition{Kind: conditionIfNoneMatch, Key: key, Tags: ifNoneMatch})
+	}
+	return conditions
+}
+
+// raftMemberResponse responds to a change of the raft cluster's members.
+func raftMemberResponse(c *gin.Context, err error) {
+	switch {
+	case err == nil:
+		c.JSON(200, gin.H{"status": "success"})
+	case err == ErrNotRaft:
+		c.JSON(404, gin.H{"error": "Not a raft node"})
+	case err == ErrMembershipChangePending:
+		c.JSON(409, gin.H{"error": err.Error()})
+	case err == ErrNotLeader || err == ErrProposalDropped || err == ErrProposalTimeout:
+		c.JSON(503, gin.H{"error": err.Error()})
+	default:
+		c.JSON(400, gin.H{"error": err.Error()})
+	}
+}
+
+// jsonEqual reports whether two JSON documents are the same, ignoring insignificant whitespace.
+func jsonEqual(a, b json.RawMessage) bool {
+	var bufA, bufB bytes.Buffer
+	if json.Compact(&bufA, a) != nil || json.Compact(&bufB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
 }
 
 func stopServer() {
@@ -2,9 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,10 +17,11 @@ import (
 func TestAPI(t *testing.T) {
 	// Start the server.
 	kv := NewStore(100, "test.db", "test.idx")
-	go startServer(kv)
+	startServer(kv)
 	defer stopServer()
 
 	client := &http.Client{}
+	defer client.CloseIdleConnections()
 
 	// Test POST /keys/:key
 	req, _ := http.NewRequest("POST", "http://localhost:8080/api/keys/testKey", bytes.NewBufferString(`{"value":"testValue"}`))
@@ -47,10 +53,11 @@ func TestAPI(t *testing.T) {
 func TestAPI_NotJSON(t *testing.T) {
 	// Start the server.
 	kv := NewStore(100, "test.db", "test.idx")
-	go startServer(kv)
+	startServer(kv)
 	defer stopServer()
 
 	client := &http.Client{}
+	defer client.CloseIdleConnections()
 
 	// Test POST /keys/:key
 	req, _ := http.NewRequest("POST", "http://localhost:8080/api/keys/testKey", bytes.NewBufferString(`testValue`))
@@ -65,3 +72,514 @@ func TestAPI_NotJSON(t *testing.T) {
 	assert.Equal(t, 400, resp.StatusCode)
 	assert.Contains(t, string(body), "Bad request")
 }
+
+func TestAPI_Delete(t *testing.T) {
+	// Start the server.
+	kv := NewStore(100, "test.db", "test.idx")
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	kv.Set("deleteKey", []byte(`{"value":"deleteValue"}`))
+
+	// Test DELETE /keys/:key
+	req, _ := http.NewRequest("DELETE", "http://localhost:8080/api/keys/deleteKey", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), "success")
+
+	// The key is gone
+	req, _ = http.NewRequest("GET", "http://localhost:8080/api/keys/deleteKey", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	assert.Equal(t, 404, resp.StatusCode)
+
+	// Deleting it again reports that it does not exist
+	req, _ = http.NewRequest("DELETE", "http://localhost:8080/api/keys/deleteKey", nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Contains(t, string(body), "Key not found")
+
+	// The console escapes the key it reports deleting
+	kv.Set("<b>key</b>", []byte(`1`))
+	req, _ = http.NewRequest("DELETE", "http://localhost:8080/console/keys?key="+url.QueryEscape("<b>key</b>"), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "<div>Deleted &lt;b&gt;key&lt;/b&gt;</div>", string(body))
+}
+
+func TestAPI_Compact(t *testing.T) {
+	// Start the server.
+	kv := NewStore(100, "test.db", "test.idx")
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	kv.Set("compactKey", []byte(`{"value":"compactValue"}`))
+
+	// Test POST /admin/compact
+	req, _ := http.NewRequest("POST", "http://localhost:8080/api/admin/compact", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), "bytesAfter")
+
+	value, ok := kv.Get("compactKey")
+	assert.True(t, ok)
+	assert.Contains(t, string(value), "compactValue")
+
+	// Test GET /admin/compression
+	resp, err = client.Get("http://localhost:8080/api/admin/compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(body), `"codec":"none"`)
+}
+
+func TestAPI_ListKeys(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	for i := 0; i < 5; i++ {
+		kv.Set(fmt.Sprintf("list:%d", i), json.RawMessage(fmt.Sprint(i)))
+	}
+	kv.Set("other", json.RawMessage("1"))
+
+	// Test GET /keys, following the cursor from page to page
+	var keys []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		query := url.Values{"prefix": {"list:"}, "limit": {"2"}, "cursor": {cursor}}
+		resp, err := client.Get("http://localhost:8080/api/keys?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Entries []struct {
+				Key   string          `json:"key"`
+				Value json.RawMessage `json:"value"`
+			} `json:"entries"`
+			Cursor string `json:"cursor"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		assert.Equal(t, 200, resp.StatusCode)
+		for _, entry := range body.Entries {
+			keys = append(keys, entry.Key)
+		}
+		cursor = body.Cursor
+		if page < 2 {
+			assert.NotEmpty(t, cursor)
+		}
+	}
+	assert.Empty(t, cursor)
+	assert.Equal(t, []string{"list:0", "list:1", "list:2", "list:3", "list:4"}, keys)
+
+	// Test GET /keys with a bad limit
+	resp, err := client.Get("http://localhost:8080/api/keys?limit=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestAPI_Txn(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	kv.Set("balance", json.RawMessage(`{"amount": 10}`))
+
+	tests := []struct {
+		body       string
+		wantStatus int
+		wantValue  string
+	}{
+		// The precondition does not hold, so nothing is written
+		{`{"preconditions": [{"key": "balance", "value": {"amount": 5}}],
+		   "operations": [{"op": "set", "key": "balance", "value": {"amount": 0}}]}`, 412, `{"amount": 10}`},
+		{`{"preconditions": [{"key": "balance", "value": {"amount":10}}, {"key": "log", "exists": false}],
+		   "operations": [{"op": "set", "key": "balance", "value": {"amount": 0}}, {"op": "set", "key": "log", "value": "paid"}]}`, 200, `{"amount": 0}`},
+		{`{"operations": [{"op": "increment", "key": "balance"}]}`, 400, `{"amount": 0}`},
+	}
+
+	for _, test := range tests {
+		// Test POST /txn
+		resp, err := client.Post("http://localhost:8080/api/txn", "application/json", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		assert.Equal(t, test.wantStatus, resp.StatusCode, test.body)
+		value, _ := kv.Get("balance")
+		assert.Equal(t, test.wantValue, string(value))
+	}
+
+	value, ok := kv.Get("log")
+	assert.True(t, ok)
+	assert.Equal(t, `"paid"`, string(value))
+}
+
+func TestAPI_History(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithVersionRetention(time.Hour))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	kv.Set("historyKey", json.RawMessage(`"first"`))
+	first := kv.Version()
+	kv.Set("historyKey", json.RawMessage(`"second"`))
+
+	// Test GET /keys/:key/history
+	resp, err := client.Get("http://localhost:8080/api/keys/historyKey/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Versions []KeyVersion `json:"versions"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	if assert.Len(t, body.Versions, 2) {
+		assert.Equal(t, `"second"`, string(body.Versions[0].Value))
+		assert.Equal(t, first, body.Versions[1].Version)
+	}
+
+	// Test GET /keys/:key at an earlier version
+	resp, err = client.Get(fmt.Sprintf("http://localhost:8080/api/keys/historyKey?version=%d", first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(data), "first")
+
+	resp, err = client.Get("http://localhost:8080/api/keys/missingKey/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestAPI_ETags(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	do := func(method string, header string, etag string, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://localhost:8080/api/keys/etagKey", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Creating the key only if it does not exist succeeds once
+	resp := do("POST", "If-None-Match", "*", `"first"`)
+	assert.Equal(t, 200, resp.StatusCode)
+	created := resp.Header.Get("ETag")
+	assert.NotEmpty(t, created)
+	assert.Equal(t, 412, do("POST", "If-None-Match", "*", `"again"`).StatusCode)
+
+	// GET returns the same tag, and nothing new if the client already has it
+	resp = do("GET", "", "", "")
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, created, resp.Header.Get("ETag"))
+	assert.Equal(t, 304, do("GET", "If-None-Match", created, "").StatusCode)
+
+	// Writes based on the version the client read win once
+	resp = do("POST", "If-Match", created, `"second"`)
+	assert.Equal(t, 200, resp.StatusCode)
+	updated := resp.Header.Get("ETag")
+	assert.NotEqual(t, created, updated)
+	assert.Equal(t, 412, do("POST", "If-Match", created, `"third"`).StatusCode)
+	assert.Equal(t, 412, do("POST", "If-Match", "W/"+updated, `"third"`).StatusCode)
+	assert.Equal(t, 412, do("DELETE", "If-Match", created, "").StatusCode)
+
+	value, _ := kv.Get("etagKey")
+	assert.Equal(t, `"second"`, string(value))
+
+	assert.Equal(t, 200, do("DELETE", "If-Match", `"0", `+updated, "").StatusCode)
+	assert.Equal(t, 412, do("DELETE", "If-Match", "*", "").StatusCode)
+	assert.Equal(t, 404, do("DELETE", "", "", "").StatusCode)
+}
+
+func TestAPI_TTL(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithExpirySweepInterval(0))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	tests := []struct {
+		url        string
+		body       string
+		wantStatus int
+	}{
+		{"http://localhost:8080/api/keys/session?ttl=0.1", `"token"`, 200},
+		{"http://localhost:8080/api/keys", `{"key": "other", "value": "token", "ttl": 0.1}`, 200},
+		{"http://localhost:8080/api/keys/forever", `"token"`, 200},
+		{"http://localhost:8080/api/keys/bad?ttl=-1", `"token"`, 400},
+		{"http://localhost:8080/api/keys/bad?ttl=soon", `"token"`, 400},
+		{"http://localhost:8080/api/keys", `{"key": "bad", "value": "token", "ttl": 0}`, 400},
+	}
+
+	for _, test := range tests {
+		resp, err := client.Post(test.url, "application/json", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, test.wantStatus, resp.StatusCode, test.url)
+	}
+
+	ttl := func(key string) (int, float64) {
+		t.Helper()
+		resp, err := client.Get("http://localhost:8080/api/keys/" + key + "/ttl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			TTL float64 `json:"ttl"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		return resp.StatusCode, body.TTL
+	}
+
+	// Test GET /keys/:key/ttl
+	status, left := ttl("session")
+	assert.Equal(t, 200, status)
+	assert.True(t, left > 0 && left <= 0.1, left)
+	status, left = ttl("forever")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, -1.0, left)
+	status, _ = ttl("bad")
+	assert.Equal(t, 404, status)
+
+	time.Sleep(100 * time.Millisecond)
+	for _, key := range []string{"session", "other"} {
+		status, _ = ttl(key)
+		assert.Equal(t, 404, status, key)
+	}
+}
+
+func TestAPI_Indexes(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	kv.Set("u1", json.RawMessage(`{"name": "alice", "age": 30}`))
+	kv.Set("u2", json.RawMessage(`{"name": "bob", "age": 25}`))
+	kv.Set("u3", json.RawMessage(`{"name": "carol", "age": 35}`))
+
+	// Test POST /indexes
+	creates := []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"name": "age", "path": "$.age"}`, 200},
+		{`{"name": "name", "path": "name"}`, 200},
+		{`{"name": "age", "path": "$.age"}`, 409},
+		{`{"name": "bad/name", "path": "age"}`, 400},
+		{`{"name": "bad", "path": "age["}`, 400},
+	}
+	for _, create := range creates {
+		resp, err := client.Post("http://localhost:8080/api/indexes", "application/json", bytes.NewBufferString(create.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, create.wantStatus, resp.StatusCode, create.body)
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantKeys   []string
+	}{
+		{"age?eq=30", 200, []string{"u1"}},
+		{"age?gte=26", 200, []string{"u1", "u3"}},
+		{"age?gte=26&lte=34", 200, []string{"u1"}},
+		{"age?lte=30&limit=1", 200, []string{"u2"}},
+		{"name?eq=bob", 200, []string{"u2"}},
+		{`name?eq="carol"`, 200, []string{"u3"}},
+		{"missing?eq=1", 404, nil},
+		{"age?limit=0", 400, nil},
+	}
+
+	for _, test := range tests {
+		// Test GET /indexes/:name
+		resp, err := client.Get("http://localhost:8080/api/indexes/" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Entries []struct {
+				Key string `json:"key"`
+			} `json:"entries"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		assert.Equal(t, test.wantStatus, resp.StatusCode, test.query)
+		var keys []string
+		for _, entry := range body.Entries {
+			keys = append(keys, entry.Key)
+		}
+		assert.Equal(t, test.wantKeys, keys, test.query)
+	}
+
+	// Test DELETE /indexes/:name
+	req, _ := http.NewRequest("DELETE", "http://localhost:8080/api/indexes/name", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Len(t, kv.Indexes(), 1)
+}
+
+func TestAPI_Query(t *testing.T) {
+	// Start the server.
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	startServer(kv)
+	defer stopServer()
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	kv.Set("u1", json.RawMessage(`{"name": "alice", "age": 30}`))
+	kv.Set("u2", json.RawMessage(`{"name": "bob", "age": 25}`))
+	kv.Set("u3", json.RawMessage(`{"name": "carol", "age": 35}`))
+	kv.CreateIndex("age", "age")
+
+	tests := []struct {
+		body       string
+		wantStatus int
+		wantRows   string
+		wantAccess string
+	}{
+		{`{"query": "SELECT name WHERE age >= 30 ORDER BY age DESC"}`, 200,
+			`[{"key": "u3", "value": {"name": "carol"}}, {"key": "u1", "value": {"name": "alice"}}]`, ""},
+		{`{"query": "SELECT * WHERE name = 'nobody'"}`, 200, `[]`, ""},
+		{`{"query": "SELECT count(*) AS n, avg(age) WHERE age > 25"}`, 200, `[{"value": {"n": 2, "avg(age)": 32.5}}]`, ""},
+		{`{"query": "EXPLAIN SELECT * WHERE age = 30"}`, 200, "", accessIndexLookup},
+		{`{"query": "SELECT * WHERE age =="}`, 400, "", ""},
+		{`not json`, 400, "", ""},
+	}
+
+	for _, test := range tests {
+		// Test POST /query
+		resp, err := client.Post("http://localhost:8080/api/query", "application/json", bytes.NewBufferString(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Rows json.RawMessage `json:"rows"`
+			Plan struct {
+				Access string `json:"access"`
+			} `json:"plan"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		assert.Equal(t, test.wantStatus, resp.StatusCode, test.body)
+		if test.wantRows != "" {
+			assert.JSONEq(t, test.wantRows, string(body.Rows), test.body)
+		}
+		assert.Equal(t, test.wantAccess, body.Plan.Access, test.body)
+	}
+
+	// Test the console's query form
+	resp, err := client.PostForm("http://localhost:8080/console/query", url.Values{"query": {"EXPLAIN SELECT * WHERE age > 1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, string(page), "index range on age")
+}
@@ -1,191 +1,436 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
 
-// IndexTree represents a B-tree
+// IndexTree is a B+tree kept in the fixed-size pages of the index file. Leaves
+// hold the index values and are linked in key order; internal nodes hold
+// separator keys and the pages of their children. Changes are made to pages in
+// memory and only written to the file, through the pager's journal, on Commit.
 type IndexTree struct {
-	Root      *IndexTreeNode
-	MinDegree int // Minimum degree of the B-tree.
+	mu    sync.RWMutex
+	pager *pager
 }
 
+// IndexValue maps a key to the position of its record in the data file.
+// Values are ordered by Key, so ranges of keys can be walked in order. Hash
+// only breaks ties between values for the same key, which the index never
+// holds at once.
 type IndexValue struct {
-	Key uint32
-	Pos int64
+	Hash uint32
+	Key  string
+	Pos  int64
+	Size int64 // Size of the record in the data file
 }
 
-// IndexTreeNode represents a node in the B-tree
-type IndexTreeNode struct {
-	IsLeaf bool
-	Keys   []IndexValue
-	Child  []*IndexTreeNode
+// Longest key the index can hold. Keeping keys well under a quarter of a page
+// means a page can always be split or rebalanced into pages that fit.
+const MaxKeySize = 1000
+
+// ErrKeyTooLarge is returned when writing a key longer than MaxKeySize
+var ErrKeyTooLarge = fmt.Errorf("key is longer than %d bytes", MaxKeySize)
+
+// compareIndexKey orders (hash, key) pairs by key first and then by hash.
+func compareIndexKey(hash1 uint32, key1 string, hash2 uint32, key2 string) int {
+	if c := strings.Compare(key1, key2); c != 0 {
+		return c
+	}
+	if hash1 < hash2 {
+		return -1
+	} else if hash1 > hash2 {
+		return 1
+	}
+	return 0
+}
+
+// less reports whether v sorts before the (hash, key) pair.
+func (v IndexValue) less(hash uint32, key string) bool {
+	return compareIndexKey(v.Hash, v.Key, hash, key) < 0
 }
 
-// searchIndexValue returns the index of the first Key that is equal or greater than k in the Keys array.
-// If all Keys are less than k, then it returns len(b.Keys)
-func (b *IndexTreeNode) searchIndexValue(k uint32) int {
-	idx := 0
-	for idx < len(b.Keys) && b.Keys[idx].Key < k {
-		idx++
+// separator returns the value with only the fields internal nodes keep.
+func (v IndexValue) separator() IndexValue {
+	return IndexValue{Hash: v.Hash, Key: v.Key}
+}
+
+// OpenIndexTree opens the index stored in the file, creating an empty one if
+// the file does not exist. At most cachePages pages are kept in memory, apart
+// from pages that have been modified since the last commit. A new index is
+// encrypted with the keys if they are not nil.
+func OpenIndexTree(filename string, cachePages int, keys *Keyring) (*IndexTree, error) {
+	p, err := openPager(filename, cachePages, keys)
+	if err != nil {
+		return nil, err
+	}
+	if p.meta.version != indexVersion {
+		p.close()
+		return nil, fmt.Errorf("index version %d must be migrated first", p.meta.version)
 	}
-	return idx
+	return &IndexTree{pager: p}, nil
 }
 
-func (idx *IndexTree) Search(k uint32) (*IndexTreeNode, int) {
-	return idx.Root.Search(k)
+// createIndexTree creates an empty index in the file, replacing any index
+// already there, encrypted with the keys if they are not nil.
+func createIndexTree(filename string, keys *Keyring) (*IndexTree, error) {
+	for _, name := range []string{filename, filename + journalSuffix} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return OpenIndexTree(filename, DefaultIndexCachePages, keys)
 }
 
-func (idx *IndexTree) Get(k uint32) (int64, bool) {
-	node, index := idx.Search(k)
-	if node == nil {
-		return -1, false
+// search returns the position of the first key in the node that is equal or
+// greater than (h, k), and whether it is equal.
+func (n *indexNode) search(h uint32, k string) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return !n.keys[i].less(h, k)
+	})
+	return i, i < len(n.keys) && n.keys[i].Hash == h && n.keys[i].Key == k
+}
+
+// childIndex returns which child of an internal node covers (h, k). The i-th
+// separator is the smallest key of the (i+1)-th child.
+func (n *indexNode) childIndex(h uint32, k string) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return compareIndexKey(h, k, n.keys[i].Hash, n.keys[i].Key) < 0
+	})
+}
+
+// pathStep records an internal node visited on the way down to a leaf, and which child was taken.
+type pathStep struct {
+	node  *indexNode
+	child int
+}
+
+// findLeaf returns the leaf that covers (h, k) and the path taken to reach it.
+func (t *IndexTree) findLeaf(h uint32, k string) (*indexNode, []pathStep, error) {
+	n, err := t.pager.get(t.pager.meta.root)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return node.Keys[index].Pos, true
+	var path []pathStep
+	for !n.isLeaf() {
+		i := n.childIndex(h, k)
+		path = append(path, pathStep{node: n, child: i})
+		if n, err = t.pager.get(n.children[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return n, path, nil
 }
 
-// Search returns the node containing the Key and the index of the Key in the Keys array.
-func (b *IndexTreeNode) Search(k uint32) (*IndexTreeNode, int) {
-	idx := b.searchIndexValue(k)
-	// if the Key is found in this node, return this node and the index of the Key.
-	if idx < len(b.Keys) && b.Keys[idx].Key == k {
-		return b, idx
-	} else if b.IsLeaf {
-		// if the node is a leaf node and the Key is not in this node, return nil.
-		return nil, -1
-	} else {
-		// if the node is not a leaf, search the appropriate Child node.
-		return b.Child[idx].Search(k)
-	}
-}
-
-// Insert inserts a Key into the tree.
-func (t *IndexTree) Insert(Key *IndexValue) {
-	Root := t.Root
-	if len(Root.Keys) == (2*t.MinDegree)-1 {
-		// Create a new Root because the Root is full
-		temp := &IndexTreeNode{}
-		t.Root = temp
-		temp.Child = append(temp.Child, Root)
-		// Split the old Root and move 1 Key to the new Root
-		t.splitChild(temp, 0)
-		t.insertNonFull(temp, Key)
-	} else {
-		// If the Root is not full, call insertNonFull for the Root
-		t.insertNonFull(Root, Key)
+// Get returns the value stored for the key.
+func (t *IndexTree) Get(h uint32, k string) (IndexValue, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaf, _, err := t.findLeaf(h, k)
+	if err != nil {
+		return IndexValue{}, false, err
 	}
+
+	i, found := leaf.search(h, k)
+	if !found {
+		return IndexValue{}, false, nil
+	}
+	return leaf.keys[i], true, nil
 }
 
-// insertNonFull inserts a Key into a non-full node.
-func (t *IndexTree) insertNonFull(x *IndexTreeNode, Key *IndexValue) {
-	// Start from the rightmost Key in the node
-	i := len(x.Keys) - 1
+// Put inserts the value into the tree, or replaces the value already stored for
+// its key. It returns the value it replaced, if any.
+func (t *IndexTree) Put(value IndexValue) (IndexValue, bool, error) {
+	if len(value.Key) > MaxKeySize {
+		return IndexValue{}, false, ErrKeyTooLarge
+	}
 
-	// If the node is a leaf node
-	if x.IsLeaf {
-		// Append a new Key at the end of the Keys
-		x.Keys = append(x.Keys, IndexValue{Key: 0, Pos: 0})
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-		// Shift all Keys greater than k to the right
-		for i >= 0 && Key.Key < x.Keys[i].Key {
-			x.Keys[i+1] = x.Keys[i]
-			i--
-		}
+	leaf, path, err := t.findLeaf(value.Hash, value.Key)
+	if err != nil {
+		return IndexValue{}, false, err
+	}
 
-		// Insert the new Key at the found Position
-		x.Keys[i+1] = *Key
-	} else {
-		// If the node is not a leaf, find the Child which is going to hold the new Key
-		for i >= 0 && Key.Key < x.Keys[i].Key {
-			i--
-		}
-		i++
+	i, found := leaf.search(value.Hash, value.Key)
+	if found {
+		old := leaf.keys[i]
+		leaf.keys[i] = value
+		t.pager.markDirty(leaf)
+		return old, true, nil
+	}
 
-		// If the found Child is full
-		if len(x.Child[i].Keys) == (2*t.MinDegree)-1 {
-			// Split the Child
-			t.splitChild(x, i)
+	leaf.keys = append(leaf.keys, IndexValue{})
+	copy(leaf.keys[i+1:], leaf.keys[i:])
+	leaf.keys[i] = value
+	t.pager.markDirty(leaf)
 
-			// After split, the middle Key of the Child moves up and the Child is split into two.
-			// Check which of the two Children is going to hold the new Key
-			if Key.Key > x.Keys[i].Key {
-				i++
+	return IndexValue{}, false, t.splitUp(leaf, path)
+}
+
+// splitUp splits the node if it no longer fits in a page, and then each of its
+// ancestors in turn as the separators pushed up into them make them too large.
+// The path holds the node's ancestors, as returned by findLeaf.
+func (t *IndexTree) splitUp(n *indexNode, path []pathStep) error {
+	for level := len(path) - 1; n.size() > t.pager.capacity; level-- {
+		separator, right, err := t.split(n)
+		if err != nil {
+			return err
+		}
+
+		if level < 0 {
+			// The root was split, so the tree grows a level
+			root, err := t.pager.alloc(pageInternal)
+			if err != nil {
+				return err
 			}
+			root.keys = []IndexValue{separator}
+			root.children = []uint64{n.id, right.id}
+			t.pager.setRoot(root.id)
+			return nil
 		}
 
-		// Insert the Key into the Child
-		t.insertNonFull(x.Child[i], Key)
+		parent := path[level].node
+		child := path[level].child
+		parent.keys = append(parent.keys, IndexValue{})
+		copy(parent.keys[child+1:], parent.keys[child:])
+		parent.keys[child] = separator
+		parent.children = append(parent.children, 0)
+		copy(parent.children[child+2:], parent.children[child+1:])
+		parent.children[child+1] = right.id
+		t.pager.markDirty(parent)
+
+		n = parent
 	}
+
+	return nil
 }
 
-// splitChild splits the Child y of x.
-func (t *IndexTree) splitChild(x *IndexTreeNode, i int) {
-	// tt is the minimum degree of the B-tree
-	tt := t.MinDegree
+// splitPoint returns where to split the keys so both halves take up about the
+// same number of bytes, keeping at least min keys on the left and leaving at
+// least one key past max on the right.
+func splitPoint(n *indexNode, keys []IndexValue, min int, max int) int {
+	total := 0
+	for _, value := range keys {
+		total += n.entrySize(value)
+	}
 
-	// y is the i-th Child of x that is going to be split
-	y := x.Child[i]
+	m, half := 0, 0
+	for m < len(keys) && half < total/2 {
+		half += n.entrySize(keys[m])
+		m++
+	}
 
-	// z is the new node, created to store tt-1 Keys of y
-	z := &IndexTreeNode{IsLeaf: y.IsLeaf}
+	if m < min {
+		m = min
+	}
+	if m > max {
+		m = max
+	}
+	return m
+}
+
+// split moves the upper half of the node's keys into a new right sibling. It
+// returns the separator the parent should hold between them.
+func (t *IndexTree) split(n *indexNode) (IndexValue, *indexNode, error) {
+	right, err := t.pager.alloc(n.kind)
+	if err != nil {
+		return IndexValue{}, nil, err
+	}
+
+	var separator IndexValue
+	if n.isLeaf() {
+		m := splitPoint(n, n.keys, 1, len(n.keys)-1)
+		right.keys = append([]IndexValue(nil), n.keys[m:]...)
+		n.keys = n.keys[:m:m]
+		right.next = n.next
+		n.next = right.id
+		separator = right.keys[0].separator()
+	} else {
+		// The middle separator moves up to the parent
+		m := splitPoint(n, n.keys, 1, len(n.keys)-2)
+		separator = n.keys[m]
+		right.keys = append([]IndexValue(nil), n.keys[m+1:]...)
+		right.children = append([]uint64(nil), n.children[m+1:]...)
+		n.keys = n.keys[:m:m]
+		n.children = n.children[: m+1 : m+1]
+	}
 
-	// Make space for the new Child
-	x.Child = append(x.Child, nil)
-	copy(x.Child[i+2:], x.Child[i+1:])
-	x.Child[i+1] = z
+	t.pager.markDirty(n)
+	t.pager.markDirty(right)
+	return separator, right, nil
+}
 
-	// Make space for the new Key in x
-	x.Keys = append(x.Keys, IndexValue{Key: 0, Pos: 0})
-	copy(x.Keys[i+1:], x.Keys[i:])
+// underflows reports whether the node is empty enough to merge with or borrow from a sibling.
+func (n *indexNode) underflows() bool {
+	return n.size() < IndexPageSize/4
+}
 
-	// Move the middle Key of y to x
-	x.Keys[i] = y.Keys[tt-1]
+// Delete removes the key from the tree and returns the value that was stored for it.
+func (t *IndexTree) Delete(h uint32, k string) (IndexValue, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	// Move the last tt-1 Keys of y to z
-	z.Keys = append(z.Keys, y.Keys[tt:]...)
-	y.Keys = y.Keys[:tt-1]
+	leaf, path, err := t.findLeaf(h, k)
+	if err != nil {
+		return IndexValue{}, false, err
+	}
 
-	// If y is not a leaf, move the last tt Children of y to z
-	if !y.IsLeaf {
-		z.Child = append(z.Child, y.Child[tt:]...)
-		y.Child = y.Child[:tt]
+	i, found := leaf.search(h, k)
+	if !found {
+		return IndexValue{}, false, nil
+	}
+
+	old := leaf.keys[i]
+	leaf.keys = append(leaf.keys[:i], leaf.keys[i+1:]...)
+	t.pager.markDirty(leaf)
+
+	// Rebalance nodes that have become too empty, working back up towards the root
+	n := leaf
+	for level := len(path) - 1; level >= 0 && n.underflows(); level-- {
+		parent := path[level].node
+		if err := t.rebalance(parent, path[level].child); err != nil {
+			return IndexValue{}, false, err
+		}
+
+		// Sharing out keys between leaves can give the parent a longer separator
+		if parent.size() > t.pager.capacity {
+			if err := t.splitUp(parent, path[:level]); err != nil {
+				return IndexValue{}, false, err
+			}
+			break
+		}
+		n = parent
+	}
+
+	// If the root has no keys left, its only child becomes the new root
+	root, err := t.pager.get(t.pager.meta.root)
+	for err == nil && !root.isLeaf() && len(root.keys) == 0 {
+		t.pager.setRoot(root.children[0])
+		t.pager.free(root)
+		root, err = t.pager.get(t.pager.meta.root)
+	}
+	if err != nil {
+		return IndexValue{}, false, err
 	}
-}
 
-// Print prints the contents of the IndexTree.
-func (t *IndexTree) Print() {
-	t.Root.Print(0)
+	return old, true, nil
 }
 
-// Print prints the contents of the IndexTreeNode.
-func (n *IndexTreeNode) Print(level int) {
-	// Print the Keys in this node
-	fmt.Printf("Level %d: ", level)
-	for _, Key := range n.Keys {
-		fmt.Printf("%d ", Key.Key)
+// rebalance fixes up the i-th child of the parent after it underflowed, by
+// merging it with a sibling if they fit in one page together, and otherwise by
+// sharing the keys of both out evenly between them.
+func (t *IndexTree) rebalance(parent *indexNode, i int) error {
+	// Pair the child with its right sibling, or its left one if it is the last child
+	if i == len(parent.children)-1 {
+		i--
 	}
-	fmt.Println()
 
-	// If this node is not a leaf, print its Child nodes
-	if !n.IsLeaf {
-		for _, Child := range n.Child {
-			Child.Print(level + 1)
+	left, err := t.pager.get(parent.children[i])
+	if err != nil {
+		return err
+	}
+	right, err := t.pager.get(parent.children[i+1])
+	if err != nil {
+		return err
+	}
+
+	var keys []IndexValue
+	var children []uint64
+	keys = append(keys, left.keys...)
+	if !left.isLeaf() {
+		// The separator between them comes down from the parent
+		keys = append(keys, parent.keys[i])
+		children = append(append(children, left.children...), right.children...)
+	}
+	keys = append(keys, right.keys...)
+
+	merged := &indexNode{kind: left.kind, keys: keys}
+	if merged.size() <= t.pager.capacity {
+		left.keys = keys
+		left.children = children
+		if left.isLeaf() {
+			left.next = right.next
 		}
+
+		parent.keys = append(parent.keys[:i], parent.keys[i+1:]...)
+		parent.children = append(parent.children[:i+1], parent.children[i+2:]...)
+		t.pager.free(right)
+	} else if left.isLeaf() {
+		m := splitPoint(left, keys, 1, len(keys)-1)
+		left.keys = keys[:m:m]
+		right.keys = append([]IndexValue(nil), keys[m:]...)
+		parent.keys[i] = right.keys[0].separator()
+		t.pager.markDirty(right)
+	} else {
+		m := splitPoint(left, keys, 1, len(keys)-2)
+		left.keys = keys[:m:m]
+		left.children = children[: m+1 : m+1]
+		parent.keys[i] = keys[m]
+		right.keys = append([]IndexValue(nil), keys[m+1:]...)
+		right.children = append([]uint64(nil), children[m+1:]...)
+		t.pager.markDirty(right)
 	}
+
+	t.pager.markDirty(left)
+	t.pager.markDirty(parent)
+	return nil
+}
+
+// Walk calls fn for every value in the tree in key order, until fn returns
+// false.
+func (t *IndexTree) Walk(fn func(value IndexValue) bool) error {
+	return t.WalkFrom("", fn)
 }
 
-func createIndexTree(Keys []IndexValue, t int) *IndexTree {
-	tree := &IndexTree{
-		Root: &IndexTreeNode{
-			IsLeaf: true,
-			Keys:   make([]IndexValue, 0),
-			Child:  make([]*IndexTreeNode, 0),
-		},
-		MinDegree: t,
+// WalkFrom calls fn in key order for every value whose key is start or
+// greater, until fn returns false.
+func (t *IndexTree) WalkFrom(start string, fn func(value IndexValue) bool) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// No value sorts before the start key with a hash of 0
+	n, _, err := t.findLeaf(0, start)
+	if err != nil {
+		return err
 	}
+	i, _ := n.search(0, start)
 
-	for _, Key := range Keys {
-		tree.Insert(&Key)
+	for {
+		for _, value := range n.keys[i:] {
+			if !fn(value) {
+				return nil
+			}
+		}
+		if n.next == 0 {
+			return nil
+		}
+		if n, err = t.pager.get(n.next); err != nil {
+			return err
+		}
+		i = 0
 	}
+}
+
+// Commit durably writes the pages changed since the last commit to the index file.
+func (t *IndexTree) Commit() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.pager.commit()
+}
+
+// Close closes the index file. Changes that have not been committed are lost.
+func (t *IndexTree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	return tree
+	return t.pager.close()
 }
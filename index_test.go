@@ -1,100 +1,125 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
+// newTestIndex creates an index in a temporary directory and puts the values into it.
+func newTestIndex(t *testing.T, values ...IndexValue) *IndexTree {
+	t.Helper()
+
+	tree, err := OpenIndexTree(filepath.Join(t.TempDir(), "test.idx"), DefaultIndexCachePages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+
+	for _, value := range values {
+		if _, _, err := tree.Put(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree
+}
+
+// getIndexValues returns every value in the tree, in order.
+func getIndexValues(t *testing.T, tree *IndexTree) []IndexValue {
+	t.Helper()
+
+	var values []IndexValue
+	if err := tree.Walk(func(value IndexValue) bool {
+		values = append(values, value)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// longKey returns a key long enough that only a dozen or so fit in a page, so
+// small tests still build trees several levels deep.
+func longKey(i int) string {
+	return fmt.Sprintf("k%d-%s", i, strings.Repeat("x", 300))
+}
+
 func TestSearch(t *testing.T) {
-	tree := createIndexTree([]IndexValue{
-		{1, 99},
-		{2, 88},
-		{3, 77},
-		{4, 66},
-		{5, 55},
-	}, 3)
+	tree := newTestIndex(t,
+		IndexValue{1, "k1", 99, 0},
+		IndexValue{2, "k2", 88, 0},
+		IndexValue{3, "k3", 77, 0},
+		IndexValue{4, "k4", 66, 0},
+		IndexValue{5, "k5", 55, 0},
+	)
 
 	tests := []struct {
-		key      uint32
+		hash     uint32
+		key      string
 		expected bool
 	}{
-		{1, true},
-		{2, true},
-		{6, false},
-		{0, false},
-		{4, true},
+		{1, "k1", true},
+		{2, "k2", true},
+		{6, "k6", false},
+		{0, "k0", false},
+		{4, "k4", true},
+		{4, "k5", false}, // Matching hash but different key
 	}
 
 	for _, test := range tests {
-		result, _ := tree.Root.Search(test.key)
-		if (result != nil) != test.expected {
-			t.Errorf("Expected %v, got %v", test.expected, result != nil)
+		_, found, err := tree.Get(test.hash, test.key)
+		assert.NoError(t, err)
+		if found != test.expected {
+			t.Errorf("Expected %v, got %v", test.expected, found)
 		}
 	}
 }
 
-// Assuming a GetIndexValues function exists
-func getIndexValues(node *IndexTreeNode, keys *[]IndexValue) {
-	if node != nil {
-		for _, child := range node.Child {
-			getIndexValues(child, keys)
-		}
-
-		*keys = append(*keys, node.Keys...)
-	}
-}
-
 func TestInsert(t *testing.T) {
 	tests := []struct {
 		keys     []IndexValue
 		expected []IndexValue
 	}{
 		{[]IndexValue{
-			{1, 99},
-			{2, 88},
-			{3, 77},
-			{4, 66},
-			{5, 55},
+			{1, "k1", 99, 0},
+			{2, "k2", 88, 0},
+			{3, "k3", 77, 0},
+			{4, "k4", 66, 0},
+			{5, "k5", 55, 0},
 		}, []IndexValue{
-			{1, 99},
-			{2, 88},
-			{3, 77},
-			{4, 66},
-			{5, 55},
+			{1, "k1", 99, 0},
+			{2, "k2", 88, 0},
+			{3, "k3", 77, 0},
+			{4, "k4", 66, 0},
+			{5, "k5", 55, 0},
 		}},
 		{[]IndexValue{
-			{5, 99},
-			{4, 88},
-			{3, 77},
-			{2, 66},
-			{1, 55},
+			{5, "k5", 99, 0},
+			{4, "k4", 88, 0},
+			{3, "k3", 77, 0},
+			{2, "k2", 66, 0},
+			{1, "k1", 55, 0},
 		}, []IndexValue{
-			{1, 55},
-			{2, 66},
-			{3, 77},
-			{4, 88},
-			{5, 99},
+			{1, "k1", 55, 0},
+			{2, "k2", 66, 0},
+			{3, "k3", 77, 0},
+			{4, "k4", 88, 0},
+			{5, "k5", 99, 0},
 		}},
 		{[]IndexValue{}, []IndexValue{}},
-		{[]IndexValue{{1, 1}}, []IndexValue{{1, 1}}},
+		{[]IndexValue{{1, "k1", 1, 0}}, []IndexValue{{1, "k1", 1, 0}}},
 	}
 
 	for _, test := range tests {
-		tree := &IndexTree{
-			Root: &IndexTreeNode{
-				IsLeaf: true,
-				Keys:   make([]IndexValue, 0),
-				Child:  make([]*IndexTreeNode, 0),
-			},
-			MinDegree: 3,
-		}
-
-		for _, key := range test.keys {
-			tree.Insert(&key)
-		}
-
-		var keys []IndexValue
-		getIndexValues(tree.Root, &keys)
+		tree := newTestIndex(t, test.keys...)
+		keys := getIndexValues(t, tree)
 
 		if test.expected == nil || len(test.expected) == 0 {
 			if len(keys) > 0 {
@@ -105,3 +130,353 @@ func TestInsert(t *testing.T) {
 		}
 	}
 }
+
+func TestInsertCollidingHashes(t *testing.T) {
+	tree := newTestIndex(t)
+
+	// Every key shares the same hash, so they can only be told apart by key
+	keys := []string{"e", "b", "d", "a", "c", "g", "f"}
+	for i, key := range keys {
+		tree.Put(IndexValue{Hash: 42, Key: key, Pos: int64(i)})
+	}
+
+	for i, key := range keys {
+		value, ok, _ := tree.Get(42, key)
+		if !ok || value.Pos != int64(i) {
+			t.Errorf("Get(42, %q) = %v, %v, want %v, true", key, value.Pos, ok, i)
+		}
+	}
+
+	if _, ok, _ := tree.Get(42, "h"); ok {
+		t.Errorf("Get(42, %q) found a key that was never inserted", "h")
+	}
+}
+
+func TestPutUpdatesExistingKey(t *testing.T) {
+	tree := newTestIndex(t, IndexValue{1, "k1", 10, 0}, IndexValue{1, "k2", 20, 0})
+
+	old, replaced, err := tree.Put(IndexValue{Hash: 1, Key: "k1", Pos: 30})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, int64(10), old.Pos)
+
+	keys := getIndexValues(t, tree)
+	expected := []IndexValue{{1, "k1", 30, 0}, {1, "k2", 20, 0}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestPutKeyTooLarge(t *testing.T) {
+	tree := newTestIndex(t)
+
+	_, _, err := tree.Put(IndexValue{Key: strings.Repeat("k", MaxKeySize+1)})
+	assert.Equal(t, ErrKeyTooLarge, err)
+
+	_, _, err = tree.Put(IndexValue{Key: strings.Repeat("k", MaxKeySize)})
+	assert.NoError(t, err)
+}
+
+// checkTree verifies the B+tree invariants: every node fits in a page and only
+// the root may be underfull, keys are in order and within the bounds set by the
+// separators above them, every leaf is at the same depth, and the links between
+// leaves visit every key in order.
+func checkTree(t *testing.T, tree *IndexTree) {
+	t.Helper()
+
+	root := tree.pager.meta.root
+	leafDepth := -1
+	var inOrder []IndexValue
+	var walk func(id uint64, depth int, lower *IndexValue, upper *IndexValue)
+	walk = func(id uint64, depth int, lower *IndexValue, upper *IndexValue) {
+		node, err := tree.pager.get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if node.size() > IndexPageSize {
+			t.Errorf("Page %d is %d bytes, want at most %d", id, node.size(), IndexPageSize)
+		}
+		if id != root && node.underflows() {
+			t.Errorf("Page %d at depth %d is underfull at %d bytes", id, depth, node.size())
+		}
+
+		for i, value := range node.keys {
+			if i > 0 && !node.keys[i-1].less(value.Hash, value.Key) {
+				t.Errorf("Keys out of order in page %d: %v before %v", id, node.keys[i-1], value)
+			}
+			if lower != nil && value.less(lower.Hash, lower.Key) {
+				t.Errorf("Key %v in page %d is below its separator %v", value, id, *lower)
+			}
+			if upper != nil && !value.less(upper.Hash, upper.Key) {
+				t.Errorf("Key %v in page %d is not below its separator %v", value, id, *upper)
+			}
+		}
+
+		if node.isLeaf() {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				t.Errorf("Leaf at depth %d, want %d", depth, leafDepth)
+			}
+			inOrder = append(inOrder, node.keys...)
+			return
+		}
+
+		if len(node.children) != len(node.keys)+1 {
+			t.Fatalf("Page %d has %d keys and %d children", id, len(node.keys), len(node.children))
+		}
+		for i, child := range node.children {
+			childLower, childUpper := lower, upper
+			if i > 0 {
+				childLower = &node.keys[i-1]
+			}
+			if i < len(node.keys) {
+				childUpper = &node.keys[i]
+			}
+			walk(child, depth+1, childLower, childUpper)
+		}
+	}
+	walk(root, 0, nil, nil)
+
+	if linked := getIndexValues(t, tree); !reflect.DeepEqual(linked, inOrder) && len(inOrder) > 0 {
+		t.Errorf("Walking the leaves found %d keys, the tree holds %d", len(linked), len(inOrder))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	orders := map[string]func(i int, n int) int{
+		"ascending":   func(i int, n int) int { return i },
+		"descending":  func(i int, n int) int { return n - 1 - i },
+		"interleaved": func(i int, n int) int { return (i * 37) % n },
+	}
+
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			n := 500
+			tree := newTestIndex(t)
+			for i := 0; i < n; i++ {
+				tree.Put(IndexValue{Hash: uint32(i % 10), Key: longKey(i), Pos: int64(i)})
+			}
+			checkTree(t, tree)
+
+			for j := 0; j < n; j++ {
+				i := order(j, n)
+				if _, ok, _ := tree.Delete(uint32(i%10), longKey(i)); !ok {
+					t.Fatalf("Delete(k%d) = false, want true", i)
+				}
+				if _, ok, _ := tree.Delete(uint32(i%10), longKey(i)); ok {
+					t.Fatalf("Second Delete(k%d) = true, want false", i)
+				}
+				checkTree(t, tree)
+
+				if _, ok, _ := tree.Get(uint32(i%10), longKey(i)); ok {
+					t.Fatalf("Get(k%d) found a deleted key", i)
+				}
+			}
+
+			if keys := getIndexValues(t, tree); len(keys) != 0 {
+				t.Errorf("Expected an empty tree, got %v", keys)
+			}
+		})
+	}
+}
+
+func TestDeleteKeepsOtherKeys(t *testing.T) {
+	tree := newTestIndex(t)
+	for i := 0; i < 200; i++ {
+		tree.Put(IndexValue{Hash: uint32(i), Key: longKey(i), Pos: int64(i)})
+	}
+
+	// Delete the even keys and check the odd ones can still be found
+	for i := 0; i < 200; i += 2 {
+		tree.Delete(uint32(i), longKey(i))
+	}
+	checkTree(t, tree)
+
+	for i := 1; i < 200; i += 2 {
+		value, ok, _ := tree.Get(uint32(i), longKey(i))
+		if !ok || value.Pos != int64(i) {
+			t.Errorf("Get(k%d) = %v, %v, want %v, true", i, value.Pos, ok, i)
+		}
+	}
+}
+
+func TestIndexMatchesMapWithSmallCache(t *testing.T) {
+	tree, err := OpenIndexTree(filepath.Join(t.TempDir(), "test.idx"), 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// Random puts and deletes, with varying key lengths, checked against a map
+	rng := rand.New(rand.NewSource(1))
+	expected := make(map[string]int64)
+	for i := 0; i < 5000; i++ {
+		n := rng.Intn(1000)
+		key := fmt.Sprintf("%d%s", n, strings.Repeat("y", n%200))
+		if rng.Intn(3) == 0 {
+			_, deleted, err := tree.Delete(hashKey(key), key)
+			assert.NoError(t, err)
+			_, existed := expected[key]
+			assert.Equal(t, existed, deleted)
+			delete(expected, key)
+		} else {
+			_, replaced, err := tree.Put(IndexValue{Hash: hashKey(key), Key: key, Pos: int64(i)})
+			assert.NoError(t, err)
+			_, existed := expected[key]
+			assert.Equal(t, existed, replaced)
+			expected[key] = int64(i)
+		}
+
+		if i%500 == 0 {
+			assert.NoError(t, tree.Commit())
+		}
+	}
+	checkTree(t, tree)
+
+	// Only pages modified since the last commit stay in memory past the cache size
+	assert.NoError(t, tree.Commit())
+	assert.LessOrEqual(t, tree.pager.lru.Len(), 4)
+
+	assert.Len(t, getIndexValues(t, tree), len(expected))
+	for key, pos := range expected {
+		value, ok, err := tree.Get(hashKey(key), key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, pos, value.Pos)
+	}
+}
+
+func TestWalkFrom(t *testing.T) {
+	tree := newTestIndex(t)
+	for _, i := range rand.Perm(200) {
+		tree.Put(IndexValue{Hash: hashKey(longKey(i)), Key: longKey(i), Pos: int64(i)})
+	}
+	checkTree(t, tree)
+
+	// Keys come out in order from the first one at or after the start
+	for _, start := range []string{"", "k1", longKey(150), "k150", "k99-y", "z"} {
+		var keys []string
+		assert.NoError(t, tree.WalkFrom(start, func(value IndexValue) bool {
+			keys = append(keys, value.Key)
+			return true
+		}))
+
+		var want []string
+		for i := 0; i < 200; i++ {
+			if longKey(i) >= start {
+				want = append(want, longKey(i))
+			}
+		}
+		sort.Strings(want)
+		assert.Equal(t, want, keys, "start %q", start)
+	}
+}
+
+func TestIndexCommitAndReopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.idx")
+	tree, err := OpenIndexTree(filename, DefaultIndexCachePages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		tree.Put(IndexValue{Hash: uint32(i), Key: longKey(i), Pos: int64(i)})
+	}
+	assert.NoError(t, tree.Commit())
+
+	// Changes after the last commit are lost when the index is closed
+	tree.Put(IndexValue{Hash: 1000, Key: "uncommitted"})
+	tree.Delete(0, longKey(0))
+	tree.Close()
+
+	tree, err = OpenIndexTree(filename, DefaultIndexCachePages, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	checkTree(t, tree)
+
+	assert.Len(t, getIndexValues(t, tree), 100)
+	_, ok, _ := tree.Get(1000, "uncommitted")
+	assert.False(t, ok)
+	_, ok, _ = tree.Get(0, longKey(0))
+	assert.True(t, ok)
+}
+
+func TestIndexReusesFreedPages(t *testing.T) {
+	tree := newTestIndex(t)
+	for i := 0; i < 200; i++ {
+		tree.Put(IndexValue{Hash: uint32(i), Key: longKey(i)})
+	}
+	pages := tree.pager.meta.numPages
+
+	for i := 0; i < 200; i++ {
+		tree.Delete(uint32(i), longKey(i))
+	}
+	assert.NotZero(t, tree.pager.meta.freeHead)
+
+	for i := 0; i < 200; i++ {
+		tree.Put(IndexValue{Hash: uint32(i), Key: longKey(i)})
+	}
+	checkTree(t, tree)
+	assert.Equal(t, pages, tree.pager.meta.numPages)
+}
+
+func TestIndexJournalRecovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		cut       int // Bytes cut off the end of the journal
+		recovered bool
+	}{
+		{"complete journal is applied", 0, true},
+		{"torn journal is discarded", 100, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "test.idx")
+			tree, err := OpenIndexTree(filename, DefaultIndexCachePages, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				tree.Put(IndexValue{Hash: uint32(i), Key: longKey(i), Pos: int64(i)})
+			}
+			assert.NoError(t, tree.Commit())
+
+			for i := 100; i < 200; i++ {
+				tree.Put(IndexValue{Hash: uint32(i), Key: longKey(i), Pos: int64(i)})
+			}
+
+			// Simulate a crash after the journal was written, but before any page was written in place
+			pages, err := tree.pager.dirtyPagesLocked()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, writeJournal(filename+journalSuffix, pages))
+			tree.Close()
+			if test.cut > 0 {
+				data, _ := os.ReadFile(filename + journalSuffix)
+				os.WriteFile(filename+journalSuffix, data[:len(data)-test.cut], 0644)
+			}
+
+			tree, err = OpenIndexTree(filename, DefaultIndexCachePages, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+			checkTree(t, tree)
+
+			_, err = os.Stat(filename + journalSuffix)
+			assert.True(t, os.IsNotExist(err))
+
+			expected := 100
+			if test.recovered {
+				expected = 200
+			}
+			assert.Len(t, getIndexValues(t, tree), expected)
+		})
+	}
+}
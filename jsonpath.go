@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPath selects a value inside a JSON document. It is written as field
+// names separated by dots, with array indexes in brackets, and may start with
+// "$" for the document itself: "$.user.name", "items[0].price".
+type jsonPath struct {
+	raw   string
+	steps []jsonPathStep
+}
+
+// jsonPathStep is a field of an object, or an element of an array if index is set.
+type jsonPathStep struct {
+	field   string
+	index   int
+	isIndex bool
+}
+
+// ErrBadJSONPath is returned when a JSON path cannot be parsed.
+var ErrBadJSONPath = errors.New("bad JSON path")
+
+// parseJSONPath parses a path written as described for jsonPath.
+func parseJSONPath(raw string) (jsonPath, error) {
+	path := jsonPath{raw: raw}
+	s := strings.TrimPrefix(raw, "$")
+	if s == raw && s != "" && s[0] != '.' && s[0] != '[' {
+		// The leading dot may be left out along with the "$"
+		s = "." + s
+	}
+
+	for s != "" {
+		switch s[0] {
+		case '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			field := s[1 : end+1]
+			if field == "" {
+				return jsonPath{}, fmt.Errorf("%w %q: empty field name", ErrBadJSONPath, raw)
+			}
+			path.steps = append(path.steps, jsonPathStep{field: field})
+			s = s[end+1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return jsonPath{}, fmt.Errorf("%w %q: missing ]", ErrBadJSONPath, raw)
+			}
+			index, err := strconv.Atoi(s[1:end])
+			if err != nil || index < 0 {
+				return jsonPath{}, fmt.Errorf("%w %q: bad array index %q", ErrBadJSONPath, raw, s[1:end])
+			}
+			path.steps = append(path.steps, jsonPathStep{index: index, isIndex: true})
+			s = s[end+1:]
+		default:
+			return jsonPath{}, fmt.Errorf("%w %q: expected . or [ at %q", ErrBadJSONPath, raw, s)
+		}
+	}
+
+	return path, nil
+}
+
+// String returns the path as it was written.
+func (p jsonPath) String() string {
+	return p.raw
+}
+
+// lookup returns the value the path selects in a decoded document, and
+// whether there is one.
+func (p jsonPath) lookup(doc interface{}) (interface{}, bool) {
+	value := doc
+	for _, step := range p.steps {
+		if step.isIndex {
+			array, ok := value.([]interface{})
+			if !ok || step.index >= len(array) {
+				return nil, false
+			}
+			value = array[step.index]
+		} else {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = object[step.field]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return value, true
+}
+
+// extract decodes the document and returns the value the path selects in it.
+func (p jsonPath) extract(data json.RawMessage) (interface{}, bool) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, false
+	}
+	return p.lookup(doc)
+}
@@ -1,15 +1,153 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
 func main() {
-	kv := NewStore(100, "test.db", "test.idx")
-	startServer(kv) // Starts a go routine
+	walDir := flag.String("wal-dir", "", "directory for the write-ahead log segments (default test.db.wal)")
+	durabilityName := flag.String("durability", "none", "when to sync the write-ahead log: none, write, interval or group")
+	syncInterval := flag.Duration("sync-interval", DefaultSyncInterval, "how often to sync the write-ahead log with -durability=interval")
+	cacheBytes := flag.Int64("cache-bytes", 0, "largest total size of the keys and values in the read cache, 0 for no limit")
+	cachePolicyName := flag.String("cache-policy", "lru", "how the read cache chooses entries to evict: lru, 2q, arc or tinylfu")
+	retention := flag.Duration("version-retention", 0, "how long to keep old versions of keys for point-in-time reads")
+	sweepInterval := flag.Duration("expiry-sweep-interval", DefaultExpirySweepInterval, "how often to delete expired keys in the background, 0 to only hide them from reads")
+	codecName := flag.String("compression", "none", "codec to compress values in the data file with: none, flate or gzip")
+	compressMinSize := flag.Int("compress-min-size", DefaultCompressMinSize, "smallest value in bytes to compress")
+	keyFile := flag.String("encryption-key-file", "", "file of encryption keys to encrypt the store with (default $"+EncryptionKeysEnv+")")
+	reencrypt := flag.Bool("reencrypt", false, "rewrite the store with the active encryption key and exit")
+	addr := flag.String("addr", ":8080", "address for the http server to listen on")
+	leader := flag.String("follow", "", "URL of a leader to replicate from, such as http://leader:8080, serving reads only")
+	raftID := flag.String("raft-id", "", "ID of this node in a raft cluster")
+	raftPeers := flag.String("raft-peers", "", "members of a new raft cluster as id=url pairs separated by commas, including this node; to join an existing cluster, its members without this node")
+	raftDir := flag.String("raft-dir", "", "directory for the raft log and state (default test.db.raft)")
+	shards := flag.String("shards", "", "run as a router over shards given as id=url pairs separated by commas, instead of serving a store")
+	routerState := flag.String("router-state", "router.json", "file the router keeps its shards in")
+	flag.Parse()
 
+	if *shards != "" {
+		runRouter(*addr, *shards, *routerState)
+		return
+	}
+
+	durability, err := ParseDurability(*durabilityName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	cachePolicy, err := ParseCachePolicy(*cachePolicyName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	codec, err := ParseCodec(*codecName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	options := []StoreOption{
+		WithDurability(durability),
+		WithSyncInterval(*syncInterval),
+		WithCacheBytes(*cacheBytes),
+		WithCachePolicy(cachePolicy),
+		WithVersionRetention(*retention),
+		WithExpirySweepInterval(*sweepInterval),
+		WithCompression(codec, *compressMinSize),
+	}
+	if *walDir != "" {
+		options = append(options, WithWALDir(*walDir))
+	}
+
+	var keys *Keyring
+	if *keyFile != "" {
+		keys, err = LoadKeyring(*keyFile)
+	} else if text := os.Getenv(EncryptionKeysEnv); text != "" {
+		keys, err = ParseKeyring(text)
+	}
+	if err != nil {
+		fmt.Println("Error loading encryption keys:", err)
+		os.Exit(2)
+	}
+
+	if *reencrypt {
+		if keys == nil {
+			fmt.Println("Re-encrypting needs encryption keys")
+			os.Exit(2)
+		}
+		// The raft log is re-encrypted along with the rest of the store
+		if *raftDir != "" {
+			options = append(options, WithRaft(RaftConfig{Dir: *raftDir}))
+		}
+		if err := Reencrypt("test.db", "test.idx", keys, options...); err != nil {
+			fmt.Println("Error re-encrypting store:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Re-encrypted store with key %d\n", keys.ActiveKey())
+		return
+	}
+	if keys != nil {
+		options = append(options, WithEncryption(keys))
+	}
+	if *leader != "" {
+		options = append(options, WithFollower(*leader))
+	}
+	if *raftID != "" {
+		if *leader != "" {
+			fmt.Println("A raft node cannot also follow a leader")
+			os.Exit(2)
+		}
+		peers, err := ParseRaftPeers(*raftPeers)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		options = append(options, WithRaft(RaftConfig{ID: *raftID, Peers: peers, Dir: *raftDir}))
+	}
+
+	kv := NewStore(100, "test.db", "test.idx", options...)
+	startServerAt(*addr, kv) // Starts a go routine
+
+	waitForSignal()
+	stopServer()
+
+	// Flush the write buffer so nothing is left for the log to replay
+	if err := kv.Close(); err != nil {
+		fmt.Println("Error closing store:", err)
+		os.Exit(1)
+	}
+}
+
+// runRouter serves a router over the shards until a signal is received. The
+// shards only seed the state file the first time; after that, shards are
+// added through the router's API.
+func runRouter(addr string, shards string, stateFile string) {
+	addrs, err := ParseShards(shards)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	sr, err := NewShardRouter(stateFile, addrs)
+	if err != nil {
+		fmt.Println("Error opening router:", err)
+		os.Exit(1)
+	}
+	serveAt(addr, sr.handler()) // Starts a go routine
+
+	waitForSignal()
+	stopServer()
+	sr.Close()
+}
+
+// waitForSignal blocks until SIGINT or SIGTERM is received.
+func waitForSignal() {
 	// Create a channel to receive OS signals
 	sig := make(chan os.Signal, 1)
 	// Notify the `sig` channel on SIGINT or SIGTERM
@@ -17,6 +155,21 @@ func main() {
 
 	// Block until a signal is received
 	<-sig
+}
 
-	stopServer()
+// parseAddrs parses id=url pairs separated by commas into a map of URLs by
+// ID. What is named in errors, as what each pair describes.
+func parseAddrs(text string, what string) (map[string]string, error) {
+	addrs := make(map[string]string)
+	if text == "" {
+		return addrs, nil
+	}
+	for _, pair := range strings.Split(text, ",") {
+		id, addr, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("%s %q is not of the form id=url", what, pair)
+		}
+		addrs[id] = strings.TrimSuffix(addr, "/")
+	}
+	return addrs, nil
 }
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Filename of the text write-ahead log used before the binary segmented log.
+// It lives next to the data file.
+const legacyWALFilename = "wa.log"
+
+// Marks every operation before it in the text log as flushed to disk
+const legacyWALCheckpoint = "Checkpoint"
+
+func legacyWALPath(filename string) string {
+	return filepath.Join(filepath.Dir(filename), legacyWALFilename)
+}
+
+// Before the index was paged, it was a B-tree held in memory and gob encoded
+// into the index file in full on every write. These types mirror that layout
+// so old index files can still be decoded and migrated.
+type gobIndexTreeNode struct {
+	IsLeaf bool
+	Keys   []IndexValue
+	Child  []*gobIndexTreeNode
+}
+
+type gobIndexTree struct {
+	Root      *gobIndexTreeNode
+	MinDegree int
+}
+
+// Before full keys were stored, records and index entries only carried the
+// 32-bit hash of the key. These types mirror that layout so old files can
+// still be decoded and migrated.
+type legacyRecord struct {
+	Key  uint32
+	Data json.RawMessage
+}
+
+type legacyIndexValue struct {
+	Key uint32
+	Pos int64
+}
+
+type legacyIndexTreeNode struct {
+	IsLeaf bool
+	Keys   []legacyIndexValue
+	Child  []*legacyIndexTreeNode
+}
+
+type legacyIndexTree struct {
+	Root      *legacyIndexTreeNode
+	MinDegree int
+}
+
+// migrateIndex converts an index file written by an earlier version to the
+// current paged format, leaving current and missing index files alone. Paged
+// indexes ordered by hash are rebuilt in key order. Hash-only indexes also
+// need their records rewritten, which are appended to the data file.
+func migrateIndex(filename string, indexFilename string, file *os.File) error {
+	paged, err := isPagedIndex(indexFilename)
+	if err != nil {
+		return err
+	}
+
+	var values []IndexValue
+	if paged {
+		var current bool
+		if values, current, err = readHashOrderedIndex(indexFilename); err != nil || current {
+			return err
+		}
+	} else {
+		indexFile, err := os.Open(indexFilename)
+		if err != nil {
+			return err
+		}
+		defer indexFile.Close()
+
+		if index, err := readGobIndex(indexFile); err == nil {
+			index.Root.collect(&values)
+		} else if legacy, legacyErr := readLegacyIndex(indexFile); legacyErr == nil {
+			if values, err = migrateLegacyRecords(legacy, file, legacyWALPath(filename)); err != nil {
+				return err
+			}
+		} else {
+			return fmt.Errorf("decoding index: %w", err)
+		}
+	}
+
+	// Build the new index alongside the old one and swap it in once it is complete
+	migrateFilename := indexFilename + ".migrate"
+	index, err := createIndexTree(migrateFilename, nil)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		if _, _, err := index.Put(value); err != nil {
+			index.Close()
+			return err
+		}
+	}
+	if err := index.Commit(); err != nil {
+		index.Close()
+		return err
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+
+	return renameAndSync(migrateFilename, indexFilename)
+}
+
+// readHashOrderedIndex returns every value in a paged index from before keys
+// were kept in order, or reports that the index is current, or not there yet.
+func readHashOrderedIndex(indexFilename string) ([]IndexValue, bool, error) {
+	if stat, err := os.Stat(indexFilename); os.IsNotExist(err) {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, false, err
+	} else if stat.Size() == 0 {
+		return nil, true, nil
+	}
+
+	// Indexes have only been encrypted since they were ordered by key
+	p, err := openPager(indexFilename, DefaultIndexCachePages, nil)
+	if errors.Is(err, ErrEncrypted) {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer p.close()
+	if p.meta.version == indexVersion {
+		return nil, true, nil
+	}
+
+	// The leaves are still linked, so walking them finds every value, just
+	// not in key order
+	var values []IndexValue
+	index := &IndexTree{pager: p}
+	err = index.Walk(func(value IndexValue) bool {
+		values = append(values, value)
+		return true
+	})
+	return values, false, err
+}
+
+func readGobIndex(indexFile *os.File) (*gobIndexTree, error) {
+	indexFile.Seek(0, 0)
+	index := new(gobIndexTree)
+	decoder := gob.NewDecoder(indexFile)
+	if err := decoder.Decode(index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// collect appends every value in the subtree to values.
+func (n *gobIndexTreeNode) collect(values *[]IndexValue) {
+	if n == nil {
+		return
+	}
+	*values = append(*values, n.Keys...)
+	for _, child := range n.Child {
+		child.collect(values)
+	}
+}
+
+func readLegacyIndex(indexFile *os.File) (*legacyIndexTree, error) {
+	indexFile.Seek(0, 0)
+	index := new(legacyIndexTree)
+	decoder := gob.NewDecoder(indexFile)
+	if err := decoder.Decode(index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// collect walks the legacy tree and returns the latest position for every hash.
+// Legacy indexes inserted a duplicate entry on every overwrite, and since the
+// data file is append-only the highest position is the most recent record.
+func (n *legacyIndexTreeNode) collect(positions map[uint32]int64) {
+	if n == nil {
+		return
+	}
+	for _, value := range n.Keys {
+		if pos, ok := positions[value.Key]; !ok || value.Pos > pos {
+			positions[value.Key] = value.Pos
+		}
+	}
+	for _, child := range n.Child {
+		child.collect(positions)
+	}
+}
+
+// migrateLegacyRecords rewrites every live legacy record in the new format,
+// keyed by its original key, and returns index values for them. Original keys
+// are recovered from the write-ahead log. Records whose key cannot be recovered
+// remain reachable under the synthetic key "legacy:<hash>" so that no data is lost.
+func migrateLegacyRecords(legacy *legacyIndexTree, file *os.File, walFilename string) ([]IndexValue, error) {
+	positions := make(map[uint32]int64)
+	legacy.Root.collect(positions)
+
+	names, err := recoverLegacyKeyNames(walFilename, positions)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []IndexValue
+	for hash, pos := range positions {
+		file.Seek(pos, 0)
+		old := &legacyRecord{}
+		if err := gob.NewDecoder(file).Decode(old); err != nil {
+			return nil, err
+		}
+
+		key, ok := names[hash]
+		if !ok {
+			key = fmt.Sprintf("legacy:%08x", hash)
+			fmt.Printf("Could not recover key for hash %d, migrating as %q\n", hash, key)
+		}
+
+		record := &Record{Hash: hashKey(key), Key: key, Data: old.Data}
+		position, size, err := writeRecord(file, record, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, IndexValue{Hash: record.Hash, Key: key, Pos: position, Size: size})
+	}
+
+	// The records must be on disk before an index points at them
+	return values, file.Sync()
+}
+
+// recoverLegacyKeyNames scans the text write-ahead log for "Set <key> <value>"
+// lines and returns the original key for each of the wanted hashes. Keys may
+// contain spaces, so every space-separated prefix is tried as a candidate.
+func recoverLegacyKeyNames(walFilename string, wanted map[uint32]int64) (map[uint32]string, error) {
+	names := make(map[uint32]string)
+
+	file, err := os.Open(walFilename)
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.HasPrefix(line, "Set ") {
+			rest := line[len("Set "):]
+			for i := 0; i < len(rest); i++ {
+				if rest[i] != ' ' {
+					continue
+				}
+				candidate := rest[:i]
+				hash := hashKey(candidate)
+				if _, ok := wanted[hash]; ok {
+					names[hash] = candidate
+					break
+				}
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+// legacyWALEntry is an operation read from the text log.
+type legacyWALEntry struct {
+	Operation
+	hashed bool // Written by BatchSet in the first version of the log, which logged the hash of the key in place of the key
+}
+
+// parseLegacyWALEntry parses an entry of the text log, without the trailing
+// newline. Entries look like `Set "key" "value"` or `Delete "key"`, with the
+// key and value quoted, or like `Set key value` in the first version of the
+// log, which wrote them as they were.
+func parseLegacyWALEntry(entry string) (legacyWALEntry, error) {
+	command, rest, _ := strings.Cut(entry, " ")
+	if !strings.HasPrefix(rest, `"`) {
+		return parseUnquotedWALEntry(command, rest)
+	}
+
+	key, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return legacyWALEntry{}, err
+	}
+	rest = rest[len(key):]
+	key, _ = strconv.Unquote(key)
+
+	switch command {
+	case "Delete":
+		if rest != "" {
+			return legacyWALEntry{}, fmt.Errorf("unexpected data after key: %q", rest)
+		}
+		return legacyWALEntry{Operation: Operation{Key: key, Deleted: true}}, nil
+	case "Set":
+		value, err := strconv.Unquote(strings.TrimPrefix(rest, " "))
+		if err != nil {
+			return legacyWALEntry{}, err
+		}
+		return legacyWALEntry{Operation: Operation{Key: key, Value: []byte(value)}}, nil
+	default:
+		return legacyWALEntry{}, fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// removeEncryptedLegacyWAL deletes the text log if the disk is encrypted, once
+// everything in it has been applied.
+func removeEncryptedLegacyWAL(walFilename string, disk *Disk) error {
+	if disk.keys == nil {
+		return nil
+	}
+	if err := os.Remove(walFilename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// parseUnquotedWALEntry parses an entry from the first version of the text
+// log, `Set key value`, with the value as JSON. Keys may contain spaces and
+// values may run over several lines, so each space on the first line is tried
+// in turn as the end of the key, until the rest is valid JSON. BatchSet wrote
+// the hash of the key in decimal in place of the key, so the entry is marked
+// as hashed if its key could be one.
+func parseUnquotedWALEntry(command string, rest string) (legacyWALEntry, error) {
+	if command != "Set" {
+		return legacyWALEntry{}, fmt.Errorf("unknown command %q", command)
+	}
+
+	first, _, _ := strings.Cut(rest, "\n")
+	for i := 0; i < len(first); i++ {
+		if first[i] != ' ' {
+			continue
+		}
+		key, value := rest[:i], rest[i+1:]
+		if !json.Valid([]byte(value)) {
+			continue
+		}
+		hash, err := strconv.ParseUint(key, 10, 32)
+		hashed := err == nil && strconv.FormatUint(hash, 10) == key
+		return legacyWALEntry{Operation: Operation{Key: key, Value: json.RawMessage(value)}, hashed: hashed}, nil
+	}
+	return legacyWALEntry{}, fmt.Errorf("no JSON value after key: %q", rest)
+}
+
+// readLegacyWAL returns the entries of the text log after its last checkpoint.
+// Each entry starts with a command, and runs on over any lines after it that
+// don't, as the first version of the log wrote values as they were and JSON
+// can span lines. A final line without a newline was cut short by a crash and
+// is ignored.
+func readLegacyWAL(walFilename string) ([]string, error) {
+	file, err := os.Open(walFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == legacyWALCheckpoint {
+			entries = entries[:0]
+			continue
+		}
+		if len(entries) > 0 && !strings.HasPrefix(line, "Set ") && !strings.HasPrefix(line, "Delete ") {
+			entries[len(entries)-1] += "\n" + line
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	return entries, nil
+}
+
+// resolveLegacyHashedKeys replaces the hashes BatchSet logged in place of keys
+// with the keys, recovered from the rest of the text log. There is no way to
+// tell the key from its hash alone, so writes whose key is not found are
+// skipped, with a warning, rather than written under the wrong key.
+func resolveLegacyHashedKeys(walFilename string, entries []legacyWALEntry) ([]Operation, error) {
+	wanted := make(map[uint32]int64)
+	for _, entry := range entries {
+		if entry.hashed {
+			hash, _ := strconv.ParseUint(entry.Key, 10, 32)
+			wanted[uint32(hash)] = 0
+		}
+	}
+
+	names, err := recoverLegacyKeyNames(walFilename, wanted)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []Operation
+	for _, entry := range entries {
+		if entry.hashed {
+			hash, _ := strconv.ParseUint(entry.Key, 10, 32)
+			key, ok := names[uint32(hash)]
+			if !ok {
+				fmt.Printf("Could not recover key for hash %d in legacy write-ahead log, skipping write\n", hash)
+				continue
+			}
+			entry.Key = key
+		}
+		ops = append(ops, entry.Operation)
+	}
+	return ops, nil
+}
+
+// replayLegacyWAL applies the operations left in the text log to the disk, then
+// appends a checkpoint to it so they are not applied again. The file itself is
+// kept, as it is also used to recover keys for hash-only data files, unless
+// the disk is encrypted: the log holds keys and values in plaintext, and by
+// the time a disk is opened with keys, its index no longer needs them. An
+// entry that cannot be parsed fails the replay, rather than losing a write
+// that was acknowledged.
+func replayLegacyWAL(walFilename string, disk *Disk) (int, error) {
+	entries, err := readLegacyWAL(walFilename)
+	if err != nil {
+		return 0, err
+	} else if len(entries) == 0 {
+		return 0, removeEncryptedLegacyWAL(walFilename, disk)
+	}
+
+	var parsed []legacyWALEntry
+	for _, entry := range entries {
+		op, err := parseLegacyWALEntry(entry)
+		if err != nil {
+			return 0, fmt.Errorf("reading legacy write-ahead log: %w", err)
+		}
+		parsed = append(parsed, op)
+	}
+	ops, err := resolveLegacyHashedKeys(walFilename, parsed)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := applyOperations(disk, ops); err != nil {
+		return 0, err
+	}
+	if err := disk.Sync(); err != nil {
+		return 0, err
+	}
+	if disk.keys != nil {
+		return len(ops), removeEncryptedLegacyWAL(walFilename, disk)
+	}
+
+	file, err := os.OpenFile(walFilename, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// Finish off a line that was cut short, so the checkpoint is on a line of its own
+	checkpoint := legacyWALCheckpoint + "\n"
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, stat.Size()-1); err != nil {
+		return 0, err
+	}
+	if last[0] != '\n' {
+		checkpoint = "\n" + checkpoint
+	}
+
+	if _, err := file.Write([]byte(checkpoint)); err != nil {
+		return 0, err
+	}
+
+	return len(ops), file.Sync()
+}
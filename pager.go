@@ -0,0 +1,574 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// The index file is divided into fixed-size pages. Page 0 holds the metadata
+// below, and every other page holds one node of the B+tree or a free page.
+//
+//	magic     [4]byte  "KVIX"
+//	version   uint32
+//	pageSize  uint32
+//	root      uint64   page of the root node
+//	numPages  uint64   number of pages in the file
+//	freeHead  uint64   first page of the free list, or 0
+//	flags     byte     indexEncrypted if the node pages are encrypted
+//
+// The node pages of an encrypted index are sealed with the keyring, bound to
+// their page number, so a node takes up to sealOverhead bytes less than a
+// page. The metadata page only describes the shape of the tree and is left
+// in plaintext, so the index can be recognised without the keys.
+//
+// Pages are read through a cache and modified in memory. Commit writes every
+// modified page to a journal file first, syncs it, and only then writes the
+// pages in place. A crash while writing in place is repaired on open by
+// writing the pages from the journal again; a crash while writing the journal
+// leaves the index file as it was at the previous commit.
+
+// Size of each page in the index file
+const IndexPageSize = 4096
+
+// Number of pages the index keeps cached in memory by default
+const DefaultIndexCachePages = 1024
+
+const indexMagic = "KVIX"
+
+// Version 1 indexes ordered keys by their hash. They can still be opened, so
+// migrateIndex can read them, but are rebuilt in key order before they are used.
+const indexVersion = 2
+const journalMagic = "KVJN"
+const journalSuffix = ".journal"
+
+const (
+	pageLeaf byte = iota + 1
+	pageInternal
+	pageFree
+)
+
+// Node header: type, number of keys and the next leaf, first child or next free page
+const nodeHeaderSize = 1 + 2 + 8
+
+var errIndexCorrupt = errors.New("corrupt index file")
+
+// Flags in the metadata page
+const indexEncrypted byte = 1
+
+// indexNode is a decoded page of the index.
+type indexNode struct {
+	id       uint64
+	kind     byte
+	keys     []IndexValue // Entries of a leaf, or separators of an internal node
+	children []uint64     // Pages of an internal node's children, one more than keys
+	next     uint64       // Next leaf in key order, or next free page
+}
+
+func (n *indexNode) isLeaf() bool {
+	return n.kind == pageLeaf
+}
+
+// entrySize returns the number of bytes a key takes up in a page of this node.
+func (n *indexNode) entrySize(value IndexValue) int {
+	if n.isLeaf() {
+		return 4 + 2 + len(value.Key) + 8 + 8
+	}
+	return 4 + 2 + len(value.Key) + 8
+}
+
+// size returns the number of bytes the node takes up when encoded.
+func (n *indexNode) size() int {
+	size := nodeHeaderSize
+	for _, value := range n.keys {
+		size += n.entrySize(value)
+	}
+	return size
+}
+
+func (n *indexNode) encode(page []byte) {
+	page[0] = n.kind
+	binary.BigEndian.PutUint16(page[1:3], uint16(len(n.keys)))
+
+	switch n.kind {
+	case pageLeaf, pageFree:
+		binary.BigEndian.PutUint64(page[3:11], n.next)
+	case pageInternal:
+		binary.BigEndian.PutUint64(page[3:11], n.children[0])
+	}
+
+	pos := nodeHeaderSize
+	for i, value := range n.keys {
+		binary.BigEndian.PutUint32(page[pos:], value.Hash)
+		binary.BigEndian.PutUint16(page[pos+4:], uint16(len(value.Key)))
+		pos += 6
+		pos += copy(page[pos:], value.Key)
+
+		if n.isLeaf() {
+			binary.BigEndian.PutUint64(page[pos:], uint64(value.Pos))
+			binary.BigEndian.PutUint64(page[pos+8:], uint64(value.Size))
+			pos += 16
+		} else {
+			binary.BigEndian.PutUint64(page[pos:], n.children[i+1])
+			pos += 8
+		}
+	}
+}
+
+func decodeIndexNode(id uint64, page []byte) (*indexNode, error) {
+	n := &indexNode{id: id, kind: page[0]}
+	count := int(binary.BigEndian.Uint16(page[1:3]))
+	first := binary.BigEndian.Uint64(page[3:11])
+
+	switch n.kind {
+	case pageLeaf, pageFree:
+		n.next = first
+	case pageInternal:
+		n.children = append(n.children, first)
+	default:
+		return nil, fmt.Errorf("%w: page %d has unknown type %d", errIndexCorrupt, id, n.kind)
+	}
+
+	pos := nodeHeaderSize
+	n.keys = make([]IndexValue, 0, count)
+	for i := 0; i < count; i++ {
+		if pos+6 > len(page) {
+			return nil, fmt.Errorf("%w: page %d overflows", errIndexCorrupt, id)
+		}
+		value := IndexValue{Hash: binary.BigEndian.Uint32(page[pos:])}
+		keyLen := int(binary.BigEndian.Uint16(page[pos+4:]))
+		pos += 6
+
+		end := pos + keyLen + 8
+		if n.isLeaf() {
+			end += 8
+		}
+		if end > len(page) {
+			return nil, fmt.Errorf("%w: page %d overflows", errIndexCorrupt, id)
+		}
+
+		value.Key = string(page[pos : pos+keyLen])
+		pos += keyLen
+
+		if n.isLeaf() {
+			value.Pos = int64(binary.BigEndian.Uint64(page[pos:]))
+			value.Size = int64(binary.BigEndian.Uint64(page[pos+8:]))
+			pos += 16
+		} else {
+			n.children = append(n.children, binary.BigEndian.Uint64(page[pos:]))
+			pos += 8
+		}
+		n.keys = append(n.keys, value)
+	}
+
+	return n, nil
+}
+
+type indexMeta struct {
+	version  uint32
+	root     uint64
+	numPages uint64
+	freeHead uint64
+	flags    byte
+}
+
+// pager reads and writes the pages of an index file through a cache.
+type pager struct {
+	mu         sync.Mutex
+	file       *os.File
+	filename   string
+	cachePages int
+	cache      map[uint64]*list.Element // Cached nodes, by page
+	lru        *list.List               // Cached nodes, most recently used at the front
+	dirty      map[uint64]*indexNode    // Nodes modified since the last commit
+	meta       indexMeta
+	metaDirty  bool
+	keys       *Keyring // Keys node pages are sealed with, if the index is encrypted
+	capacity   int      // Most bytes a node can take up
+}
+
+// openPager opens the index file, creating it with an empty root leaf if
+// needed. A new index is encrypted if keys are given; an existing one is
+// encrypted or not as it was created, and keys are required to open it if it is.
+func openPager(filename string, cachePages int, keys *Keyring) (*pager, error) {
+	if err := recoverJournal(filename); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pager{
+		file:       file,
+		filename:   filename,
+		cachePages: cachePages,
+		cache:      make(map[uint64]*list.Element),
+		lru:        list.New(),
+		dirty:      make(map[uint64]*indexNode),
+		capacity:   IndexPageSize,
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if stat.Size() == 0 {
+		// A new index starts out as a single empty leaf
+		p.meta = indexMeta{version: indexVersion, root: 1, numPages: 2}
+		p.metaDirty = true
+		if keys != nil {
+			p.meta.flags |= indexEncrypted
+			p.keys, p.capacity = keys, IndexPageSize-sealOverhead
+		}
+		root := &indexNode{id: 1, kind: pageLeaf}
+		p.markDirty(root)
+		if err := p.commit(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+
+	page := make([]byte, IndexPageSize)
+	if _, err := file.ReadAt(page, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if string(page[0:4]) != indexMagic {
+		file.Close()
+		return nil, fmt.Errorf("%w: bad magic", errIndexCorrupt)
+	}
+	version := binary.BigEndian.Uint32(page[4:8])
+	if version < 1 || version > indexVersion {
+		file.Close()
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	if pageSize := binary.BigEndian.Uint32(page[8:12]); pageSize != IndexPageSize {
+		file.Close()
+		return nil, fmt.Errorf("unsupported index page size %d", pageSize)
+	}
+	p.meta = indexMeta{
+		version:  version,
+		root:     binary.BigEndian.Uint64(page[12:20]),
+		numPages: binary.BigEndian.Uint64(page[20:28]),
+		freeHead: binary.BigEndian.Uint64(page[28:36]),
+		flags:    page[36],
+	}
+	if p.meta.flags&indexEncrypted != 0 {
+		if keys == nil {
+			file.Close()
+			return nil, fmt.Errorf("index %s: %w", filename, ErrEncrypted)
+		}
+		p.keys, p.capacity = keys, IndexPageSize-sealOverhead
+	}
+
+	return p, nil
+}
+
+// isPagedIndex reports whether the file holds a paged index, or is empty.
+func isPagedIndex(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(indexMagic))
+	n, err := io.ReadFull(file, magic)
+	if n == 0 && err == io.EOF {
+		return true, nil
+	}
+	return string(magic[:n]) == indexMagic, nil
+}
+
+func (p *pager) encodeMeta(page []byte) {
+	copy(page[0:4], indexMagic)
+	binary.BigEndian.PutUint32(page[4:8], p.meta.version)
+	binary.BigEndian.PutUint32(page[8:12], IndexPageSize)
+	binary.BigEndian.PutUint64(page[12:20], p.meta.root)
+	binary.BigEndian.PutUint64(page[20:28], p.meta.numPages)
+	binary.BigEndian.PutUint64(page[28:36], p.meta.freeHead)
+	page[36] = p.meta.flags
+}
+
+// encrypted reports whether the index's node pages are encrypted.
+func (p *pager) encrypted() bool {
+	return p.keys != nil
+}
+
+// pageAD returns the additional data a node page is sealed with, so that a
+// sealed page cannot be moved to another page number.
+func pageAD(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// get returns the node stored in the page, reading it into the cache if needed.
+func (p *pager) get(id uint64) (*indexNode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if element, ok := p.cache[id]; ok {
+		p.lru.MoveToFront(element)
+		return element.Value.(*indexNode), nil
+	}
+
+	if id == 0 || id >= p.meta.numPages {
+		return nil, fmt.Errorf("%w: page %d out of range", errIndexCorrupt, id)
+	}
+
+	page := make([]byte, IndexPageSize)
+	if _, err := p.file.ReadAt(page, int64(id)*IndexPageSize); err != nil {
+		return nil, err
+	}
+	if p.keys != nil {
+		plaintext, err := p.keys.open(page, pageAD(id))
+		if err != nil {
+			return nil, fmt.Errorf("index page %d: %w", id, err)
+		}
+		page = plaintext
+	}
+
+	n, err := decodeIndexNode(id, page)
+	if err != nil {
+		return nil, err
+	}
+	p.addLocked(n)
+
+	return n, nil
+}
+
+// addLocked caches the node, then evicts nodes if the cache is too large.
+func (p *pager) addLocked(n *indexNode) {
+	p.cache[n.id] = p.lru.PushFront(n)
+	p.evictLocked()
+}
+
+// evictLocked drops the least recently used clean nodes until the cache is
+// back to its size. Dirty nodes stay cached until they are committed.
+func (p *pager) evictLocked() {
+	for element := p.lru.Back(); element != nil && p.lru.Len() > p.cachePages; {
+		prev := element.Prev()
+		evict := element.Value.(*indexNode)
+		if _, dirty := p.dirty[evict.id]; !dirty {
+			p.lru.Remove(element)
+			delete(p.cache, evict.id)
+		}
+		element = prev
+	}
+}
+
+// markDirty records that the node has been modified and must be written on commit.
+func (p *pager) markDirty(n *indexNode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dirty[n.id] = n
+
+	// The node may have been evicted since it was read
+	if element, ok := p.cache[n.id]; !ok {
+		p.addLocked(n)
+	} else if element.Value != n {
+		element.Value = n
+	}
+}
+
+// alloc returns a new empty node of the given kind, reusing a free page if there is one.
+func (p *pager) alloc(kind byte) (*indexNode, error) {
+	var id uint64
+	if p.meta.freeHead != 0 {
+		free, err := p.get(p.meta.freeHead)
+		if err != nil {
+			return nil, err
+		}
+		id = free.id
+		p.meta.freeHead = free.next
+	} else {
+		id = p.meta.numPages
+		p.meta.numPages++
+	}
+	p.metaDirty = true
+
+	p.mu.Lock()
+	if element, ok := p.cache[id]; ok {
+		p.lru.Remove(element)
+		delete(p.cache, id)
+	}
+	p.mu.Unlock()
+
+	n := &indexNode{id: id, kind: kind}
+	p.markDirty(n)
+	return n, nil
+}
+
+// free adds the node's page to the free list.
+func (p *pager) free(n *indexNode) {
+	n.kind = pageFree
+	n.keys = nil
+	n.children = nil
+	n.next = p.meta.freeHead
+	p.meta.freeHead = n.id
+	p.metaDirty = true
+	p.markDirty(n)
+}
+
+// commit durably writes every modified page to the index file.
+func (p *pager) commit() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.dirty) == 0 && !p.metaDirty {
+		return nil
+	}
+
+	pages, err := p.dirtyPagesLocked()
+	if err != nil {
+		return err
+	}
+
+	if err := writeJournal(p.filename+journalSuffix, pages); err != nil {
+		return err
+	}
+	if err := writePages(p.file, pages); err != nil {
+		return err
+	}
+	if err := os.Remove(p.filename + journalSuffix); err != nil {
+		return err
+	}
+
+	p.dirty = make(map[uint64]*indexNode)
+	p.metaDirty = false
+
+	// Now that they are clean, nodes over the cache size can be evicted again
+	p.evictLocked()
+
+	return nil
+}
+
+// dirtyPagesLocked encodes the metadata and every modified node.
+func (p *pager) dirtyPagesLocked() (map[uint64][]byte, error) {
+	pages := make(map[uint64][]byte, len(p.dirty)+1)
+
+	meta := make([]byte, IndexPageSize)
+	p.encodeMeta(meta)
+	pages[0] = meta
+
+	for id, n := range p.dirty {
+		if n.size() > p.capacity {
+			return nil, fmt.Errorf("index page %d is too large: %d bytes", id, n.size())
+		}
+		page := make([]byte, p.capacity)
+		n.encode(page)
+		if p.keys != nil {
+			page = p.keys.seal(page, pageAD(id))
+		}
+		pages[id] = page
+	}
+
+	return pages, nil
+}
+
+// setRoot makes the node in the page the root of the tree.
+func (p *pager) setRoot(id uint64) {
+	p.meta.root = id
+	p.metaDirty = true
+}
+
+func (p *pager) close() error {
+	return p.file.Close()
+}
+
+// writePages writes the pages in place and syncs the file.
+func writePages(file *os.File, pages map[uint64][]byte) error {
+	for id, page := range pages {
+		if _, err := file.WriteAt(page, int64(id)*IndexPageSize); err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// writeJournal durably writes the pages to the journal. The journal holds a
+// header with the number of pages, each page prefixed with its number, and a
+// CRC-32C of everything before it so an incomplete journal can be detected.
+func writeJournal(filename string, pages map[uint64][]byte) error {
+	data := make([]byte, 0, 8+len(pages)*(8+IndexPageSize)+4)
+	data = append(data, journalMagic...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(pages)))
+	for id, page := range pages {
+		data = binary.BigEndian.AppendUint64(data, id)
+		data = append(data, page...)
+	}
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(data, walCRCTable))
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readJournal returns the pages in a journal, or nil if it is incomplete.
+func readJournal(data []byte) map[uint64][]byte {
+	if len(data) < 12 || string(data[0:4]) != journalMagic {
+		return nil
+	}
+
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	if len(data) != 8+count*(8+IndexPageSize)+4 {
+		return nil
+	}
+	if crc32.Checksum(data[:len(data)-4], walCRCTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil
+	}
+
+	pages := make(map[uint64][]byte, count)
+	pos := 8
+	for i := 0; i < count; i++ {
+		id := binary.BigEndian.Uint64(data[pos:])
+		pages[id] = data[pos+8 : pos+8+IndexPageSize]
+		pos += 8 + IndexPageSize
+	}
+	return pages
+}
+
+// recoverJournal finishes a commit that was interrupted after its journal was
+// written. An incomplete journal means the commit never started writing in
+// place, so it is simply removed.
+func recoverJournal(filename string) error {
+	data, err := os.ReadFile(filename + journalSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if pages := readJournal(data); pages != nil {
+		file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := writePages(file, pages); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(filename + journalSuffix)
+}
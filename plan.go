@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Ways a query can find the documents it might match, from the most selective
+const (
+	accessKeyLookup   = "key lookup"   // Get each of a list of keys
+	accessIndexLookup = "index lookup" // Look up values in a secondary index
+	accessKeyRange    = "key range"    // Scan a range of keys
+	accessIndexRange  = "index range"  // Scan a range of values in a secondary index
+	accessFullScan    = "full scan"    // Scan every key
+)
+
+// QueryPlan describes how a query is run. The access method finds the
+// documents the query might match, and every one of them is then checked
+// against the whole WHERE clause, so the plan only affects how many documents
+// are read, not which are returned.
+type QueryPlan struct {
+	Access     string   `json:"access"`
+	Index      string   `json:"index,omitempty"`
+	Keys       []string `json:"keys,omitempty"`   // Keys looked up, or the start and end of the key range
+	Ranges     []string `json:"ranges,omitempty"` // Values looked up or scanned in the index
+	Filter     string   `json:"filter,omitempty"`
+	Group      string   `json:"group,omitempty"` // Field documents are grouped by
+	Aggregates []string `json:"aggregates,omitempty"`
+	Order      string   `json:"order,omitempty"`
+	Limit      int      `json:"limit,omitempty"`
+
+	keys       []string // Keys to look up
+	start, end string   // Range of keys to scan
+	ranges     []IndexRange
+}
+
+// String describes the plan on one line.
+func (p *QueryPlan) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.Access)
+	if p.Index != "" {
+		fmt.Fprintf(&sb, " on %s", p.Index)
+	}
+	if len(p.Ranges) > 0 {
+		fmt.Fprintf(&sb, " [%s]", strings.Join(p.Ranges, ", "))
+	}
+	if len(p.Keys) > 0 {
+		fmt.Fprintf(&sb, " [%s]", strings.Join(p.Keys, ", "))
+	}
+	if p.Filter != "" {
+		fmt.Fprintf(&sb, ", filter %s", p.Filter)
+	}
+	if len(p.Aggregates) > 0 {
+		fmt.Fprintf(&sb, ", aggregate %s", strings.Join(p.Aggregates, ", "))
+	}
+	if p.Group != "" {
+		fmt.Fprintf(&sb, ", group by %s", p.Group)
+	}
+	if p.Order != "" {
+		fmt.Fprintf(&sb, ", order by %s", p.Order)
+	}
+	if p.Limit > 0 {
+		fmt.Fprintf(&sb, ", limit %d", p.Limit)
+	}
+	return sb.String()
+}
+
+// QueryRow is a document returned by a query, or the fields of it the query
+// selected. Rows of aggregates have no key.
+type QueryRow struct {
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// QueryResult is the plan a query was run with and the documents it returned.
+// Rows is nil for EXPLAIN queries, which are planned but not run.
+type QueryResult struct {
+	Plan *QueryPlan
+	Rows []QueryRow
+}
+
+// Query parses and runs a query written in the query language. Rows are
+// returned in the order the query asks for, or in the order the plan reads
+// them if it has no ORDER BY: by key, or by value for an index.
+func (s *Store) Query(query string) (*QueryResult, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := s.plan(q)
+	result := &QueryResult{Plan: plan}
+	if q.Explain {
+		return result, nil
+	}
+
+	if q.aggregating() {
+		result.Rows, err = s.executeAggregate(q, plan)
+	} else {
+		result.Rows, err = s.execute(q, plan)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// conjuncts returns the conditions that must all hold for the expression to hold.
+func conjuncts(expr queryExpr) []queryExpr {
+	if and, ok := expr.(andExpr); ok {
+		return append(conjuncts(and.left), conjuncts(and.right)...)
+	} else if expr == nil {
+		return nil
+	}
+	return []queryExpr{expr}
+}
+
+// samePath reports whether two JSON paths select the same value, however they are written.
+func samePath(a, b jsonPath) bool {
+	if len(a.steps) != len(b.steps) {
+		return false
+	}
+	for i := range a.steps {
+		if a.steps[i] != b.steps[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// plan chooses how to find the documents the query might match. It looks
+// through the conditions the WHERE clause requires for ones on the key or on
+// the path of a secondary index, and picks the most selective access method
+// they allow, falling back to a full scan.
+func (s *Store) plan(q *Query) *QueryPlan {
+	plan := &QueryPlan{Access: accessFullScan, Limit: q.Limit}
+	if q.Where != nil {
+		plan.Filter = q.Where.String()
+	}
+	if q.orderColumn != "" {
+		plan.Order = q.orderColumn + " ASC"
+		if q.Desc {
+			plan.Order = q.orderColumn + " DESC"
+		}
+	}
+	for _, agg := range q.Aggregates {
+		plan.Aggregates = append(plan.Aggregates, agg.String())
+	}
+	if q.GroupBy != nil {
+		plan.Group = q.GroupBy.String()
+	}
+
+	indexes := s.Indexes()
+	indexFor := func(field queryField) *SecondaryIndex {
+		if field.key {
+			return nil
+		}
+		for _, idx := range indexes {
+			if samePath(idx.path, field.path) {
+				return idx
+			}
+		}
+		return nil
+	}
+
+	var keys []string
+	var start, end string
+	keyRange := false
+	lookups := make(map[string][]IndexRange)
+	ranges := make(map[string]IndexRange)
+	var lookupIndex, rangeIndex string
+
+	for _, expr := range conjuncts(q.Where) {
+		var field queryField
+		var op string
+		var values []interface{}
+		switch e := expr.(type) {
+		case compareExpr:
+			field, op, values = e.field, e.op, []interface{}{e.value}
+		case inExpr:
+			if e.not {
+				continue
+			}
+			field, op, values = e.field, "IN", e.values
+		default:
+			continue
+		}
+		if op == "!=" {
+			continue
+		}
+
+		if field.key {
+			strs, ok := queryStrings(values)
+			if !ok {
+				continue
+			}
+			switch op {
+			case "=", "IN":
+				if keys == nil {
+					keys = strs
+				}
+			case ">=":
+				start, keyRange = maxString(start, strs[0]), true
+			case ">":
+				start, keyRange = maxString(start, keyAfter(strs[0])), true
+			case "<":
+				end, keyRange = minEnd(end, strs[0]), true
+			case "<=":
+				end, keyRange = minEnd(end, keyAfter(strs[0])), true
+			}
+			continue
+		}
+
+		idx := indexFor(field)
+		if idx == nil {
+			continue
+		}
+		encoded := make([]string, len(values))
+		ok := true
+		for i, value := range values {
+			encoded[i], ok = encodeIndexValue(value)
+			if !ok {
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		switch op {
+		case "=", "IN":
+			if _, ok := lookups[idx.Name]; ok {
+				continue
+			}
+			// One point range for each distinct value, in index order
+			order := make([]int, len(values))
+			for i := range order {
+				order[i] = i
+			}
+			sort.Slice(order, func(i, j int) bool { return encoded[order[i]] < encoded[order[j]] })
+			var points []IndexRange
+			for n, i := range order {
+				if n > 0 && encoded[i] == encoded[order[n-1]] {
+					continue
+				}
+				points = append(points, IndexRange{Min: values[i], Max: values[i]})
+			}
+			lookups[idx.Name] = points
+			if lookupIndex == "" {
+				lookupIndex = idx.Name
+			}
+		default:
+			r, seen := ranges[idx.Name]
+			ranges[idx.Name] = narrowRange(r, op, values[0])
+			if !seen && rangeIndex == "" {
+				rangeIndex = idx.Name
+			}
+		}
+	}
+
+	switch {
+	case keys != nil:
+		plan.Access, plan.keys = accessKeyLookup, sortedUnique(keys)
+		for _, key := range plan.keys {
+			plan.Keys = append(plan.Keys, formatQueryValue(key))
+		}
+	case lookupIndex != "":
+		plan.Access, plan.Index, plan.ranges = accessIndexLookup, lookupIndex, lookups[lookupIndex]
+	case keyRange:
+		plan.Access, plan.start, plan.end = accessKeyRange, start, end
+		plan.Keys = []string{formatQueryValue(start), formatQueryValue(end)}
+	case rangeIndex != "":
+		plan.Access, plan.Index, plan.ranges = accessIndexRange, rangeIndex, []IndexRange{ranges[rangeIndex]}
+	}
+	for _, r := range plan.ranges {
+		plan.Ranges = append(plan.Ranges, formatIndexRange(r))
+	}
+
+	return plan
+}
+
+// queryStrings returns the values as strings, or false if any is not one.
+func queryStrings(values []interface{}) ([]string, bool) {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		strs[i] = s
+	}
+	return strs, true
+}
+
+func sortedUnique(strs []string) []string {
+	sort.Strings(strs)
+	unique := strs[:0]
+	for i, s := range strs {
+		if i == 0 || s != strs[i-1] {
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
+func maxString(a, b string) string {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// minEnd returns the lower of two range ends, where an empty end is open.
+func minEnd(a, b string) string {
+	if a == "" || (b != "" && b < a) {
+		return b
+	}
+	return a
+}
+
+// narrowRange narrows the range by a comparison with a value. Index ranges are
+// inclusive, so < and > narrow it as <= and >= do, and leave the rest to the
+// filter. Bounds of a different type to the range's are ignored.
+func narrowRange(r IndexRange, op string, value interface{}) IndexRange {
+	encoded, _ := encodeIndexValue(value)
+	sameType := func(bound interface{}) bool {
+		other, ok := encodeIndexValue(bound)
+		return !ok || other[0] == encoded[0]
+	}
+	if !sameType(r.Min) || !sameType(r.Max) {
+		return r
+	}
+
+	switch op {
+	case ">", ">=":
+		if min, ok := encodeIndexValue(r.Min); !ok || encoded > min {
+			r.Min = value
+		}
+	case "<", "<=":
+		if max, ok := encodeIndexValue(r.Max); !ok || encoded < max {
+			r.Max = value
+		}
+	}
+	return r
+}
+
+// formatIndexRange describes a range of index values.
+func formatIndexRange(r IndexRange) string {
+	switch {
+	case r.Min != nil && r.Max != nil:
+		if c, ok := compareQueryValues(r.Min, r.Max); ok && c == 0 {
+			return "= " + formatQueryValue(r.Min)
+		}
+		return fmt.Sprintf("%s to %s", formatQueryValue(r.Min), formatQueryValue(r.Max))
+	case r.Min != nil:
+		return ">= " + formatQueryValue(r.Min)
+	default:
+		return "<= " + formatQueryValue(r.Max)
+	}
+}
+
+// candidates calls fn with each document the plan finds, until it returns false.
+func (s *Store) candidates(plan *QueryPlan, fn func(key string, value json.RawMessage) bool) error {
+	switch plan.Access {
+	case accessKeyLookup:
+		for _, key := range plan.keys {
+			if value, ok := s.Get(key); ok && !fn(key, value) {
+				return nil
+			}
+		}
+		return nil
+
+	case accessIndexLookup, accessIndexRange:
+		it := s.scanIndex(plan.Index, plan.ranges, 0)
+		for it.Next() {
+			if !fn(it.entry.Key, it.entry.Value) {
+				break
+			}
+		}
+		return it.Err()
+	}
+
+	it := s.Scan(plan.start, plan.end, 0)
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// queryMatch is a document that matched a query.
+type queryMatch struct {
+	key   string
+	value json.RawMessage
+	doc   interface{}
+	order string // Encoded value the rows are ordered by
+}
+
+// execute runs the query with the plan. With ORDER BY and LIMIT it only keeps
+// the best matches so far, so it never holds more than twice the limit.
+func (s *Store) execute(q *Query, plan *QueryPlan) ([]QueryRow, error) {
+	var matches []queryMatch
+	less := func(a, b queryMatch) bool {
+		if a.order != b.order {
+			return (a.order < b.order) != q.Desc
+		}
+		return a.key < b.key
+	}
+	best := func() {
+		sort.SliceStable(matches, func(i, j int) bool { return less(matches[i], matches[j]) })
+		if q.Limit > 0 && len(matches) > q.Limit {
+			matches = matches[:q.Limit]
+		}
+	}
+
+	err := s.candidates(plan, func(key string, value json.RawMessage) bool {
+		var doc interface{}
+		if err := json.Unmarshal(value, &doc); err != nil {
+			doc = nil
+		}
+		if q.Where != nil && !q.Where.matches(key, doc) {
+			return true
+		}
+
+		match := queryMatch{key: key, value: value, doc: doc}
+		if q.OrderBy == nil {
+			matches = append(matches, match)
+			return q.Limit == 0 || len(matches) < q.Limit
+		}
+
+		// Values that cannot be ordered come first
+		if v, ok := q.OrderBy.value(key, doc); ok {
+			match.order, _ = encodeIndexValue(v)
+		}
+		matches = append(matches, match)
+		if q.Limit > 0 && len(matches) >= 2*q.Limit {
+			best()
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if q.OrderBy != nil {
+		best()
+	}
+
+	rows := make([]QueryRow, len(matches))
+	for i, match := range matches {
+		rows[i] = QueryRow{Key: match.key, Value: match.value}
+		if q.Fields == nil {
+			continue
+		}
+		fields := make(map[string]interface{}, len(q.Fields))
+		for _, field := range q.Fields {
+			if v, ok := field.value(match.key, match.doc); ok {
+				fields[field.String()] = v
+			}
+		}
+		if rows[i].Value, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The query language selects documents by the values at JSON paths in them:
+//
+//	[EXPLAIN] SELECT * | column, ...
+//	[WHERE condition]
+//	[GROUP BY path]
+//	[ORDER BY column [ASC | DESC]]
+//	[LIMIT n]
+//
+// Conditions compare a path with a literal using =, !=, <, <=, > or >=, test
+// it against a list with [NOT] IN (literal, ...), and combine with AND, OR,
+// NOT and parentheses. Literals are numbers, 'strings' or "strings", true,
+// false and null. The path _key stands for the document's key. Keywords are
+// not case sensitive.
+//
+// A column is a path, or an aggregate of the values at a path in the matching
+// documents, optionally named with AS. Queries with aggregates or GROUP BY
+// return a row for each distinct value of the GROUP BY path, or a single row
+// without one, and order by their columns; see aggregate.go.
+//
+// Values only compare with values of the same type. A path that selects an
+// array matches if any of its elements does, except with != and NOT IN, which
+// match if none does, and a path that selects nothing matches no comparison.
+
+// ErrBadQuery is returned when a query cannot be parsed.
+var ErrBadQuery = errors.New("bad query")
+
+// Query is a parsed query.
+type Query struct {
+	Explain bool
+	Fields  []queryField // Fields to return, or nil for the whole document
+	Where   queryExpr    // Condition documents must meet, or nil for every document
+	OrderBy *queryField  // Field to order by, or nil for the order they are read in
+	Desc    bool
+	Limit   int // Most documents to return, or 0 for no limit
+
+	Aggregates []queryAggregate
+	GroupBy    *queryField // Field to group documents by, or nil to aggregate them all together
+
+	orderColumn string // Name of the column to order by
+}
+
+// aggregating reports whether the query returns aggregates rather than documents.
+func (q *Query) aggregating() bool {
+	return len(q.Aggregates) > 0 || q.GroupBy != nil
+}
+
+// queryField is a JSON path in a document, or its key.
+type queryField struct {
+	key  bool
+	path jsonPath
+}
+
+// Name of the field that stands for a document's key
+const queryKeyField = "_key"
+
+// value returns the value of the field in the decoded document, and whether it has one.
+func (f queryField) value(key string, doc interface{}) (interface{}, bool) {
+	if f.key {
+		return key, true
+	}
+	return f.path.lookup(doc)
+}
+
+func (f queryField) String() string {
+	if f.key {
+		return queryKeyField
+	}
+	return f.path.String()
+}
+
+// sameField reports whether two fields select the same value.
+func sameField(a, b queryField) bool {
+	return a.key == b.key && (a.key || samePath(a.path, b.path))
+}
+
+// queryExpr is a condition in a WHERE clause.
+type queryExpr interface {
+	// matches reports whether the document with the key meets the condition.
+	matches(key string, doc interface{}) bool
+	String() string
+}
+
+type andExpr struct{ left, right queryExpr }
+type orExpr struct{ left, right queryExpr }
+type notExpr struct{ expr queryExpr }
+
+// compareExpr compares a field with a literal.
+type compareExpr struct {
+	field queryField
+	op    string
+	value interface{}
+}
+
+// inExpr tests whether a field is one of a list of literals.
+type inExpr struct {
+	field  queryField
+	values []interface{}
+	not    bool
+}
+
+func (e andExpr) matches(key string, doc interface{}) bool {
+	return e.left.matches(key, doc) && e.right.matches(key, doc)
+}
+
+func (e andExpr) String() string {
+	return fmt.Sprintf("(%s AND %s)", e.left, e.right)
+}
+
+func (e orExpr) matches(key string, doc interface{}) bool {
+	return e.left.matches(key, doc) || e.right.matches(key, doc)
+}
+
+func (e orExpr) String() string {
+	return fmt.Sprintf("(%s OR %s)", e.left, e.right)
+}
+
+func (e notExpr) matches(key string, doc interface{}) bool {
+	return !e.expr.matches(key, doc)
+}
+
+func (e notExpr) String() string {
+	return fmt.Sprintf("NOT %s", e.expr)
+}
+
+func (e compareExpr) matches(key string, doc interface{}) bool {
+	value, ok := e.field.value(key, doc)
+	if !ok {
+		return false
+	}
+	if e.op == "!=" {
+		return !anyElement(value, func(v interface{}) bool {
+			c, ok := compareQueryValues(v, e.value)
+			return ok && c == 0
+		})
+	}
+
+	return anyElement(value, func(v interface{}) bool {
+		c, ok := compareQueryValues(v, e.value)
+		if !ok {
+			return false
+		}
+		switch e.op {
+		case "=":
+			return c == 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		case ">=":
+			return c >= 0
+		}
+		return false
+	})
+}
+
+func (e compareExpr) String() string {
+	return fmt.Sprintf("%s %s %s", e.field, e.op, formatQueryValue(e.value))
+}
+
+func (e inExpr) matches(key string, doc interface{}) bool {
+	value, ok := e.field.value(key, doc)
+	if !ok {
+		return false
+	}
+	found := anyElement(value, func(v interface{}) bool {
+		for _, want := range e.values {
+			if c, ok := compareQueryValues(v, want); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	})
+	return found != e.not
+}
+
+func (e inExpr) String() string {
+	values := make([]string, len(e.values))
+	for i, value := range e.values {
+		values[i] = formatQueryValue(value)
+	}
+	op := "IN"
+	if e.not {
+		op = "NOT IN"
+	}
+	return fmt.Sprintf("%s %s (%s)", e.field, op, strings.Join(values, ", "))
+}
+
+// anyElement reports whether fn holds for the value, or for any element of it
+// if it is an array.
+func anyElement(value interface{}, fn func(v interface{}) bool) bool {
+	if array, ok := value.([]interface{}); ok {
+		for _, element := range array {
+			if fn(element) {
+				return true
+			}
+		}
+		return false
+	}
+	return fn(value)
+}
+
+// compareQueryValues compares two decoded JSON values, returning -1, 0 or 1.
+// It returns false if they are of different types or not comparable.
+func compareQueryValues(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case nil:
+		return 0, b == nil
+	case bool:
+		b, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if a == b {
+			return 0, true
+		} else if !a {
+			return -1, true
+		}
+		return 1, true
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+// formatQueryValue writes a literal as it would appear in a query.
+func formatQueryValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// queryToken is a token of a query: a keyword or path, a literal, or an operator.
+type queryToken struct {
+	kind  byte // See the token kinds below
+	text  string
+	value interface{} // Value of a literal
+	pos   int
+}
+
+const (
+	tokenEOF byte = iota
+	tokenWord
+	tokenLiteral
+	tokenSymbol
+)
+
+// lexQuery splits a query into tokens.
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '\'' || c == '"':
+			// Quotes inside a string are doubled
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(query) {
+					return nil, fmt.Errorf("%w: unterminated string at position %d", ErrBadQuery, i)
+				}
+				if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						sb.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(query[j])
+				j++
+			}
+			tokens = append(tokens, queryToken{kind: tokenLiteral, text: query[i : j+1], value: sb.String(), pos: i})
+			i = j + 1
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(query) && strings.IndexByte("0123456789.eE+-", query[j]) >= 0 {
+				// A sign is only part of the number straight after an exponent
+				if (query[j] == '+' || query[j] == '-') && query[j-1] != 'e' && query[j-1] != 'E' {
+					break
+				}
+				j++
+			}
+			n, err := strconv.ParseFloat(query[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad number %q at position %d", ErrBadQuery, query[i:j], i)
+			}
+			tokens = append(tokens, queryToken{kind: tokenLiteral, text: query[i:j], value: n, pos: i})
+			i = j
+		case isPathChar(c):
+			j := i
+			for j < len(query) && isPathChar(query[j]) {
+				j++
+			}
+			tokens = append(tokens, queryToken{kind: tokenWord, text: query[i:j], pos: i})
+			i = j
+		default:
+			// Two character operators first
+			symbol := string(c)
+			if i+1 < len(query) {
+				switch query[i : i+2] {
+				case "!=", "<>", "<=", ">=":
+					symbol = query[i : i+2]
+				}
+			}
+			if strings.IndexByte("=<>(),*", c) < 0 && len(symbol) == 1 {
+				return nil, fmt.Errorf("%w: unexpected %q at position %d", ErrBadQuery, c, i)
+			}
+			if symbol == "<>" {
+				symbol = "!="
+			}
+			tokens = append(tokens, queryToken{kind: tokenSymbol, text: symbol, pos: i})
+			i += len(symbol)
+		}
+	}
+	return append(tokens, queryToken{kind: tokenEOF, pos: len(query)}), nil
+}
+
+// isPathChar reports whether the character can be part of a keyword or path.
+func isPathChar(c byte) bool {
+	return c == '_' || c == '$' || c == '.' || c == '[' || c == ']' ||
+		c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// queryParser parses a query with recursive descent.
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// ParseQuery parses a query written in the query language.
+func ParseQuery(query string) (*Query, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+
+	q := &Query{}
+	if p.keyword("EXPLAIN") {
+		q.Explain = true
+	}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	star := p.symbol("*")
+	for !star {
+		if err := p.column(q); err != nil {
+			return nil, err
+		}
+		if !p.symbol(",") {
+			break
+		}
+	}
+
+	if p.keyword("WHERE") {
+		if q.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		q.GroupBy = &field
+	}
+
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if agg, ok, err := p.aggregate(); err != nil {
+			return nil, err
+		} else if ok {
+			q.orderColumn = agg.String()
+		} else {
+			field, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			q.OrderBy = &field
+			q.orderColumn = field.String()
+		}
+		if p.keyword("DESC") {
+			q.Desc = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		token := p.next()
+		n, ok := token.value.(float64)
+		if token.kind != tokenLiteral || !ok || n < 1 || n != float64(int(n)) {
+			return nil, p.errorAt(token, "a positive whole number")
+		}
+		q.Limit = int(n)
+	}
+
+	if token := p.peek(); token.kind != tokenEOF {
+		return nil, p.errorAt(token, "end of query")
+	}
+
+	if q.aggregating() {
+		if star {
+			return nil, fmt.Errorf("%w: SELECT * cannot be used with aggregates or GROUP BY", ErrBadQuery)
+		}
+		if err := q.checkAggregate(); err != nil {
+			return nil, err
+		}
+	} else if q.orderColumn != "" && q.OrderBy == nil {
+		return nil, fmt.Errorf("%w: cannot order by %s without aggregates in SELECT", ErrBadQuery, q.orderColumn)
+	}
+	return q, nil
+}
+
+// column parses a column of the SELECT clause into the query.
+func (p *queryParser) column(q *Query) error {
+	agg, ok, err := p.aggregate()
+	if err != nil {
+		return err
+	} else if !ok {
+		field, err := p.field()
+		if err != nil {
+			return err
+		}
+		q.Fields = append(q.Fields, field)
+		return nil
+	}
+
+	if p.keyword("AS") {
+		token := p.next()
+		if token.kind != tokenWord || queryKeywords[strings.ToUpper(token.text)] {
+			return p.errorAt(token, "a column name")
+		}
+		agg.alias = token.text
+	}
+	q.Aggregates = append(q.Aggregates, agg)
+	return nil
+}
+
+// aggregate parses an aggregate function call if there is one next, and
+// reports whether there was.
+func (p *queryParser) aggregate() (queryAggregate, bool, error) {
+	token := p.peek()
+	fn := strings.ToLower(token.text)
+	if token.kind != tokenWord || !aggregateFuncs[fn] {
+		return queryAggregate{}, false, nil
+	}
+	if open := p.tokens[p.pos+1]; open.kind != tokenSymbol || open.text != "(" {
+		return queryAggregate{}, false, nil
+	}
+	p.pos += 2
+
+	agg := queryAggregate{fn: fn}
+	if p.symbol("*") {
+		if fn != "count" {
+			return queryAggregate{}, false, fmt.Errorf("%w: only count can be applied to *", ErrBadQuery)
+		}
+	} else {
+		field, err := p.field()
+		if err != nil {
+			return queryAggregate{}, false, err
+		}
+		agg.field = &field
+	}
+	if !p.symbol(")") {
+		return queryAggregate{}, false, p.errorAt(p.peek(), ")")
+	}
+	return agg, true, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// isKeyword reports whether the token is the keyword.
+func isKeyword(token queryToken, keyword string) bool {
+	return token.kind == tokenWord && strings.EqualFold(token.text, keyword)
+}
+
+// keyword consumes the next token if it is the keyword, and reports whether it was.
+func (p *queryParser) keyword(keyword string) bool {
+	if isKeyword(p.peek(), keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectKeyword(keyword string) error {
+	if !p.keyword(keyword) {
+		return p.errorAt(p.peek(), keyword)
+	}
+	return nil
+}
+
+// symbol consumes the next token if it is the symbol, and reports whether it was.
+func (p *queryParser) symbol(symbol string) bool {
+	if token := p.peek(); token.kind == tokenSymbol && token.text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) errorAt(token queryToken, expected string) error {
+	found := token.text
+	if token.kind == tokenEOF {
+		found = "end of query"
+	}
+	return fmt.Errorf("%w: expected %s at position %d, found %q", ErrBadQuery, expected, token.pos, found)
+}
+
+// Keywords that cannot be used as field names without a "$." in front
+var queryKeywords = map[string]bool{
+	"SELECT": true, "WHERE": true, "AND": true, "OR": true, "NOT": true, "IN": true,
+	"ORDER": true, "BY": true, "ASC": true, "DESC": true, "LIMIT": true, "EXPLAIN": true,
+	"GROUP": true, "AS": true,
+	"TRUE": true, "FALSE": true, "NULL": true,
+}
+
+func (p *queryParser) field() (queryField, error) {
+	token := p.next()
+	if token.kind != tokenWord || queryKeywords[strings.ToUpper(token.text)] {
+		return queryField{}, p.errorAt(token, "a field")
+	}
+	if token.text == queryKeyField {
+		return queryField{key: true}, nil
+	}
+	path, err := parseJSONPath(token.text)
+	if err != nil {
+		return queryField{}, fmt.Errorf("%w: %v", ErrBadQuery, err)
+	}
+	return queryField{path: path}, nil
+}
+
+func (p *queryParser) literal() (interface{}, error) {
+	token := p.next()
+	switch {
+	case token.kind == tokenLiteral:
+		return token.value, nil
+	case isKeyword(token, "TRUE"):
+		return true, nil
+	case isKeyword(token, "FALSE"):
+		return false, nil
+	case isKeyword(token, "NULL"):
+		return nil, nil
+	}
+	return nil, p.errorAt(token, "a value")
+}
+
+func (p *queryParser) or() (queryExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) and() (queryExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) not() (queryExpr, error) {
+	if p.keyword("NOT") {
+		expr, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+	return p.primary()
+}
+
+func (p *queryParser) primary() (queryExpr, error) {
+	if p.symbol("(") {
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.errorAt(p.peek(), ")")
+		}
+		return expr, nil
+	}
+
+	field, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+
+	not := p.keyword("NOT")
+	if p.keyword("IN") {
+		if !p.symbol("(") {
+			return nil, p.errorAt(p.peek(), "(")
+		}
+		expr := inExpr{field: field, not: not}
+		for {
+			value, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			expr.values = append(expr.values, value)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if !p.symbol(")") {
+			return nil, p.errorAt(p.peek(), ")")
+		}
+		return expr, nil
+	} else if not {
+		return nil, p.errorAt(p.peek(), "IN")
+	}
+
+	token := p.next()
+	switch token.text {
+	case "=", "!=", "<", "<=", ">", ">=":
+		if token.kind != tokenSymbol {
+			break
+		}
+		value, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{field: field, op: token.text, value: value}, nil
+	}
+	return nil, p.errorAt(token, "a comparison")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rowKeys returns the keys of the rows.
+func rowKeys(rows []QueryRow) []string {
+	keys := []string{}
+	for _, row := range rows {
+		keys = append(keys, row.Key)
+	}
+	return keys
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		where string // WHERE clause as it is written back, or "" if it is invalid
+	}{
+		{"SELECT * WHERE a = 1", "a = 1"},
+		{"select * where a = 1 and b != 'x' or not c < 2", "((a = 1 AND b != 'x') OR NOT c < 2)"},
+		{"SELECT * WHERE a = 1 AND (b = 2 OR c = 3)", "(a = 1 AND (b = 2 OR c = 3))"},
+		{"SELECT * WHERE $.a.b[0] >= -1.5e3", "$.a.b[0] >= -1500"},
+		{`SELECT * WHERE name IN ('it''s', "b", true, null)`, "name IN ('it''s', 'b', true, null)"},
+		{"SELECT * WHERE name NOT IN (1)", "name NOT IN (1)"},
+		{"SELECT * WHERE a <> 1", "a != 1"},
+		{"SELECT * WHERE _key > 'a'", "_key > 'a'"},
+		{"SELECT * WHERE", ""},
+		{"SELECT * WHERE a = ", ""},
+		{"SELECT * WHERE a == 1", ""},
+		{"SELECT * WHERE a = 'open", ""},
+		{"SELECT * WHERE (a = 1", ""},
+		{"SELECT * WHERE a IN ()", ""},
+		{"SELECT * WHERE where = 1", ""},
+		{"SELECT * WHERE a..b = 1", ""},
+		{"SELECT * LIMIT 0", ""},
+		{"SELECT * LIMIT 1.5", ""},
+		{"SELECT * ORDER a", ""},
+		{"SELECT * extra", ""},
+		{"WHERE a = 1", ""},
+	}
+
+	for _, test := range tests {
+		q, err := ParseQuery(test.query)
+		if test.where == "" {
+			assert.ErrorIs(t, err, ErrBadQuery, test.query)
+			continue
+		}
+		if assert.NoError(t, err, test.query) {
+			assert.Equal(t, test.where, q.Where.String(), test.query)
+		}
+	}
+
+	q, err := ParseQuery("EXPLAIN SELECT name, $.age ORDER BY age DESC LIMIT 5")
+	assert.NoError(t, err)
+	assert.True(t, q.Explain)
+	assert.Len(t, q.Fields, 2)
+	assert.Nil(t, q.Where)
+	assert.Equal(t, "age", q.OrderBy.String())
+	assert.True(t, q.Desc)
+	assert.Equal(t, 5, q.Limit)
+}
+
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+
+	users := map[string]string{
+		"u1": `{"name": "alice", "age": 30, "tags": ["admin", "ops"]}`,
+		"u2": `{"name": "bob", "age": 25, "tags": ["ops"]}`,
+		"u3": `{"name": "carol", "age": 35}`,
+		"u4": `{"name": "dave", "age": "unknown"}`,
+		"u5": `"not an object"`,
+	}
+	for key, value := range users {
+		assert.NoError(t, kv.Set(key, json.RawMessage(value)))
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT *", []string{"u1", "u2", "u3", "u4", "u5"}},
+		{"SELECT * WHERE age = 30", []string{"u1"}},
+		{"SELECT * WHERE age > 25", []string{"u1", "u3"}},
+		{"SELECT * WHERE age >= 25 AND age < 35 ORDER BY _key", []string{"u1", "u2"}},
+		{"SELECT * WHERE age != 30", []string{"u2", "u3", "u4"}},
+		{"SELECT * WHERE NOT age = 30", []string{"u2", "u3", "u4", "u5"}},
+		{"SELECT * WHERE age = 'unknown' OR name = 'bob'", []string{"u2", "u4"}},
+		{"SELECT * WHERE name IN ('alice', 'carol', 'zed')", []string{"u1", "u3"}},
+		{"SELECT * WHERE name NOT IN ('alice', 'carol')", []string{"u2", "u4"}},
+		{"SELECT * WHERE tags = 'ops'", []string{"u1", "u2"}},
+		{"SELECT * WHERE tags != 'admin'", []string{"u2"}},
+		{"SELECT * WHERE _key >= 'u2' AND _key <= 'u3'", []string{"u2", "u3"}},
+		{"SELECT * WHERE _key IN ('u5', 'u1', 'u9')", []string{"u1", "u5"}},
+		{"SELECT * ORDER BY age", []string{"u5", "u2", "u1", "u3", "u4"}},
+		{"SELECT * ORDER BY age DESC LIMIT 2", []string{"u4", "u3"}},
+		{"SELECT * WHERE age < 100 ORDER BY name DESC", []string{"u3", "u2", "u1"}},
+		{"SELECT * LIMIT 2", []string{"u1", "u2"}},
+	}
+
+	check := func() {
+		t.Helper()
+		for _, test := range tests {
+			result, err := kv.Query(test.query)
+			if assert.NoError(t, err, test.query) {
+				assert.Equal(t, test.want, rowKeys(result.Rows), "%s (%s)", test.query, result.Plan)
+			}
+		}
+	}
+
+	// The same results with a full scan, and with secondary indexes
+	check()
+	assert.NoError(t, kv.Flush())
+	check()
+	assert.NoError(t, kv.CreateIndex("age", "age"))
+	assert.NoError(t, kv.CreateIndex("name", "$.name"))
+	assert.NoError(t, kv.CreateIndex("tags", "tags"))
+	check()
+
+	// Projection
+	result, err := kv.Query("SELECT _key, name, tags[0] WHERE age = 30")
+	assert.NoError(t, err)
+	if assert.Len(t, result.Rows, 1) {
+		assert.JSONEq(t, `{"_key": "u1", "name": "alice", "tags[0]": "admin"}`, string(result.Rows[0].Value))
+	}
+
+	_, err = kv.Query("SELECT * WHERE")
+	assert.ErrorIs(t, err, ErrBadQuery)
+}
+
+func TestQueryPlansAgree(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+
+	// Some of the names are too long for an index entry of their own
+	long := "l" + strings.Repeat("x", 2000)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("n%02d", i%7)
+		if i%3 == 0 {
+			name = fmt.Sprintf("%s%d", long, i%2)
+		}
+		value, _ := json.Marshal(map[string]interface{}{"name": name, "n": i})
+		assert.NoError(t, kv.Set(fmt.Sprintf("d%02d", i), value))
+		if i == 19 {
+			assert.NoError(t, kv.Flush())
+		}
+	}
+
+	queries := []string{
+		"SELECT * WHERE name = '" + long + "0' ORDER BY _key",
+		"SELECT * WHERE name IN ('n01', '" + long + "1') ORDER BY _key",
+		"SELECT * WHERE name >= 'l' AND name < 'n03' ORDER BY n",
+		"SELECT * WHERE name > 'a' ORDER BY name DESC LIMIT 5",
+		"SELECT count(*) WHERE name >= 'l'",
+		"SELECT name, count(*) WHERE name > 'a' GROUP BY name",
+	}
+	run := func(scan bool) []string {
+		t.Helper()
+		var rows []string
+		for _, query := range queries {
+			result, err := kv.Query(query)
+			if !assert.NoError(t, err, query) {
+				continue
+			}
+			assert.Equal(t, scan, result.Plan.Access == accessFullScan, query)
+			data, _ := json.Marshal(result.Rows)
+			rows = append(rows, string(data))
+		}
+		return rows
+	}
+
+	// With an index, the queries return what they did with a full scan, both
+	// for writes still in the write batch and once they have been flushed
+	scanned := run(true)
+	assert.NoError(t, kv.CreateIndex("name", "name"))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, scanned, run(false))
+		assert.NoError(t, kv.Flush())
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+
+	assert.NoError(t, kv.CreateIndex("age", "$.age"))
+	assert.NoError(t, kv.CreateIndex("name", "name"))
+
+	tests := []struct {
+		query  string
+		access string
+		index  string
+		ranges []string
+	}{
+		{"EXPLAIN SELECT *", accessFullScan, "", nil},
+		{"EXPLAIN SELECT * WHERE city = 'paris'", accessFullScan, "", nil},
+		{"EXPLAIN SELECT * WHERE age = 30 OR name = 'bob'", accessFullScan, "", nil},
+		{"EXPLAIN SELECT * WHERE age != 30", accessFullScan, "", nil},
+		{"EXPLAIN SELECT * WHERE age = null", accessFullScan, "", nil},
+		{"EXPLAIN SELECT * WHERE age = 30", accessIndexLookup, "age", []string{"= 30"}},
+		{"EXPLAIN SELECT * WHERE $.name IN ('b', 'a', 'b')", accessIndexLookup, "name", []string{"= 'a'", "= 'b'"}},
+		{"EXPLAIN SELECT * WHERE age > 20 AND name = 'bob'", accessIndexLookup, "name", []string{"= 'bob'"}},
+		{"EXPLAIN SELECT * WHERE age > 20 AND age <= 40 AND age >= 25", accessIndexRange, "age", []string{"25 to 40"}},
+		{"EXPLAIN SELECT * WHERE age < 20", accessIndexRange, "age", []string{"<= 20"}},
+		{"EXPLAIN SELECT * WHERE _key IN ('b', 'a') AND age = 30", accessKeyLookup, "", nil},
+		{"EXPLAIN SELECT * WHERE _key >= 'a' AND age > 30", accessKeyRange, "", nil},
+	}
+
+	for _, test := range tests {
+		result, err := kv.Query(test.query)
+		if !assert.NoError(t, err, test.query) {
+			continue
+		}
+		assert.Nil(t, result.Rows, test.query)
+		assert.Equal(t, test.access, result.Plan.Access, test.query)
+		assert.Equal(t, test.index, result.Plan.Index, test.query)
+		assert.Equal(t, test.ranges, result.Plan.Ranges, test.query)
+	}
+
+	result, err := kv.Query("EXPLAIN SELECT * WHERE age >= 30 AND city = 'paris' ORDER BY name DESC LIMIT 10")
+	assert.NoError(t, err)
+	assert.Equal(t, "index range on age [>= 30], filter (age >= 30 AND city = 'paris'), order by name DESC, limit 10", result.Plan.String())
+}
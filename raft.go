@@ -0,0 +1,804 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+// Raft keeps the stores of a cluster of nodes in step, so that a write
+// survives as long as a majority of the nodes do. One node is elected leader
+// and appends each write to its raft log as an entry, then replicates the
+// entry to the other nodes. Once a majority of the nodes have the entry it is
+// committed, and every node applies it to its store.
+//
+// The raft type here is the algorithm alone: it has no clock, network or
+// goroutines of its own. Time passes when tick is called, messages from other
+// nodes are handed to step, and the messages it wants to send pile up in msgs
+// for whoever drives it to deliver. That keeps it deterministic, so tests can
+// play out elections and partitions one tick at a time.
+//
+// Entries are given store versions as they are appended to the leader's log,
+// each numbered on from the writes before it, so every node gives a write the
+// same version. Conditional writes carry their conditions with them, and each
+// node checks them as it applies the entry, coming to the same answer as the
+// others. A write whose conditions fail leaves a gap in the versions.
+//
+// Membership changes one node at a time, through entries holding the new set
+// of members, which take effect as soon as they are appended to a log.
+//
+// Once enough entries have been applied, the log up to them is compacted
+// away, as the store already has what they wrote. A node too far behind for
+// the leader's log to catch it up is sent a snapshot of the leader's store
+// instead, a chunk at a time.
+
+// Most entries sent in a single append message
+const raftMaxEntries = 256
+
+// ErrNotLeader is returned when writing to a node of a raft cluster that is
+// not its leader.
+var ErrNotLeader = errors.New("not the raft leader")
+
+// ErrMembershipChangePending is returned when changing the members of a raft
+// cluster while an earlier change has yet to be committed.
+var ErrMembershipChangePending = errors.New("a membership change is already in progress")
+
+type raftRole int
+
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+func (r raftRole) String() string {
+	switch r {
+	case raftCandidate:
+		return "candidate"
+	case raftLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+type raftEntryType int
+
+const (
+	raftWrite      raftEntryType = iota + 1 // Operations to apply to the store
+	raftMembership                          // A new set of members
+	raftNoop                                // Appended by a new leader, to commit the entries before it
+)
+
+// RaftEntry is an entry in the raft log.
+type RaftEntry struct {
+	Index uint64
+	Term  uint64 // Term of the leader that appended it
+	Type  raftEntryType
+
+	// Version of the entry's first write. Entries without writes have the
+	// version the next write will have.
+	Seq uint64
+
+	Ops        []Operation       // For writes, the operations to apply together
+	Conditions []writeCondition  // For writes, what must hold for them to be applied
+	Members    map[string]string // For membership changes, the address of each member, by ID
+}
+
+// RaftSnapshot describes the state of a store as of an entry in the raft log.
+type RaftSnapshot struct {
+	Index   uint64            `json:"index"`
+	Term    uint64            `json:"term"`
+	Seq     uint64            `json:"seq"`     // Version of the store as of the entry
+	Members map[string]string `json:"members"` // Members as of the entry
+}
+
+type raftMessageType int
+
+const (
+	msgVote raftMessageType = iota + 1
+	msgVoteResp
+	msgApp
+	msgAppResp
+	msgHeartbeat
+	msgHeartbeatResp
+	msgSnap
+	msgSnapResp
+)
+
+// RaftMessage is a message between the nodes of a raft cluster. Responses are
+// messages of their own, rather than replies, so they can be sent the same way.
+type RaftMessage struct {
+	Type raftMessageType
+	From string
+	To   string
+	Term uint64
+
+	// For appends, the entry before Entries. For votes, the candidate's last
+	// entry. For append responses, the last entry that matches the leader's
+	// log, or the index of the entry before those rejected.
+	Index   uint64
+	LogTerm uint64 // Term of Index
+
+	Entries []RaftEntry
+	Commit  uint64 // Leader's commit index
+
+	Reject       bool
+	Hint         uint64 // For rejected appends, the follower's last index
+	NeedSnapshot bool   // For rejected appends, the follower can only catch up from a snapshot
+
+	// For snapshot chunks, the snapshot and the writes in the chunk, from
+	// key Start up to key Next. Responses ask for the chunk from Start.
+	Snapshot *RaftSnapshot
+	Ops      []Operation
+	Start    string
+	Next     string
+	Done     bool // Last chunk of the snapshot
+}
+
+// raftSnapshotter reads and restores snapshots of the store.
+type raftSnapshotter interface {
+	// readSnapshot returns a chunk of the snapshot being sent to a node,
+	// taking a new snapshot of what has been applied when start is empty.
+	// It returns the index of the last entry in the snapshot, the writes in
+	// the chunk, where the next chunk starts and whether this is the last.
+	readSnapshot(to string, start string) (uint64, []Operation, string, bool, error)
+	releaseSnapshot(to string)
+	restoreSnapshot(snapshot RaftSnapshot, ops []Operation, first bool, done bool) error
+}
+
+type progressState int
+
+const (
+	progressProbe     progressState = iota // Finding where the follower's log matches, one append at a time
+	progressReplicate                      // Sending entries as they are appended
+	progressSnapshot                       // Sending a snapshot
+)
+
+// raftProgress is the leader's view of a follower.
+type raftProgress struct {
+	match  uint64 // Last entry known to match the leader's log
+	next   uint64 // Next entry to send
+	state  progressState
+	paused bool // A probe is waiting for its response
+	active bool // Heard from since the leader last checked for a quorum
+
+	snapshot      *RaftSnapshot // Snapshot being sent
+	snapshotTicks int           // Ticks since the follower last asked for more of it
+}
+
+type raft struct {
+	id        string
+	storage   *raftStorage
+	snapshots raftSnapshotter
+
+	role   raftRole
+	term   uint64
+	vote   string
+	leader string
+
+	members      map[string]string
+	membersIndex uint64 // Entry the members were set by
+
+	commit  uint64 // Last entry known to be committed
+	applied uint64 // Last entry applied to the store
+
+	electionTimeout   int
+	heartbeatTimeout  int
+	randomizedTimeout int // Election timeout until the next election, between electionTimeout and twice it
+	electionElapsed   int
+	heartbeatElapsed  int
+	rand              *rand.Rand
+
+	votes    map[string]bool          // For candidates, the votes received
+	progress map[string]*raftProgress // For leaders, the progress of each follower
+
+	// For followers, the snapshot being restored and the key its next chunk
+	// starts at. Until it is restored, appends are turned away.
+	restoring    *RaftSnapshot
+	restoreNext  string
+	needSnapshot bool
+
+	msgs []RaftMessage // Messages waiting to be sent
+}
+
+// newRaft returns a follower with the state in the storage. Election timeouts
+// are randomised from the node ID, so they are the same every time.
+func newRaft(id string, storage *raftStorage, snapshots raftSnapshotter, electionTicks int, heartbeatTicks int) *raft {
+	r := &raft{
+		id:               id,
+		storage:          storage,
+		snapshots:        snapshots,
+		term:             storage.state.Term,
+		vote:             storage.state.Vote,
+		needSnapshot:     storage.state.Restoring,
+		commit:           storage.snapshot.Index,
+		applied:          storage.snapshot.Index,
+		electionTimeout:  electionTicks,
+		heartbeatTimeout: heartbeatTicks,
+		rand:             rand.New(rand.NewSource(int64(hashKey(id)))),
+	}
+	r.members, r.membersIndex = storage.membersAt(storage.lastIndex())
+	r.resetTimeout()
+	return r
+}
+
+// peers returns the IDs of the other members, in order.
+func (r *raft) peers() []string {
+	var peers []string
+	for id := range r.members {
+		if id != r.id {
+			peers = append(peers, id)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (r *raft) quorum() int {
+	return len(r.members)/2 + 1
+}
+
+func (r *raft) resetTimeout() {
+	r.randomizedTimeout = r.electionTimeout + r.rand.Intn(r.electionTimeout)
+}
+
+func (r *raft) persist() error {
+	return r.storage.setState(raftHardState{Term: r.term, Vote: r.vote, Restoring: r.needSnapshot})
+}
+
+func (r *raft) send(m RaftMessage) {
+	m.From, m.Term = r.id, r.term
+	r.msgs = append(r.msgs, m)
+}
+
+// tick moves the node's clock on. Followers and candidates start an election
+// once they have heard nothing for an election timeout. Leaders send
+// heartbeats, and step down if they stop hearing from a majority.
+func (r *raft) tick() error {
+	r.electionElapsed++
+	if r.role != raftLeader {
+		if r.electionElapsed >= r.randomizedTimeout {
+			return r.campaign()
+		}
+		return nil
+	}
+
+	if r.electionElapsed >= r.electionTimeout {
+		r.electionElapsed = 0
+		if !r.quorumActive() {
+			return r.becomeFollower(r.term, "")
+		}
+	}
+
+	for _, id := range r.peers() {
+		if pr := r.progress[id]; pr.state == progressSnapshot {
+			// The follower stopped asking for more of the snapshot
+			if pr.snapshotTicks++; pr.snapshotTicks >= r.electionTimeout {
+				r.abortSnapshot(id)
+			}
+		}
+	}
+
+	r.heartbeatElapsed++
+	if r.heartbeatElapsed >= r.heartbeatTimeout {
+		r.heartbeatElapsed = 0
+		for _, id := range r.peers() {
+			pr := r.progress[id]
+			commit := r.commit
+			if pr.match < commit {
+				commit = pr.match
+			}
+			r.send(RaftMessage{Type: msgHeartbeat, To: id, Commit: commit})
+		}
+	}
+	return nil
+}
+
+// quorumActive reports whether a majority of the members have been heard from
+// since it was last called.
+func (r *raft) quorumActive() bool {
+	active := 0
+	if _, ok := r.members[r.id]; ok {
+		active++
+	}
+	for _, pr := range r.progress {
+		if pr.active {
+			active++
+		}
+		pr.active = false
+	}
+	return active >= r.quorum()
+}
+
+func (r *raft) becomeFollower(term uint64, leader string) error {
+	if term > r.term {
+		r.term, r.vote = term, ""
+		if err := r.persist(); err != nil {
+			return err
+		}
+	}
+	if r.role == raftLeader {
+		for _, id := range r.peers() {
+			if r.progress[id].state == progressSnapshot {
+				r.snapshots.releaseSnapshot(id)
+			}
+		}
+	}
+
+	r.role, r.leader = raftFollower, leader
+	r.votes, r.progress = nil, nil
+	r.electionElapsed = 0
+	r.resetTimeout()
+	return nil
+}
+
+// campaign starts an election, unless the node is not a member or cannot be
+// trusted to lead until it has restored a snapshot.
+func (r *raft) campaign() error {
+	r.electionElapsed = 0
+	if _, ok := r.members[r.id]; !ok || r.needSnapshot {
+		return nil
+	}
+
+	r.term++
+	r.vote = r.id
+	if err := r.persist(); err != nil {
+		return err
+	}
+	r.role, r.leader = raftCandidate, ""
+	r.votes = map[string]bool{r.id: true}
+	r.resetTimeout()
+	if r.quorum() == 1 {
+		return r.becomeLeader()
+	}
+
+	lastIndex := r.storage.lastIndex()
+	lastTerm, _ := r.storage.term(lastIndex)
+	for _, id := range r.peers() {
+		r.send(RaftMessage{Type: msgVote, To: id, Index: lastIndex, LogTerm: lastTerm})
+	}
+	return nil
+}
+
+func (r *raft) becomeLeader() error {
+	r.role, r.leader = raftLeader, r.id
+	r.votes = nil
+	r.progress = make(map[string]*raftProgress)
+	for _, id := range r.peers() {
+		r.progress[id] = &raftProgress{next: r.storage.lastIndex() + 1, active: true}
+	}
+	r.electionElapsed, r.heartbeatElapsed = 0, 0
+
+	// Entries from earlier terms are only committed along with one from this term
+	_, err := r.propose(RaftEntry{Type: raftNoop})
+	return err
+}
+
+// propose appends the entry to the leader's log and starts replicating it,
+// returning it with its index, term and version.
+func (r *raft) propose(entry RaftEntry) (RaftEntry, error) {
+	if r.role != raftLeader {
+		return entry, ErrNotLeader
+	}
+	if entry.Type == raftMembership {
+		// Only one change at a time, and not until the leader has committed
+		// an entry of its own, so it knows the last change was committed
+		if term, _ := r.storage.term(r.commit); r.membersIndex > r.commit || term != r.term {
+			return entry, ErrMembershipChangePending
+		}
+	}
+
+	last := r.storage.lastIndex()
+	entry.Index, entry.Term, entry.Seq = last+1, r.term, r.storage.seqAfter(last)
+	if err := r.storage.append([]RaftEntry{entry}); err != nil {
+		return entry, err
+	}
+	if entry.Type == raftMembership {
+		r.setMembers(entry.Members, entry.Index)
+	}
+
+	if r.maybeCommit() {
+		return entry, r.committed()
+	}
+	for _, id := range r.peers() {
+		if err := r.sendAppend(id, false); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+// setMembers changes the members, and for a leader, which followers it tracks.
+func (r *raft) setMembers(members map[string]string, index uint64) {
+	r.members, r.membersIndex = members, index
+	if r.role != raftLeader {
+		return
+	}
+
+	for id, pr := range r.progress {
+		if _, ok := members[id]; !ok {
+			if pr.state == progressSnapshot {
+				r.snapshots.releaseSnapshot(id)
+			}
+			delete(r.progress, id)
+		}
+	}
+	for _, id := range r.peers() {
+		if r.progress[id] == nil {
+			r.progress[id] = &raftProgress{next: r.storage.lastIndex() + 1, active: true}
+		}
+	}
+}
+
+// maybeCommit moves the commit index on to the last entry a majority of the
+// members have, if it is from the leader's term, and reports whether it moved.
+func (r *raft) maybeCommit() bool {
+	var matches []uint64
+	for id := range r.members {
+		if id == r.id {
+			matches = append(matches, r.storage.lastIndex())
+		} else {
+			matches = append(matches, r.progress[id].match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+
+	n := matches[r.quorum()-1]
+	if n <= r.commit {
+		return false
+	}
+	if term, _ := r.storage.term(n); term != r.term {
+		return false
+	}
+	r.commit = n
+	return true
+}
+
+// committed tells the followers the commit index has moved on. A leader that
+// has been removed from the cluster steps down once its removal is committed.
+func (r *raft) committed() error {
+	for _, id := range r.peers() {
+		if err := r.sendAppend(id, true); err != nil {
+			return err
+		}
+	}
+	if _, ok := r.members[r.id]; !ok && r.membersIndex <= r.commit {
+		return r.becomeFollower(r.term, "")
+	}
+	return nil
+}
+
+// sendAppend sends the follower the entries it has yet to be sent, or a
+// snapshot if the log no longer has them. With empty set, it sends an append
+// even if there are no entries, to tell the follower the commit index.
+func (r *raft) sendAppend(to string, empty bool) error {
+	pr := r.progress[to]
+	if pr.state == progressSnapshot || pr.paused {
+		return nil
+	}
+
+	prevIndex := pr.next - 1
+	prevTerm, ok := r.storage.term(prevIndex)
+	if !ok {
+		return r.sendSnapshot(to)
+	}
+	entries := r.storage.entriesFrom(pr.next, raftMaxEntries)
+	if len(entries) == 0 && !empty {
+		return nil
+	}
+
+	r.send(RaftMessage{Type: msgApp, To: to, Index: prevIndex, LogTerm: prevTerm, Entries: entries, Commit: r.commit})
+	if pr.state == progressProbe {
+		pr.paused = true
+	} else if len(entries) > 0 {
+		pr.next = entries[len(entries)-1].Index + 1
+	}
+	return nil
+}
+
+// sendSnapshot starts sending the follower a snapshot of the leader's store.
+func (r *raft) sendSnapshot(to string) error {
+	index, ops, next, done, err := r.snapshots.readSnapshot(to, "")
+	if err != nil {
+		return err
+	}
+
+	term, _ := r.storage.term(index)
+	members, _ := r.storage.membersAt(index)
+	pr := r.progress[to]
+	pr.state, pr.snapshotTicks = progressSnapshot, 0
+	pr.snapshot = &RaftSnapshot{Index: index, Term: term, Seq: r.storage.seqAfter(index) - 1, Members: members}
+	r.send(RaftMessage{Type: msgSnap, To: to, Snapshot: pr.snapshot, Ops: ops, Next: next, Done: done})
+	return nil
+}
+
+// abortSnapshot gives up on sending a snapshot, so it can be started again.
+func (r *raft) abortSnapshot(to string) {
+	r.snapshots.releaseSnapshot(to)
+	pr := r.progress[to]
+	pr.state, pr.snapshot, pr.paused = progressProbe, nil, false
+	pr.next = pr.match + 1
+}
+
+// step handles a message from another node.
+func (r *raft) step(m RaftMessage) error {
+	switch {
+	case m.Term > r.term:
+		if m.Type == msgVote && r.leader != "" && r.electionElapsed < r.electionTimeout {
+			// The candidate may only have been cut off for a while, so it
+			// is ignored while the leader is still heard from
+			return nil
+		}
+		leader := ""
+		if m.Type == msgApp || m.Type == msgHeartbeat || m.Type == msgSnap {
+			leader = m.From
+		}
+		if err := r.becomeFollower(m.Term, leader); err != nil {
+			return err
+		}
+	case m.Term < r.term:
+		// Tell a stale leader or candidate about the new term, so it steps down
+		if m.Type == msgApp || m.Type == msgHeartbeat || m.Type == msgSnap {
+			r.send(RaftMessage{Type: msgAppResp, To: m.From, Reject: true})
+		} else if m.Type == msgVote {
+			r.send(RaftMessage{Type: msgVoteResp, To: m.From, Reject: true})
+		}
+		return nil
+	}
+
+	switch m.Type {
+	case msgVote:
+		return r.handleVote(m)
+	case msgVoteResp:
+		if r.role == raftCandidate {
+			return r.handleVoteResp(m)
+		}
+	case msgApp, msgHeartbeat, msgSnap:
+		if r.role == raftLeader {
+			return nil
+		}
+		if r.role == raftCandidate {
+			if err := r.becomeFollower(r.term, m.From); err != nil {
+				return err
+			}
+		}
+		r.leader, r.electionElapsed = m.From, 0
+
+		switch m.Type {
+		case msgApp:
+			return r.handleAppend(m)
+		case msgHeartbeat:
+			r.handleHeartbeat(m)
+		case msgSnap:
+			return r.handleSnapshot(m)
+		}
+	case msgAppResp, msgHeartbeatResp, msgSnapResp:
+		if r.role != raftLeader || r.progress[m.From] == nil {
+			return nil
+		}
+		r.progress[m.From].active = true
+
+		switch m.Type {
+		case msgAppResp:
+			return r.handleAppendResp(m)
+		case msgHeartbeatResp:
+			return r.handleHeartbeatResp(m)
+		case msgSnapResp:
+			return r.handleSnapshotResp(m)
+		}
+	}
+	return nil
+}
+
+// handleVote grants the vote if the node has not voted for anyone else in the
+// term and the candidate's log has everything the node's has.
+func (r *raft) handleVote(m RaftMessage) error {
+	lastIndex := r.storage.lastIndex()
+	lastTerm, _ := r.storage.term(lastIndex)
+	canVote := r.role == raftFollower && (r.vote == "" || r.vote == m.From)
+	upToDate := m.LogTerm > lastTerm || (m.LogTerm == lastTerm && m.Index >= lastIndex)
+	if !canVote || !upToDate {
+		r.send(RaftMessage{Type: msgVoteResp, To: m.From, Reject: true})
+		return nil
+	}
+
+	r.vote = m.From
+	if err := r.persist(); err != nil {
+		return err
+	}
+	r.electionElapsed = 0
+	r.send(RaftMessage{Type: msgVoteResp, To: m.From})
+	return nil
+}
+
+func (r *raft) handleVoteResp(m RaftMessage) error {
+	r.votes[m.From] = !m.Reject
+
+	granted, rejected := 0, 0
+	for id := range r.members {
+		if vote, ok := r.votes[id]; ok && vote {
+			granted++
+		} else if ok {
+			rejected++
+		}
+	}
+	if granted >= r.quorum() {
+		return r.becomeLeader()
+	} else if rejected >= r.quorum() {
+		return r.becomeFollower(r.term, "")
+	}
+	return nil
+}
+
+// handleAppend appends the leader's entries, if the log matches the leader's
+// up to the entry before them, replacing any that conflict.
+func (r *raft) handleAppend(m RaftMessage) error {
+	if r.needSnapshot {
+		r.send(RaftMessage{Type: msgAppResp, To: m.From, Index: m.Index, Reject: true, NeedSnapshot: true})
+		return nil
+	}
+	if m.Index < r.commit {
+		// Everything up to the commit index already matches
+		r.send(RaftMessage{Type: msgAppResp, To: m.From, Index: r.commit})
+		return nil
+	}
+	if term, ok := r.storage.term(m.Index); !ok || term != m.LogTerm {
+		r.send(RaftMessage{Type: msgAppResp, To: m.From, Index: m.Index, Reject: true, Hint: r.storage.lastIndex()})
+		return nil
+	}
+
+	for i, entry := range m.Entries {
+		if term, ok := r.storage.term(entry.Index); !ok || term != entry.Term {
+			if err := r.storage.append(m.Entries[i:]); err != nil {
+				return err
+			}
+			r.members, r.membersIndex = r.storage.membersAt(r.storage.lastIndex())
+			break
+		}
+	}
+
+	last := m.Index + uint64(len(m.Entries))
+	if m.Commit > r.commit {
+		r.commit = minUint64(m.Commit, last)
+	}
+	r.send(RaftMessage{Type: msgAppResp, To: m.From, Index: last})
+	return nil
+}
+
+// handleHeartbeat moves the commit index on. The leader only sends a commit
+// index up to the entries it knows the follower has.
+func (r *raft) handleHeartbeat(m RaftMessage) {
+	if !r.needSnapshot && m.Commit > r.commit {
+		r.commit = minUint64(m.Commit, r.storage.lastIndex())
+	}
+	r.send(RaftMessage{Type: msgHeartbeatResp, To: m.From})
+}
+
+// handleSnapshot restores a chunk of a snapshot. Once the last chunk is
+// restored, the log is replaced by the snapshot.
+func (r *raft) handleSnapshot(m RaftMessage) error {
+	snapshot := *m.Snapshot
+	first := m.Start == ""
+	if first {
+		if snapshot.Index <= r.commit && !r.needSnapshot {
+			r.send(RaftMessage{Type: msgAppResp, To: m.From, Index: r.commit})
+			return nil
+		}
+		r.restoring, r.needSnapshot = &snapshot, true
+		if err := r.persist(); err != nil {
+			return err
+		}
+	} else if r.restoring == nil || r.restoring.Index != snapshot.Index || r.restoreNext != m.Start {
+		// A chunk went missing, so the snapshot has to be started again
+		r.send(RaftMessage{Type: msgSnapResp, To: m.From, Index: snapshot.Index, Reject: true})
+		return nil
+	}
+
+	if err := r.snapshots.restoreSnapshot(snapshot, m.Ops, first, m.Done); err != nil {
+		r.restoring = nil
+		r.send(RaftMessage{Type: msgSnapResp, To: m.From, Index: snapshot.Index, Reject: true})
+		return err
+	}
+	if !m.Done {
+		r.restoreNext = m.Next
+		r.send(RaftMessage{Type: msgSnapResp, To: m.From, Index: snapshot.Index, Start: m.Next})
+		return nil
+	}
+
+	if err := r.storage.restore(snapshot); err != nil {
+		return err
+	}
+	r.restoring, r.needSnapshot = nil, false
+	if err := r.persist(); err != nil {
+		return err
+	}
+	r.commit, r.applied = snapshot.Index, snapshot.Index
+	r.members, r.membersIndex = snapshot.Members, snapshot.Index
+	r.send(RaftMessage{Type: msgAppResp, To: m.From, Index: snapshot.Index})
+	return nil
+}
+
+func (r *raft) handleAppendResp(m RaftMessage) error {
+	pr := r.progress[m.From]
+	if m.NeedSnapshot {
+		if pr.state != progressSnapshot {
+			return r.sendSnapshot(m.From)
+		}
+		return nil
+	}
+
+	if m.Reject {
+		// Rejections of appends other than the last probe are stale
+		if pr.state == progressSnapshot || m.Index <= pr.match || (pr.state == progressProbe && m.Index != pr.next-1) {
+			return nil
+		}
+		pr.next = maxUint64(pr.match+1, minUint64(m.Index, m.Hint+1))
+		pr.state, pr.paused = progressProbe, false
+		return r.sendAppend(m.From, true)
+	}
+
+	if pr.state == progressSnapshot {
+		r.snapshots.releaseSnapshot(m.From)
+		pr.snapshot = nil
+	}
+	if m.Index > pr.match {
+		pr.match = m.Index
+	}
+	if pr.next <= pr.match {
+		pr.next = pr.match + 1
+	}
+	pr.state, pr.paused = progressReplicate, false
+
+	if r.maybeCommit() {
+		return r.committed()
+	}
+	return r.sendAppend(m.From, false)
+}
+
+// handleHeartbeatResp sends a follower that is behind the entries it is
+// missing, starting again from the last one it is known to have, in case
+// appends were lost.
+func (r *raft) handleHeartbeatResp(m RaftMessage) error {
+	pr := r.progress[m.From]
+	if pr.state == progressSnapshot || pr.match >= r.storage.lastIndex() {
+		return nil
+	}
+	pr.state, pr.paused, pr.next = progressProbe, false, pr.match+1
+	return r.sendAppend(m.From, true)
+}
+
+// handleSnapshotResp sends the next chunk of a snapshot, or starts it again if
+// the follower lost track of it.
+func (r *raft) handleSnapshotResp(m RaftMessage) error {
+	pr := r.progress[m.From]
+	if pr.state != progressSnapshot || pr.snapshot.Index != m.Index {
+		return nil
+	}
+	if m.Reject {
+		r.abortSnapshot(m.From)
+		return nil
+	}
+
+	_, ops, next, done, err := r.snapshots.readSnapshot(m.From, m.Start)
+	if err != nil {
+		r.abortSnapshot(m.From)
+		return err
+	}
+	pr.snapshotTicks = 0
+	r.send(RaftMessage{Type: msgSnap, To: m.From, Snapshot: pr.snapshot, Ops: ops, Start: m.Start, Next: next, Done: done})
+	return nil
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint64(a uint64, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
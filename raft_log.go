@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A node keeps its raft state in a directory of its own:
+//
+//	state     the current term, who the node voted for in it, and whether it
+//	          is part way through restoring a snapshot, as JSON
+//	snapshot  the index, term and store version of the last entry compacted
+//	          out of the log, and the members as of it, as JSON
+//	log       the entries after it, gob encoded and framed as in the
+//	          write-ahead log, sealed with the keyring if there is one
+//
+// Every change is synced before it returns, as a node must not forget a vote
+// or an entry it has acknowledged.
+
+const (
+	raftStateFile    = "state"
+	raftSnapshotFile = "snapshot"
+	raftLogFile      = "log"
+)
+
+// raftHardState is what a node must remember across restarts, besides its log.
+type raftHardState struct {
+	Term      uint64 `json:"term"`
+	Vote      string `json:"vote,omitempty"`
+	Restoring bool   `json:"restoring,omitempty"` // A snapshot was being restored, so the store cannot be trusted until one is
+}
+
+// raftStorage is a node's persistent raft state and log.
+type raftStorage struct {
+	dir  string
+	keys *Keyring
+
+	state    raftHardState
+	snapshot RaftSnapshot
+	entries  []RaftEntry // Entries after the snapshot, in order
+	offsets  []int64     // Where each entry starts in the log file
+
+	file *os.File
+	size int64
+}
+
+// openRaftStorage opens the raft state in dir, creating it with the members
+// if the node has never been started before.
+func openRaftStorage(dir string, keys *Keyring, members map[string]string) (*raftStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &raftStorage{dir: dir, keys: keys}
+
+	if err := readJSONFile(filepath.Join(dir, raftStateFile), &s.state); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading raft state: %w", err)
+	}
+	err := readJSONFile(filepath.Join(dir, raftSnapshotFile), &s.snapshot)
+	if os.IsNotExist(err) {
+		s.snapshot.Members = members
+		err = writeJSONFile(filepath.Join(dir, raftSnapshotFile), &s.snapshot)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading raft snapshot: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, raftLogFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for pos := int64(0); pos < int64(len(data)); {
+		// A torn entry at the end was never acknowledged, so it is dropped
+		start := pos
+		payload, next, err := readFrame(data, pos)
+		if err == errWALTorn {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entry, err := s.decodeEntry(payload)
+		if err != nil {
+			return nil, fmt.Errorf("reading raft log: %w", err)
+		}
+		pos = next
+		s.size = next
+
+		// Entries the snapshot covers are left behind if the node stopped
+		// part way through compacting the log
+		if entry.Index <= s.snapshot.Index {
+			if len(s.entries) > 0 {
+				return nil, fmt.Errorf("raft log entry %d follows entry %d", entry.Index, s.lastIndex())
+			}
+			continue
+		}
+		if entry.Index != s.lastIndex()+1 {
+			return nil, fmt.Errorf("raft log entry %d follows entry %d", entry.Index, s.lastIndex())
+		}
+		s.entries = append(s.entries, entry)
+		s.offsets = append(s.offsets, start)
+	}
+
+	s.file, err = os.OpenFile(filepath.Join(dir, raftLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.file.Truncate(s.size); err != nil {
+		return nil, err
+	}
+	if _, err := s.file.Seek(s.size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readJSONFile decodes the JSON file into v.
+func readJSONFile(filename string, v interface{}) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile replaces the file with v encoded as JSON, all at once.
+func writeJSONFile(filename string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAndSync(filename+".tmp", data); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// encodeEntry returns the entry gob encoded. In an encrypted log it is sealed,
+// bound to its index, which is written in the clear in front of it.
+func (s *raftStorage) encodeEntry(entry *RaftEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return nil, err
+	}
+	if s.keys == nil {
+		return buf.Bytes(), nil
+	}
+	header := binary.BigEndian.AppendUint64(nil, entry.Index)
+	return append(header, s.keys.seal(buf.Bytes(), header)...), nil
+}
+
+func (s *raftStorage) decodeEntry(payload []byte) (RaftEntry, error) {
+	var entry RaftEntry
+	if s.keys != nil {
+		if len(payload) < 8 {
+			return entry, errWALTorn
+		}
+		opened, err := s.keys.open(payload[8:], payload[:8])
+		if err != nil {
+			return entry, err
+		}
+		payload = opened
+	}
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entry)
+	return entry, err
+}
+
+// setState records the term, vote and restoring flag.
+func (s *raftStorage) setState(state raftHardState) error {
+	if state == s.state {
+		return nil
+	}
+	if err := writeJSONFile(filepath.Join(s.dir, raftStateFile), &state); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+// firstIndex returns the index of the first entry in the log.
+func (s *raftStorage) firstIndex() uint64 {
+	return s.snapshot.Index + 1
+}
+
+// lastIndex returns the index of the last entry in the log, or of the
+// snapshot if the log is empty.
+func (s *raftStorage) lastIndex() uint64 {
+	return s.snapshot.Index + uint64(len(s.entries))
+}
+
+// term returns the term of the entry at the index, if the log still has it.
+// The term of the last entry compacted away is kept along with the snapshot.
+func (s *raftStorage) term(index uint64) (uint64, bool) {
+	if index == s.snapshot.Index {
+		return s.snapshot.Term, true
+	}
+	if index < s.firstIndex() || index > s.lastIndex() {
+		return 0, false
+	}
+	return s.entries[index-s.firstIndex()].Term, true
+}
+
+// entry returns the entry at the index, which must be in the log.
+func (s *raftStorage) entry(index uint64) *RaftEntry {
+	return &s.entries[index-s.firstIndex()]
+}
+
+// entriesFrom returns up to n entries from the index on.
+func (s *raftStorage) entriesFrom(index uint64, n int) []RaftEntry {
+	if index > s.lastIndex() {
+		return nil
+	}
+	entries := s.entries[index-s.firstIndex():]
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return append([]RaftEntry(nil), entries...)
+}
+
+// seqAfter returns the store version the first write after the entry at the
+// index is given.
+func (s *raftStorage) seqAfter(index uint64) uint64 {
+	if index == s.snapshot.Index {
+		return s.snapshot.Seq + 1
+	}
+	entry := s.entry(index)
+	return entry.Seq + uint64(len(entry.Ops))
+}
+
+// membersAt returns the members as of the entry at the index, and the index
+// of the entry that set them, or of the snapshot.
+func (s *raftStorage) membersAt(index uint64) (map[string]string, uint64) {
+	for i := index; i > s.snapshot.Index; i-- {
+		if entry := s.entry(i); entry.Type == raftMembership {
+			return entry.Members, i
+		}
+	}
+	return s.snapshot.Members, s.snapshot.Index
+}
+
+// append writes the entries to the log, replacing any entries from the first
+// of their indexes on.
+func (s *raftStorage) append(entries []RaftEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first := entries[0].Index
+	if first <= s.snapshot.Index || first > s.lastIndex()+1 {
+		return fmt.Errorf("raft log entry %d does not follow on from entries %d to %d", first, s.firstIndex(), s.lastIndex())
+	}
+
+	if first <= s.lastIndex() {
+		i := first - s.firstIndex()
+		if err := s.file.Truncate(s.offsets[i]); err != nil {
+			return err
+		}
+		if _, err := s.file.Seek(s.offsets[i], io.SeekStart); err != nil {
+			return err
+		}
+		s.size = s.offsets[i]
+		s.entries, s.offsets = s.entries[:i], s.offsets[:i]
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]int64, len(entries))
+	for i := range entries {
+		payload, err := s.encodeEntry(&entries[i])
+		if err != nil {
+			return err
+		}
+		offsets[i] = s.size + int64(buf.Len())
+		writeFrame(&buf, payload)
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+
+	s.entries = append(s.entries, entries...)
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(buf.Len())
+	return nil
+}
+
+// compact drops the entries up to the index from the log, once the store has
+// everything they wrote.
+func (s *raftStorage) compact(index uint64) error {
+	if index <= s.snapshot.Index {
+		return nil
+	}
+	term, _ := s.term(index)
+	members, _ := s.membersAt(index)
+	snapshot := RaftSnapshot{Index: index, Term: term, Seq: s.seqAfter(index) - 1, Members: members}
+	return s.reset(snapshot, s.entries[index-s.firstIndex()+1:])
+}
+
+// restore replaces the whole log with a snapshot restored from the leader.
+func (s *raftStorage) restore(snapshot RaftSnapshot) error {
+	return s.reset(snapshot, nil)
+}
+
+// reset writes the snapshot, and then rewrites the log with the entries.
+func (s *raftStorage) reset(snapshot RaftSnapshot, entries []RaftEntry) error {
+	if err := writeJSONFile(filepath.Join(s.dir, raftSnapshotFile), &snapshot); err != nil {
+		return err
+	}
+
+	// If the node stops before the new log replaces the old one, the old
+	// entries the snapshot covers are skipped when it is opened again
+	entries = append([]RaftEntry(nil), entries...)
+	s.snapshot, s.entries, s.offsets = snapshot, nil, nil
+
+	var buf bytes.Buffer
+	for i := range entries {
+		payload, err := s.encodeEntry(&entries[i])
+		if err != nil {
+			return err
+		}
+		s.offsets = append(s.offsets, int64(buf.Len()))
+		writeFrame(&buf, payload)
+	}
+	filename := filepath.Join(s.dir, raftLogFile)
+	if err := writeFileAndSync(filename+".tmp", buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.entries, s.size = file, entries, int64(buf.Len())
+	return nil
+}
+
+func (s *raftStorage) close() error {
+	return s.file.Close()
+}
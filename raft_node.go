@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrProposalDropped is returned when a write was appended to the log of a
+// leader that lost its leadership before the write was committed.
+var ErrProposalDropped = errors.New("write was dropped by a change of raft leader")
+
+// ErrProposalTimeout is returned when a write was not committed in time. It
+// may still be committed later.
+var ErrProposalTimeout = errors.New("timed out waiting for the raft cluster to commit the write")
+
+// ErrNotRaft is returned when changing the members of a store that is not
+// part of a raft cluster.
+var ErrNotRaft = errors.New("store is not part of a raft cluster")
+
+var errRaftStopped = errors.New("raft node has stopped")
+
+const (
+	DefaultRaftTickInterval    = 100 * time.Millisecond
+	DefaultRaftElectionTicks   = 10
+	DefaultRaftHeartbeatTicks  = 1
+	DefaultRaftSnapshotEntries = 10000
+	DefaultRaftProposalTimeout = 5 * time.Second
+)
+
+// RaftConfig configures a store's node in a raft cluster.
+type RaftConfig struct {
+	ID string
+
+	// Address of every member of the cluster by ID, including this node, for
+	// when the cluster is first started. Afterwards the members are kept in
+	// the raft log, and changed with AddMember and RemoveMember. A node that
+	// is joining an existing cluster starts with the members it is joining,
+	// not including itself, so it can answer the leader.
+	Peers map[string]string
+
+	// Directory the raft log and state are kept in. By default this is the
+	// data filename with a ".raft" suffix.
+	Dir string
+
+	// Transport carries messages between the nodes. By default they are
+	// posted to /api/raft/messages on each node's address, a base URL such
+	// as "http://node1:8080".
+	Transport RaftTransport
+
+	TickInterval    time.Duration // How often the raft clock ticks
+	ElectionTicks   int           // Ticks without hearing from a leader before a node stands for election
+	HeartbeatTicks  int           // Ticks between a leader's heartbeats
+	SnapshotEntries int           // Entries applied before the log is compacted
+	ProposalTimeout time.Duration // How long writes wait to be committed
+
+	manualTick bool // Only tick when the tests say so
+}
+
+// WithRaft makes the store a node of a raft cluster. Writes are sent to the
+// leader's log and applied to every node's store once a majority of the nodes
+// have them. Writes to a node that is not the leader fail with ErrNotLeader.
+func WithRaft(config RaftConfig) StoreOption {
+	return func(o *storeOptions) {
+		o.raft = &config
+	}
+}
+
+// ParseRaftPeers parses members of a raft cluster given as id=url pairs
+// separated by commas, such as "n1=http://localhost:8081,n2=http://localhost:8082".
+func ParseRaftPeers(text string) (map[string]string, error) {
+	return parseAddrs(text, "raft peer")
+}
+
+// raftNode drives the raft algorithm for a store: it ticks its clock, passes
+// it messages from the transport, sends the messages it produces and applies
+// committed entries to the store.
+type raftNode struct {
+	store     *Store
+	transport RaftTransport
+	config    RaftConfig
+
+	mu        sync.Mutex
+	raft      *raft
+	addrs     map[string]string        // Addresses of every node seen, by ID, so removed nodes can be answered
+	proposals map[uint64]*raftProposal // Writes waiting to be committed, by index
+	sending   map[string]*Snapshot     // Snapshots of the store being sent, by node
+	restoring *snapshotLoad            // The snapshot being restored
+	stopped   bool
+
+	stop      chan struct{} // Closed to stop the ticker
+	done      chan struct{} // Closed once the ticker has stopped
+	closeOnce sync.Once
+}
+
+type raftProposal struct {
+	term   uint64
+	result chan error
+}
+
+// startRaft opens the node's raft log and starts it as a follower.
+func startRaft(store *Store, config RaftConfig) (*raftNode, error) {
+	if config.TickInterval <= 0 {
+		config.TickInterval = DefaultRaftTickInterval
+	}
+	if config.ElectionTicks <= 0 {
+		config.ElectionTicks = DefaultRaftElectionTicks
+	}
+	if config.HeartbeatTicks <= 0 {
+		config.HeartbeatTicks = DefaultRaftHeartbeatTicks
+	}
+	if config.SnapshotEntries <= 0 {
+		config.SnapshotEntries = DefaultRaftSnapshotEntries
+	}
+	if config.ProposalTimeout <= 0 {
+		config.ProposalTimeout = DefaultRaftProposalTimeout
+	}
+	if config.Transport == nil {
+		config.Transport = newHTTPRaftTransport()
+	}
+
+	storage, err := openRaftStorage(config.Dir, store.Buffer.Disk.keys, config.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &raftNode{
+		store:     store,
+		transport: config.Transport,
+		config:    config,
+		addrs:     make(map[string]string),
+		proposals: make(map[uint64]*raftProposal),
+		sending:   make(map[string]*Snapshot),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	n.raft = newRaft(config.ID, storage, n, config.ElectionTicks, config.HeartbeatTicks)
+	for id, addr := range config.Peers {
+		n.addrs[id] = addr
+	}
+
+	n.transport.Receive(n.step)
+	if config.manualTick {
+		close(n.done)
+	} else {
+		go n.run()
+	}
+	return n, nil
+}
+
+func (n *raftNode) run() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(n.config.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.tick()
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+func (n *raftNode) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return
+	}
+	if err := n.raft.tick(); err != nil {
+		fmt.Println("Error in raft:", err)
+	}
+	n.ready()
+}
+
+// step passes a message from another node to the raft algorithm.
+func (n *raftNode) step(m RaftMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped || m.To != n.raft.id {
+		return
+	}
+	if err := n.raft.step(m); err != nil {
+		fmt.Println("Error in raft:", err)
+	}
+	n.ready()
+}
+
+// ready applies the entries that have been committed, compacts the log once
+// enough have been and sends the messages the algorithm has produced. It must
+// be called with the node's lock held.
+func (n *raftNode) ready() {
+	for n.raft.applied < n.raft.commit {
+		index := n.raft.applied + 1
+		entry := n.raft.storage.entry(index)
+		err := n.store.applyEntry(entry)
+		if err != nil && !isConditionError(err) {
+			fmt.Println("Error applying raft entry:", err)
+		}
+		n.raft.applied = index
+
+		if p, ok := n.proposals[index]; ok {
+			delete(n.proposals, index)
+			if p.term != entry.Term {
+				err = ErrProposalDropped
+			}
+			p.result <- err
+		}
+	}
+
+	if n.raft.applied-n.raft.storage.snapshot.Index >= uint64(n.config.SnapshotEntries) {
+		// The store's log has to keep the writes the raft log no longer will
+		err := n.store.WAL.Sync()
+		if err == nil {
+			err = n.raft.storage.compact(n.raft.applied)
+		}
+		if err != nil {
+			fmt.Println("Error compacting raft log:", err)
+		}
+	}
+
+	for id, addr := range n.raft.members {
+		n.addrs[id] = addr
+	}
+	msgs := n.raft.msgs
+	n.raft.msgs = nil
+	for _, m := range msgs {
+		if addr, ok := n.addrs[m.To]; ok {
+			n.transport.Send(addr, m)
+		}
+	}
+}
+
+// isConditionError reports whether the error is from a condition of a write
+// not holding, rather than from failing to apply it.
+func isConditionError(err error) bool {
+	switch err {
+	case ErrKeyNotFound, ErrKeyExists, ErrVersionMismatch, ErrTxnConflict, errNotExpired:
+		return true
+	}
+	return false
+}
+
+// propose appends the entry to the leader's log and waits for it to be
+// committed and applied, returning it as it was appended and the result of
+// applying it.
+func (n *raftNode) propose(entry RaftEntry) (RaftEntry, error) {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return entry, errRaftStopped
+	}
+	entry, err := n.raft.propose(entry)
+	if err != nil {
+		n.mu.Unlock()
+		return entry, err
+	}
+	p := &raftProposal{term: entry.Term, result: make(chan error, 1)}
+	n.proposals[entry.Index] = p
+	n.ready()
+	n.mu.Unlock()
+
+	timeout := time.NewTimer(n.config.ProposalTimeout)
+	defer timeout.Stop()
+	select {
+	case err := <-p.result:
+		return entry, err
+	case <-timeout.C:
+		n.mu.Lock()
+		if n.proposals[entry.Index] == p {
+			delete(n.proposals, entry.Index)
+		}
+		n.mu.Unlock()
+		return entry, ErrProposalTimeout
+	}
+}
+
+// write proposes the operations and waits for them to be applied, returning
+// the error from the first of the conditions that did not hold, if any. The
+// operations are given the versions they were written at.
+func (n *raftNode) write(ops []Operation, conditions []writeCondition) error {
+	// The log keeps its own copy, as the operations are numbered afterwards
+	entry, err := n.propose(RaftEntry{Type: raftWrite, Ops: append([]Operation(nil), ops...), Conditions: conditions})
+	if err != nil {
+		return err
+	}
+	for i := range ops {
+		ops[i].Seq = entry.Seq + uint64(i)
+	}
+	return nil
+}
+
+// changeMembers proposes the members with the change made to them.
+func (n *raftNode) changeMembers(change func(members map[string]string) error) error {
+	n.mu.Lock()
+	members := make(map[string]string, len(n.raft.members))
+	for id, addr := range n.raft.members {
+		members[id] = addr
+	}
+	n.mu.Unlock()
+
+	if err := change(members); err != nil {
+		return err
+	}
+	_, err := n.propose(RaftEntry{Type: raftMembership, Members: members})
+	return err
+}
+
+func (n *raftNode) isLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.raft.role == raftLeader
+}
+
+// leaderAddr returns the address of the leader, if one is known.
+func (n *raftNode) leaderAddr() (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	addr, ok := n.addrs[n.raft.leader]
+	return addr, ok && n.raft.leader != ""
+}
+
+// readSnapshot implements raftSnapshotter, reading the snapshot a chunk at a
+// time from a snapshot of the store as of the last entry applied.
+func (n *raftNode) readSnapshot(to string, start string) (uint64, []Operation, string, bool, error) {
+	if start == "" {
+		n.releaseSnapshot(to)
+		n.sending[to] = n.store.Snapshot()
+	}
+	snapshot, ok := n.sending[to]
+	if !ok {
+		return 0, nil, "", false, fmt.Errorf("no snapshot is being sent to %s", to)
+	}
+
+	ops, next, done, err := n.store.snapshotChunk(start, snapshot.version, scanChunkSize)
+	return n.raft.applied, ops, next, done, err
+}
+
+func (n *raftNode) releaseSnapshot(to string) {
+	if snapshot, ok := n.sending[to]; ok {
+		snapshot.Release()
+		delete(n.sending, to)
+	}
+}
+
+// restoreSnapshot implements raftSnapshotter, loading the chunks of the
+// snapshot into the store as the follower does.
+func (n *raftNode) restoreSnapshot(snapshot RaftSnapshot, ops []Operation, first bool, done bool) error {
+	if first {
+		// Everything written before the snapshot started is deleted once
+		// it is restored, unless the snapshot writes it again
+		if err := n.store.Flush(); err != nil {
+			return err
+		}
+		n.restoring = &snapshotLoad{}
+	}
+
+	if err := n.store.loadSnapshot(n.restoring, ops); err != nil {
+		return err
+	}
+	if done {
+		return n.store.finishSnapshot(n.restoring, snapshot.Seq)
+	}
+	return nil
+}
+
+// close stops the node. Writes waiting to be committed fail.
+func (n *raftNode) close() error {
+	n.closeOnce.Do(func() {
+		close(n.stop)
+	})
+	<-n.done
+	err := n.transport.Close()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stopped = true
+	for index, p := range n.proposals {
+		p.result <- errRaftStopped
+		delete(n.proposals, index)
+	}
+	for to := range n.sending {
+		n.releaseSnapshot(to)
+	}
+	if closeErr := n.raft.storage.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// applyEntry applies a committed write to the store, if its conditions hold,
+// giving its operations the versions they were given in the log. A write the
+// store already has from before it was restarted is skipped.
+func (s *Store) applyEntry(entry *RaftEntry) error {
+	if entry.Type != raftWrite || entry.Seq <= s.WAL.LastSeq() {
+		return nil
+	}
+	ops := make([]Operation, len(entry.Ops))
+	for i, op := range entry.Ops {
+		op.Seq = entry.Seq + uint64(i)
+		ops[i] = op
+	}
+
+	s.Mutex.Lock()
+	if err := s.check(entry.Conditions, ops[0].Time); err != nil {
+		s.Mutex.Unlock()
+		return err
+	}
+	if err := s.WAL.appendReplicated(ops); err != nil {
+		s.Mutex.Unlock()
+		return err
+	}
+	s.snapshots.recordWrites(ops)
+	s.trackExpiry(ops)
+	s.Buffer.BatchPut(ops)
+	s.Mutex.Unlock()
+	return nil
+}
+
+// RaftStatus is a node's view of its raft cluster.
+type RaftStatus struct {
+	ID            string                  `json:"id"`
+	Role          string                  `json:"role"`
+	Term          uint64                  `json:"term"`
+	Leader        string                  `json:"leader,omitempty"`
+	LeaderAddr    string                  `json:"leaderAddr,omitempty"`
+	Members       map[string]string       `json:"members"`
+	Commit        uint64                  `json:"commit"`
+	Applied       uint64                  `json:"applied"`
+	LastIndex     uint64                  `json:"lastIndex"`
+	SnapshotIndex uint64                  `json:"snapshotIndex"`
+	Restoring     bool                    `json:"restoring,omitempty"`
+	Progress      map[string]RaftProgress `json:"progress,omitempty"` // For the leader, how far each follower has got
+}
+
+// RaftProgress is how far a follower has got, as far as the leader knows.
+type RaftProgress struct {
+	Match uint64 `json:"match"`
+	Next  uint64 `json:"next"`
+	State string `json:"state"`
+}
+
+// RaftStatus returns the state of the store's raft node. It returns false if
+// the store is not part of a raft cluster.
+func (s *Store) RaftStatus() (RaftStatus, bool) {
+	if s.raft == nil {
+		return RaftStatus{}, false
+	}
+	n := s.raft
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r := n.raft
+	status := RaftStatus{
+		ID:            r.id,
+		Role:          r.role.String(),
+		Term:          r.term,
+		Leader:        r.leader,
+		LeaderAddr:    r.members[r.leader],
+		Members:       make(map[string]string, len(r.members)),
+		Commit:        r.commit,
+		Applied:       r.applied,
+		LastIndex:     r.storage.lastIndex(),
+		SnapshotIndex: r.storage.snapshot.Index,
+		Restoring:     r.needSnapshot,
+	}
+	for id, addr := range r.members {
+		status.Members[id] = addr
+	}
+	if r.role == raftLeader {
+		status.Progress = make(map[string]RaftProgress, len(r.progress))
+		for id, pr := range r.progress {
+			status.Progress[id] = RaftProgress{Match: pr.match, Next: pr.next, State: []string{"probe", "replicate", "snapshot"}[pr.state]}
+		}
+	}
+	return status, true
+}
+
+// AddMember adds the node with the ID at the address to the cluster, or moves
+// an existing member to the address. The new node should be started with the
+// existing members as its peers, and catches up from the leader. It must be
+// called on the leader.
+func (s *Store) AddMember(id string, addr string) error {
+	if s.raft == nil {
+		return ErrNotRaft
+	}
+	return s.raft.changeMembers(func(members map[string]string) error {
+		members[id] = addr
+		return nil
+	})
+}
+
+// RemoveMember removes the node with the ID from the cluster. It must be
+// called on the leader. A leader that removes itself steps down once the
+// change is committed.
+func (s *Store) RemoveMember(id string) error {
+	if s.raft == nil {
+		return ErrNotRaft
+	}
+	return s.raft.changeMembers(func(members map[string]string) error {
+		if _, ok := members[id]; !ok {
+			return fmt.Errorf("%q is not a member", id)
+		}
+		if len(members) == 1 {
+			return errors.New("cannot remove the last member")
+		}
+		delete(members, id)
+		return nil
+	})
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// raftTestCluster runs raft nodes over an in-memory network, ticking them
+// only when the test says so.
+type raftTestCluster struct {
+	t       *testing.T
+	network *MemNetwork
+	peers   map[string]string
+	dirs    map[string]string
+	stores  map[string]*Store
+	config  RaftConfig
+	options []StoreOption // Passed to every store as it starts
+}
+
+func newRaftTestCluster(t *testing.T, config RaftConfig, ids ...string) *raftTestCluster {
+	c := &raftTestCluster{
+		t:       t,
+		network: NewMemNetwork(),
+		peers:   make(map[string]string),
+		dirs:    make(map[string]string),
+		stores:  make(map[string]*Store),
+		config:  config,
+	}
+	for _, id := range ids {
+		c.peers[id] = "http://" + id
+	}
+	for _, id := range ids {
+		c.start(id, c.peers)
+	}
+	t.Cleanup(func() {
+		for id := range c.stores {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts the node, or restarts it with the state it stopped with.
+func (c *raftTestCluster) start(id string, peers map[string]string) *Store {
+	if c.dirs[id] == "" {
+		c.dirs[id] = c.t.TempDir()
+	}
+	config := c.config
+	config.ID, config.Peers = id, peers
+	config.Transport = c.network.Transport("http://" + id)
+	config.manualTick = true
+	options := append([]StoreOption{WithRaft(config), WithExpirySweepInterval(0)}, c.options...)
+	c.stores[id] = newTestStore(c.t, c.dirs[id], options...)
+	return c.stores[id]
+}
+
+func (c *raftTestCluster) stop(id string) {
+	assert.NoError(c.t, c.stores[id].Close())
+	delete(c.stores, id)
+}
+
+// tick ticks every node, or just those given, then delivers the messages
+// that follow.
+func (c *raftTestCluster) tick(ids ...string) {
+	if len(ids) == 0 {
+		for id := range c.stores {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		c.stores[id].raft.tick()
+	}
+	c.network.Deliver()
+}
+
+// elect ticks the nodes until one of them is leader, and returns its ID.
+func (c *raftTestCluster) elect(ids ...string) string {
+	c.t.Helper()
+	for i := 0; i < 100; i++ {
+		c.tick(ids...)
+		if leader := c.leader(ids...); leader != "" {
+			return leader
+		}
+	}
+	c.t.Fatal("no leader elected")
+	return ""
+}
+
+// leader returns the ID of the only leader among the nodes, if there is one.
+func (c *raftTestCluster) leader(ids ...string) string {
+	if len(ids) == 0 {
+		for id := range c.stores {
+			ids = append(ids, id)
+		}
+	}
+	leader := ""
+	for _, id := range ids {
+		if status, _ := c.stores[id].RaftStatus(); status.Role == "leader" {
+			if leader != "" {
+				return ""
+			}
+			leader = id
+		}
+	}
+	return leader
+}
+
+// partition cuts the nodes off from the rest.
+func (c *raftTestCluster) partition(ids ...string) {
+	var addrs []string
+	for _, id := range ids {
+		addrs = append(addrs, c.peers[id])
+	}
+	c.network.Partition(addrs...)
+}
+
+// do runs the write, delivering messages until it returns, then delivers the
+// messages that tell the followers it was committed.
+func (c *raftTestCluster) do(write func() error) error {
+	result := make(chan error, 1)
+	go func() { result <- write() }()
+	for {
+		select {
+		case err := <-result:
+			c.network.Deliver()
+			return err
+		default:
+			c.network.Deliver()
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func (c *raftTestCluster) set(id string, key string, value string) error {
+	return c.do(func() error { return c.stores[id].Set(key, json.RawMessage(value)) })
+}
+
+// assertConsistent checks every node has the same value and version for each
+// key as the node with the ID.
+func (c *raftTestCluster) assertConsistent(id string, keys ...string) {
+	c.t.Helper()
+	for other, store := range c.stores {
+		if other != id {
+			assertReplicated(c.t, c.stores[id], store, keys...)
+		}
+	}
+}
+
+func TestRaftElectionAndReplication(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{}, "a", "b", "c")
+	leader := c.elect()
+
+	for id, store := range c.stores {
+		status, ok := store.RaftStatus()
+		assert.True(t, ok)
+		assert.Equal(t, leader, status.Leader, id)
+		assert.Equal(t, "http://"+leader, status.LeaderAddr, id)
+		assert.Len(t, status.Members, 3)
+	}
+
+	assert.NoError(t, c.set(leader, "one", `1`))
+	assert.NoError(t, c.do(func() error {
+		return c.stores[leader].BatchSet([]StoreEntry{{Key: "two", Value: json.RawMessage(`2`)}, {Key: "three", Value: json.RawMessage(`3`)}})
+	}))
+	assert.NoError(t, c.do(func() error { return c.stores[leader].Delete("three") }))
+	c.assertConsistent(leader, "one", "two", "three")
+	_, version, _ := c.stores[leader].GetVersion("two")
+	assert.Equal(t, uint64(2), version)
+
+	// Conditions are checked by each node as it applies the write
+	var swapped uint64
+	assert.Equal(t, ErrKeyNotFound, c.do(func() error { return c.stores[leader].Delete("missing") }))
+	assert.Equal(t, ErrKeyExists, c.do(func() error {
+		_, err := c.stores[leader].SetIfNotExists("one", json.RawMessage(`"again"`))
+		return err
+	}))
+	assert.NoError(t, c.do(func() error {
+		var err error
+		swapped, err = c.stores[leader].CompareAndSwap("one", 1, json.RawMessage(`"swapped"`))
+		return err
+	}))
+	assert.Greater(t, swapped, version)
+	c.assertConsistent(leader, "one", "missing")
+
+	txn := c.stores[leader].Begin()
+	assert.NoError(t, txn.Set("two", json.RawMessage(`"txn"`)))
+	assert.NoError(t, c.set(leader, "two", `"first"`))
+	assert.Equal(t, ErrTxnConflict, c.do(txn.Commit))
+	c.assertConsistent(leader, "two")
+
+	// Keys a transaction watches conflict on every node too
+	txn = c.stores[leader].Begin()
+	assert.NoError(t, txn.Watch("two"))
+	assert.NoError(t, txn.Set("watched", json.RawMessage(`1`)))
+	assert.NoError(t, c.set(leader, "two", `"second"`))
+	assert.Equal(t, ErrTxnConflict, c.do(txn.Commit))
+	c.assertConsistent(leader, "two", "watched")
+
+	for id := range c.stores {
+		if id != leader {
+			assert.Equal(t, ErrNotLeader, c.stores[id].Set("one", json.RawMessage(`0`)), id)
+		}
+	}
+}
+
+func TestRaftPartition(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{ProposalTimeout: 10 * time.Second}, "a", "b", "c", "d", "e")
+	old := c.elect()
+	assert.NoError(t, c.set(old, "key", `"before"`))
+
+	// Cut the leader and one other node off from the majority
+	minority := []string{old}
+	var majority []string
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if id == old {
+			continue
+		} else if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	assert.Len(t, minority, 2)
+	assert.Len(t, majority, 3)
+	c.partition(minority...)
+
+	// A write to the old leader cannot be committed without the majority
+	stale := make(chan error, 1)
+	go func() { stale <- c.stores[old].Set("key", json.RawMessage(`"stale"`)) }()
+	assert.Eventually(t, func() bool {
+		status, _ := c.stores[old].RaftStatus()
+		return status.LastIndex > status.Commit
+	}, 10*time.Second, time.Millisecond)
+
+	leader := c.elect(majority...)
+	assert.NotEqual(t, old, leader)
+	assert.NoError(t, c.set(leader, "key", `"after"`))
+	assert.NoError(t, c.set(leader, "other", `true`))
+
+	// The old leader steps down once it stops hearing from a majority
+	for i := 0; i < 20; i++ {
+		c.tick(minority...)
+	}
+	status, _ := c.stores[old].RaftStatus()
+	assert.Equal(t, "follower", status.Role)
+
+	// Once healed, the write the old leader took is replaced by the new
+	// leader's entries
+	c.network.Heal()
+	for i := 0; i < 5; i++ {
+		c.tick()
+	}
+	assert.Equal(t, ErrProposalDropped, <-stale)
+	c.assertConsistent(leader, "key", "other")
+	value, _ := c.stores[old].Get("key")
+	assert.JSONEq(t, `"after"`, string(value))
+	for id, store := range c.stores {
+		status, _ := store.RaftStatus()
+		assert.Equal(t, leader, status.Leader, id)
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{SnapshotEntries: 10}, "a", "b", "c")
+	leader := c.elect()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, c.set(leader, fmt.Sprintf("key%03d", i), fmt.Sprint(i)))
+	}
+	behind := "a"
+	if leader == behind {
+		behind = "b"
+	}
+	c.stop(behind)
+
+	// Enough is written while the node is down for the log to be compacted
+	// past where it got to, including a key it had being deleted
+	for i := 0; i < 600; i++ {
+		assert.NoError(t, c.set(leader, fmt.Sprintf("key%03d", i), fmt.Sprintf(`{"n": %d}`, i)))
+	}
+	assert.NoError(t, c.do(func() error { return c.stores[leader].Delete("key001") }))
+	assert.NoError(t, c.do(func() error {
+		return c.stores[leader].SetWithTTL("session", json.RawMessage(`"abc"`), time.Hour)
+	}))
+	status, _ := c.stores[leader].RaftStatus()
+	assert.Greater(t, status.SnapshotIndex, uint64(10))
+
+	c.start(behind, nil)
+	for i := 0; i < 10; i++ {
+		c.tick()
+	}
+	restored, _ := c.stores[behind].RaftStatus()
+	assert.False(t, restored.Restoring)
+	assert.Equal(t, status.Commit, restored.Commit)
+	c.assertConsistent(leader, "key000", "key001", "key004", "key300", "key599", "session")
+	ttl, ok := c.stores[behind].TTL("session")
+	assert.True(t, ok)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	// Writes carry on from the snapshot's version
+	assert.NoError(t, c.set(leader, "after", `true`))
+	c.assertConsistent(leader, "after")
+}
+
+func TestRaftMembership(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{}, "a", "b", "c")
+	leader := c.elect()
+	assert.NoError(t, c.set(leader, "key", `1`))
+
+	// A new node joins knowing the members, and catches up from the leader
+	c.start("d", c.peers)
+	assert.NoError(t, c.do(func() error { return c.stores[leader].AddMember("d", "http://d") }))
+	c.tick()
+	c.assertConsistent(leader, "key")
+	status, _ := c.stores["d"].RaftStatus()
+	assert.Len(t, status.Members, 4)
+	assert.Equal(t, leader, status.Leader)
+
+	assert.Equal(t, ErrNotRaft, newTestStore(t, t.TempDir()).AddMember("e", "http://e"))
+
+	// A leader that removes itself steps down, and the others elect a new one
+	assert.NoError(t, c.do(func() error { return c.stores[leader].RemoveMember(leader) }))
+	c.tick()
+	status, _ = c.stores[leader].RaftStatus()
+	assert.Equal(t, "follower", status.Role)
+	assert.Len(t, status.Members, 3)
+	c.stop(leader)
+
+	var rest []string
+	for id := range c.stores {
+		if id != leader {
+			rest = append(rest, id)
+		}
+	}
+	next := c.elect(rest...)
+	assert.NotEqual(t, leader, next)
+	assert.NoError(t, c.set(next, "key", `2`))
+	c.assertConsistent(next, "key")
+}
+
+func TestRaftMembershipChangePending(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{}, "a", "b", "c")
+	leader := c.elect()
+	c.partition(leader)
+
+	// The first change cannot be committed, so a second is turned away
+	go c.stores[leader].AddMember("d", "http://d")
+	assert.Eventually(t, func() bool {
+		status, _ := c.stores[leader].RaftStatus()
+		return len(status.Members) == 4
+	}, 10*time.Second, time.Millisecond)
+	assert.Equal(t, ErrMembershipChangePending, c.stores[leader].RemoveMember("b"))
+}
+
+func TestRaftRestart(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{}, "a", "b", "c")
+	leader := c.elect()
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, c.set(leader, fmt.Sprintf("key%02d", i), fmt.Sprint(i)))
+	}
+	_, version, _ := c.stores[leader].GetVersion("key19")
+
+	// Every node restarts with its log and store, without applying writes
+	// twice. Stopping a node twice does nothing.
+	for _, id := range []string{"a", "b", "c"} {
+		store := c.stores[id]
+		c.stop(id)
+		assert.NoError(t, store.Close(), id)
+		assert.NotPanics(t, func() { store.raft.close() }, id)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		c.start(id, c.peers)
+	}
+	leader = c.elect()
+	for i := 0; i < 5; i++ {
+		c.tick()
+	}
+	for id, store := range c.stores {
+		_, got, ok := store.GetVersion("key19")
+		assert.True(t, ok, id)
+		assert.Equal(t, version, got, id)
+	}
+
+	assert.NoError(t, c.set(leader, "after", `true`))
+	_, after, _ := c.stores[leader].GetVersion("after")
+	assert.Equal(t, version+1, after)
+	c.assertConsistent(leader, "key00", "key19", "after")
+}
+
+func TestRaftStorage(t *testing.T) {
+	keys, err := ParseKeyring(testKey1)
+	assert.NoError(t, err)
+	tests := []struct {
+		name string
+		keys *Keyring
+	}{
+		{"plain", nil},
+		{"encrypted", keys},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			members := map[string]string{"a": "http://a"}
+			s, err := openRaftStorage(dir, test.keys, members)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0), s.lastIndex())
+			assert.Equal(t, uint64(1), s.seqAfter(0))
+
+			var entries []RaftEntry
+			for i := uint64(1); i <= 5; i++ {
+				entries = append(entries, RaftEntry{Index: i, Term: 1, Type: raftWrite, Seq: i, Ops: []Operation{{Key: fmt.Sprint(i)}}})
+			}
+			assert.NoError(t, s.append(entries))
+			assert.NoError(t, s.setState(raftHardState{Term: 2, Vote: "a"}))
+
+			// Entries that conflict are replaced
+			assert.NoError(t, s.append([]RaftEntry{{Index: 4, Term: 2, Type: raftMembership, Seq: 4, Members: map[string]string{"a": "http://a", "b": "http://b"}}}))
+			assert.Equal(t, uint64(4), s.lastIndex())
+			assert.Equal(t, uint64(4), s.seqAfter(4))
+			got, index := s.membersAt(4)
+			assert.Len(t, got, 2)
+			assert.Equal(t, uint64(4), index)
+			got, _ = s.membersAt(3)
+			assert.Equal(t, members, got)
+
+			assert.NoError(t, s.compact(2))
+			_, ok := s.term(1)
+			assert.False(t, ok)
+			term, ok := s.term(2)
+			assert.True(t, ok)
+			assert.Equal(t, uint64(1), term)
+			assert.NoError(t, s.close())
+
+			// A torn entry at the end is dropped when the log is opened again
+			file, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_APPEND|os.O_WRONLY, 0644)
+			assert.NoError(t, err)
+			_, err = file.Write([]byte{0, 0, 0, 9, 1})
+			assert.NoError(t, err)
+			assert.NoError(t, file.Close())
+
+			s, err = openRaftStorage(dir, test.keys, nil)
+			assert.NoError(t, err)
+			defer s.close()
+			assert.Equal(t, raftHardState{Term: 2, Vote: "a"}, s.state)
+			assert.Equal(t, uint64(3), s.firstIndex())
+			assert.Equal(t, uint64(4), s.lastIndex())
+			assert.Equal(t, "3", s.entry(3).Ops[0].Key)
+			assert.Len(t, s.entriesFrom(3, 10), 2)
+			assert.Len(t, s.snapshot.Members, 1)
+			assert.NoError(t, s.append([]RaftEntry{{Index: 5, Term: 2, Type: raftNoop, Seq: 4}}))
+		})
+	}
+}
+
+func TestRaftHTTP(t *testing.T) {
+	c := newRaftTestCluster(t, RaftConfig{}, "a", "b", "c")
+
+	// Without a leader there is nowhere to send writes
+	router := newRouter(c.stores["a"])
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/keys/key", strings.NewReader(`1`)))
+	assert.Equal(t, 503, w.Code)
+
+	leader := c.elect()
+	follower := "a"
+	if leader == follower {
+		follower = "b"
+	}
+
+	// Writes to a follower are redirected to the leader, reads are not
+	router = newRouter(c.stores[follower])
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/keys/key?ttl=60", strings.NewReader(`1`)))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "http://"+leader+"/api/keys/key?ttl=60", w.Header().Get("Location"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/keys/key", nil))
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/raft/status", nil))
+	assert.Equal(t, 200, w.Code)
+	var status RaftStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, follower, status.ID)
+	assert.Equal(t, leader, status.Leader)
+
+	// The leader takes writes and membership changes itself
+	router = newRouter(c.stores[leader])
+	w = httptest.NewRecorder()
+	assert.NoError(t, c.do(func() error {
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/keys/key", strings.NewReader(`1`)))
+		return nil
+	}))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, formatETag(1), w.Header().Get("ETag"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/raft/members", strings.NewReader(`{"id": "d"}`)))
+	assert.Equal(t, 400, w.Code)
+	w = httptest.NewRecorder()
+	assert.NoError(t, c.do(func() error {
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/api/raft/members/"+follower, nil))
+		return nil
+	}))
+	assert.Equal(t, 200, w.Code)
+	status, _ = c.stores[leader].RaftStatus()
+	assert.Len(t, status.Members, 2)
+
+	// A store outside a cluster has no raft status
+	w = httptest.NewRecorder()
+	newRouter(newTestStore(t, t.TempDir())).ServeHTTP(w, httptest.NewRequest("GET", "/api/raft/status", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestRaftReencrypt(t *testing.T) {
+	keys, err := ParseKeyring(testKey1)
+	assert.NoError(t, err)
+	dir := t.TempDir() // Made first so it is removed after the node stops
+	c := newRaftTestCluster(t, RaftConfig{})
+	c.peers["a"], c.dirs["a"] = "http://a", dir
+	c.options = []StoreOption{WithEncryption(keys)}
+	c.start("a", c.peers)
+	c.elect()
+	assert.NoError(t, c.set("a", "before", `"secret-before"`))
+	c.stop("a")
+
+	// Rotate to a new key, which the log entries written since are sealed with
+	rotated, err := ParseKeyring(testKey1 + "," + testKey2)
+	assert.NoError(t, err)
+	c.options = []StoreOption{WithEncryption(rotated)}
+	c.start("a", c.peers)
+	c.elect()
+	assert.NoError(t, c.set("a", "after", `"secret-after"`))
+	c.stop("a")
+
+	// Until the store is re-encrypted, the raft log cannot be read without the old key
+	newKey, err := ParseKeyring(testKey2)
+	assert.NoError(t, err)
+	raftDir := filepath.Join(dir, "test.db.raft")
+	_, err = openRaftStorage(raftDir, newKey, nil)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	assert.NoError(t, Reencrypt(filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), rotated))
+	s, err := openRaftStorage(raftDir, newKey, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, s.close())
+
+	c.options = []StoreOption{WithEncryption(newKey)}
+	c.start("a", c.peers)
+	c.elect()
+	for _, key := range []string{"before", "after"} {
+		_, ok := c.stores["a"].Get(key)
+		assert.True(t, ok, key)
+	}
+	assert.NoError(t, c.set("a", "rotated", `1`))
+}
+
+func TestParseRaftPeers(t *testing.T) {
+	peers, err := ParseRaftPeers("a=http://localhost:8081/,b=http://localhost:8082")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "http://localhost:8081", "b": "http://localhost:8082"}, peers)
+
+	peers, err = ParseRaftPeers("")
+	assert.NoError(t, err)
+	assert.Empty(t, peers)
+
+	_, err = ParseRaftPeers("a=http://localhost:8081,b")
+	assert.Error(t, err)
+}
+
+func TestRaftOverHTTP(t *testing.T) {
+	// Listen first, so each node knows the others' addresses
+	ids := []string{"a", "b", "c"}
+	peers := make(map[string]string)
+	listeners := make(map[string]net.Listener)
+	for _, id := range ids {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		listeners[id] = ln
+		peers[id] = "http://" + ln.Addr().String()
+	}
+
+	stores := make(map[string]*Store)
+	for _, id := range ids {
+		store := newTestStore(t, t.TempDir(), WithRaft(RaftConfig{ID: id, Peers: peers, TickInterval: 10 * time.Millisecond}))
+		stores[id] = store
+		server := &httptest.Server{Listener: listeners[id], Config: &http.Server{Handler: newRouter(store)}}
+		server.Start()
+		defer store.Close()
+		defer server.Close()
+	}
+
+	leader := ""
+	assert.Eventually(t, func() bool {
+		status, _ := stores["a"].RaftStatus()
+		leader = status.Leader
+		return leader != ""
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Writes to any node end up on the leader, which commits them on every node
+	for i, id := range ids {
+		req, err := http.NewRequest("POST", peers[id]+"/api/keys/key"+id, strings.NewReader(fmt.Sprint(i)))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode, id)
+	}
+	assert.Eventually(t, func() bool {
+		for _, store := range stores {
+			if _, ok := store.Get("keyc"); !ok {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+	for _, id := range ids {
+		assertReplicated(t, stores[leader], stores[id], "keya", "keyb", "keyc")
+	}
+}
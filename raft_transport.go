@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RaftTransport carries messages between the nodes of a raft cluster. Sends
+// must not block; messages may be lost, as raft sends them again.
+type RaftTransport interface {
+	// Send sends the message to the node at the address.
+	Send(addr string, m RaftMessage)
+	// Receive sets the function messages sent to the node are passed to.
+	Receive(step func(RaftMessage))
+	Close() error
+}
+
+// Most messages queued for a node before more are dropped
+const raftSendQueueSize = 4096
+
+// How long a batch of messages has to reach a node
+const raftSendTimeout = 5 * time.Second
+
+// httpRaftTransport posts messages to the /api/raft/messages route of each
+// node, gob encoded, in batches of whatever has been queued for it.
+type httpRaftTransport struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	peers  map[string]chan RaftMessage // Messages waiting to be posted, by address
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newHTTPRaftTransport() *httpRaftTransport {
+	return &httpRaftTransport{
+		client: &http.Client{Timeout: raftSendTimeout},
+		peers:  make(map[string]chan RaftMessage),
+	}
+}
+
+func (t *httpRaftTransport) Send(addr string, m RaftMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	queue, ok := t.peers[addr]
+	if !ok {
+		queue = make(chan RaftMessage, raftSendQueueSize)
+		t.peers[addr] = queue
+		t.wg.Add(1)
+		go t.post(addr, queue)
+	}
+	select {
+	case queue <- m:
+	default:
+	}
+}
+
+// Receive does nothing, as messages arrive through the HTTP API, which
+// passes them to the store.
+func (t *httpRaftTransport) Receive(step func(RaftMessage)) {}
+
+// post sends the messages queued for the node at the address, one batch at a
+// time so they arrive in order, until the queue is closed.
+func (t *httpRaftTransport) post(addr string, queue chan RaftMessage) {
+	defer t.wg.Done()
+
+	for m := range queue {
+		batch := []RaftMessage{m}
+		for more := true; more; {
+			select {
+			case m, ok := <-queue:
+				if !ok {
+					more = false
+					break
+				}
+				batch = append(batch, m)
+			default:
+				more = false
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(batch); err != nil {
+			fmt.Println("Error encoding raft messages:", err)
+			continue
+		}
+		// Messages that do not arrive are sent again by raft, so failures
+		// are left for it to deal with
+		resp, err := t.client.Post(addr+"/api/raft/messages", "application/octet-stream", &buf)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+func (t *httpRaftTransport) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		for _, queue := range t.peers {
+			close(queue)
+		}
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+	return nil
+}
+
+// receiveRaftMessages passes a batch of messages posted by another node to
+// the store's raft node.
+func (s *Store) receiveRaftMessages(msgs []RaftMessage) error {
+	if s.raft == nil {
+		return ErrNotRaft
+	}
+	for _, m := range msgs {
+		s.raft.step(m)
+	}
+	return nil
+}
+
+// MemNetwork connects raft nodes in the same process, for tests. Messages are
+// queued until Deliver is called, and delivered in the order they were sent,
+// so a test decides exactly what each node sees. The network can be split
+// into partitions, across which messages are dropped.
+type MemNetwork struct {
+	mu        sync.Mutex
+	nodes     map[string]func(RaftMessage) // By address
+	queue     []memMessage
+	partition map[string]int // Partition each address is in; messages only reach nodes in the same one
+}
+
+type memMessage struct {
+	from string
+	to   string
+	data []byte
+}
+
+// NewMemNetwork returns an empty network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{nodes: make(map[string]func(RaftMessage))}
+}
+
+// Transport returns the transport for the node at the address.
+func (nw *MemNetwork) Transport(addr string) RaftTransport {
+	return &memTransport{network: nw, addr: addr}
+}
+
+// Partition cuts the nodes at the addresses off from the rest of the network.
+// They can still reach each other. Each call makes a new partition, taking
+// the nodes out of any they were in.
+func (nw *MemNetwork) Partition(addrs ...string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	if nw.partition == nil {
+		nw.partition = make(map[string]int)
+	}
+	group := len(nw.partition) + 1
+	for _, addr := range addrs {
+		nw.partition[addr] = group
+	}
+}
+
+// Heal joins the partitions back together.
+func (nw *MemNetwork) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+
+	nw.partition = nil
+}
+
+// Deliver delivers the queued messages, and the messages sent in response to
+// them, until none are left. It returns how many were delivered.
+func (nw *MemNetwork) Deliver() int {
+	delivered := 0
+	for {
+		nw.mu.Lock()
+		if len(nw.queue) == 0 {
+			nw.mu.Unlock()
+			return delivered
+		}
+		m := nw.queue[0]
+		nw.queue = nw.queue[1:]
+		step, ok := nw.nodes[m.to]
+		if nw.partition[m.from] != nw.partition[m.to] {
+			ok = false
+		}
+		nw.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		// Messages are copied through gob, as they would be over the wire
+		var msg RaftMessage
+		if err := gob.NewDecoder(bytes.NewReader(m.data)).Decode(&msg); err != nil {
+			panic(err)
+		}
+		step(msg)
+		delivered++
+	}
+}
+
+type memTransport struct {
+	network *MemNetwork
+	addr    string
+}
+
+func (t *memTransport) Send(addr string, m RaftMessage) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m); err != nil {
+		panic(err)
+	}
+
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.network.queue = append(t.network.queue, memMessage{from: t.addr, to: addr, data: buf.Bytes()})
+}
+
+func (t *memTransport) Receive(step func(RaftMessage)) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	t.network.nodes[t.addr] = step
+}
+
+// Close takes the node off the network.
+func (t *memTransport) Close() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+	delete(t.network.nodes, t.addr)
+	return nil
+}
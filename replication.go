@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A follower replicates a leader by streaming its write-ahead log over HTTP.
+// It asks the leader for the records from the sequence number after the last
+// one it applied, and the leader sends them as they are appended, as a stream
+// of JSON messages, one per line:
+//
+//	{"type": "entries", "ops": [...]}        Entries of a snapshot
+//	{"type": "snapshot", "upto": 41, ...}    The snapshot is complete, as of version 41
+//	{"type": "record", "ops": [...], ...}    A record from the log, whose operations are applied together
+//	{"type": "progress", "upto": 57, ...}    Every record up to 57 has been sent
+//
+// Every message carries the sequence number of the last record in the
+// leader's log, and the follower's lag is how far behind that it is. A
+// follower that starts out empty asks for the records from 0, and is sent a
+// snapshot of the leader's keys first. A snapshot that was cut short is copied
+// again from scratch, and keys left over from it that the new snapshot does not
+// have are deleted. Operations keep the sequence numbers the leader gave them,
+// so versions and ETags are the same on every node.
+//
+// The leader keeps the log segments a connected follower has yet to read. A
+// follower that falls further behind than the log the leader still has stops
+// with ErrReplicationGap, and has to be started again with an empty store.
+// Records are sent once they are in the leader's log, before it syncs it.
+
+// How often the leader sends progress when there is nothing new to send
+const ReplicationHeartbeat = time.Second
+
+// A follower reconnects if it hears nothing from the leader for this long
+const replicationTimeout = 5 * ReplicationHeartbeat
+
+// How long a follower waits before reconnecting after an error
+const replicationRetryInterval = time.Second
+
+// ErrReadOnly is returned when writing to a follower.
+var ErrReadOnly = errors.New("store is a read-only follower")
+
+// ErrReplicationGap is returned when a follower needs records the leader has
+// already removed from its log.
+var ErrReplicationGap = errors.New("leader no longer has the records the follower needs")
+
+// errLeaderBehind is returned when a follower asks for records after the end
+// of the leader's log.
+var errLeaderBehind = errors.New("follower is ahead of the leader")
+
+// Message types in the replication stream
+const (
+	replicateEntries  = "entries"
+	replicateSnapshot = "snapshot"
+	replicateRecord   = "record"
+	replicateProgress = "progress"
+)
+
+type replicationMessage struct {
+	Type      string         `json:"type"`
+	Ops       []replicatedOp `json:"ops,omitempty"`
+	Upto      uint64         `json:"upto"`      // Every record up to this sequence number has been sent
+	LeaderSeq uint64         `json:"leaderSeq"` // Last sequence number in the leader's log
+}
+
+type replicatedOp struct {
+	Seq     uint64          `json:"seq"`
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Expires int64           `json:"expires,omitempty"`
+	Time    int64           `json:"time,omitempty"`
+}
+
+func replicatedOps(ops []Operation) []replicatedOp {
+	replicated := make([]replicatedOp, len(ops))
+	for i, op := range ops {
+		replicated[i] = replicatedOp{Seq: op.Seq, Key: op.Key, Value: op.Value, Deleted: op.Deleted, Expires: op.Expires, Time: op.Time}
+	}
+	return replicated
+}
+
+func operations(replicated []replicatedOp) []Operation {
+	ops := make([]Operation, len(replicated))
+	for i, op := range replicated {
+		ops[i] = Operation{Seq: op.Seq, Key: op.Key, Value: op.Value, Deleted: op.Deleted, Expires: op.Expires, Time: op.Time}
+	}
+	return ops
+}
+
+// ReplicationStatus describes a store's part in replication.
+type ReplicationStatus struct {
+	Role string `json:"role"` // leader or follower
+	Seq  uint64 `json:"seq"`  // Last sequence number in the store's log
+
+	// For a leader, the followers streaming its log
+	Followers []FollowerProgress `json:"followers,omitempty"`
+
+	// For a follower
+	Leader      string    `json:"leader,omitempty"`
+	Connected   bool      `json:"connected"`
+	LeaderSeq   uint64    `json:"leaderSeq,omitempty"` // Last sequence number in the leader's log, when last heard
+	Lag         uint64    `json:"lag"`                 // Sequence numbers behind the leader
+	LagSeconds  float64   `json:"lagSeconds"`          // How long since the follower was last caught up
+	LastContact time.Time `json:"lastContact,omitempty"`
+	Error       string    `json:"error,omitempty"` // Why replication last stopped
+}
+
+// FollowerProgress is how far a follower connected to the leader has got.
+type FollowerProgress struct {
+	Addr          string `json:"addr"`
+	Upto          uint64 `json:"upto"` // Every record up to this sequence number has been sent
+	Lag           uint64 `json:"lag"`
+	Bootstrapping bool   `json:"bootstrapping,omitempty"` // Whether it is still being sent a snapshot
+}
+
+// ReplicationStatus returns the store's replication status.
+func (s *Store) ReplicationStatus() ReplicationStatus {
+	if s.follower != nil {
+		return s.follower.status()
+	}
+
+	seq := s.WAL.LastSeq()
+	return ReplicationStatus{Role: "leader", Seq: seq, Followers: s.replication.progress(seq)}
+}
+
+// replicationTracker keeps track of the followers streaming a leader's log.
+type replicationTracker struct {
+	mu      sync.Mutex
+	nextID  int
+	streams map[int]*replicationStream
+}
+
+type replicationStream struct {
+	addr          string
+	next          uint64 // First sequence number the follower has yet to be sent
+	bootstrapping bool
+}
+
+func newReplicationTracker() *replicationTracker {
+	return &replicationTracker{streams: make(map[int]*replicationStream)}
+}
+
+func (tr *replicationTracker) open(addr string, next uint64, bootstrapping bool) int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.nextID++
+	tr.streams[tr.nextID] = &replicationStream{addr: addr, next: next, bootstrapping: bootstrapping}
+	return tr.nextID
+}
+
+func (tr *replicationTracker) update(id int, next uint64, bootstrapping bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.streams[id].next, tr.streams[id].bootstrapping = next, bootstrapping
+}
+
+func (tr *replicationTracker) close(id int) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	delete(tr.streams, id)
+}
+
+// oldest returns the first sequence number a follower has yet to be sent, if
+// any followers are connected.
+func (tr *replicationTracker) oldest() (uint64, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	oldest, ok := uint64(0), false
+	for _, stream := range tr.streams {
+		if !ok || stream.next < oldest {
+			oldest, ok = stream.next, true
+		}
+	}
+	return oldest, ok
+}
+
+// progress returns how far each follower has got, given the last sequence
+// number in the log.
+func (tr *replicationTracker) progress(seq uint64) []FollowerProgress {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	progress := make([]FollowerProgress, 0, len(tr.streams))
+	for _, stream := range tr.streams {
+		p := FollowerProgress{Addr: stream.addr, Upto: stream.next - 1, Bootstrapping: stream.bootstrapping}
+		if seq > p.Upto {
+			p.Lag = seq - p.Upto
+		}
+		progress = append(progress, p)
+	}
+	sort.Slice(progress, func(i, j int) bool {
+		return progress[i].Addr < progress[j].Addr
+	})
+	return progress
+}
+
+// replicate sends the records in the log from sequence number from, and then
+// each record as it is appended, until the context is done or send fails.
+// From 0, it sends a snapshot of the store first.
+func (s *Store) replicate(ctx context.Context, from uint64, addr string, send func(*replicationMessage) error) error {
+	// The snapshot will be at least as new as this, so the log is kept from here
+	id := s.replication.open(addr, s.WAL.LastSeq()+1, from == 0)
+	defer s.replication.close(id)
+
+	if from == 0 {
+		version, err := s.sendSnapshot(send)
+		if err != nil {
+			return err
+		}
+		from = version + 1
+	}
+
+	cursor, err := s.WAL.cursor(from)
+	if err != nil {
+		return err
+	}
+	s.replication.update(id, from, false)
+
+	ticker := time.NewTicker(ReplicationHeartbeat)
+	defer ticker.Stop()
+
+	// Start by telling the follower how far behind it is
+	sent := from - 1
+	heartbeat := true
+	for {
+		// Wait for records appended after this read, not before it
+		appended := s.WAL.appendedSignal()
+
+		records, err := cursor.read()
+		for _, ops := range records {
+			last := ops[len(ops)-1].Seq
+			if err := send(&replicationMessage{Type: replicateRecord, Ops: replicatedOps(ops), Upto: last, LeaderSeq: s.WAL.LastSeq()}); err != nil {
+				return err
+			}
+			sent = last
+		}
+		if err != nil {
+			return err
+		}
+		if upto := cursor.next - 1; upto != sent || heartbeat {
+			if err := send(&replicationMessage{Type: replicateProgress, Upto: upto, LeaderSeq: s.WAL.LastSeq()}); err != nil {
+				return err
+			}
+			sent = upto
+		}
+		s.replication.update(id, cursor.next, false)
+
+		heartbeat = false
+		select {
+		case <-appended:
+		case <-ticker.C:
+			heartbeat = true
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sendSnapshot sends every key in the store as of a snapshot, a chunk at a
+// time, and returns the snapshot's version.
+func (s *Store) sendSnapshot(send func(*replicationMessage) error) (uint64, error) {
+	snapshot := s.Snapshot()
+	defer snapshot.Release()
+
+	for start, done := "", false; !done; {
+		var ops []Operation
+		var err error
+		ops, start, done, err = s.snapshotChunk(start, snapshot.version, scanChunkSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(ops) > 0 {
+			if err := send(&replicationMessage{Type: replicateEntries, Ops: replicatedOps(ops)}); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return snapshot.version, send(&replicationMessage{Type: replicateSnapshot, Upto: snapshot.version, LeaderSeq: s.WAL.LastSeq()})
+}
+
+// snapshotChunk returns the writes that gave about n keys from start their
+// values at the version, skipping keys that were deleted or had expired, and
+// returns where the next chunk starts and whether this was the last.
+func (s *Store) snapshotChunk(start string, version uint64, n int) ([]Operation, string, bool, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	// Deleted keys stay in the index until they are compacted away, so it
+	// also finds the keys that were deleted after the version
+	var keys []string
+	err := s.Buffer.Disk.Index.WalkFrom(start, func(value IndexValue) bool {
+		if len(keys) == n {
+			return false
+		}
+		keys = append(keys, value.Key)
+		return true
+	})
+	if err != nil {
+		return nil, "", false, err
+	}
+	done := len(keys) < n
+
+	// Add the keys only written to the write batch so far, up to the last
+	// key on disk in the chunk
+	for _, op := range s.Buffer.pendingRange(start, "") {
+		if done || op.Key < keys[len(keys)-1] {
+			keys = append(keys, op.Key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Now().UnixNano()
+	var ops []Operation
+	next := start
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		next = keyAfter(key)
+
+		op, ok, err := s.Buffer.versionAt(key, version)
+		if err != nil {
+			return nil, "", false, err
+		}
+		if ok && !op.Deleted && !op.expired(now) {
+			ops = append(ops, op)
+		}
+	}
+
+	return ops, next, done, nil
+}
+
+// walCursor reads through the log from a sequence number, picking up records
+// as they are appended.
+type walCursor struct {
+	wal     *WAL
+	segment uint64 // Segment being read
+	offset  int64  // Where the next record in the segment starts
+	next    uint64 // First sequence number yet to be read
+}
+
+// cursor returns a cursor over the records in the log from sequence number from.
+func (w *WAL) cursor(from uint64) (*walCursor, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if from > w.nextSeq {
+		return nil, fmt.Errorf("%w: wants records from %d, but the log ends at %d", errLeaderBehind, from, w.nextSeq-1)
+	}
+	if from < w.segments[0] {
+		return nil, fmt.Errorf("%w: wants records from %d, but the log starts at %d", ErrReplicationGap, from, w.segments[0])
+	}
+
+	// Start from the last segment that starts at or before from
+	i := sort.Search(len(w.segments), func(i int) bool { return w.segments[i] > from }) - 1
+	return &walCursor{wal: w, segment: w.segments[i], next: from}, nil
+}
+
+// appendedSignal returns a channel that is closed when records are next appended.
+func (w *WAL) appendedSignal() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.appended
+}
+
+// read returns the operations of each record appended since the last read, or
+// since the cursor's sequence number. Checkpoints are skipped, but still move
+// the cursor on.
+func (c *walCursor) read() ([][]Operation, error) {
+	var records [][]Operation
+	for {
+		// A segment is complete once there is one after it, so check for one
+		// before reading to the end of this one
+		c.wal.mu.Lock()
+		following := uint64(0)
+		for i, first := range c.wal.segments {
+			if first == c.segment && i < len(c.wal.segments)-1 {
+				following = c.wal.segments[i+1]
+			}
+		}
+		c.wal.mu.Unlock()
+
+		data, err := readFileFrom(c.wal.segmentPath(c.segment), c.offset)
+		if os.IsNotExist(err) {
+			return records, fmt.Errorf("%w: segment %d was removed", ErrReplicationGap, c.segment)
+		} else if err != nil {
+			return records, err
+		}
+
+		// A torn record at the end of the segment being appended to is still
+		// being written, and is read again next time
+		decoded, size, err := decodeWALFrames(data, c.wal.keys)
+		if err == errWALTorn && following != 0 {
+			return records, fmt.Errorf("corrupt write-ahead log segment %s", c.wal.segmentPath(c.segment))
+		} else if err != nil && err != errWALTorn {
+			return records, err
+		}
+		c.offset += size
+
+		for _, record := range decoded {
+			var ops []Operation
+			for _, op := range record.operations() {
+				if op.Seq >= c.next {
+					ops = append(ops, op)
+				}
+			}
+			if len(ops) > 0 {
+				records = append(records, ops)
+			}
+			if record.lastSeq() >= c.next {
+				c.next = record.lastSeq() + 1
+			}
+		}
+
+		if err == errWALTorn || following == 0 {
+			return records, nil
+		}
+		c.segment, c.offset = following, 0
+	}
+}
+
+// readFileFrom returns the contents of the file from the offset on.
+func readFileFrom(filename string, offset int64) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
+
+// appendReplicated appends operations from the leader's log, keeping their
+// sequence numbers, which must follow on from the end of the log.
+func (w *WAL) appendReplicated(ops []Operation) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ops[0].Seq < w.nextSeq {
+		return fmt.Errorf("replicated record %d is before the end of the log at %d", ops[0].Seq, w.nextSeq-1)
+	}
+	for i, op := range ops {
+		if op.Seq != ops[0].Seq+uint64(i) {
+			return fmt.Errorf("replicated record %d is not numbered in order", ops[0].Seq)
+		}
+	}
+
+	w.nextSeq = ops[0].Seq
+	return w.appendLocked(ops)
+}
+
+// skipTo moves the end of the log on to the sequence number, with a
+// checkpoint marking everything up to it as on disk.
+func (w *WAL) skipTo(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if seq+1 < w.nextSeq {
+		return fmt.Errorf("cannot move the log back from %d to %d", w.nextSeq-1, seq)
+	}
+	var buf bytes.Buffer
+	encodeWALRecord(&buf, &walRecord{Seq: seq, Type: walCheckpoint, Upto: seq}, w.keys)
+	w.nextSeq = seq
+	return w.write(buf.Bytes(), 1)
+}
+
+// Follower streams the leader's log into a store.
+type Follower struct {
+	store  *Store
+	leader string // Base URL of the leader
+	client *http.Client
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the follower has stopped
+
+	mu          sync.Mutex
+	connected   bool
+	upto        uint64 // Every record up to this sequence number has been received
+	leaderSeq   uint64
+	caughtUp    time.Time // When the follower was last caught up
+	lastContact time.Time
+	err         error
+}
+
+// startFollower starts replicating from the leader into the store in the background.
+func startFollower(store *Store, leader string) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		store:    store,
+		leader:   leader,
+		client:   &http.Client{},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		caughtUp: time.Now(),
+	}
+	go f.run(ctx)
+	return f
+}
+
+// stop stops replicating and waits for the record being applied, if any.
+func (f *Follower) stop() {
+	f.cancel()
+	<-f.done
+}
+
+// run follows the leader until stopped, reconnecting after errors.
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		fmt.Println("Error replicating from leader:", err)
+		f.mu.Lock()
+		f.connected, f.err = false, err
+		f.mu.Unlock()
+
+		select {
+		case <-time.After(replicationRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow connects to the leader and applies what it sends until the
+// connection fails.
+func (f *Follower) follow(ctx context.Context) error {
+	// A follower that has not finished copying a snapshot starts again
+	from := f.store.WAL.LastSeq() + 1
+	if from == 1 {
+		from = 0
+	}
+	var load snapshotLoad
+
+	// Give up on a leader that stops sending heartbeats
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", f.leader+"/api/replication/stream?from="+strconv.FormatUint(from, 10), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode == http.StatusGone {
+			// The leader's message already starts with the error
+			return fmt.Errorf("%w%s", ErrReplicationGap, strings.TrimPrefix(body.Error, ErrReplicationGap.Error()))
+		}
+		return fmt.Errorf("leader returned %s: %s", resp.Status, body.Error)
+	}
+
+	f.mu.Lock()
+	f.connected, f.err = true, nil
+	f.mu.Unlock()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg replicationMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if watchdog.Stop() {
+				return fmt.Errorf("reading from leader: %w", err)
+			}
+			return errors.New("leader stopped responding")
+		}
+		watchdog.Reset(replicationTimeout)
+
+		switch msg.Type {
+		case replicateEntries:
+			if from != 0 {
+				return errors.New("leader sent a snapshot that was not asked for")
+			}
+			err = f.store.loadSnapshot(&load, operations(msg.Ops))
+		case replicateSnapshot:
+			err = f.store.finishSnapshot(&load, msg.Upto)
+		case replicateRecord:
+			err = f.store.applyReplicated(operations(msg.Ops))
+		}
+		if err != nil {
+			return err
+		}
+		f.received(&msg)
+	}
+}
+
+// received notes how far the leader has got and how far behind it the
+// follower is, as of the message.
+func (f *Follower) received(msg *replicationMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.lastContact = now
+	if msg.Type == replicateEntries {
+		return
+	}
+	f.leaderSeq = msg.LeaderSeq
+	if msg.Upto > f.upto {
+		f.upto = msg.Upto
+	}
+	if f.upto >= f.leaderSeq {
+		f.caughtUp = now
+	}
+}
+
+func (f *Follower) status() ReplicationStatus {
+	seq := f.store.WAL.LastSeq()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := ReplicationStatus{
+		Role:        "follower",
+		Seq:         seq,
+		Leader:      f.leader,
+		Connected:   f.connected,
+		LeaderSeq:   f.leaderSeq,
+		LastContact: f.lastContact,
+	}
+	if f.leaderSeq > f.upto {
+		status.Lag = f.leaderSeq - f.upto
+		status.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	if f.err != nil {
+		status.Error = f.err.Error()
+	}
+	return status
+}
+
+// snapshotLoad follows a snapshot being loaded into a store. Its entries
+// arrive in key order, so keys the store already has that fall between them
+// are left over from before it, and are deleted once it is complete.
+type snapshotLoad struct {
+	next  string   // Where the entries yet to be loaded start
+	stale []string // Keys left over from before the snapshot
+}
+
+// loadSnapshot writes entries of a snapshot from the leader straight to disk.
+// They are not logged, as the snapshot is copied again if the follower stops
+// before it is complete.
+func (s *Store) loadSnapshot(load *snapshotLoad, ops []Operation) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := s.findStale(load, ops[len(ops)-1].Key, ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := s.Buffer.Disk.Write(op); err != nil {
+			return err
+		}
+		s.Buffer.UpdateCache(op.entry())
+	}
+	return nil
+}
+
+// findStale notes the keys on disk from where the snapshot has got to up to
+// last, or to the end if last is empty, that are not among the entries, which
+// are in key order, and moves the snapshot on past last.
+func (s *Store) findStale(load *snapshotLoad, last string, ops []Operation) error {
+	disk := s.Buffer.Disk
+	var readErr error
+	err := disk.Index.WalkFrom(load.next, func(value IndexValue) bool {
+		if last != "" && value.Key > last {
+			return false
+		}
+		for len(ops) > 0 && ops[0].Key < value.Key {
+			ops = ops[1:]
+		}
+		if len(ops) > 0 && ops[0].Key == value.Key {
+			return true
+		}
+		record, err := disk.readRecord(value)
+		if err != nil {
+			readErr = fmt.Errorf("reading record for %q: %w", value.Key, err)
+			return false
+		}
+		if !record.Deleted {
+			load.stale = append(load.stale, record.Key)
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return err
+	}
+	load.next = keyAfter(last)
+	return nil
+}
+
+// finishSnapshot deletes the keys left over from before the snapshot, which
+// it does not have, syncs the snapshot to disk and moves the log on to its
+// version, so replication carries on from there.
+func (s *Store) finishSnapshot(load *snapshotLoad, version uint64) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	if err := s.findStale(load, "", nil); err != nil {
+		return err
+	}
+	disk := s.Buffer.Disk
+	for _, key := range load.stale {
+		op := Operation{Seq: version, Key: key, Deleted: true}
+		if err := disk.Write(op); err != nil {
+			return err
+		}
+		s.Buffer.UpdateCache(op.entry())
+	}
+
+	if err := disk.Sync(); err != nil {
+		return err
+	}
+	return s.WAL.skipTo(version)
+}
+
+// applyReplicated applies the operations of a record from the leader's log
+// together, as apply does for writes made to the store itself. They keep the
+// times they were written on the leader, and are given the current time only
+// if the leader did not log one.
+func (s *Store) applyReplicated(ops []Operation) error {
+	s.Mutex.Lock()
+	now := time.Now().UnixNano()
+	for i := range ops {
+		if ops[i].Time == 0 {
+			ops[i].Time = now
+		}
+	}
+
+	if err := s.WAL.appendReplicated(ops); err != nil {
+		s.Mutex.Unlock()
+		return err
+	}
+	s.snapshots.recordWrites(ops)
+	s.Buffer.BatchPut(ops)
+	s.Mutex.Unlock()
+
+	return s.WAL.Commit(ops[len(ops)-1].Seq)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestStore opens a store in its own directory.
+func newTestStore(t *testing.T, dir string, options ...StoreOption) *Store {
+	return NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), options...)
+}
+
+// caughtUp reports whether the follower has applied everything in the leader's log.
+func caughtUp(leader *Store, follower *Store) bool {
+	status := follower.ReplicationStatus()
+	return status.Connected && status.Lag == 0 && status.LeaderSeq == leader.WAL.LastSeq()
+}
+
+// assertReplicated checks that the follower has the same value and version
+// for each key as the leader.
+func assertReplicated(t *testing.T, leader *Store, follower *Store, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		want, wantVersion, wantOK := leader.GetVersion(key)
+		got, gotVersion, gotOK := follower.GetVersion(key)
+		assert.Equal(t, wantOK, gotOK, key)
+		assert.Equal(t, wantVersion, gotVersion, key)
+		if wantOK {
+			assert.JSONEq(t, string(want), string(got), key)
+		}
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leader := newTestStore(t, t.TempDir())
+	defer leader.Close()
+	server := httptest.NewServer(newRouter(leader))
+	defer server.Close()
+
+	// Written before the follower starts, so it is copied from a snapshot,
+	// some from disk and some from the write batch
+	for i := 0; i < 250; i++ {
+		assert.NoError(t, leader.Set(fmt.Sprintf("key%03d", i), json.RawMessage(fmt.Sprintf(`{"n": %d}`, i))))
+	}
+	assert.NoError(t, leader.Delete("key007"))
+	assert.NoError(t, leader.Flush())
+	assert.NoError(t, leader.Set("key001", json.RawMessage(`{"n": "one"}`)))
+	assert.NoError(t, leader.SetWithTTL("session", json.RawMessage(`"abc"`), time.Hour))
+	assert.NoError(t, leader.Delete("key002"))
+
+	followerDir := t.TempDir()
+	follower := newTestStore(t, followerDir, WithFollower(server.URL))
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) }, 10*time.Second, 10*time.Millisecond)
+	assertReplicated(t, leader, follower, "key000", "key001", "key002", "key007", "key249", "session")
+	ttl, ok := follower.TTL("session")
+	assert.True(t, ok)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	// Writes made afterwards are streamed, batches and transactions together
+	assert.NoError(t, leader.Set("key003", json.RawMessage(`{"n": "three"}`)))
+	assert.NoError(t, leader.BatchSet([]StoreEntry{
+		{Key: "batch1", Value: json.RawMessage(`1`)},
+		{Key: "batch2", Value: json.RawMessage(`2`)},
+	}))
+	assert.NoError(t, leader.BatchDelete([]string{"key004", "key005"}))
+	txn := leader.Begin()
+	assert.NoError(t, txn.Set("txn", json.RawMessage(`true`)))
+	assert.NoError(t, txn.Delete("key006"))
+	assert.NoError(t, txn.Commit())
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) }, 10*time.Second, 10*time.Millisecond)
+	assertReplicated(t, leader, follower, "key003", "batch1", "batch2", "key004", "key005", "key006", "txn")
+
+	// Versions keep the times they were written on the leader, whether they
+	// came from the snapshot or the log
+	for _, key := range []string{"key001", "key003", "batch1", "txn"} {
+		want, err := leader.History(key)
+		assert.NoError(t, err)
+		history, err := follower.History(key)
+		assert.NoError(t, err)
+		if assert.NotEmpty(t, history, key) {
+			assert.Equal(t, want[0].Version, history[0].Version, key)
+			assert.True(t, want[0].Time.Equal(history[0].Time), key)
+		}
+	}
+
+	// Followers only take writes from the leader
+	assert.ErrorIs(t, follower.Set("key000", json.RawMessage(`0`)), ErrReadOnly)
+	assert.ErrorIs(t, follower.Delete("key000"), ErrReadOnly)
+	txn = follower.Begin()
+	assert.NoError(t, txn.Set("txn", json.RawMessage(`false`)))
+	assert.ErrorIs(t, txn.Commit(), ErrReadOnly)
+
+	status := leader.ReplicationStatus()
+	assert.Equal(t, "leader", status.Role)
+	if assert.Len(t, status.Followers, 1) {
+		assert.Equal(t, uint64(0), status.Followers[0].Lag)
+		assert.False(t, status.Followers[0].Bootstrapping)
+	}
+	status = follower.ReplicationStatus()
+	assert.Equal(t, "follower", status.Role)
+	assert.Equal(t, server.URL, status.Leader)
+	assert.Zero(t, status.LagSeconds)
+	assert.Empty(t, status.Error)
+
+	// A follower that restarts carries on from where it got to
+	assert.NoError(t, follower.Close())
+	assert.NoError(t, leader.Set("missed", json.RawMessage(`"while stopped"`)))
+	assert.NoError(t, leader.Flush())
+	follower = newTestStore(t, followerDir, WithFollower(server.URL))
+	defer follower.Close()
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) }, 10*time.Second, 10*time.Millisecond)
+	assertReplicated(t, leader, follower, "missed", "key001", "batch1", "txn")
+}
+
+func TestReplicationAPI(t *testing.T) {
+	leader := newTestStore(t, t.TempDir())
+	defer leader.Close()
+	leaderServer := httptest.NewServer(newRouter(leader))
+	defer leaderServer.Close()
+	assert.NoError(t, leader.Set("key", json.RawMessage(`{"value": 1}`)))
+
+	follower := newTestStore(t, t.TempDir(), WithFollower(leaderServer.URL))
+	defer follower.Close()
+	followerServer := httptest.NewServer(newRouter(follower))
+	defer followerServer.Close()
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) }, 10*time.Second, 10*time.Millisecond)
+
+	client := &http.Client{}
+	defer client.CloseIdleConnections()
+
+	// Reads are served, writes are turned away
+	resp, err := client.Get(followerServer.URL + "/api/keys/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.JSONEq(t, `{"value": {"value": 1}}`, string(body))
+	_, version, _ := leader.GetVersion("key")
+	assert.Equal(t, formatETag(version), resp.Header.Get("ETag"))
+
+	resp, err = client.Post(followerServer.URL+"/api/keys/key", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, string(body), leaderServer.URL)
+
+	var status ReplicationStatus
+	resp, err = client.Get(followerServer.URL + "/api/replication/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.Equal(t, "follower", status.Role)
+	assert.True(t, status.Connected)
+
+	resp, err = client.Get(leaderServer.URL + "/api/replication/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = ReplicationStatus{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	resp.Body.Close()
+	assert.Equal(t, "leader", status.Role)
+	assert.Len(t, status.Followers, 1)
+
+	// Asking for records the leader never wrote
+	resp, err = client.Get(leaderServer.URL + "/api/replication/stream?from=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, 409, resp.StatusCode)
+}
+
+func TestReplicationGap(t *testing.T) {
+	leader := newTestStore(t, t.TempDir(), WithWALSegmentSize(256))
+	defer leader.Close()
+	server := httptest.NewServer(newRouter(leader))
+	defer server.Close()
+	assert.NoError(t, leader.Set("key", json.RawMessage(`1`)))
+
+	followerDir := t.TempDir()
+	follower := newTestStore(t, followerDir, WithFollower(server.URL))
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) }, 10*time.Second, 10*time.Millisecond)
+
+	// While the follower is connected, the leader keeps the log it has yet to read
+	assert.NoError(t, follower.Close())
+	assert.Eventually(t, func() bool {
+		return len(leader.ReplicationStatus().Followers) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Once it has gone, the log it needs is removed
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, leader.Set(fmt.Sprintf("key%d", i), json.RawMessage(`"a value long enough to fill segments"`)))
+	}
+	assert.NoError(t, leader.Flush())
+
+	follower = newTestStore(t, followerDir, WithFollower(server.URL))
+	defer follower.Close()
+	assert.Eventually(t, func() bool {
+		return follower.ReplicationStatus().Error != ""
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Contains(t, follower.ReplicationStatus().Error, ErrReplicationGap.Error())
+}
+
+func TestWALRetain(t *testing.T) {
+	wal, err := NewWAL(t.TempDir(), 64, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	var last uint64
+	for i := 0; i < 20; i++ {
+		ops := []Operation{{Key: fmt.Sprintf("key%d", i), Value: json.RawMessage(`"some value"`)}}
+		assert.NoError(t, wal.Append(ops))
+		last = ops[0].Seq
+	}
+
+	// A follower still needs the records from 11, which starts a segment
+	assert.Contains(t, wal.segments, uint64(11))
+	wal.Retain = func() (uint64, bool) { return 11, true }
+	assert.NoError(t, wal.Checkpoint(last))
+	_, err = wal.cursor(10)
+	assert.ErrorIs(t, err, ErrReplicationGap)
+
+	cursor, err := wal.cursor(11)
+	assert.NoError(t, err)
+	records, err := cursor.read()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 10) {
+		assert.Equal(t, "key10", records[0][0].Key)
+		assert.Equal(t, uint64(11), records[0][0].Seq)
+	}
+
+	// Records appended later are picked up where the cursor left off
+	assert.NoError(t, wal.Append([]Operation{{Key: "a", Value: json.RawMessage(`1`)}, {Key: "b", Deleted: true}}))
+	records, err = cursor.read()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, []Operation{
+			{Seq: last + 2, Key: "a", Value: json.RawMessage(`1`)},
+			{Seq: last + 3, Key: "b", Deleted: true},
+		}, records[0])
+	}
+	records, err = cursor.read()
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	// Once it has caught up, the rest can go
+	wal.Retain = nil
+	assert.NoError(t, wal.Checkpoint(last+3))
+	_, err = wal.cursor(11)
+	assert.ErrorIs(t, err, ErrReplicationGap)
+}
+
+func TestFollowerRecopiesSnapshot(t *testing.T) {
+	// A leader that is cut off part way through sending a snapshot
+	partial := gin.New()
+	partial.GET("/api/replication/stream", func(c *gin.Context) {
+		c.String(200, `{"type": "entries", "ops": [{"seq": 1, "key": "stale", "value": 1}, {"seq": 2, "key": "kept", "value": 1}]}`+"\n")
+	})
+	partialServer := httptest.NewServer(partial)
+	defer partialServer.Close()
+
+	followerDir := t.TempDir()
+	follower := newTestStore(t, followerDir, WithFollower(partialServer.URL))
+	assert.Eventually(t, func() bool {
+		_, ok := follower.Get("stale")
+		return ok
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NoError(t, follower.Close())
+
+	leader := newTestStore(t, t.TempDir())
+	defer leader.Close()
+	server := httptest.NewServer(newRouter(leader))
+	defer server.Close()
+	assert.NoError(t, leader.Set("kept", json.RawMessage(`2`)))
+	assert.NoError(t, leader.Set("new", json.RawMessage(`3`)))
+
+	// The snapshot is copied again, without what it no longer has
+	follower = newTestStore(t, followerDir, WithFollower(server.URL))
+	defer follower.Close()
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) }, 10*time.Second, 10*time.Millisecond)
+	assertReplicated(t, leader, follower, "stale", "kept", "new")
+}
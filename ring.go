@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Points each shard has on the hash ring. More points spread the keys more
+// evenly between shards.
+const DefaultVirtualNodes = 128
+
+// hashRing assigns keys to shards by consistent hashing. Each shard is hashed
+// to many points around a ring of 32-bit hashes, and a key belongs to the
+// shard at the first point at or after the key's hash, going round. Adding a
+// shard only moves the keys that fall just before its points, all of them to
+// the new shard.
+type hashRing struct {
+	points []ringPoint // In order of hash
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+// newHashRing returns a ring of the shards with vnodes points each.
+func newHashRing(shards []string, vnodes int) *hashRing {
+	ring := &hashRing{}
+	for _, shard := range shards {
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{hash: ringHash(shard + "#" + strconv.Itoa(i)), shard: shard})
+		}
+	}
+	// Shards whose points share a hash are ordered by name, so every ring of
+	// the same shards agrees
+	sort.Slice(ring.points, func(i, j int) bool {
+		a, b := ring.points[i], ring.points[j]
+		return a.hash < b.hash || (a.hash == b.hash && a.shard < b.shard)
+	})
+	return ring
+}
+
+// owner returns the shard the key belongs to, or "" if the ring is empty.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ringHash places a key on the ring. Keys are hashed as the store hashes them,
+// then the bits are mixed, as FNV alone leaves short keys that differ only at
+// the end close together.
+func ringHash(key string) uint32 {
+	h := hashKey(key)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
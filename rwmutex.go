@@ -1,50 +1,164 @@
 package main
 
-// myRWMutex is a struct that represents a read-write mutex.
-// It has two channels: mut for write locks and readers for read locks.
+import "context"
+
+// myRWMutex is a reader/writer lock. Any number of readers can hold it at
+// once, or a single writer. Writers are preferred: once a writer is waiting,
+// readers that arrive after it wait until it has had the lock, so a steady
+// stream of readers cannot starve writers. Readers that were already waiting
+// when a writer releases the lock go next, so writers cannot starve them either.
+//
+// Unlike sync.RWMutex, acquiring the lock can give up when a context is done,
+// and TryLock and TryRLock never block.
 type myRWMutex struct {
-  mut     chan struct{} // Channel used for write locks.
-  readers chan int      // Channel used for read locks.
+	state   chan struct{} // Held while reading or changing the fields below, capacity 1.
+	readers int           // Number of readers holding the lock.
+	writer  bool          // Whether a writer holds the lock.
+	waiting int           // Number of writers waiting for the lock.
+	release uint64        // Number of times a writer has released the lock.
+	changed chan struct{} // Closed and replaced whenever the lock may have become free.
 }
 
 // newMyRWMutex is a constructor function that creates a new myRWMutex.
-// It initializes the mut channel with a buffer size of 1 to allow one write lock at a time.
-// It also initializes the readers channel with a buffer size of 1 to allow one read lock at a time.
 func newMyRWMutex() *myRWMutex {
-  return &myRWMutex{
-    mut:     make(chan struct{}, 1), // Initialize the mut channel.
-    readers: make(chan int, 1),      // Initialize the readers channel.
-  }
+	return &myRWMutex{
+		state:   make(chan struct{}, 1),
+		changed: make(chan struct{}),
+	}
+}
+
+func (m *myRWMutex) acquireState() {
+	m.state <- struct{}{}
+}
+
+func (m *myRWMutex) releaseState() {
+	<-m.state
+}
+
+// broadcast wakes every goroutine waiting for the lock, so they can check
+// whether they can take it now. It must be called with the state held.
+func (m *myRWMutex) broadcast() {
+	close(m.changed)
+	m.changed = make(chan struct{})
 }
 
-// Lock is a method that acquires a write lock.
-// It sends an empty struct to the mut channel.
-// If the channel is full, this operation will block until the channel is empty,
-// ensuring that only one goroutine can acquire the write lock at a time.
+// wait releases the state until the lock changes or the context is done, and
+// then takes the state back. It must be called with the state held.
+func (m *myRWMutex) wait(ctx context.Context) error {
+	changed := m.changed
+	m.releaseState()
+
+	var err error
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	m.acquireState()
+	return err
+}
+
+// Lock acquires the write lock, blocking until there are no readers and no other writer.
 func (m *myRWMutex) Lock() {
-  m.mut <- struct{}{} // Acquire the write lock.
+	m.LockContext(context.Background())
+}
+
+// LockContext acquires the write lock like Lock, but gives up and returns the
+// context's error if the context is done first.
+func (m *myRWMutex) LockContext(ctx context.Context) error {
+	m.acquireState()
+	defer m.releaseState()
+
+	// Registering as waiting holds back readers that arrive from now on
+	m.waiting++
+	for m.writer || m.readers > 0 {
+		if err := m.wait(ctx); err != nil {
+			m.waiting--
+			// Readers held back by this writer may be able to go now
+			m.broadcast()
+			return err
+		}
+	}
+	m.waiting--
+
+	m.writer = true
+	return nil
+}
+
+// TryLock acquires the write lock if it is free, and reports whether it did.
+func (m *myRWMutex) TryLock() bool {
+	m.acquireState()
+	defer m.releaseState()
+
+	if m.writer || m.readers > 0 {
+		return false
+	}
+	m.writer = true
+	return true
 }
 
-// Unlock is a method that releases a write lock.
-// It receives from the mut channel.
-// If the channel is empty, this operation will block until the channel is full,
-// ensuring that a goroutine can only release the write lock if it has acquired it.
+// Unlock releases the write lock. It panics if the write lock is not held.
 func (m *myRWMutex) Unlock() {
-  <-m.mut // Release the write lock.
+	m.acquireState()
+	defer m.releaseState()
+
+	if !m.writer {
+		panic("myRWMutex: Unlock of unlocked mutex")
+	}
+	m.writer = false
+	m.release++
+	m.broadcast()
 }
 
-// RLock is a method that acquires a read lock.
-// It sends an integer to the readers channel.
-// If the channel is full, this operation will block until the channel is empty,
-// ensuring that only one goroutine can acquire the read lock at a time.
+// RLock acquires a read lock, blocking while a writer holds or is waiting for the lock.
 func (m *myRWMutex) RLock() {
-  m.readers <- 1 // Acquire the read lock.
+	m.RLockContext(context.Background())
+}
+
+// RLockContext acquires a read lock like RLock, but gives up and returns the
+// context's error if the context is done first.
+func (m *myRWMutex) RLockContext(ctx context.Context) error {
+	m.acquireState()
+	defer m.releaseState()
+
+	// Only writers already waiting when this reader arrived can make it wait
+	// past the next time a writer releases the lock
+	release := m.release
+	for m.writer || (m.waiting > 0 && m.release == release) {
+		if err := m.wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	m.readers++
+	return nil
 }
 
-// RUnlock is a method that releases a read lock.
-// It receives from the readers channel.
-// If the channel is empty, this operation will block until the channel is full,
-// ensuring that a goroutine can only release the read lock if it has acquired it.
+// TryRLock acquires a read lock if no writer holds or is waiting for the lock,
+// and reports whether it did.
+func (m *myRWMutex) TryRLock() bool {
+	m.acquireState()
+	defer m.releaseState()
+
+	if m.writer || m.waiting > 0 {
+		return false
+	}
+	m.readers++
+	return true
+}
+
+// RUnlock releases a read lock. It panics if no read lock is held.
 func (m *myRWMutex) RUnlock() {
-  <-m.readers // Release the read lock.
-}
\ No newline at end of file
+	m.acquireState()
+	defer m.releaseState()
+
+	if m.readers == 0 {
+		panic("myRWMutex: RUnlock of unlocked mutex")
+	}
+	m.readers--
+	if m.readers == 0 {
+		// The last reader out lets waiting writers in
+		m.broadcast()
+	}
+}
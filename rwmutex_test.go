@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRWMutexConcurrentReaders(t *testing.T) {
+	m := newMyRWMutex()
+
+	// Every reader holds the lock until all of them have it
+	n := 10
+	var holding sync.WaitGroup
+	holding.Add(n)
+	done := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			m.RLock()
+			holding.Done()
+			holding.Wait()
+			m.RUnlock()
+		}()
+	}
+	go func() {
+		holding.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Readers could not hold the lock at the same time")
+	}
+}
+
+func TestRWMutexWriterExcludesReaders(t *testing.T) {
+	m := newMyRWMutex()
+
+	m.RLock()
+	assert.False(t, m.TryLock())
+	m.RUnlock()
+
+	assert.True(t, m.TryLock())
+	assert.False(t, m.TryLock())
+	assert.False(t, m.TryRLock())
+	m.Unlock()
+
+	assert.True(t, m.TryRLock())
+	assert.True(t, m.TryRLock())
+	m.RUnlock()
+	m.RUnlock()
+}
+
+func TestRWMutexWriterPreference(t *testing.T) {
+	m := newMyRWMutex()
+	m.RLock()
+
+	// A writer waits for the reader to finish
+	locked := make(chan struct{})
+	go func() {
+		m.Lock()
+		close(locked)
+	}()
+	assert.Eventually(t, func() bool {
+		m.acquireState()
+		defer m.releaseState()
+		return m.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	// New readers queue up behind the waiting writer instead of overtaking it
+	assert.False(t, m.TryRLock())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, m.RLockContext(ctx))
+
+	read := make(chan struct{})
+	go func() {
+		m.RLock()
+		close(read)
+	}()
+
+	m.RUnlock()
+	<-locked
+	select {
+	case <-read:
+		t.Fatal("Reader got the lock while the writer held it")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The waiting reader goes once the writer is done
+	m.Unlock()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("Reader did not get the lock after the writer released it")
+	}
+	m.RUnlock()
+}
+
+func TestRWMutexReadersNotStarvedByWriters(t *testing.T) {
+	m := newMyRWMutex()
+	m.Lock()
+
+	read := make(chan struct{})
+	go func() {
+		m.RLock()
+		close(read)
+		m.RUnlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Another writer queues up, but the reader that was already waiting goes first
+	go func() {
+		m.Lock()
+		m.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	m.Unlock()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("Reader waiting before the second writer did not get the lock")
+	}
+}
+
+func TestRWMutexLockContext(t *testing.T) {
+	m := newMyRWMutex()
+	m.RLock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, m.LockContext(ctx))
+
+	// The writer that gave up no longer holds readers back
+	assert.True(t, m.TryRLock())
+	m.RUnlock()
+	m.RUnlock()
+
+	assert.NoError(t, m.LockContext(context.Background()))
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, m.RLockContext(ctx))
+	m.Unlock()
+}
+
+func TestRWMutexUnlockOfUnlockedPanics(t *testing.T) {
+	m := newMyRWMutex()
+	assert.Panics(t, m.Unlock)
+	assert.Panics(t, m.RUnlock)
+}
+
+func TestRWMutexStress(t *testing.T) {
+	m := newMyRWMutex()
+
+	// Writers update both counters together, so readers must never see them differ
+	var a, b int
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				m.Lock()
+				a++
+				b++
+				m.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				m.RLock()
+				if a != b {
+					t.Errorf("Read %d and %d while a write was in progress", a, b)
+				}
+				m.RUnlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1600, a)
+}
+
+func TestStoreConcurrentReadsAndWrites(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(10, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, kv.Set(fmt.Sprintf("key%d", j%20), json.RawMessage(fmt.Sprint(i))))
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 300; j++ {
+				kv.Get(fmt.Sprintf("key%d", j%20))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j := 0; j < 20; j++ {
+		_, ok := kv.Get(fmt.Sprintf("key%d", j))
+		assert.True(t, ok)
+	}
+}
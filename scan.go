@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Number of entries an Iterator reads under the store's lock at a time
+const scanChunkSize = 100
+
+// Iterator steps through a range of keys in order. It reads the range a chunk
+// at a time, each under the store's read lock, so writes are not held up while
+// it is in use; each chunk reflects the store as it was when it was read.
+//
+//	it := kv.Prefix("user:")
+//	for it.Next() {
+//		fmt.Println(it.Key(), string(it.Value()))
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	store   *Store
+	from    string // Smallest key the next chunk can start at
+	end     string // Keys from end on are past the range, unless it is empty
+	limit   int    // Most entries to return, or 0 for no limit
+	count   int    // Entries returned so far
+	entries []StoreEntry
+	entry   StoreEntry
+	done    bool // Whether the last chunk has been read
+	err     error
+}
+
+// Scan returns an iterator over the keys from start up to but not including
+// end, in order, and stops after limit entries. An empty end leaves the range
+// open, and a limit of 0 returns every entry in the range.
+func (s *Store) Scan(start string, end string, limit int) *Iterator {
+	return &Iterator{store: s, from: start, end: end, limit: limit}
+}
+
+// Prefix returns an iterator over the keys that start with the prefix, in order.
+func (s *Store) Prefix(prefix string) *Iterator {
+	return s.Scan(prefix, prefixEnd(prefix), 0)
+}
+
+// prefixEnd returns the smallest key that is greater than every key with the
+// prefix, or an empty string if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// keyAfter returns the smallest key that is greater than the key.
+func keyAfter(key string) string {
+	return key + "\x00"
+}
+
+// Next moves the iterator to the next entry, and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		return false
+	}
+
+	if len(it.entries) == 0 {
+		if it.done {
+			return false
+		}
+
+		n := scanChunkSize
+		if it.limit > 0 && it.limit-it.count < n {
+			n = it.limit - it.count
+		}
+		it.entries, it.err = it.store.scanChunk(it.from, it.end, n)
+		if it.err != nil {
+			return false
+		}
+		if len(it.entries) < n {
+			it.done = true
+		}
+		if len(it.entries) == 0 {
+			return false
+		}
+		it.from = keyAfter(it.entries[len(it.entries)-1].Key)
+	}
+
+	it.entry = it.entries[0]
+	it.entries = it.entries[1:]
+	it.count++
+	return true
+}
+
+// Key returns the key of the current entry.
+func (it *Iterator) Key() string {
+	return it.entry.Key
+}
+
+// Value returns the value of the current entry.
+func (it *Iterator) Value() json.RawMessage {
+	return it.entry.Value
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// scanChunk returns up to n entries with keys from start up to but not
+// including end, in order. Writes still in the write batch take the place of
+// what is on disk, and deletes waiting there hide the key, as do expired values.
+func (s *Store) scanChunk(start string, end string, n int) ([]StoreEntry, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	pending := s.Buffer.pendingRange(start, end)
+	entries := make([]StoreEntry, 0, n)
+	add := func(op Operation) {
+		if !op.Deleted && !op.expired(now) {
+			entries = append(entries, StoreEntry{Key: op.Key, Value: op.Value})
+		}
+	}
+
+	err := s.Buffer.Disk.Scan(start, end, func(key string, value json.RawMessage) bool {
+		// Pending writes to keys before this one come first
+		for len(pending) > 0 && pending[0].Key < key && len(entries) < n {
+			add(pending[0])
+			pending = pending[1:]
+		}
+		if len(entries) >= n {
+			return false
+		}
+
+		if len(pending) > 0 && pending[0].Key == key {
+			add(pending[0])
+			pending = pending[1:]
+		} else {
+			entries = append(entries, StoreEntry{Key: key, Value: value})
+		}
+		return len(entries) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Then the pending writes past the last key on disk
+	for len(pending) > 0 && len(entries) < n {
+		add(pending[0])
+		pending = pending[1:]
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scanKeys returns the keys and values the iterator steps through, as "key=value".
+func scanKeys(t *testing.T, it *Iterator) []string {
+	t.Helper()
+
+	var got []string
+	for it.Next() {
+		got = append(got, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	assert.NoError(t, it.Err())
+	return got
+}
+
+func TestScanMergesWriteBatchWithDisk(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	for _, key := range []string{"b", "d", "f", "h"} {
+		assert.NoError(t, kv.Set(key, json.RawMessage(`"disk"`)))
+	}
+	assert.NoError(t, kv.Flush())
+
+	// Pending writes add, replace and delete keys on disk
+	assert.NoError(t, kv.Set("a", json.RawMessage(`"new"`)))
+	assert.NoError(t, kv.Set("d", json.RawMessage(`"new"`)))
+	assert.NoError(t, kv.Delete("f"))
+	assert.NoError(t, kv.Set("g", json.RawMessage(`"new"`)))
+	assert.NoError(t, kv.Set("z", json.RawMessage(`"new"`)))
+
+	tests := []struct {
+		start, end string
+		limit      int
+		want       []string
+	}{
+		{"", "", 0, []string{`a="new"`, `b="disk"`, `d="new"`, `g="new"`, `h="disk"`, `z="new"`}},
+		{"c", "", 0, []string{`d="new"`, `g="new"`, `h="disk"`, `z="new"`}},
+		{"b", "h", 0, []string{`b="disk"`, `d="new"`, `g="new"`}},
+		{"", "", 3, []string{`a="new"`, `b="disk"`, `d="new"`}},
+		{"e", "g", 0, nil},
+	}
+
+	for _, test := range tests {
+		got := scanKeys(t, kv.Scan(test.start, test.end, test.limit))
+		assert.Equal(t, test.want, got, "start %q end %q limit %d", test.start, test.end, test.limit)
+	}
+}
+
+func TestScanAcrossChunks(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(10, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	n := 3*scanChunkSize + 7
+	for i := 0; i < n; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("key%04d", i), json.RawMessage(fmt.Sprint(i))))
+	}
+
+	// The store is not locked between chunks, so writes can go on while iterating
+	it := kv.Prefix("key")
+	count := 0
+	for it.Next() {
+		assert.Equal(t, fmt.Sprintf("key%04d", count), it.Key())
+		if count%50 == 0 {
+			assert.NoError(t, kv.Set(fmt.Sprintf("other%d", count), json.RawMessage("1")))
+		}
+		count++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, n, count)
+}
+
+func TestPrefix(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	for _, key := range []string{"user", "user:1", "user:2", "user;", "users", "admin:1", "\xff\xff"} {
+		assert.NoError(t, kv.Set(key, json.RawMessage("1")))
+	}
+
+	assert.Equal(t, []string{"user:1=1", "user:2=1"}, scanKeys(t, kv.Prefix("user:")))
+	assert.Equal(t, []string{"\xff\xff=1"}, scanKeys(t, kv.Prefix("\xff")))
+	assert.Len(t, scanKeys(t, kv.Prefix("")), 7)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, want string
+	}{
+		{"", ""},
+		{"a", "b"},
+		{"user:", "user;"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, prefixEnd(test.prefix), "prefix %q", test.prefix)
+	}
+}
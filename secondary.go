@@ -0,0 +1,678 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A secondary index maps the values of a field of the documents in the store
+// to the keys of the documents. It is a B+tree like the primary index, kept in
+// its own file, whose keys are the encoded field value followed by the
+// primary key; see encodeIndexValue. Only strings, numbers and booleans are
+// indexed, and a field holding an array is indexed under each of them. A
+// value too long to fit in an entry alongside its key is not left out: the
+// document gets an overflow entry of its key alone instead, and queries check
+// the documents with overflow entries against the values they are after.
+//
+// Secondary indexes are updated as records are written to disk, so writes
+// still in the write batch are merged in when querying, as for scans, and
+// recovery updates them as it replays the log. They are committed just before
+// the primary index, so after a crash they are never behind it.
+
+// SecondaryIndex indexes the documents in the store by the value at a JSON path.
+type SecondaryIndex struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+
+	path jsonPath
+	tree *IndexTree
+}
+
+// IndexRange selects the entries of a secondary index with values from Min to
+// Max, inclusive. A nil bound leaves that end of the range open, but still
+// only covers values of the other bound's type. Booleans sort before numbers,
+// and numbers before strings.
+type IndexRange struct {
+	Min interface{}
+	Max interface{}
+}
+
+// ErrIndexNotFound is returned when using a secondary index that does not exist.
+var ErrIndexNotFound = errors.New("index not found")
+
+// ErrIndexExists is returned when creating a secondary index with the name of one that already exists.
+var ErrIndexExists = errors.New("index already exists")
+
+// ErrBadIndexName is returned when creating a secondary index with a name that
+// is empty or has characters other than letters, digits, "-" and "_".
+var ErrBadIndexName = errors.New("index names may only contain letters, digits, - and _")
+
+var indexNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Suffix of the file listing the secondary indexes, after the index filename
+const indexCatalogSuffix = ".indexes"
+
+// Type tags of encoded index values, in the order values of each type sort
+const (
+	indexBool byte = iota + 1
+	indexNumber
+	indexString
+)
+
+// Tag of overflow entries, which sort before every value
+const indexOverflow byte = 0
+
+// encodeIndexValue encodes a string, number or boolean so that encoded values
+// sort in the same order as the values, and no encoded value is a prefix of
+// another. It returns false for values of other types.
+func encodeIndexValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return string([]byte{indexBool, 1}), true
+		}
+		return string([]byte{indexBool, 0}), true
+	case float64:
+		// Flip the sign bit of positive numbers, and every bit of negative
+		// ones, so their bytes sort in numeric order
+		bits := math.Float64bits(v)
+		if v == 0 {
+			bits = 0 // -0 and 0 are the same value
+		}
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return string(binary.BigEndian.AppendUint64([]byte{indexNumber}, bits)), true
+	case string:
+		// Escape zero bytes so the terminator sorts before anything that follows
+		return string([]byte{indexString}) + strings.ReplaceAll(v, "\x00", "\x00\xff") + "\x00\x01", true
+	}
+	return "", false
+}
+
+// encodedValueLen returns the length of the encoded value at the start of an
+// index entry key.
+func encodedValueLen(entry string) int {
+	if entry == "" {
+		return 0
+	}
+	switch entry[0] {
+	case indexBool:
+		return 2
+	case indexNumber:
+		return 9
+	case indexString:
+		if end := strings.Index(entry, "\x00\x01"); end >= 0 {
+			return end + 2
+		}
+	}
+	return len(entry)
+}
+
+// bounds returns the entry keys the range starts at and ends before. An empty
+// end leaves the range open.
+func (r IndexRange) bounds() (string, string) {
+	var start, end string
+	if min, ok := encodeIndexValue(r.Min); ok {
+		start = min
+	}
+	if max, ok := encodeIndexValue(r.Max); ok {
+		end = prefixEnd(max)
+	}
+
+	// An open end only covers the type of the other bound
+	if start == "" && end != "" {
+		start = end[:1]
+	} else if end == "" && start != "" {
+		end = prefixEnd(start[:1])
+	}
+	return start, end
+}
+
+// inRange reports whether the encoded value is within the bounds returned by IndexRange.bounds.
+func inRange(value string, start string, end string) bool {
+	return value >= start && (end == "" || value < end)
+}
+
+// values returns the encoded values the index holds for the document.
+func (idx *SecondaryIndex) values(data json.RawMessage) []string {
+	value, ok := idx.path.extract(data)
+	if !ok {
+		return nil
+	}
+
+	elements := []interface{}{value}
+	if array, ok := value.([]interface{}); ok {
+		elements = array
+	}
+
+	var values []string
+	seen := make(map[string]bool)
+	for _, element := range elements {
+		if encoded, ok := encodeIndexValue(element); ok && !seen[encoded] {
+			seen[encoded] = true
+			values = append(values, encoded)
+		}
+	}
+	return values
+}
+
+// fitsIndexEntry reports whether the encoded value fits in an index entry
+// alongside the key.
+func fitsIndexEntry(value string, key string) bool {
+	return len(value)+len(key) <= MaxKeySize
+}
+
+// overflowEntry returns the entry that finds the document at the key when it
+// has values too long for entries of their own. A key too long to fit after
+// the tag keeps its last byte in the hash, which is otherwise always 0 in a
+// secondary index.
+func overflowEntry(key string) IndexValue {
+	tag := string([]byte{indexOverflow})
+	if len(key) < MaxKeySize {
+		return IndexValue{Key: tag + key}
+	}
+	return IndexValue{Hash: uint32(key[len(key)-1]) + 1, Key: tag + key[:len(key)-1]}
+}
+
+// overflowKey returns the key of the document an overflow entry finds.
+func overflowKey(entry IndexValue) string {
+	key := entry.Key[1:]
+	if entry.Hash != 0 {
+		key += string([]byte{byte(entry.Hash - 1)})
+	}
+	return key
+}
+
+// entries returns the index entries for the document at the key: each of its
+// values followed by the key, and an overflow entry in place of those that
+// don't fit.
+func (idx *SecondaryIndex) entries(key string, data json.RawMessage) []IndexValue {
+	var entries []IndexValue
+	overflow := false
+	for _, value := range idx.values(data) {
+		if !fitsIndexEntry(value, key) {
+			overflow = true
+			continue
+		}
+		entries = append(entries, IndexValue{Key: value + key})
+	}
+	if overflow {
+		entries = append(entries, overflowEntry(key))
+	}
+	return entries
+}
+
+// update replaces the entries for the key's old document with those for its
+// new one. A nil document has no entries.
+func (idx *SecondaryIndex) update(key string, old json.RawMessage, new json.RawMessage) error {
+	oldEntries := idx.entries(key, old)
+	newEntries := idx.entries(key, new)
+
+	keep := make(map[IndexValue]bool, len(newEntries))
+	for _, entry := range newEntries {
+		keep[entry] = true
+	}
+	for _, entry := range oldEntries {
+		if !keep[entry] {
+			if _, _, err := idx.tree.Delete(entry.Hash, entry.Key); err != nil {
+				return err
+			}
+		}
+		delete(keep, entry)
+	}
+	for _, entry := range newEntries {
+		if !keep[entry] {
+			continue
+		}
+		if _, _, err := idx.tree.Put(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Suffix of the files secondary indexes are kept in, after the index filename and the index name
+const secondaryIndexSuffix = ".sidx"
+
+// secondaryIndexFilename returns the name of the file a secondary index is kept in.
+func (d *Disk) secondaryIndexFilename(name string) string {
+	return d.IndexFilename + "." + name + secondaryIndexSuffix
+}
+
+// openSecondaryIndexes opens the secondary indexes listed in the catalog.
+func (d *Disk) openSecondaryIndexes() error {
+	d.secondary = make(map[string]*SecondaryIndex)
+
+	data, err := os.ReadFile(d.IndexFilename + indexCatalogSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var indexes []*SecondaryIndex
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		return fmt.Errorf("reading index catalog: %w", err)
+	}
+	for _, idx := range indexes {
+		if idx.path, err = parseJSONPath(idx.Path); err != nil {
+			return err
+		}
+		if idx.tree, err = OpenIndexTree(d.secondaryIndexFilename(idx.Name), DefaultIndexCachePages, d.keys); err != nil {
+			return fmt.Errorf("opening index %q: %w", idx.Name, err)
+		}
+		d.secondary[idx.Name] = idx
+	}
+	return nil
+}
+
+// saveIndexCatalog durably replaces the catalog with the current secondary indexes.
+func (d *Disk) saveIndexCatalog() error {
+	indexes := d.Indexes()
+	data, err := json.Marshal(indexes)
+	if err != nil {
+		return err
+	}
+
+	filename := d.IndexFilename + indexCatalogSuffix
+	file, err := os.OpenFile(filename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return renameAndSync(filename+".tmp", filename)
+}
+
+// Indexes returns the secondary indexes, sorted by name.
+func (d *Disk) Indexes() []*SecondaryIndex {
+	indexes := make([]*SecondaryIndex, 0, len(d.secondary))
+	for _, idx := range d.secondary {
+		indexes = append(indexes, idx)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].Name < indexes[j].Name
+	})
+	return indexes
+}
+
+// CreateIndex creates a secondary index on the value at the JSON path and
+// fills it from the documents on disk. It is only added to the catalog once
+// it is complete, so an index interrupted by a crash is simply not there.
+func (d *Disk) CreateIndex(name string, path string) error {
+	if !indexNamePattern.MatchString(name) {
+		return ErrBadIndexName
+	}
+	if _, ok := d.secondary[name]; ok {
+		return ErrIndexExists
+	}
+	parsed, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+
+	tree, err := createIndexTree(d.secondaryIndexFilename(name), d.keys)
+	if err != nil {
+		return err
+	}
+	idx := &SecondaryIndex{Name: name, Path: path, path: parsed, tree: tree}
+
+	var readErr error
+	err = d.Index.Walk(func(value IndexValue) bool {
+		record, err := d.readRecord(value)
+		if err != nil {
+			readErr = fmt.Errorf("reading record for %q: %w", value.Key, err)
+			return false
+		}
+		if !record.Deleted {
+			if readErr = idx.update(record.Key, nil, record.Data); readErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err == nil {
+		err = tree.Commit()
+	}
+	if err != nil {
+		tree.Close()
+		return err
+	}
+
+	d.secondary[name] = idx
+	if err := d.saveIndexCatalog(); err != nil {
+		delete(d.secondary, name)
+		tree.Close()
+		return err
+	}
+	return nil
+}
+
+// DropIndex removes the secondary index and its file.
+func (d *Disk) DropIndex(name string) error {
+	idx, ok := d.secondary[name]
+	if !ok {
+		return ErrIndexNotFound
+	}
+
+	delete(d.secondary, name)
+	if err := d.saveIndexCatalog(); err != nil {
+		d.secondary[name] = idx
+		return err
+	}
+
+	idx.tree.Close()
+	return os.Remove(d.secondaryIndexFilename(name))
+}
+
+// updateSecondaryIndexes updates every secondary index for a write to the key
+// that replaces the old record, if there is one.
+func (d *Disk) updateSecondaryIndexes(old IndexValue, exists bool, op Operation) error {
+	if len(d.secondary) == 0 {
+		return nil
+	}
+
+	var oldData json.RawMessage
+	if exists {
+		record, err := d.readRecord(old)
+		if err != nil {
+			return fmt.Errorf("reading record for %q: %w", op.Key, err)
+		}
+		if !record.Deleted {
+			oldData = record.Data
+		}
+	}
+	var newData json.RawMessage
+	if !op.Deleted {
+		newData = op.Value
+	}
+
+	for _, idx := range d.secondary {
+		if err := idx.update(op.Key, oldData, newData); err != nil {
+			return fmt.Errorf("updating index %q: %w", idx.Name, err)
+		}
+	}
+	return nil
+}
+
+// commitSecondaryIndexes durably writes the changes to every secondary index.
+func (d *Disk) commitSecondaryIndexes() error {
+	for _, idx := range d.secondary {
+		if err := idx.tree.Commit(); err != nil {
+			return fmt.Errorf("committing index %q: %w", idx.Name, err)
+		}
+	}
+	return nil
+}
+
+// closeSecondaryIndexes closes the files of every secondary index.
+func (d *Disk) closeSecondaryIndexes() error {
+	for _, idx := range d.secondary {
+		if err := idx.tree.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateIndex creates a secondary index named name on the value at the JSON
+// path in each document, and fills it from the documents already stored.
+// Writes wait until it has been filled.
+func (s *Store) CreateIndex(name string, path string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.Buffer.Disk.CreateIndex(name, path)
+}
+
+// DropIndex removes the secondary index.
+func (s *Store) DropIndex(name string) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	return s.Buffer.Disk.DropIndex(name)
+}
+
+// Indexes returns the secondary indexes, sorted by name.
+func (s *Store) Indexes() []*SecondaryIndex {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return s.Buffer.Disk.Indexes()
+}
+
+// QueryIndex returns the documents whose value at the secondary index's path
+// is in the range, in order of that value and then of key, stopping after
+// limit entries. A limit of 0 returns every entry in the range.
+func (s *Store) QueryIndex(name string, r IndexRange, limit int) ([]StoreEntry, error) {
+	entries := []StoreEntry{}
+	it := s.scanIndex(name, []IndexRange{r}, limit)
+	for it.Next() {
+		entries = append(entries, it.entry)
+	}
+	return entries, it.Err()
+}
+
+// indexSpan is the index entries from start up to but not including end that
+// a range of values covers.
+type indexSpan struct {
+	start string
+	end   string
+}
+
+// indexIterator steps through the documents a secondary index finds in a list
+// of ranges, one range after another, each in order of value and then of key.
+// Like Iterator, it reads a chunk at a time under the store's read lock, so
+// memory does not grow with the number of documents. A document with more than
+// one value is found once, at its first value in the first range it is in.
+type indexIterator struct {
+	store *Store
+	name  string
+	spans []indexSpan
+	span  int    // Range being read
+	from  string // Smallest index entry the next chunk can start at
+	limit int    // Most entries to return, or 0 for no limit
+	count int    // Entries returned so far
+
+	entries []StoreEntry
+	entry   StoreEntry
+	err     error
+}
+
+// scanIndex returns an iterator over the documents the index finds in the
+// ranges, stopping after limit of them, or none if limit is 0.
+func (s *Store) scanIndex(name string, ranges []IndexRange, limit int) *indexIterator {
+	it := &indexIterator{store: s, name: name, limit: limit}
+	for _, r := range ranges {
+		start, end := r.bounds()
+		it.spans = append(it.spans, indexSpan{start: start, end: end})
+	}
+	return it
+}
+
+// Next moves the iterator to the next document, and reports whether there is one.
+func (it *indexIterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		return false
+	}
+
+	for len(it.entries) == 0 {
+		if it.span >= len(it.spans) {
+			return false
+		}
+
+		n := scanChunkSize
+		if it.limit > 0 && it.limit-it.count < n {
+			n = it.limit - it.count
+		}
+		var chunk []indexMatch
+		chunk, it.err = it.store.indexChunk(it.name, it.spans, it.span, it.from, n)
+		if it.err != nil {
+			return false
+		}
+		if len(chunk) < n {
+			it.span, it.from = it.span+1, ""
+		} else {
+			it.from = keyAfter(chunk[len(chunk)-1].entry)
+		}
+		for _, m := range chunk {
+			it.entries = append(it.entries, m.StoreEntry)
+		}
+	}
+
+	it.entry = it.entries[0]
+	it.entries = it.entries[1:]
+	it.count++
+	return true
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *indexIterator) Err() error {
+	return it.err
+}
+
+// indexMatch is a document found by the index entry it was found at.
+type indexMatch struct {
+	entry string
+	StoreEntry
+}
+
+// indexChunk returns up to n of the documents found in the range at i, from
+// the index entry from on, in order of entry. Writes still in the write batch
+// take the place of what is on disk. Documents found by their overflow entry
+// are ordered by the entry their value would have had.
+func (s *Store) indexChunk(name string, spans []indexSpan, i int, from string, n int) ([]indexMatch, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	idx, ok := s.Buffer.Disk.secondary[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+
+	start, end := spans[i].start, spans[i].end
+	if from > start {
+		start = from
+	}
+	now := time.Now().UnixNano()
+	var matches []indexMatch
+
+	// Documents on disk, unless there is a newer write waiting in the write
+	// batch. The walk starts after the overflow entries.
+	walkFrom := start
+	if values := string([]byte{indexOverflow + 1}); walkFrom < values {
+		walkFrom = values
+	}
+	err := idx.tree.WalkFrom(walkFrom, func(value IndexValue) bool {
+		if end != "" && value.Key >= end {
+			return false
+		}
+		l := encodedValueLen(value.Key)
+		encoded, key := value.Key[:l], value.Key[l:]
+		if _, ok := s.Buffer.pendingOp(key); ok {
+			return true
+		}
+
+		record, ok := s.Buffer.Disk.latest(key)
+		if !ok || record.expired(now) {
+			return true
+		}
+		if first, ok := firstIndexValue(idx.values(record.Data), spans, i); ok && first == encoded {
+			matches = append(matches, indexMatch{entry: value.Key, StoreEntry: StoreEntry{Key: key, Value: record.Data}})
+		}
+		return len(matches) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Then the documents on disk with values too long for entries of their
+	// own, and the writes in the write batch, up to where the documents on disk
+	// got to if they filled the chunk. Like the write batch, the overflow
+	// entries are read in full for every chunk.
+	last := ""
+	if len(matches) == n {
+		last = matches[n-1].entry
+	}
+	err = idx.tree.WalkFrom(string([]byte{indexOverflow}), func(value IndexValue) bool {
+		if value.Key == "" || value.Key[0] != indexOverflow {
+			return false
+		}
+		key := overflowKey(value)
+		if _, ok := s.Buffer.pendingOp(key); ok {
+			return true
+		}
+
+		record, ok := s.Buffer.Disk.latest(key)
+		if !ok || record.expired(now) {
+			return true
+		}
+		first, ok := firstIndexValue(idx.values(record.Data), spans, i)
+		entry := first + key
+		if ok && !fitsIndexEntry(first, key) && entry >= start && (last == "" || entry <= last) {
+			matches = append(matches, indexMatch{entry: entry, StoreEntry: StoreEntry{Key: key, Value: record.Data}})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range s.Buffer.pendingRange("", "") {
+		if op.Deleted || op.expired(now) {
+			continue
+		}
+		first, ok := firstIndexValue(idx.values(op.Value), spans, i)
+		entry := first + op.Key
+		if ok && entry >= start && (last == "" || entry <= last) {
+			matches = append(matches, indexMatch{entry: entry, StoreEntry: StoreEntry{Key: op.Key, Value: op.Value}})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].entry < matches[j].entry
+	})
+	if len(matches) > n {
+		matches = matches[:n]
+	}
+	return matches, nil
+}
+
+// firstIndexValue returns the smallest of a document's values in the range at
+// i, unless one of its values is in an earlier range, where it was found already.
+func firstIndexValue(values []string, spans []indexSpan, i int) (string, bool) {
+	first, ok := "", false
+	for _, v := range values {
+		for _, span := range spans[:i] {
+			if inRange(v, span.start, span.end) {
+				return "", false
+			}
+		}
+		if inRange(v, spans[i].start, spans[i].end) && (!ok || v < first) {
+			first, ok = v, true
+		}
+	}
+	return first, ok
+}
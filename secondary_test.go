@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// indexKeys returns the keys of the entries.
+func indexKeys(entries []StoreEntry) []string {
+	keys := []string{}
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func TestParseJSONPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"user":  map[string]interface{}{"name": "alice"},
+		"items": []interface{}{map[string]interface{}{"price": 3.0}},
+	}
+
+	tests := []struct {
+		path    string
+		want    interface{}
+		found   bool
+		invalid bool
+	}{
+		{"$.user.name", "alice", true, false},
+		{"user.name", "alice", true, false},
+		{"items[0].price", 3.0, true, false},
+		{"$.items[1].price", nil, false, false},
+		{"user.missing", nil, false, false},
+		{"user..name", nil, false, true},
+		{"items[x]", nil, false, true},
+		{"items[0", nil, false, true},
+	}
+
+	for _, test := range tests {
+		path, err := parseJSONPath(test.path)
+		if test.invalid {
+			assert.ErrorIs(t, err, ErrBadJSONPath, test.path)
+			continue
+		}
+		assert.NoError(t, err, test.path)
+		got, ok := path.lookup(doc)
+		assert.Equal(t, test.found, ok, test.path)
+		assert.Equal(t, test.want, got, test.path)
+	}
+}
+
+func TestEncodeIndexValueOrder(t *testing.T) {
+	// Values in the order their encodings must sort
+	values := []interface{}{false, true, -1e10, -1.5, 0.0, 0.5, 2.0, 1e10, "", "\x00", "a", "a\x00", "ab", "b"}
+
+	var encoded []string
+	for _, value := range values {
+		e, ok := encodeIndexValue(value)
+		assert.True(t, ok)
+		assert.Equal(t, len(e), encodedValueLen(e+"key"), value)
+		encoded = append(encoded, e)
+	}
+	assert.True(t, sort.StringsAreSorted(encoded))
+
+	for _, value := range []interface{}{nil, []interface{}{}, map[string]interface{}{}} {
+		_, ok := encodeIndexValue(value)
+		assert.False(t, ok)
+	}
+}
+
+func TestQueryIndex(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	users := map[string]string{
+		"u1": `{"name": "alice", "age": 30, "tags": ["admin", "ops"]}`,
+		"u2": `{"name": "bob", "age": 25, "tags": ["ops"]}`,
+		"u3": `{"name": "carol", "age": 35}`,
+		"u4": `{"name": "dave", "age": "unknown"}`,
+		"u5": `"not an object"`,
+	}
+	for key, value := range users {
+		assert.NoError(t, kv.Set(key, json.RawMessage(value)))
+	}
+	assert.NoError(t, kv.Flush())
+
+	// Indexes are filled from the documents on disk when they are created
+	assert.NoError(t, kv.CreateIndex("age", "$.age"))
+	assert.NoError(t, kv.CreateIndex("tags", "tags"))
+	assert.Equal(t, ErrIndexExists, kv.CreateIndex("age", "$.age"))
+	assert.Equal(t, ErrBadIndexName, kv.CreateIndex("bad name", "$.age"))
+	assert.ErrorIs(t, kv.CreateIndex("bad", "$..age"), ErrBadJSONPath)
+
+	check := func(name string, r IndexRange, limit int, want []string) {
+		t.Helper()
+		entries, err := kv.QueryIndex(name, r, limit)
+		assert.NoError(t, err)
+		assert.Equal(t, want, indexKeys(entries), "%s %v", name, r)
+	}
+	check("age", IndexRange{Min: 30.0, Max: 30.0}, 0, []string{"u1"})
+	check("age", IndexRange{Min: 26.0}, 0, []string{"u1", "u3"})
+	check("age", IndexRange{Max: 30.0}, 0, []string{"u2", "u1"})
+	check("age", IndexRange{}, 0, []string{"u2", "u1", "u3", "u4"})
+	check("age", IndexRange{}, 2, []string{"u2", "u1"})
+	check("age", IndexRange{Min: "unknown", Max: "unknown"}, 0, []string{"u4"})
+	check("tags", IndexRange{Min: "ops", Max: "ops"}, 0, []string{"u1", "u2"})
+
+	// Writes are reflected straight away, whether they are still in the write
+	// batch or have been flushed
+	assert.NoError(t, kv.Set("u2", json.RawMessage(`{"name": "bob", "age": 40}`)))
+	assert.NoError(t, kv.Delete("u3"))
+	assert.NoError(t, kv.Set("u6", json.RawMessage(`{"age": 27, "tags": ["ops"]}`)))
+	for i := 0; i < 2; i++ {
+		check("age", IndexRange{Min: 26.0}, 0, []string{"u6", "u1", "u2"})
+		check("age", IndexRange{Min: 26.0}, 2, []string{"u6", "u1"})
+		check("tags", IndexRange{Min: "ops", Max: "ops"}, 0, []string{"u1", "u6"})
+		assert.NoError(t, kv.Flush())
+	}
+
+	_, err := kv.QueryIndex("missing", IndexRange{}, 0)
+	assert.Equal(t, ErrIndexNotFound, err)
+}
+
+func TestScanIndex(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+	assert.NoError(t, kv.CreateIndex("tags", "tags"))
+
+	// More documents than fit in a chunk, each with two tags, some of them
+	// still in the write batch
+	for i := 0; i < 380; i++ {
+		value := fmt.Sprintf(`{"tags": ["t%d", "t%d"]}`, i%5, (i+1)%5)
+		assert.NoError(t, kv.Set(fmt.Sprintf("d%03d", i), json.RawMessage(value)))
+		if i == 349 {
+			assert.NoError(t, kv.Flush())
+		}
+	}
+
+	// Each document is found once, in the first range it is in
+	var keys []string
+	seen := make(map[string]bool)
+	it := kv.scanIndex("tags", []IndexRange{{Min: "t1", Max: "t1"}, {Min: "t0", Max: "t0"}}, 0)
+	for it.Next() {
+		assert.False(t, seen[it.entry.Key], it.entry.Key)
+		seen[it.entry.Key] = true
+		keys = append(keys, it.entry.Key)
+	}
+	assert.NoError(t, it.Err())
+	var want []string
+	for _, tagged := range []func(i int) bool{
+		func(i int) bool { return i%5 == 0 || i%5 == 1 }, // t1
+		func(i int) bool { return i%5 == 4 },             // t0 but not t1
+	} {
+		for i := 0; i < 380; i++ {
+			if tagged(i) {
+				want = append(want, fmt.Sprintf("d%03d", i))
+			}
+		}
+	}
+	assert.Equal(t, want, keys)
+
+	// Aggregates over the index see every document, as a full scan does
+	result, err := kv.Query("SELECT count(*) WHERE tags IN ('t0', 't1')")
+	assert.NoError(t, err)
+	assert.Equal(t, "index lookup on tags [= 't0', = 't1'], filter tags IN ('t0', 't1'), aggregate count(*)", result.Plan.String())
+	assert.JSONEq(t, `{"count(*)": 228}`, string(result.Rows[0].Value))
+
+	it = kv.scanIndex("missing", []IndexRange{{}}, 0)
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrIndexNotFound, it.Err())
+}
+
+func TestQueryIndexLongValues(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+	assert.NoError(t, kv.CreateIndex("name", "name"))
+
+	// Values too long to fit in an index entry alongside their key, and a key
+	// too long to fit alongside any value
+	long := "l" + strings.Repeat("x", 2000)
+	longKey := strings.Repeat("k", MaxKeySize)
+	docs := map[string]string{
+		"long":  long,
+		"short": "m",
+		longKey: "n",
+		"last":  strings.Repeat("z", 1500),
+	}
+	for key, name := range docs {
+		value, _ := json.Marshal(map[string]string{"name": name})
+		assert.NoError(t, kv.Set(key, value))
+	}
+
+	check := func(name string, r IndexRange, limit int, want []string) {
+		t.Helper()
+		entries, err := kv.QueryIndex(name, r, limit)
+		assert.NoError(t, err)
+		assert.Equal(t, want, indexKeys(entries), "%s %v", name, r)
+	}
+
+	// They are found in order of value, whether the writes are still in the
+	// write batch, have been flushed, or were on disk when the index was made
+	for i := 0; i < 2; i++ {
+		check("name", IndexRange{Min: "a"}, 0, []string{"long", "short", longKey, "last"})
+		check("name", IndexRange{Min: "a"}, 2, []string{"long", "short"})
+		check("name", IndexRange{Min: long, Max: long}, 0, []string{"long"})
+		check("name", IndexRange{Min: "n", Max: "n"}, 0, []string{longKey})
+		check("name", IndexRange{Min: "l", Max: "lz"}, 0, []string{"long"})
+		assert.NoError(t, kv.Flush())
+	}
+	assert.NoError(t, kv.CreateIndex("name2", "name"))
+	check("name2", IndexRange{Min: "a"}, 0, []string{"long", "short", longKey, "last"})
+
+	// A value that becomes short enough takes the place of the overflow entry
+	assert.NoError(t, kv.Set("long", json.RawMessage(`{"name": "b"}`)))
+	assert.NoError(t, kv.Delete(longKey))
+	assert.NoError(t, kv.Flush())
+	check("name", IndexRange{Min: "a"}, 0, []string{"long", "short", "last"})
+	check("name", IndexRange{Min: long, Max: long}, 0, []string{})
+	var overflow int
+	kv.Buffer.Disk.secondary["name"].tree.Walk(func(value IndexValue) bool {
+		if value.Key[0] == indexOverflow {
+			overflow++
+		}
+		return true
+	})
+	assert.Equal(t, 1, overflow)
+}
+
+func TestSecondaryIndexReopened(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+	kv := NewStore(100, filename, indexFilename)
+
+	assert.NoError(t, kv.CreateIndex("name", "name"))
+	assert.NoError(t, kv.CreateIndex("dropped", "name"))
+	assert.NoError(t, kv.DropIndex("dropped"))
+	assert.Equal(t, ErrIndexNotFound, kv.DropIndex("dropped"))
+	assert.NoError(t, kv.Set("a", json.RawMessage(`{"name": "alice"}`)))
+	assert.NoError(t, kv.Close())
+
+	// Writes recovered from the log update the index too
+	kv = NewStore(100, filename, indexFilename)
+	assert.NoError(t, kv.Set("b", json.RawMessage(`{"name": "alice"}`)))
+	kv.WAL.Close()
+	kv = NewStore(100, filename, indexFilename)
+	defer kv.Close()
+
+	indexes := kv.Indexes()
+	if assert.Len(t, indexes, 1) {
+		assert.Equal(t, "name", indexes[0].Name)
+	}
+	entries, err := kv.QueryIndex("name", IndexRange{Min: "alice", Max: "alice"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, indexKeys(entries))
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A shard router spreads the keys of one logical store across shards, each
+// an ordinary kvstore server. It owns a consistent-hash ring of the shards and
+// proxies requests for a key to the shard that owns it. Requests that cover
+// many keys are fanned out: a batch is split up by shard, and a scan asks
+// every shard for a page and merges them in key order.
+//
+// Adding a shard moves keys to it while the router carries on serving. The
+// keys that belong to the new shard are copied to it in the background and
+// deleted from the shard they were on. Until that finishes, a request for one
+// of those keys moves the key first, so it is only ever served by the new
+// shard. The router assumes every request to the shards goes through it.
+
+// ErrShardExists is returned when adding a shard with the ID of another.
+var ErrShardExists = errors.New("shard already exists")
+
+// ErrMigrationInProgress is returned when adding a shard while keys are still
+// being moved to the last one added.
+var ErrMigrationInProgress = errors.New("keys are still being moved to the last shard added")
+
+var errRouterClosed = errors.New("router is closed")
+
+// How long a router waits before carrying on with a move of keys that failed
+const migrationRetryInterval = time.Second
+
+// How long a shard has to answer a request
+const shardTimeout = 30 * time.Second
+
+// Shard is a shard server, at a base URL such as "http://shard1:8080".
+type Shard struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// routerState is what a router keeps in its state file.
+type routerState struct {
+	Shards map[string]string `json:"shards"`           // Address of each shard, by ID
+	Adding *Shard            `json:"adding,omitempty"` // Shard keys are being moved to
+}
+
+// ShardStatus describes a router's shards.
+type ShardStatus struct {
+	Shards       map[string]string `json:"shards"`
+	VirtualNodes int               `json:"virtualNodes"`
+	Adding       *ShardMigration   `json:"adding,omitempty"`
+}
+
+// ShardMigration is how far the keys of a shard being added have been moved.
+type ShardMigration struct {
+	Shard
+	Moved int    `json:"moved"`
+	Error string `json:"error,omitempty"` // Why the last attempt failed, if it did
+}
+
+// ShardRouter routes requests to shards by consistent hashing.
+type ShardRouter struct {
+	stateFile string
+	client    *http.Client
+
+	// Held for reading while each request is served, and for writing while a
+	// shard is added, so no request routed by the old ring is still running
+	// once keys start to move
+	routing sync.RWMutex
+
+	mu        sync.Mutex
+	shards    map[string]string
+	ring      *hashRing
+	adding    *ShardMigration
+	addedRing *hashRing // Ring with the shard being added
+
+	// Held while a key is moved, and while a request for a key that is
+	// moving is served
+	keyLocks [256]sync.Mutex
+
+	stop chan struct{} // Closed to stop moving keys
+	wg   sync.WaitGroup
+}
+
+// NewShardRouter opens a router with the state in the file, creating it with
+// the shards if it does not exist. If keys were being moved to a new shard
+// when the router was last stopped, it carries on moving them.
+func NewShardRouter(stateFile string, shards map[string]string) (*ShardRouter, error) {
+	return openShardRouter(stateFile, shards, true)
+}
+
+// ParseShards parses shards given as id=url pairs separated by commas, such
+// as "s1=http://localhost:8081,s2=http://localhost:8082".
+func ParseShards(text string) (map[string]string, error) {
+	return parseAddrs(text, "shard")
+}
+
+func openShardRouter(stateFile string, shards map[string]string, migrate bool) (*ShardRouter, error) {
+	var state routerState
+	err := readJSONFile(stateFile, &state)
+	if os.IsNotExist(err) {
+		state.Shards = make(map[string]string, len(shards))
+		for id, addr := range shards {
+			state.Shards[id] = addr
+		}
+		err = writeJSONFile(stateFile, &state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading router state: %w", err)
+	}
+	if len(state.Shards) == 0 {
+		return nil, errors.New("router has no shards")
+	}
+
+	sr := &ShardRouter{
+		stateFile: stateFile,
+		client:    &http.Client{Timeout: shardTimeout},
+		shards:    state.Shards,
+		ring:      newHashRing(shardIDs(state.Shards), DefaultVirtualNodes),
+		stop:      make(chan struct{}),
+	}
+	if state.Adding != nil {
+		sr.startAdding(*state.Adding, migrate)
+	}
+	return sr, nil
+}
+
+// shardIDs returns the IDs of the shards, in order.
+func shardIDs(shards map[string]string) []string {
+	ids := make([]string, 0, len(shards))
+	for id := range shards {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close stops moving keys. They carry on being moved when the router is
+// opened again.
+func (sr *ShardRouter) Close() error {
+	close(sr.stop)
+	sr.wg.Wait()
+	return nil
+}
+
+// Status returns the router's shards, and how far keys have been moved to a
+// shard being added.
+func (sr *ShardRouter) Status() ShardStatus {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	status := ShardStatus{Shards: make(map[string]string, len(sr.shards)), VirtualNodes: DefaultVirtualNodes}
+	for id, addr := range sr.shards {
+		status.Shards[id] = addr
+	}
+	if sr.adding != nil {
+		adding := *sr.adding
+		status.Adding = &adding
+	}
+	return status
+}
+
+// AddShard adds the shard to the ring, and starts moving the keys that now
+// belong to it from the other shards. It returns once the router has started
+// routing those keys to the new shard.
+func (sr *ShardRouter) AddShard(id string, addr string) error {
+	sr.routing.Lock()
+	defer sr.routing.Unlock()
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.adding != nil {
+		return ErrMigrationInProgress
+	}
+	if _, ok := sr.shards[id]; ok {
+		return ErrShardExists
+	}
+	shard := Shard{ID: id, Addr: addr}
+	if err := writeJSONFile(sr.stateFile, &routerState{Shards: sr.shards, Adding: &shard}); err != nil {
+		return err
+	}
+	sr.startAdding(shard, true)
+	return nil
+}
+
+// startAdding routes the keys that belong to the shard to it, and unless told
+// not to, starts moving them. It must be called with mu held, or before the
+// router is used.
+func (sr *ShardRouter) startAdding(shard Shard, migrate bool) {
+	sr.adding = &ShardMigration{Shard: shard}
+	sr.addedRing = newHashRing(append(shardIDs(sr.shards), shard.ID), DefaultVirtualNodes)
+	if migrate {
+		sr.wg.Add(1)
+		go sr.migrate()
+	}
+}
+
+// migrate moves the keys that belong to the shard being added, trying again
+// until it succeeds or the router is closed, then finishes adding the shard.
+func (sr *ShardRouter) migrate() {
+	defer sr.wg.Done()
+
+	for {
+		err := sr.moveKeys()
+		if err == nil {
+			break
+		} else if err == errRouterClosed {
+			return
+		}
+
+		fmt.Println("Error moving keys to new shard:", err)
+		sr.mu.Lock()
+		sr.adding.Error = err.Error()
+		sr.mu.Unlock()
+		select {
+		case <-sr.stop:
+			return
+		case <-time.After(migrationRetryInterval):
+		}
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	shards := make(map[string]string, len(sr.shards)+1)
+	for id, addr := range sr.shards {
+		shards[id] = addr
+	}
+	shards[sr.adding.ID] = sr.adding.Addr
+	if err := writeJSONFile(sr.stateFile, &routerState{Shards: shards}); err != nil {
+		// The keys are moved again when the router is next opened
+		fmt.Println("Error saving router state:", err)
+	}
+	sr.shards, sr.ring = shards, sr.addedRing
+	sr.adding, sr.addedRing = nil, nil
+}
+
+// moveKeys goes through the keys of every other shard, moving those that
+// belong to the shard being added.
+func (sr *ShardRouter) moveKeys() error {
+	sr.mu.Lock()
+	target := sr.adding.Shard
+	ring := sr.addedRing
+	shards := sr.shards
+	sr.mu.Unlock()
+
+	for _, id := range shardIDs(shards) {
+		for cursor, more := "", true; more; {
+			select {
+			case <-sr.stop:
+				return errRouterClosed
+			default:
+			}
+
+			query := url.Values{"limit": {strconv.Itoa(MaxListLimit)}}
+			if cursor != "" {
+				query.Set("cursor", cursor)
+			}
+			page, err := sr.listKeys(shards[id], query)
+			if err != nil {
+				return fmt.Errorf("listing keys of shard %s: %w", id, err)
+			}
+
+			for _, entry := range page.Entries {
+				if ring.owner(entry.Key) != target.ID {
+					continue
+				}
+				lock := sr.keyLock(entry.Key)
+				lock.Lock()
+				moved, err := sr.moveKey(entry.Key, shards[id], target.Addr)
+				lock.Unlock()
+				if err != nil {
+					return fmt.Errorf("moving %q from shard %s: %w", entry.Key, id, err)
+				}
+				if moved {
+					sr.mu.Lock()
+					sr.adding.Moved++
+					sr.mu.Unlock()
+				}
+			}
+			cursor, more = page.Cursor, page.Cursor != ""
+		}
+	}
+	return nil
+}
+
+func (sr *ShardRouter) keyLock(key string) *sync.Mutex {
+	return &sr.keyLocks[hashKey(key)%uint32(len(sr.keyLocks))]
+}
+
+// route returns the address of the shard that owns the key. While a shard is
+// being added, the keys that belong to it are routed to it, and the address
+// of the shard they are moving from is returned too.
+func (sr *ShardRouter) route(key string) (string, string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	owner := sr.ring.owner(key)
+	if sr.adding != nil && sr.addedRing.owner(key) != owner {
+		return sr.adding.Addr, sr.shards[owner]
+	}
+	return sr.shards[owner], ""
+}
+
+// moveKey copies the key, with its expiry, from one shard to another, unless
+// the other shard has been written a newer value already, then deletes it
+// from the first. It reports whether the first shard had the key. The key's
+// lock must be held.
+func (sr *ShardRouter) moveKey(key string, from string, to string) (bool, error) {
+	path := "/api/keys/" + url.PathEscape(key)
+	var value struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if found, err := sr.getJSON(from+path, &value); err != nil || !found {
+		return false, err
+	}
+	var ttl struct {
+		TTL float64 `json:"ttl"`
+	}
+	found, err := sr.getJSON(from+path+"/ttl", &ttl)
+	if err != nil {
+		return false, err
+	}
+
+	// A key that expired in the meantime is left for its shard to delete
+	if found {
+		target := to + path
+		if ttl.TTL > 0 {
+			target += "?ttl=" + strconv.FormatFloat(ttl.TTL, 'f', -1, 64)
+		}
+		header := http.Header{"Content-Type": {"application/json"}, "If-None-Match": {"*"}}
+		status, body, err := sr.send("POST", target, value.Value, header)
+		if err != nil {
+			return false, err
+		} else if status != 200 && status != http.StatusPreconditionFailed {
+			return false, shardError(status, body)
+		}
+	}
+
+	status, body, err := sr.send("DELETE", from+path, nil, nil)
+	if err != nil {
+		return false, err
+	} else if status != 200 && status != 404 {
+		return false, shardError(status, body)
+	}
+	return found, nil
+}
+
+// send makes a request to a shard and returns the status and body of the response.
+func (sr *ShardRouter) send(method string, target string, body []byte, header http.Header) (int, []byte, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// getJSON decodes the response to a GET from a shard into v. It returns false
+// if the shard responded with a 404.
+func (sr *ShardRouter) getJSON(target string, v interface{}) (bool, error) {
+	status, body, err := sr.send("GET", target, nil, nil)
+	if err != nil {
+		return false, err
+	} else if status == 404 {
+		return false, nil
+	} else if status != 200 {
+		return false, shardError(status, body)
+	}
+	return true, json.Unmarshal(body, v)
+}
+
+// shardError returns an error for a response from a shard that failed.
+func shardError(status int, body []byte) error {
+	var response struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &response)
+	return fmt.Errorf("shard returned %d: %s", status, response.Error)
+}
+
+// keyPage is a page of keys listed by GET /api/keys.
+type keyPage struct {
+	Entries []keyPageEntry `json:"entries"`
+	Cursor  string         `json:"cursor"`
+}
+
+type keyPageEntry struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (sr *ShardRouter) listKeys(addr string, query url.Values) (keyPage, error) {
+	var page keyPage
+	_, err := sr.getJSON(addr+"/api/keys?"+query.Encode(), &page)
+	return page, err
+}
+
+// Scan returns a page of up to limit keys in order, from every shard, as
+// GET /api/keys does for a single store. The query is passed on to each
+// shard, which each return a page of their own from the same place, and the
+// first limit keys of them are kept.
+func (sr *ShardRouter) Scan(query url.Values, limit int) (keyPage, error) {
+	sr.routing.RLock()
+	defer sr.routing.RUnlock()
+
+	sr.mu.Lock()
+	var addrs []string
+	for _, id := range shardIDs(sr.shards) {
+		addrs = append(addrs, sr.shards[id])
+	}
+	if sr.adding != nil {
+		addrs = append(addrs, sr.adding.Addr)
+	}
+	sr.mu.Unlock()
+
+	pages := make([]keyPage, len(addrs))
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			pages[i], errs[i] = sr.listKeys(addr, query)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	// A key being moved may be on two shards for a moment, in which case
+	// the one it is moving to has the newest value
+	entries := make(map[string]keyPageEntry)
+	more := false
+	for i, page := range pages {
+		if errs[i] != nil {
+			return keyPage{}, errs[i]
+		}
+		for _, entry := range page.Entries {
+			if _, ok := entries[entry.Key]; ok {
+				if owner, _ := sr.route(entry.Key); owner != addrs[i] {
+					continue
+				}
+			}
+			entries[entry.Key] = entry
+		}
+		more = more || page.Cursor != ""
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+
+	result := keyPage{Entries: make([]keyPageEntry, len(keys))}
+	for i, key := range keys {
+		result.Entries[i] = entries[key]
+	}
+	if more && len(keys) > 0 {
+		result.Cursor = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+	return result, nil
+}
+
+// BatchSet sets the keys, sending each shard its share of them at once. The
+// batch is applied atomically on each shard, but not across shards.
+func (sr *ShardRouter) BatchSet(entries []StoreEntry) error {
+	for _, entry := range entries {
+		if len(entry.Key) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+	}
+
+	sr.routing.RLock()
+	defer sr.routing.RUnlock()
+
+	// Keys being moved are written to the shard they are moving to, which
+	// the move does not overwrite
+	batches := make(map[string][]StoreEntry)
+	for _, entry := range entries {
+		addr, _ := sr.route(entry.Key)
+		batches[addr] = append(batches[addr], entry)
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for addr, batch := range batches {
+		wg.Add(1)
+		go func(addr string, batch []StoreEntry) {
+			defer wg.Done()
+			err := sr.sendBatch(addr, batch)
+			mu.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("writing to shard at %s: %w", addr, err)
+			}
+			mu.Unlock()
+		}(addr, batch)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (sr *ShardRouter) sendBatch(addr string, batch []StoreEntry) error {
+	body := struct {
+		Entries []keyPageEntry `json:"entries"`
+	}{Entries: make([]keyPageEntry, len(batch))}
+	for i, entry := range batch {
+		body.Entries[i] = keyPageEntry{Key: entry.Key, Value: entry.Value}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	status, resp, err := sr.send("POST", addr+"/api/batch", data, http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	} else if status != 200 {
+		return shardError(status, resp)
+	}
+	return nil
+}
+
+// proxyKey passes the request for the key on to the shard that owns it,
+// moving the key there first if it is still on the shard it is moving from.
+func (sr *ShardRouter) proxyKey(c *gin.Context, key string, body []byte) {
+	sr.routing.RLock()
+	defer sr.routing.RUnlock()
+
+	addr, from := sr.route(key)
+	if from != "" {
+		lock := sr.keyLock(key)
+		lock.Lock()
+		defer lock.Unlock()
+		if _, err := sr.moveKey(key, from, addr); err != nil {
+			fmt.Println("Error moving key to new shard:", err)
+			c.JSON(502, gin.H{"error": "Shard unavailable"})
+			return
+		}
+	}
+
+	header := make(http.Header)
+	for _, name := range []string{"Content-Type", "If-Match", "If-None-Match"} {
+		if value := c.GetHeader(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, addr+c.Request.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Internal server error"})
+		return
+	}
+	req.Header = header
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		c.JSON(502, gin.H{"error": "Shard unavailable"})
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range []string{"Content-Type", "ETag"} {
+		if value := resp.Header.Get(name); value != "" {
+			c.Header(name, value)
+		}
+	}
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+}
+
+// handler returns the routes the router serves: the key routes of the API,
+// and routes to list and add shards.
+func (sr *ShardRouter) handler() *gin.Engine {
+	r := gin.Default()
+
+	proxy := func(c *gin.Context) {
+		sr.proxyKey(c, c.Param("key"), nil)
+	}
+
+	api := r.Group("/api")
+	{
+		api.GET("/keys", func(c *gin.Context) {
+			limit := DefaultListLimit
+			if value := c.Query("limit"); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 1 || n > MaxListLimit {
+					c.JSON(400, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxListLimit)})
+					return
+				}
+				limit = n
+			}
+
+			page, err := sr.Scan(c.Request.URL.Query(), limit)
+			if err != nil {
+				fmt.Println("Error scanning shards:", err)
+				c.JSON(502, gin.H{"error": "Shard unavailable"})
+				return
+			}
+			entries := make([]gin.H, len(page.Entries))
+			for i, entry := range page.Entries {
+				entries[i] = gin.H{"key": entry.Key, "value": entry.Value}
+			}
+			c.JSON(200, gin.H{"entries": entries, "cursor": page.Cursor})
+		})
+
+		api.GET("/keys/:key", proxy)
+		api.GET("/keys/:key/history", proxy)
+		api.GET("/keys/:key/ttl", proxy)
+		api.POST("/keys/:key", func(c *gin.Context) {
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+			sr.proxyKey(c, c.Param("key"), body)
+		})
+		api.DELETE("/keys/:key", proxy)
+
+		// The key is in the body, so is read from it to route the request
+		api.POST("/keys", func(c *gin.Context) {
+			body, err := io.ReadAll(c.Request.Body)
+			var request struct {
+				Key string `json:"key"`
+			}
+			if err == nil {
+				err = json.Unmarshal(body, &request)
+			}
+			if err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+			sr.proxyKey(c, request.Key, body)
+		})
+
+		api.POST("/batch", func(c *gin.Context) {
+			var body struct {
+				Entries []StoreEntry `json:"entries"`
+			}
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+
+			err := sr.BatchSet(body.Entries)
+			if err == ErrKeyTooLarge {
+				c.JSON(400, gin.H{"error": "Key too large"})
+				return
+			} else if err != nil {
+				fmt.Println("Error writing batch to shards:", err)
+				c.JSON(502, gin.H{"error": "Shard unavailable"})
+				return
+			}
+			c.JSON(200, gin.H{"status": "success"})
+		})
+	}
+
+	shards := r.Group("/api/shards")
+	{
+		shards.GET("", func(c *gin.Context) {
+			c.JSON(200, sr.Status())
+		})
+
+		// Adds a shard, moving keys to it in the background
+		shards.POST("", func(c *gin.Context) {
+			var body Shard
+			if err := c.BindJSON(&body); err != nil || body.ID == "" || body.Addr == "" {
+				c.JSON(400, gin.H{"error": "Bad request"})
+				return
+			}
+
+			err := sr.AddShard(body.ID, body.Addr)
+			if err == ErrShardExists || err == ErrMigrationInProgress {
+				c.JSON(409, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(500, gin.H{"error": "Internal server error"})
+				return
+			}
+			c.JSON(202, sr.Status())
+		})
+	}
+
+	return r
+}
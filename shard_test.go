@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// shardTestCluster is a router in front of shards that are each a store
+// served over HTTP.
+type shardTestCluster struct {
+	t         *testing.T
+	stateFile string
+	stores    map[string]*Store
+	addrs     map[string]string
+	router    *ShardRouter
+	handler   *gin.Engine
+}
+
+func newShardTestCluster(t *testing.T, ids ...string) *shardTestCluster {
+	c := &shardTestCluster{
+		t:         t,
+		stateFile: filepath.Join(t.TempDir(), "router.json"),
+		stores:    make(map[string]*Store),
+		addrs:     make(map[string]string),
+	}
+	for _, id := range ids {
+		c.startShard(id)
+	}
+	router, err := NewShardRouter(c.stateFile, c.addrs)
+	assert.NoError(t, err)
+	c.open(router)
+	return c
+}
+
+// startShard starts a store for a shard, without adding it to the router.
+func (c *shardTestCluster) startShard(id string) string {
+	store := newTestStore(c.t, c.t.TempDir())
+	server := httptest.NewServer(newRouter(store))
+	c.t.Cleanup(func() {
+		server.Close()
+		store.Close()
+	})
+	c.stores[id] = store
+	c.addrs[id] = server.URL
+	return server.URL
+}
+
+func (c *shardTestCluster) open(router *ShardRouter) {
+	c.router = router
+	c.handler = router.handler()
+	c.t.Cleanup(func() { router.Close() })
+}
+
+func (c *shardTestCluster) do(method string, target string, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, req)
+	return w
+}
+
+// holders returns the shards that have the key.
+func (c *shardTestCluster) holders(key string) []string {
+	var ids []string
+	for _, id := range shardIDs(c.addrs) {
+		if _, ok := c.stores[id].Get(key); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (c *shardTestCluster) migrated() bool {
+	return c.router.Status().Adding == nil
+}
+
+func TestHashRing(t *testing.T) {
+	ring := newHashRing([]string{"a", "b", "c"}, DefaultVirtualNodes)
+	assert.Equal(t, "", newHashRing(nil, DefaultVirtualNodes).owner("key"))
+
+	// Keys are spread evenly, and every ring of the same shards agrees
+	counts := make(map[string]int)
+	same := newHashRing([]string{"c", "a", "b"}, DefaultVirtualNodes)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		counts[ring.owner(key)]++
+		assert.Equal(t, ring.owner(key), same.owner(key))
+	}
+	for _, shard := range []string{"a", "b", "c"} {
+		assert.InDelta(t, 1000, counts[shard], 250, shard)
+	}
+
+	// Adding a shard only moves keys to it, about a quarter of them
+	added := newHashRing([]string{"a", "b", "c", "d"}, DefaultVirtualNodes)
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if owner := added.owner(key); owner != ring.owner(key) {
+			assert.Equal(t, "d", owner)
+			moved++
+		}
+	}
+	assert.InDelta(t, 750, moved, 250)
+}
+
+func TestShardRouterProxy(t *testing.T) {
+	c := newShardTestCluster(t, "a", "b", "c")
+
+	for i := 0; i < 30; i++ {
+		w := c.do("POST", fmt.Sprintf("/api/keys/key%02d", i), fmt.Sprintf(`{"n": %d}`, i))
+		assert.Equal(t, 200, w.Code)
+	}
+	w := c.do("POST", "/api/keys", `{"key": "session", "value": "abc", "ttl": 60}`)
+	assert.Equal(t, 200, w.Code)
+
+	// Each key lives only on the shard the ring gives it to, and the keys
+	// are spread over all of them
+	used := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		owner := c.router.ring.owner(key)
+		assert.Equal(t, []string{owner}, c.holders(key), key)
+		used[owner] = true
+	}
+	assert.Len(t, used, 3)
+
+	w = c.do("GET", "/api/keys/key07", "")
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"value": {"n": 7}}`, w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// Conditional writes are passed on with their headers
+	w = c.do("POST", "/api/keys/key07", `{"n": "seven"}`, "If-Match", `"999"`)
+	assert.Equal(t, 412, w.Code)
+	w = c.do("POST", "/api/keys/key07", `{"n": "seven"}`, "If-Match", etag)
+	assert.Equal(t, 200, w.Code)
+	w = c.do("GET", "/api/keys/key07/history", "")
+	assert.Equal(t, 200, w.Code)
+
+	w = c.do("GET", "/api/keys/session/ttl", "")
+	assert.Equal(t, 200, w.Code)
+	var ttl struct {
+		TTL float64 `json:"ttl"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ttl))
+	assert.InDelta(t, 60, ttl.TTL, 5)
+
+	w = c.do("DELETE", "/api/keys/key07", "")
+	assert.Equal(t, 200, w.Code)
+	w = c.do("DELETE", "/api/keys/key07", "")
+	assert.Equal(t, 404, w.Code)
+	assert.Empty(t, c.holders("key07"))
+
+	w = c.do("POST", "/api/keys", `not json`)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestShardRouterUnavailable(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "router.json")
+	router, err := NewShardRouter(stateFile, map[string]string{"a": "http://127.0.0.1:1"})
+	assert.NoError(t, err)
+	defer router.Close()
+	handler := router.handler()
+
+	for _, target := range []string{"/api/keys/key", "/api/keys"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		assert.Equal(t, 502, w.Code, target)
+	}
+
+	_, err = NewShardRouter(filepath.Join(t.TempDir(), "router.json"), nil)
+	assert.Error(t, err)
+}
+
+func TestShardRouterBatch(t *testing.T) {
+	c := newShardTestCluster(t, "a", "b")
+
+	var entries []string
+	for i := 0; i < 20; i++ {
+		entries = append(entries, fmt.Sprintf(`{"key": "key%02d", "value": %d}`, i, i))
+	}
+	w := c.do("POST", "/api/batch", `{"entries": [`+strings.Join(entries, ",")+`]}`)
+	assert.Equal(t, 200, w.Code)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		owner := c.router.ring.owner(key)
+		assert.Equal(t, []string{owner}, c.holders(key), key)
+		value, _ := c.stores[owner].Get(key)
+		assert.JSONEq(t, fmt.Sprint(i), string(value))
+	}
+
+	w = c.do("POST", "/api/batch", `{"entries": [{"key": "`+strings.Repeat("k", MaxKeySize+1)+`", "value": 1}]}`)
+	assert.Equal(t, 400, w.Code)
+	w = c.do("POST", "/api/batch", `not json`)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestShardRouterScan(t *testing.T) {
+	c := newShardTestCluster(t, "a", "b", "c")
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, c.router.BatchSet([]StoreEntry{
+			{Key: fmt.Sprintf("user:%02d", i), Value: json.RawMessage(fmt.Sprint(i))},
+			{Key: fmt.Sprintf("order:%02d", i), Value: json.RawMessage(fmt.Sprint(i))},
+		}))
+	}
+
+	// Pages merge the shards' keys in order, each following on from the last
+	var keys []string
+	for cursor, pages := "", 0; ; pages++ {
+		w := c.do("GET", "/api/keys?prefix=user:&limit=15&cursor="+cursor, "")
+		assert.Equal(t, 200, w.Code)
+		var page keyPage
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		assert.LessOrEqual(t, len(page.Entries), 15)
+		for _, entry := range page.Entries {
+			keys = append(keys, entry.Key)
+		}
+		if page.Cursor == "" {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		cursor = page.Cursor
+	}
+	var want []string
+	for i := 0; i < 50; i++ {
+		want = append(want, fmt.Sprintf("user:%02d", i))
+	}
+	assert.Equal(t, want, keys)
+
+	w := c.do("GET", "/api/keys?limit=0", "")
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestShardRouterAddShard(t *testing.T) {
+	c := newShardTestCluster(t, "a", "b")
+
+	for i := 0; i < 300; i++ {
+		assert.NoError(t, c.router.BatchSet([]StoreEntry{{Key: fmt.Sprintf("key%03d", i), Value: json.RawMessage(fmt.Sprint(i))}}))
+	}
+	w := c.do("POST", "/api/keys/session?ttl=3600", `"abc"`)
+	assert.Equal(t, 200, w.Code)
+
+	addr := c.startShard("c")
+	w = c.do("POST", "/api/shards", fmt.Sprintf(`{"id": "c", "addr": %q}`, addr))
+	assert.Equal(t, 202, w.Code)
+	assert.Eventually(t, c.migrated, 10*time.Second, 10*time.Millisecond)
+
+	// Every key is still there, and the new shard has its share of them
+	ring := newHashRing([]string{"a", "b", "c"}, DefaultVirtualNodes)
+	moved := 0
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		assert.Equal(t, []string{ring.owner(key)}, c.holders(key), key)
+		w := c.do("GET", "/api/keys/"+key, "")
+		assert.Equal(t, 200, w.Code)
+		assert.JSONEq(t, fmt.Sprintf(`{"value": %d}`, i), w.Body.String())
+		if ring.owner(key) == "c" {
+			moved++
+		}
+	}
+	assert.Greater(t, moved, 0)
+	ttl, ok := c.stores[ring.owner("session")].TTL("session")
+	assert.True(t, ok)
+	assert.Greater(t, ttl, 59*time.Minute)
+
+	w = c.do("GET", "/api/shards", "")
+	assert.Equal(t, 200, w.Code)
+	var status ShardStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, c.addrs, status.Shards)
+	assert.Nil(t, status.Adding)
+
+	w = c.do("POST", "/api/shards", fmt.Sprintf(`{"id": "c", "addr": %q}`, addr))
+	assert.Equal(t, 409, w.Code)
+	w = c.do("POST", "/api/shards", `{"id": "d"}`)
+	assert.Equal(t, 400, w.Code)
+
+	// The router remembers the new shard
+	router, err := NewShardRouter(c.stateFile, map[string]string{"a": c.addrs["a"]})
+	assert.NoError(t, err)
+	defer router.Close()
+	assert.Equal(t, c.addrs, router.Status().Shards)
+}
+
+func TestShardRouterMoveOnAccess(t *testing.T) {
+	c := newShardTestCluster(t, "a", "b")
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, c.router.BatchSet([]StoreEntry{{Key: fmt.Sprintf("key%03d", i), Value: json.RawMessage(fmt.Sprint(i))}}))
+	}
+
+	// A router that was stopped part way through adding a shard, opened
+	// without moving keys in the background
+	addr := c.startShard("c")
+	state := routerState{Shards: map[string]string{"a": c.addrs["a"], "b": c.addrs["b"]}, Adding: &Shard{ID: "c", Addr: addr}}
+	assert.NoError(t, writeJSONFile(c.stateFile, &state))
+	router, err := openShardRouter(c.stateFile, nil, false)
+	assert.NoError(t, err)
+	c.open(router)
+
+	w := c.do("POST", "/api/shards", `{"id": "d", "addr": "http://127.0.0.1:1"}`)
+	assert.Equal(t, 409, w.Code)
+
+	ring := newHashRing([]string{"a", "b", "c"}, DefaultVirtualNodes)
+	var moving []string
+	for i := 0; i < 100; i++ {
+		if key := fmt.Sprintf("key%03d", i); ring.owner(key) == "c" {
+			moving = append(moving, key)
+		}
+	}
+	assert.GreaterOrEqual(t, len(moving), 3)
+
+	// Reading, writing or deleting a key that has yet to move moves it first
+	w = c.do("GET", "/api/keys/"+moving[0], "")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"c"}, c.holders(moving[0]))
+	w = c.do("POST", "/api/keys/"+moving[1], `"new"`)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []string{"c"}, c.holders(moving[1]))
+	value, _ := c.stores["c"].Get(moving[1])
+	assert.JSONEq(t, `"new"`, string(value))
+	w = c.do("DELETE", "/api/keys/"+moving[2], "")
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, c.holders(moving[2]))
+
+	// Scans see the keys that have yet to move, and the ones that have
+	w = c.do("GET", "/api/keys?limit=1000", "")
+	assert.Equal(t, 200, w.Code)
+	var page keyPage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Len(t, page.Entries, 99)
+
+	status := c.router.Status()
+	if assert.NotNil(t, status.Adding) {
+		assert.Equal(t, "c", status.Adding.ID)
+		assert.Equal(t, 0, status.Adding.Moved, "keys moved on access are not counted")
+	}
+}
+
+func TestShardStoreBatch(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+	router := newRouter(store)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/batch", strings.NewReader(`{"entries": [{"key": "a", "value": 1}, {"key": "b", "value": {"n": 2}}]}`)))
+	assert.Equal(t, 200, w.Code)
+	value, _ := store.Get("b")
+	assert.JSONEq(t, `{"n": 2}`, string(value))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/batch", strings.NewReader(`{"entries": [{"key": "c", "value": 3}, {"key": "`+strings.Repeat("k", MaxKeySize+1)+`", "value": 1}]}`)))
+	assert.Equal(t, 400, w.Code)
+	_, ok := store.Get("c")
+	assert.False(t, ok, "a batch with a bad key is not applied at all")
+}
+
+func TestParseShards(t *testing.T) {
+	shards, err := ParseShards("s1=http://localhost:8081/,s2=http://localhost:8082")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"s1": "http://localhost:8081", "s2": "http://localhost:8082"}, shards)
+
+	_, err = ParseShards("s1=http://localhost:8081,http://localhost:8082")
+	assert.Error(t, err)
+}
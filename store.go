@@ -2,44 +2,269 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
-	"os"
+	"sync"
+	"time"
 )
 
 type Store struct {
 	Buffer *Buffer
 	Mutex  *myRWMutex
-	WALog  *os.File // Write-ahead log
+	WAL    *WAL // Write-ahead log
+
+	snapshots   snapshotTracker  // Open transactions and snapshots, guarded by Mutex
+	expiring    map[string]int64 // When each key whose latest write expires does so, guarded by Mutex
+	replication *replicationTracker
+	follower    *Follower // Replicates from the leader, if the store is a follower
+	raft        *raftNode // Commits writes through a raft cluster, if the store is a node of one
+
+	stopSweeper    chan struct{} // Closed to stop the expiry sweeper
+	sweeperStopped chan struct{} // Closed once the sweeper has stopped
+	closeOnce      sync.Once
+	closeErr       error // What the first Close returned
+}
+
+// StoreOption configures optional settings of a Store
+type StoreOption func(*storeOptions)
+
+type storeOptions struct {
+	walDir         string
+	walSegmentSize int64
+	durability     Durability
+	syncInterval   time.Duration
+	compactRatio   float64
+	compactMinSize int64
+	cacheBytes     int64
+	cachePolicy    CachePolicy
+	retention      time.Duration
+	sweepInterval  time.Duration
+	codec          Codec
+	compressMin    int
+	keys           *Keyring
+	leader         string
+	raft           *RaftConfig
+}
+
+// WithWALDir sets the directory the write-ahead log segments are kept in. By
+// default this is the data filename with a ".wal" suffix.
+func WithWALDir(dir string) StoreOption {
+	return func(o *storeOptions) {
+		o.walDir = dir
+	}
+}
+
+// WithWALSegmentSize sets the size at which the write-ahead log moves on to a new segment.
+func WithWALSegmentSize(size int64) StoreOption {
+	return func(o *storeOptions) {
+		o.walSegmentSize = size
+	}
+}
+
+// WithDurability sets when the write-ahead log is synced to stable storage. The
+// default is DurabilityNone.
+func WithDurability(durability Durability) StoreOption {
+	return func(o *storeOptions) {
+		o.durability = durability
+	}
+}
+
+// WithSyncInterval sets how often the write-ahead log is synced with DurabilityInterval.
+func WithSyncInterval(interval time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		o.syncInterval = interval
+	}
+}
+
+// WithCompaction sets when the data file is compacted automatically: once at
+// least ratio of it is dead and it is at least minSize bytes. A ratio of 0
+// disables automatic compaction.
+func WithCompaction(ratio float64, minSize int64) StoreOption {
+	return func(o *storeOptions) {
+		o.compactRatio = ratio
+		o.compactMinSize = minSize
+	}
+}
+
+// WithCacheBytes bounds the read cache by the total size of the keys and values
+// in it, as well as by the number of entries given to NewStore. A size of 0,
+// the default, leaves the cache bounded by entries alone.
+func WithCacheBytes(size int64) StoreOption {
+	return func(o *storeOptions) {
+		o.cacheBytes = size
+	}
+}
+
+// WithCachePolicy sets how the read cache chooses which entries to evict. The
+// default is CacheLRU.
+func WithCachePolicy(policy CachePolicy) StoreOption {
+	return func(o *storeOptions) {
+		o.cachePolicy = policy
+	}
+}
+
+// WithVersionRetention keeps the versions of each key that were current at
+// any point in the last d, so they can be read with GetAt, until the data file
+// is compacted after that. By default only the latest version is kept, along
+// with those open snapshots and transactions read.
+func WithVersionRetention(d time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		o.retention = d
+	}
+}
+
+// WithExpirySweepInterval sets how often expired keys are deleted in the
+// background. Until then they are only hidden from reads. An interval of 0
+// disables the sweeper.
+func WithExpirySweepInterval(interval time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		o.sweepInterval = interval
+	}
+}
+
+// WithCompression compresses values of at least minSize bytes with the codec
+// as they are written to the data file. Values are not compressed by default.
+// Records already written keep the codec they were written with until the
+// data file is compacted.
+func WithCompression(codec Codec, minSize int) StoreOption {
+	return func(o *storeOptions) {
+		o.codec = codec
+		o.compressMin = minSize
+	}
+}
+
+// WithEncryption encrypts the data file, index files and write-ahead log with
+// the keyring. A store written without encryption must be re-encrypted with
+// Reencrypt before it can be opened with it.
+func WithEncryption(keys *Keyring) StoreOption {
+	return func(o *storeOptions) {
+		o.keys = keys
+	}
+}
+
+// WithFollower makes the store a read-only follower of the leader at the URL,
+// such as "http://leader:8080". It copies the leader's data from a snapshot
+// when it starts out empty, then streams and applies every write made on the
+// leader. Writes to the store itself fail with ErrReadOnly.
+func WithFollower(leader string) StoreOption {
+	return func(o *storeOptions) {
+		o.leader = leader
+	}
 }
 
 type StoreEntry struct {
-	Key   uint32
+	Key   string
 	Value json.RawMessage
 }
 
+// ErrKeyNotFound is returned when deleting a key that does not exist
+var ErrKeyNotFound = errors.New("key not found")
+
 // Maximum size of the buffer before flushing to disk
 const MaxBufferSize = 100
 
-func NewStore(bufferSize int, filename string, indexFilename string) *Store {
-	disk, err := NewDisk(filename, indexFilename)
-	buffer := NewBuffer(bufferSize, MaxBufferSize, disk)
-	waLog, err := os.OpenFile("wa.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func NewStore(bufferSize int, filename string, indexFilename string, options ...StoreOption) *Store {
+	opts := storeOptions{
+		walDir:         filename + ".wal",
+		walSegmentSize: DefaultWALSegmentSize,
+		durability:     DurabilityNone,
+		syncInterval:   DefaultSyncInterval,
+		compactRatio:   DefaultCompactRatio,
+		compactMinSize: DefaultCompactMinSize,
+		cachePolicy:    CacheLRU,
+		sweepInterval:  DefaultExpirySweepInterval,
+		compressMin:    DefaultCompressMinSize,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
 
+	disk, err := NewDisk(filename, indexFilename, opts.keys)
 	if err != nil {
 		fmt.Println("Error creating disk:", err)
 		panic(err)
 	}
+	disk.CompactRatio = opts.compactRatio
+	disk.CompactMinSize = opts.compactMinSize
+	disk.Retention = opts.retention
+	disk.Codec = opts.codec
+	disk.CompressMinSize = opts.compressMin
+
+	// Apply whatever was left in the text log used by earlier versions
+	if _, err := replayLegacyWAL(legacyWALPath(filename), disk); err != nil {
+		fmt.Println("Error replaying legacy write-ahead log:", err)
+		panic(err)
+	}
+
+	wal, err := NewWAL(opts.walDir, opts.walSegmentSize, opts.durability, opts.syncInterval, opts.keys)
+	if err != nil {
+		fmt.Println("Error opening write-ahead log:", err)
+		panic(err)
+	}
+	// Followers and raft nodes number their writes as the leader did
+	wal.replica = opts.leader != "" || opts.raft != nil
+
+	// Recover any operations that were logged but not flushed before a crash
+	replayed, err := wal.Replay(disk)
+	if err != nil {
+		fmt.Println("Error replaying write-ahead log:", err)
+		panic(err)
+	} else if replayed > 0 {
+		fmt.Printf("Replayed %d operations from the write-ahead log\n", replayed)
+	}
 
 	mutex := newMyRWMutex()
-	return &Store{
-		Buffer: buffer,
-		Mutex:  mutex,
-		WALog:  waLog,
+
+	cache := newCache(opts.cachePolicy, bufferSize, opts.cacheBytes)
+	buffer := NewBuffer(cache, MaxBufferSize, disk)
+	buffer.Checkpoint = wal.Checkpoint
+	buffer.Locker = mutex
+	store := &Store{
+		Buffer:      buffer,
+		Mutex:       mutex,
+		WAL:         wal,
+		snapshots:   newSnapshotTracker(),
+		expiring:    make(map[string]int64),
+		replication: newReplicationTracker(),
+
+		stopSweeper:    make(chan struct{}),
+		sweeperStopped: make(chan struct{}),
+	}
+	// Compaction and flushes keep the versions open snapshots may read
+	disk.Pinned = store.snapshots.oldest
+	// Checkpoints keep the log segments followers have yet to read
+	wal.Retain = store.replication.oldest
+
+	if opts.raft != nil {
+		if opts.raft.Dir == "" {
+			opts.raft.Dir = filename + ".raft"
+		}
+		store.raft, err = startRaft(store, *opts.raft)
+		if err != nil {
+			fmt.Println("Error starting raft:", err)
+			panic(err)
+		}
+	}
+
+	// A follower's keys expire when the leader deletes them
+	if opts.sweepInterval > 0 && opts.leader == "" {
+		go store.sweeper(opts.sweepInterval)
+	} else {
+		close(store.sweeperStopped)
+	}
+
+	if opts.leader != "" {
+		store.follower = startFollower(store, opts.leader)
 	}
+
+	return store
 }
 
-func (s *Store) hashKey(key string) uint32 {
+// hashKey returns the 32-bit FNV-1a hash of the key. Hashes are only used to
+// order the index; distinct keys may share a hash, so the full key is always
+// stored and compared alongside it.
+func hashKey(key string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(key))
 	return h.Sum32()
@@ -49,49 +274,192 @@ func (s *Store) Get(key string) (json.RawMessage, bool) {
 	s.Mutex.RLock()
 	defer s.Mutex.RUnlock()
 
-	hash := s.hashKey(key)
-	value, ok := s.Buffer.Get(hash)
+	value, ok := s.Buffer.Get(key)
 
 	return value, ok
 }
 
-func (s *Store) Set(key string, value json.RawMessage) error {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+// Compact rewrites the data file without the records that have been overwritten
+// or deleted. Reads and writes carry on while the live records are copied, and
+// only wait while it catches up with the writes made in the meantime and swaps
+// the new files in.
+func (s *Store) Compact() (CompactionStats, error) {
+	return s.Buffer.Compact()
+}
 
-	// Write the operation to the log before applying it to the index
-	logEntry := fmt.Sprintf("Set %s %s\n", key, string(value))
-	_, err := s.WALog.Write([]byte(logEntry))
-	if err != nil {
-		return err
+// Flush writes everything in the write buffer to disk.
+func (s *Store) Flush() error {
+	return s.Buffer.Flush()
+}
+
+// Close stops the expiry sweeper, flushes the write buffer and closes the log
+// and the data and index files. The store must not be used afterwards. Closing
+// it again does nothing, and returns what the first Close did.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+func (s *Store) close() error {
+	close(s.stopSweeper)
+	<-s.sweeperStopped
+	if s.follower != nil {
+		s.follower.stop()
+	}
+	if s.raft != nil {
+		if err := s.raft.close(); err != nil {
+			return err
+		}
 	}
 
-	// Write the operation to the buffer
-	hash := s.hashKey(key)
-	s.Buffer.Put(hash, value)
+	if err := s.Buffer.Close(); err != nil {
+		return err
+	}
+	if err := s.WAL.Close(); err != nil {
+		return err
+	}
+	return s.Buffer.Disk.Close()
+}
 
-	return nil
+func (s *Store) Set(key string, value json.RawMessage) error {
+	return s.apply([]Operation{{Key: key, Value: value}}, nil)
 }
 
 func (s *Store) BatchSet(entries []StoreEntry) error {
+	ops := make([]Operation, len(entries))
+	for i, entry := range entries {
+		ops[i] = Operation{Key: entry.Key, Value: entry.Value}
+	}
+
+	return s.apply(ops, nil)
+}
+
+// Delete removes the key from the store. It returns ErrKeyNotFound if the key does not exist.
+func (s *Store) Delete(key string) error {
+	return s.apply([]Operation{{Key: key, Deleted: true}}, []writeCondition{{Kind: conditionExists, Key: key}})
+}
+
+// BatchDelete removes all of the keys from the store. Keys that do not exist are ignored.
+func (s *Store) BatchDelete(keys []string) error {
+	ops := make([]Operation, len(keys))
+	for i, key := range keys {
+		ops[i] = Operation{Key: key, Deleted: true}
+	}
+
+	return s.apply(ops, nil)
+}
+
+// apply writes the operations to the log and then to the buffer while holding
+// the write lock. The operations are only applied if all of the conditions
+// hold, which is checked under the lock first. Once the lock is released, apply
+// waits for the log to be as durable as the store's durability setting requires,
+// so that concurrent writers can share a single sync. In a raft cluster, the
+// operations are applied by every node once the cluster has committed them.
+func (s *Store) apply(ops []Operation, conditions []writeCondition) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if s.follower != nil {
+		return ErrReadOnly
+	}
+
+	// Keys the index cannot hold are turned away before they reach the log
+	for _, op := range ops {
+		if len(op.Key) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+	}
+
+	now := time.Now().UnixNano()
+	for i := range ops {
+		ops[i].Time = now
+	}
+	if s.raft != nil {
+		return s.raft.write(ops, conditions)
+	}
+
 	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	if err := s.check(conditions, now); err != nil {
+		s.Mutex.Unlock()
+		return err
+	}
 
 	// Write the operations to the log before applying them to the index
-	for _, entry := range entries {
-		logEntry := fmt.Sprintf("Set %d %s\n", entry.Key, string(entry.Value))
-		_, err := s.WALog.Write([]byte(logEntry))
-		if err != nil {
-			return err
-		}
+	if err := s.WAL.Append(ops); err != nil {
+		s.Mutex.Unlock()
+		return err
 	}
 
+	// Open transactions that wrote the same keys can no longer commit
+	s.snapshots.recordWrites(ops)
+	s.trackExpiry(ops)
+
 	// Write the operations to the buffer
-	ops := make([]Operation, len(entries))
-	for i, entry := range entries {
-		ops[i] = Operation{Key: entry.Key, Value: entry.Value}
-	}
 	s.Buffer.BatchPut(ops)
+	s.Mutex.Unlock()
+
+	return s.WAL.Commit(ops[len(ops)-1].Seq)
+}
+
+// writeCondition is something that must hold for a write to be applied. They
+// are kept as data, rather than as functions, so that every node in a raft
+// cluster can check them in the same way as it applies the write.
+type writeCondition struct {
+	Kind    conditionKind
+	Key     string
+	Version uint64
+	Tags    string // For conditionIfMatch and conditionIfNoneMatch, the header's entity tags
+}
+
+type conditionKind int
 
+const (
+	conditionExists      conditionKind = iota + 1 // The key exists
+	conditionMissing                              // The key does not exist
+	conditionVersion                              // The key exists at Version
+	conditionUnchanged                            // The key is at Version, or 0 if it does not exist
+	conditionUnwritten                            // No open transaction has seen the key written since Version
+	conditionExpired                              // The key has expired
+	conditionIfMatch                              // The key matches an If-Match header
+	conditionIfNoneMatch                          // The key does not match an If-None-Match header
+)
+
+// check returns the error for the first of the conditions that does not hold
+// at now. It must be called with the write lock held.
+func (s *Store) check(conditions []writeCondition, now int64) error {
+	for _, c := range conditions {
+		if c.Kind == conditionUnwritten {
+			if s.snapshots.writtenSince(c.Key, c.Version) {
+				return ErrTxnConflict
+			}
+			continue
+		}
+
+		entry, found := s.Buffer.lookup(c.Key)
+		exists := found && !entry.expired(now)
+		version := uint64(0)
+		if exists {
+			version = entry.version
+		}
+
+		switch {
+		case c.Kind == conditionExists && !exists:
+			return ErrKeyNotFound
+		case c.Kind == conditionMissing && exists:
+			return ErrKeyExists
+		case c.Kind == conditionVersion && (!exists || version != c.Version):
+			return ErrVersionMismatch
+		case c.Kind == conditionUnchanged && version != c.Version:
+			return ErrTxnConflict
+		case c.Kind == conditionExpired && (!found || entry.expires == 0 || entry.expires > now):
+			return errNotExpired
+		case c.Kind == conditionIfMatch && !matchETags(c.Tags, version, exists, false):
+			return ErrVersionMismatch
+		case c.Kind == conditionIfNoneMatch && matchETags(c.Tags, version, exists, true):
+			return ErrVersionMismatch
+		}
+	}
 	return nil
 }
@@ -2,8 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -78,3 +82,199 @@ func TestSetGetLargeData(t *testing.T) {
 		t.Errorf("Set(%q) = %v, want %v", key, got, value)
 	}
 }
+
+func TestStoreDelete(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	kv.Set("key1", json.RawMessage(`"value1"`))
+	kv.Set("key2", json.RawMessage(`"value2"`))
+
+	assert.NoError(t, kv.Delete("key1"))
+
+	_, ok := kv.Get("key1")
+	assert.False(t, ok)
+	got, ok := kv.Get("key2")
+	assert.True(t, ok)
+	assert.Equal(t, `"value2"`, string(got))
+
+	assert.Equal(t, ErrKeyNotFound, kv.Delete("key1"))
+	assert.Equal(t, ErrKeyNotFound, kv.Delete("nonexistent"))
+
+	// Setting the key again brings it back
+	kv.Set("key1", json.RawMessage(`"value3"`))
+	got, ok = kv.Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, `"value3"`, string(got))
+}
+
+func TestStoreDeleteFlushedToDisk(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	entries := make([]StoreEntry, MaxBufferSize)
+	keys := make([]string, MaxBufferSize)
+	for i := range entries {
+		entries[i] = StoreEntry{Key: fmt.Sprintf("key%d", i), Value: json.RawMessage(fmt.Sprint(i))}
+		if i%2 == 0 {
+			keys[i] = fmt.Sprintf("key%d", i)
+		} else {
+			keys[i] = fmt.Sprintf("missing%d", i)
+		}
+	}
+
+	// Each batch fills the write buffer, so both are flushed to disk
+	assert.NoError(t, kv.BatchSet(entries))
+	assert.NoError(t, kv.BatchDelete(keys))
+
+	for i := range entries {
+		_, ok := kv.Buffer.Disk.Get(fmt.Sprintf("key%d", i))
+		assert.Equal(t, i%2 == 1, ok, "key%d", i)
+	}
+}
+
+func TestSetKeyTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	key := strings.Repeat("k", MaxKeySize+1)
+	assert.Equal(t, ErrKeyTooLarge, kv.Set(key, json.RawMessage("1")))
+
+	// Nothing was written to the log
+	ops, err := kv.WAL.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, ops)
+}
+
+func TestStoreCloseFlushesBuffer(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+	kv := NewStore(100, filename, indexFilename)
+
+	assert.NoError(t, kv.Set("key1", json.RawMessage(`"value1"`)))
+	assert.NoError(t, kv.Set("key2", json.RawMessage(`"value2"`)))
+	assert.NoError(t, kv.Delete("key2"))
+	assert.NoError(t, kv.Close())
+	assert.NoError(t, kv.Close(), "closing again does nothing")
+
+	// Everything reached the disk, so the log has nothing left to replay
+	disk, err := NewDisk(filename, indexFilename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := disk.Get("key1")
+	assert.True(t, ok)
+	assert.Equal(t, `"value1"`, string(got))
+	_, ok = disk.Get("key2")
+	assert.False(t, ok)
+
+	kv = NewStore(100, filename, indexFilename)
+	ops, err := kv.WAL.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, ops)
+
+	// Nor does closing the log twice stop the background syncer twice
+	assert.NoError(t, kv.WAL.Close())
+	assert.NotPanics(t, func() { kv.WAL.Close() })
+}
+
+func TestStoreFlush(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	assert.NoError(t, kv.Set("key", json.RawMessage("1")))
+	_, ok := kv.Buffer.Disk.Get("key")
+	assert.False(t, ok)
+
+	assert.NoError(t, kv.Flush())
+	_, ok = kv.Buffer.Disk.Get("key")
+	assert.True(t, ok)
+	assert.Empty(t, kv.Buffer.WriteBatch)
+}
+
+func TestBufferFlushesInBackground(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	kv.Buffer.FlushInterval = time.Millisecond
+	defer kv.Close()
+
+	// Writes keep coming while the flusher runs, and each one is eventually flushed
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, kv.Set(fmt.Sprintf("key%d-%d", i, j), json.RawMessage("1")))
+				kv.Get(fmt.Sprintf("key%d-%d", i, j/2))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		kv.Mutex.RLock()
+		defer kv.Mutex.RUnlock()
+		return len(kv.Buffer.WriteBatch) == 0
+	}, time.Second, time.Millisecond)
+
+	kv.Mutex.RLock()
+	defer kv.Mutex.RUnlock()
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 50; j++ {
+			_, ok := kv.Buffer.Disk.Get(fmt.Sprintf("key%d-%d", i, j))
+			assert.True(t, ok, "key%d-%d", i, j)
+		}
+	}
+}
+
+func TestGetPendingWriteEvictedFromCache(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(2, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	assert.NoError(t, kv.Set("deleted", json.RawMessage(`"old"`)))
+	assert.NoError(t, kv.Flush())
+
+	// The cache only holds two entries, so most of these are only in the write batch
+	assert.NoError(t, kv.Set("key1", json.RawMessage("1")))
+	assert.NoError(t, kv.Delete("deleted"))
+	for i := 2; i <= 5; i++ {
+		assert.NoError(t, kv.Set(fmt.Sprintf("key%d", i), json.RawMessage(fmt.Sprint(i))))
+	}
+
+	for i := 1; i <= 5; i++ {
+		got, ok := kv.Get(fmt.Sprintf("key%d", i))
+		assert.True(t, ok, "key%d", i)
+		assert.Equal(t, fmt.Sprint(i), string(got))
+	}
+	_, ok := kv.Get("deleted")
+	assert.False(t, ok)
+	assert.Equal(t, ErrKeyNotFound, kv.Delete("deleted"))
+}
+
+func TestWriteBatchCoalescesWrites(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kv.Set("key", json.RawMessage(fmt.Sprint(i))))
+	}
+	assert.NoError(t, kv.Set("other", json.RawMessage("1")))
+	assert.NoError(t, kv.Delete("other"))
+	assert.Len(t, kv.Buffer.WriteBatch, 2)
+
+	// Only the last write to the key reaches the data file
+	assert.NoError(t, kv.Flush())
+	assert.Equal(t, 0.0, kv.Buffer.Disk.DeadRatio())
+	got, ok := kv.Buffer.Disk.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "9", string(got))
+	_, ok = kv.Buffer.Disk.Get("other")
+	assert.False(t, ok)
+
+	// The checkpoint covers the coalesced writes as well
+	ops, err := kv.WAL.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, ops)
+}
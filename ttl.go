@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Keys written with a TTL expire once it has passed. Expiry is lazy at first:
+// reads treat an expired value as missing from the moment it expires. The
+// sweeper then expires it actively, by writing a tombstone for it through the
+// log like any other delete, so that compaction can reclaim its records.
+
+// Default interval at which the sweeper deletes expired keys
+const DefaultExpirySweepInterval = time.Second
+
+// Longest TTL a key can be written with
+const MaxTTL = 100 * 365 * 24 * time.Hour
+
+// ErrInvalidTTL is returned when writing a key with a TTL that is not positive
+// or is longer than MaxTTL.
+var ErrInvalidTTL = errors.New("TTL must be positive and at most MaxTTL")
+
+// errNotExpired stops the sweeper deleting a key that was written again since it expired.
+var errNotExpired = errors.New("key has not expired")
+
+// expired reports whether the entry's value had expired by now, in
+// nanoseconds since the epoch.
+func (e *Entry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
+}
+
+// expired reports whether the value the operation writes had expired by now.
+func (op Operation) expired(now int64) bool {
+	return op.Expires != 0 && op.Expires <= now
+}
+
+// expired reports whether the record's value had expired by now.
+func (r *Record) expired(now int64) bool {
+	return r.Expires != 0 && r.Expires <= now
+}
+
+// entry returns the cache entry for the record.
+func (r *Record) entry() Entry {
+	return Entry{key: r.Key, value: r.Data, deleted: r.Deleted, version: r.Version, expires: r.Expires}
+}
+
+// SetWithTTL sets the value of the key, which expires once the TTL has passed.
+// Writing the key again replaces the TTL, or removes it if written with Set.
+func (s *Store) SetWithTTL(key string, value json.RawMessage, ttl time.Duration) error {
+	if ttl <= 0 || ttl > MaxTTL {
+		return ErrInvalidTTL
+	}
+	return s.apply([]Operation{{Key: key, Value: value, Expires: time.Now().Add(ttl).UnixNano()}}, nil)
+}
+
+// TTL returns how long the key has left before it expires, or 0 if it never
+// does. It returns false if the key does not exist or has already expired.
+func (s *Store) TTL(key string) (time.Duration, bool) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	entry, ok := s.Buffer.lookup(key)
+	now := time.Now()
+	if !ok || entry.expired(now.UnixNano()) {
+		return 0, false
+	}
+	if entry.expires == 0 {
+		return 0, true
+	}
+	return time.Duration(entry.expires - now.UnixNano()), true
+}
+
+// trackExpiry notes when the keys the operations write expire, if they do. It
+// must be called with the write lock held.
+func (s *Store) trackExpiry(ops []Operation) {
+	for _, op := range ops {
+		if op.Expires != 0 && !op.Deleted {
+			s.expiring[op.Key] = op.Expires
+		} else {
+			delete(s.expiring, op.Key)
+		}
+	}
+}
+
+// sweeper runs in the background, deleting expired keys every interval until
+// the store is closed. It starts by finding the keys on disk that expire.
+func (s *Store) sweeper(interval time.Duration) {
+	defer close(s.sweeperStopped)
+
+	if err := s.loadExpiries(); err != nil {
+		fmt.Println("Error loading expiring keys:", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.sweepExpired(); err != nil {
+				fmt.Println("Error deleting expired keys:", err)
+			}
+		case <-s.stopSweeper:
+			return
+		}
+	}
+}
+
+// loadExpiries walks the keys on disk a chunk at a time, each under the write
+// lock, tracking those that expire. Keys with a write waiting in the write
+// batch are skipped, since that write is newer and was tracked when it was made.
+func (s *Store) loadExpiries() error {
+	for start, done := "", false; !done; {
+		select {
+		case <-s.stopSweeper:
+			return nil
+		default:
+		}
+
+		var err error
+		start, done, err = s.loadExpiriesChunk(start)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadExpiriesChunk tracks the expiring keys in the next chunk of keys from
+// start, and returns where the next chunk starts and whether this was the last.
+func (s *Store) loadExpiriesChunk(start string) (string, bool, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	var readErr error
+	count := 0
+	next := start
+	err := s.Buffer.Disk.Index.WalkFrom(start, func(value IndexValue) bool {
+		if count == scanChunkSize {
+			return false
+		}
+		count++
+		next = keyAfter(value.Key)
+
+		record, err := s.Buffer.Disk.readRecord(value)
+		if err != nil {
+			readErr = fmt.Errorf("reading record for %q: %w", value.Key, err)
+			return false
+		}
+		if _, ok := s.Buffer.pendingOp(value.Key); !ok && record.Expires != 0 && !record.Deleted {
+			s.expiring[value.Key] = record.Expires
+		}
+		return true
+	})
+	if err != nil {
+		return "", false, err
+	} else if readErr != nil {
+		return "", false, readErr
+	}
+
+	return next, count < scanChunkSize, nil
+}
+
+// sweepExpired deletes the keys that have expired, and returns how many it deleted.
+func (s *Store) sweepExpired() (int, error) {
+	// In a raft cluster the leader deletes expired keys for every node
+	if s.raft != nil && !s.raft.isLeader() {
+		return 0, nil
+	}
+	now := time.Now().UnixNano()
+
+	s.Mutex.RLock()
+	var keys []string
+	for key, expires := range s.expiring {
+		if expires <= now {
+			keys = append(keys, key)
+		}
+	}
+	s.Mutex.RUnlock()
+
+	deleted := 0
+	for _, key := range keys {
+		// The key may have been written again since it was found
+		err := s.apply([]Operation{{Key: key, Deleted: true}}, []writeCondition{{Kind: conditionExpired, Key: key}})
+		if err == errNotExpired {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithExpirySweepInterval(0))
+
+	ttl := 100 * time.Millisecond
+	assert.NoError(t, kv.SetWithTTL("session", json.RawMessage(`"token"`), ttl))
+	assert.NoError(t, kv.SetWithTTL("flushed", json.RawMessage(`"token"`), ttl))
+	assert.NoError(t, kv.Set("forever", json.RawMessage("1")))
+	assert.NoError(t, kv.Flush())
+	assert.NoError(t, kv.SetWithTTL("session", json.RawMessage(`"token"`), ttl))
+	assert.Equal(t, ErrInvalidTTL, kv.SetWithTTL("bad", json.RawMessage("1"), 0))
+
+	left, ok := kv.TTL("session")
+	assert.True(t, ok)
+	assert.True(t, left > 0 && left <= ttl, left)
+	left, ok = kv.TTL("forever")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), left)
+
+	// Expired keys read as missing from the cache, the write batch and the disk,
+	// even though nothing has deleted them yet
+	time.Sleep(ttl)
+	check := func() {
+		for _, key := range []string{"session", "flushed"} {
+			_, ok := kv.Get(key)
+			assert.False(t, ok, key)
+			_, ok = kv.TTL(key)
+			assert.False(t, ok, key)
+		}
+		assert.Equal(t, []string{"forever=1"}, scanKeys(t, kv.Scan("", "", 0)))
+	}
+	check()
+	kv.Buffer.cache.Remove("session")
+	kv.Buffer.cache.Remove("flushed")
+	check()
+
+	// An expired key can be created again, and Set clears the TTL
+	_, err := kv.SetIfNotExists("session", json.RawMessage(`"new"`))
+	assert.NoError(t, err)
+	assert.NoError(t, kv.SetWithTTL("forever", json.RawMessage("2"), ttl))
+	assert.NoError(t, kv.Set("forever", json.RawMessage("3")))
+	left, ok = kv.TTL("forever")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), left)
+}
+
+func TestExpirySweeper(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithExpirySweepInterval(10*time.Millisecond))
+	defer kv.Close()
+
+	assert.NoError(t, kv.SetWithTTL("session", json.RawMessage(`"token"`), 50*time.Millisecond))
+	assert.NoError(t, kv.SetWithTTL("renewed", json.RawMessage(`"token"`), 50*time.Millisecond))
+	assert.NoError(t, kv.SetWithTTL("renewed", json.RawMessage(`"token"`), time.Hour))
+
+	// The sweeper deletes the expired key through the log, like any other delete
+	deleted := func() bool {
+		versions, err := kv.History("session")
+		return err == nil && len(versions) > 0 && versions[0].Deleted
+	}
+	assert.Eventually(t, deleted, time.Second, 10*time.Millisecond)
+
+	_, ok := kv.Get("renewed")
+	assert.True(t, ok)
+	kv.Mutex.RLock()
+	assert.Equal(t, []string{"renewed"}, keysOf(kv.expiring))
+	kv.Mutex.RUnlock()
+}
+
+func TestExpiryRecovered(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+	kv := NewStore(100, filename, indexFilename, WithExpirySweepInterval(0))
+
+	assert.NoError(t, kv.SetWithTTL("flushed", json.RawMessage("1"), 100*time.Millisecond))
+	assert.NoError(t, kv.Flush())
+	assert.NoError(t, kv.SetWithTTL("logged", json.RawMessage("1"), time.Hour))
+	kv.WAL.Close()
+
+	// The expiry of both is recovered, from the data file and from the log
+	kv = NewStore(100, filename, indexFilename, WithExpirySweepInterval(10*time.Millisecond))
+	defer kv.Close()
+
+	left, ok := kv.TTL("logged")
+	assert.True(t, ok)
+	assert.True(t, left > time.Minute, left)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		versions, err := kv.History("flushed")
+		return err == nil && len(versions) > 0 && versions[0].Deleted
+	}, time.Second, 10*time.Millisecond)
+}
+
+// keysOf returns the keys of the map.
+func keysOf(m map[string]int64) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Txn is a transaction: a group of reads and writes across any number of keys
+// that takes effect all at once or not at all. It reads from a snapshot of the
+// store taken when it began, along with its own writes, which are held in the
+// transaction until Commit. Commit logs them as a single record, so recovery
+// after a crash either applies all of them or none.
+//
+// Conflicts are detected optimistically at commit: if another write to a key
+// the transaction writes or watches was made after the transaction began,
+// Commit fails with ErrTxnConflict and nothing is applied, so the first writer
+// wins.
+//
+// A Txn must not be used from more than one goroutine at a time, and must be
+// committed or rolled back once it is finished with.
+type Txn struct {
+	store    *Store
+	snapshot uint64               // Sequence number of the last write the transaction can see
+	writes   map[string]Operation // Writes made by the transaction, by key
+	watched  map[string]bool      // Keys that must not be written by others before Commit
+	done     bool
+}
+
+// ErrTxnConflict is returned when a transaction writes a key that another
+// write changed after the transaction began.
+var ErrTxnConflict = errors.New("transaction conflicts with a concurrent write")
+
+// ErrTxnDone is returned when using a transaction that was already committed or rolled back.
+var ErrTxnDone = errors.New("transaction has already been committed or rolled back")
+
+// Begin starts a transaction reading from the store as it is now.
+func (s *Store) Begin() *Txn {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	t := &Txn{
+		store:    s,
+		snapshot: s.WAL.LastSeq(),
+		writes:   make(map[string]Operation),
+		watched:  make(map[string]bool),
+	}
+	s.snapshots.open(t.snapshot)
+	return t
+}
+
+// Get returns the value of the key as of when the transaction began, or as the
+// transaction last wrote it.
+func (t *Txn) Get(key string) (json.RawMessage, bool, error) {
+	if t.done {
+		return nil, false, ErrTxnDone
+	}
+
+	if op, ok := t.writes[key]; ok {
+		if op.Deleted {
+			return nil, false, nil
+		}
+		return op.Value, true, nil
+	}
+
+	value, ok := t.store.GetAt(key, t.snapshot)
+	return value, ok, nil
+}
+
+// Watch makes the transaction conflict with writes to the key made by others
+// after it began, as if it wrote the key itself. A caller that decides what to
+// write from the values it reads watches those keys, so that the decision
+// still holds when the writes are applied.
+func (t *Txn) Watch(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.watched[key] = true
+	return nil
+}
+
+// Set writes the value of the key when the transaction commits.
+func (t *Txn) Set(key string, value json.RawMessage) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	t.writes[key] = Operation{Key: key, Value: value}
+	return nil
+}
+
+// Delete removes the key when the transaction commits. Unlike Store.Delete, it
+// does not check that the key exists.
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.writes[key] = Operation{Key: key, Deleted: true}
+	return nil
+}
+
+// Commit applies the transaction's writes, unless another write to one of the
+// same keys, or to a key it watches, was made after the transaction began, in
+// which case it applies none of them and returns ErrTxnConflict. The
+// transaction is finished either way.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	defer t.finish()
+
+	keys := make([]string, 0, len(t.writes))
+	for key := range t.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ops := make([]Operation, len(keys))
+	for i, key := range keys {
+		ops[i] = t.writes[key]
+	}
+
+	for key := range t.watched {
+		if _, ok := t.writes[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	conditions, err := t.conditions(keys)
+	if err != nil {
+		return err
+	}
+	return t.store.apply(ops, conditions)
+}
+
+// conditions returns what must hold for the transaction's writes to commit,
+// for each of the keys it writes or watches. A single store knows which keys
+// were written while the transaction was open. Every node in a raft cluster
+// has to come to the same answer as it applies the writes, so there each key
+// must still be at the version the transaction could see.
+func (t *Txn) conditions(keys []string) ([]writeCondition, error) {
+	conditions := make([]writeCondition, len(keys))
+	if t.store.raft == nil {
+		for i, key := range keys {
+			conditions[i] = writeCondition{Kind: conditionUnwritten, Key: key, Version: t.snapshot}
+		}
+		return conditions, nil
+	}
+
+	t.store.Mutex.RLock()
+	defer t.store.Mutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	for i, key := range keys {
+		op, ok, err := t.store.Buffer.versionAt(key, t.snapshot)
+		if err != nil {
+			return nil, err
+		}
+		conditions[i] = writeCondition{Kind: conditionUnchanged, Key: key}
+		if ok && !op.Deleted && !op.expired(now) {
+			conditions[i].Version = op.Seq
+		}
+	}
+	return conditions, nil
+}
+
+// Rollback discards the transaction's writes. It does nothing if the
+// transaction has already been committed or rolled back.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.finish()
+}
+
+// finish stops the store tracking writes on the transaction's behalf.
+func (t *Txn) finish() {
+	t.store.Mutex.Lock()
+	defer t.store.Mutex.Unlock()
+
+	t.store.snapshots.close(t.snapshot)
+	t.done = true
+}
+
+// snapshotTracker keeps track of the versions open transactions and snapshots
+// read at, and remembers the last write to each key for as long as an open
+// transaction could conflict with it, that is, for writes made after the
+// oldest of them began.
+type snapshotTracker struct {
+	versions map[uint64]int    // Number of transactions and snapshots open at each version
+	written  map[string]uint64 // Sequence number of the last write to each key
+}
+
+func newSnapshotTracker() snapshotTracker {
+	return snapshotTracker{
+		versions: make(map[uint64]int),
+		written:  make(map[string]uint64),
+	}
+}
+
+func (tr *snapshotTracker) open(version uint64) {
+	tr.versions[version]++
+}
+
+// close forgets a transaction or snapshot at the version, along with the
+// writes nothing still open could conflict with.
+func (tr *snapshotTracker) close(version uint64) {
+	if tr.versions[version]--; tr.versions[version] <= 0 {
+		delete(tr.versions, version)
+	}
+
+	oldest, ok := tr.oldest()
+	if !ok {
+		tr.written = make(map[string]uint64)
+		return
+	}
+	for key, seq := range tr.written {
+		if seq <= oldest {
+			delete(tr.written, key)
+		}
+	}
+}
+
+// oldest returns the oldest version a transaction or snapshot is open at, if any.
+func (tr *snapshotTracker) oldest() (uint64, bool) {
+	oldest, ok := uint64(0), false
+	for version := range tr.versions {
+		if !ok || version < oldest {
+			oldest, ok = version, true
+		}
+	}
+	return oldest, ok
+}
+
+// recordWrites notes the writes, which must already have their sequence numbers.
+func (tr *snapshotTracker) recordWrites(ops []Operation) {
+	if len(tr.versions) == 0 {
+		return
+	}
+	for _, op := range ops {
+		tr.written[op.Key] = op.Seq
+	}
+}
+
+// writtenSince reports whether the key was written after the version.
+func (tr *snapshotTracker) writtenSince(key string, version uint64) bool {
+	seq, ok := tr.written[key]
+	return ok && seq > version
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxnCommit(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	assert.NoError(t, kv.Set("deleted", json.RawMessage("0")))
+
+	txn := kv.Begin()
+	assert.NoError(t, txn.Set("a", json.RawMessage("1")))
+	assert.NoError(t, txn.Set("b", json.RawMessage("2")))
+	assert.NoError(t, txn.Delete("deleted"))
+
+	// The transaction sees its own writes, but nothing else does until it commits
+	got, ok, err := txn.Get("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(got))
+	_, ok, err = txn.Get("deleted")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, ok = kv.Get("a")
+	assert.False(t, ok)
+	_, ok = kv.Get("deleted")
+	assert.True(t, ok)
+
+	assert.NoError(t, txn.Commit())
+	got, ok = kv.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "2", string(got))
+	_, ok = kv.Get("deleted")
+	assert.False(t, ok)
+
+	assert.Equal(t, ErrTxnDone, txn.Commit())
+	assert.Equal(t, ErrTxnDone, txn.Set("c", json.RawMessage("3")))
+	assert.Empty(t, kv.snapshots.versions)
+}
+
+func TestTxnRollback(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	txn := kv.Begin()
+	assert.NoError(t, txn.Set("a", json.RawMessage("1")))
+	txn.Rollback()
+	txn.Rollback()
+
+	_, ok := kv.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, ErrTxnDone, txn.Commit())
+	assert.Empty(t, kv.snapshots.versions)
+}
+
+func TestTxnWriteConflict(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	first := kv.Begin()
+	second := kv.Begin()
+	assert.NoError(t, first.Set("x", json.RawMessage("1")))
+	assert.NoError(t, second.Set("x", json.RawMessage("2")))
+	assert.NoError(t, second.Set("y", json.RawMessage("2")))
+
+	// The first to commit wins, and none of the loser's writes are applied
+	assert.NoError(t, first.Commit())
+	assert.Equal(t, ErrTxnConflict, second.Commit())
+
+	got, _ := kv.Get("x")
+	assert.Equal(t, "1", string(got))
+	_, ok := kv.Get("y")
+	assert.False(t, ok)
+
+	// Writes to other keys do not conflict
+	third := kv.Begin()
+	assert.NoError(t, kv.Set("z", json.RawMessage("3")))
+	assert.NoError(t, third.Set("x", json.RawMessage("3")))
+	assert.NoError(t, third.Commit())
+	assert.Empty(t, kv.snapshots.written)
+}
+
+func TestTxnWatch(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	assert.NoError(t, kv.Set("balance", json.RawMessage("10")))
+
+	// A write to a watched key between Begin and Commit conflicts, though the
+	// transaction does not write the key itself
+	txn := kv.Begin()
+	assert.NoError(t, txn.Watch("balance"))
+	assert.NoError(t, txn.Set("log", json.RawMessage(`"paid"`)))
+	assert.NoError(t, kv.Set("balance", json.RawMessage("0")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+	_, ok := kv.Get("log")
+	assert.False(t, ok)
+
+	// Without a concurrent write, it commits
+	txn = kv.Begin()
+	assert.NoError(t, txn.Watch("balance"))
+	assert.NoError(t, txn.Set("log", json.RawMessage(`"paid"`)))
+	assert.NoError(t, txn.Commit())
+	_, ok = kv.Get("log")
+	assert.True(t, ok)
+	assert.Equal(t, ErrTxnDone, txn.Watch("balance"))
+}
+
+func TestTxnReadsFromSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+	assert.NoError(t, kv.Set("a", json.RawMessage("1")))
+	assert.NoError(t, kv.Set("b", json.RawMessage("1")))
+
+	txn := kv.Begin()
+	defer txn.Rollback()
+	assert.NoError(t, kv.Set("a", json.RawMessage("2")))
+
+	// Writes made after the transaction began are not visible to it
+	for _, key := range []string{"a", "b"} {
+		got, ok, err := txn.Get(key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "1", string(got))
+	}
+
+	// Even once they have been flushed to disk
+	assert.NoError(t, kv.Flush())
+	got, _, err := txn.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(got))
+
+	// Reading a key another write changed does not conflict, writing it does
+	assert.NoError(t, txn.Set("a", json.RawMessage("3")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+}
+
+func TestTxnRecoveredFromLog(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+	kv := NewStore(100, filename, indexFilename)
+
+	txn := kv.Begin()
+	assert.NoError(t, txn.Set("a", json.RawMessage("1")))
+	assert.NoError(t, txn.Set("b", json.RawMessage("2")))
+	assert.NoError(t, txn.Commit())
+	kv.WAL.Close()
+
+	// Opening the store again without a shutdown recovers the whole transaction
+	kv = NewStore(100, filename, indexFilename)
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		got, ok := kv.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, want, string(got))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Every write is a new version of its key, numbered by its sequence number in
+// the write-ahead log, so versions only ever increase. A record points to the
+// record of the version before it, and older versions are kept until they
+// are garbage collected by compaction; see Disk.Retention.
+
+// KeyVersion is one version of a key.
+type KeyVersion struct {
+	Version uint64          `json:"version"`
+	Time    time.Time       `json:"time"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+func (op Operation) keyVersion() KeyVersion {
+	return KeyVersion{Version: op.Seq, Time: time.Unix(0, op.Time), Value: op.Value, Deleted: op.Deleted}
+}
+
+func (r *Record) keyVersion() KeyVersion {
+	return KeyVersion{Version: r.Version, Time: time.Unix(0, r.Time), Value: r.Data, Deleted: r.Deleted}
+}
+
+// retentionPolicy decides which superseded versions are still needed: those
+// that were current at some point within the retention window, and those an
+// open snapshot may read.
+type retentionPolicy struct {
+	cutoff    int64  // Versions superseded after this time are needed
+	pinned    uint64 // Versions superseded by a version after this one are needed
+	hasPinned bool
+}
+
+// retention returns the policy for keeping versions as of now.
+func (d *Disk) retention() retentionPolicy {
+	r := retentionPolicy{cutoff: time.Now().Add(-d.Retention).UnixNano()}
+	if d.Pinned != nil {
+		r.pinned, r.hasPinned = d.Pinned()
+	}
+	return r
+}
+
+// needsPrevious reports whether the version before the one written at the
+// version and time is still needed.
+func (r retentionPolicy) needsPrevious(version uint64, time int64) bool {
+	return time > r.cutoff || (r.hasPinned && version > r.pinned)
+}
+
+// keep returns the operations, oldest first, from the end of the superseded
+// ones that are still needed now that latest has replaced them.
+func (r retentionPolicy) keep(superseded []Operation, latest Operation) []Operation {
+	i := len(superseded)
+	for next := latest; i > 0 && r.needsPrevious(next.Seq, next.Time); {
+		i--
+		next = superseded[i]
+	}
+	return superseded[i:]
+}
+
+// walkVersions calls fn with the records of the key's versions, newest first,
+// until fn returns false or there are no more.
+func (d *Disk) walkVersions(key string, fn func(record *Record) bool) error {
+	hash := hashKey(key)
+	value, ok, err := d.Index.Get(hash, key)
+	if err != nil || !ok {
+		return err
+	}
+
+	for {
+		record, err := d.readRecord(value)
+		if err != nil {
+			return fmt.Errorf("reading record for %q: %w", key, err)
+		}
+		if record.Hash != hash || record.Key != key {
+			return fmt.Errorf("%w: record for %q found for %q", errIndexCorrupt, record.Key, key)
+		}
+		if !fn(record) || record.PrevSize == 0 {
+			return nil
+		}
+		value = IndexValue{Pos: record.PrevPos, Size: record.PrevSize}
+	}
+}
+
+// GetAt returns the value the key had at the version. Versions that have been
+// garbage collected, or whose values have expired since, read as missing.
+func (d *Disk) GetAt(key string, version uint64) (json.RawMessage, bool) {
+	op, ok, err := d.versionAt(key, version)
+	if err != nil {
+		fmt.Println("Error reading history:", err)
+		return nil, false
+	}
+	if !ok || op.Deleted || op.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+	return op.Value, true
+}
+
+// versionAt returns the write that gave the key its value at the version, if
+// it has not been garbage collected.
+func (d *Disk) versionAt(key string, version uint64) (Operation, bool, error) {
+	var op Operation
+	var found bool
+	err := d.walkVersions(key, func(record *Record) bool {
+		if record.Version > version {
+			return true
+		}
+		op = Operation{Seq: record.Version, Key: record.Key, Value: record.Data, Deleted: record.Deleted, Time: record.Time, Expires: record.Expires}
+		found = true
+		return false
+	})
+	return op, found, err
+}
+
+// History returns the versions of the key that have not been garbage collected, newest first.
+func (d *Disk) History(key string) ([]KeyVersion, error) {
+	var versions []KeyVersion
+	err := d.walkVersions(key, func(record *Record) bool {
+		// A write applied again by recovery after it reached the disk shows up twice
+		if n := len(versions); n > 0 && record.Version != 0 && record.Version == versions[n-1].Version {
+			return true
+		}
+		versions = append(versions, record.keyVersion())
+		return true
+	})
+	return versions, err
+}
+
+// Snapshot is a consistent view of the store as of a version. Reads through it
+// see every write up to that version and none after, however many keys they
+// read. The versions it reads are kept from garbage collection until it is
+// released, so it must be released once it is finished with.
+type Snapshot struct {
+	store    *Store
+	version  uint64
+	released bool
+}
+
+// Version returns the latest version written to the store.
+func (s *Store) Version() uint64 {
+	return s.WAL.LastSeq()
+}
+
+// Snapshot returns a snapshot of the store as it is now.
+func (s *Store) Snapshot() *Snapshot {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+
+	version := s.WAL.LastSeq()
+	s.snapshots.open(version)
+	return &Snapshot{store: s, version: version}
+}
+
+// Version returns the version the snapshot reads at.
+func (sn *Snapshot) Version() uint64 {
+	return sn.version
+}
+
+// Get returns the value of the key as of the snapshot.
+func (sn *Snapshot) Get(key string) (json.RawMessage, bool) {
+	return sn.store.GetAt(key, sn.version)
+}
+
+// Release lets the versions the snapshot reads be garbage collected. It does
+// nothing if the snapshot has already been released.
+func (sn *Snapshot) Release() {
+	sn.store.Mutex.Lock()
+	defer sn.store.Mutex.Unlock()
+
+	if !sn.released {
+		sn.store.snapshots.close(sn.version)
+		sn.released = true
+	}
+}
+
+// GetAt returns the value the key had at the version: the value of the latest
+// write to it with that version or an earlier one. Versions that have been
+// garbage collected read as missing.
+func (s *Store) GetAt(key string, version uint64) (json.RawMessage, bool) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return s.Buffer.GetAt(key, version)
+}
+
+// History returns the versions of the key that have not been garbage collected, newest first.
+func (s *Store) History(key string) ([]KeyVersion, error) {
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
+
+	return s.Buffer.History(key)
+}
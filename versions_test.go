@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAt(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithVersionRetention(time.Hour))
+
+	// Write a few versions of the key, noting the version after each
+	before := kv.Version()
+	writes := []struct {
+		value   string
+		deleted bool
+	}{{"1", false}, {"2", false}, {"", true}, {"3", false}}
+	versions := make([]uint64, len(writes))
+	for i, write := range writes {
+		if write.deleted {
+			assert.NoError(t, kv.Delete("key"))
+		} else {
+			assert.NoError(t, kv.Set("key", json.RawMessage(write.value)))
+		}
+		assert.NoError(t, kv.Set("other", json.RawMessage("0")))
+		versions[i] = kv.Version()
+	}
+
+	check := func() {
+		_, ok := kv.GetAt("key", before)
+		assert.False(t, ok)
+		for i, write := range writes {
+			got, ok := kv.GetAt("key", versions[i])
+			assert.Equal(t, !write.deleted, ok, "version %d", versions[i])
+			assert.Equal(t, write.value, string(got), "version %d", versions[i])
+		}
+	}
+
+	// Versions are read from the write batch and then from the disk
+	check()
+	assert.NoError(t, kv.Flush())
+	check()
+	_, err := kv.Compact()
+	assert.NoError(t, err)
+	check()
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithVersionRetention(time.Hour))
+
+	assert.NoError(t, kv.Set("key", json.RawMessage("1")))
+	assert.NoError(t, kv.Flush())
+	assert.NoError(t, kv.Set("key", json.RawMessage("2")))
+	assert.NoError(t, kv.Delete("key"))
+	assert.NoError(t, kv.Set("key", json.RawMessage("3")))
+
+	versions, err := kv.History("key")
+	assert.NoError(t, err)
+	var values []string
+	for i, version := range versions {
+		if version.Deleted {
+			values = append(values, "deleted")
+		} else {
+			values = append(values, string(version.Value))
+		}
+		if i > 0 {
+			assert.Less(t, version.Version, versions[i-1].Version)
+		}
+	}
+	assert.Equal(t, []string{"3", "deleted", "2", "1"}, values)
+
+	versions, err = kv.History("missing")
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"))
+
+	assert.NoError(t, kv.Set("a", json.RawMessage("1")))
+	assert.NoError(t, kv.Set("b", json.RawMessage("1")))
+	snapshot := kv.Snapshot()
+
+	assert.NoError(t, kv.BatchSet([]StoreEntry{{Key: "a", Value: json.RawMessage("2")}, {Key: "c", Value: json.RawMessage("2")}}))
+	assert.NoError(t, kv.Delete("b"))
+
+	// Without retention, old versions are only kept while the snapshot needs them
+	check := func() {
+		for key, want := range map[string]string{"a": "1", "b": "1", "c": ""} {
+			got, ok := snapshot.Get(key)
+			assert.Equal(t, want != "", ok, key)
+			assert.Equal(t, want, string(got), key)
+		}
+	}
+	check()
+	assert.NoError(t, kv.Flush())
+	_, err := kv.Compact()
+	assert.NoError(t, err)
+	check()
+
+	snapshot.Release()
+	snapshot.Release()
+	stats, err := kv.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Keys)
+	assert.Equal(t, 2, stats.Records)
+	_, ok := kv.GetAt("a", snapshot.Version())
+	assert.False(t, ok)
+}
+
+func TestCompactDropsVersionsPastRetention(t *testing.T) {
+	dir := t.TempDir()
+	retention := 100 * time.Millisecond
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithVersionRetention(retention))
+
+	for _, value := range []string{"1", "2", "3"} {
+		assert.NoError(t, kv.Set("key", json.RawMessage(value)))
+		assert.NoError(t, kv.Set("deleted", json.RawMessage(value)))
+	}
+	assert.NoError(t, kv.Delete("deleted"))
+	assert.NoError(t, kv.Flush())
+
+	// Every version is still within the retention window
+	stats, err := kv.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Keys)
+	assert.Equal(t, 7, stats.Records)
+
+	// Once it has passed, only the latest version of each key that still exists is kept
+	time.Sleep(retention)
+	stats, err = kv.Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Keys)
+	assert.Equal(t, 1, stats.Records)
+
+	versions, err := kv.History("key")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "3", string(versions[0].Value))
+	versions, err = kv.History("deleted")
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+}
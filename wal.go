@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The write-ahead log is a directory of segment files. Each segment is named
+// after the sequence number of its first record and holds a series of records
+// framed as:
+//
+//	length  uint32  length of the payload
+//	crc     uint32  CRC-32C of the payload
+//	payload []byte  sequence number, record type and type specific fields
+//
+// Operations logged together are written as a single batch record, so that
+// recovery either finds all of them or, if the write was torn, none of them.
+// A segment is closed and a new one started once it grows past the segment
+// size. Checkpoint records mark every record up to a sequence number as flushed
+// to disk, after which the segments holding only older records are removed.
+//
+// In an encrypted log, every payload is replaced by a sealed record: its
+// sequence number, the walSealed type, and the original payload sealed with
+// the keyring, bound to the sequence number.
+
+// Default size at which the log moves on to a new segment
+const DefaultWALSegmentSize = 4 << 20
+
+// Frames claiming to be larger than this are treated as corrupt
+const maxWALRecordSize = 1 << 30
+
+const walSegmentExt = ".wal"
+
+type walRecordType byte
+
+const (
+	walSet walRecordType = iota + 1
+	walDelete
+	walCheckpoint
+	walBatch
+	walSetExpiring // A set whose value expires
+	walSealed      // Any other record, encrypted
+)
+
+// walTimed flags the type of a set or delete followed by the time it was
+// applied. Records logged before times were kept don't have it.
+const walTimed walRecordType = 0x80
+
+// walRecord is a single entry in the log.
+type walRecord struct {
+	Seq     uint64
+	Type    walRecordType
+	Key     string
+	Value   []byte
+	Time    int64       // For sets and deletes, when the operation was applied, in nanoseconds since the epoch
+	Expires int64       // For expiring sets, when the value expires, in nanoseconds since the epoch
+	Upto    uint64      // For checkpoints, the last sequence number flushed to disk
+	Batch   []walRecord // For batches, the sets and deletes numbered on from Seq
+}
+
+// lastSeq returns the sequence number of the last operation in the record.
+func (r *walRecord) lastSeq() uint64 {
+	if r.Type == walBatch && len(r.Batch) > 0 {
+		return r.Seq + uint64(len(r.Batch)) - 1
+	}
+	return r.Seq
+}
+
+// operations returns the sets and deletes in the record as operations.
+func (r *walRecord) operations() []Operation {
+	switch r.Type {
+	case walSet:
+		return []Operation{{Seq: r.Seq, Key: r.Key, Value: r.Value, Time: r.Time}}
+	case walSetExpiring:
+		return []Operation{{Seq: r.Seq, Key: r.Key, Value: r.Value, Time: r.Time, Expires: r.Expires}}
+	case walDelete:
+		return []Operation{{Seq: r.Seq, Key: r.Key, Deleted: true, Time: r.Time}}
+	case walBatch:
+		var ops []Operation
+		for i := range r.Batch {
+			r.Batch[i].Seq = r.Seq + uint64(i)
+			ops = append(ops, r.Batch[i].operations()...)
+		}
+		return ops
+	}
+	return nil
+}
+
+// encodedType returns the type the record is written with, flagged with
+// walTimed if it is a set or delete with a time.
+func (r *walRecord) encodedType() walRecordType {
+	if r.Time != 0 && (r.Type == walSet || r.Type == walSetExpiring || r.Type == walDelete) {
+		return r.Type | walTimed
+	}
+	return r.Type
+}
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errWALTorn is returned when a frame is incomplete or fails its checksum,
+// which happens when the process dies part way through a write.
+var errWALTorn = errors.New("torn write-ahead log record")
+
+// Durability controls when the log is synced to stable storage, and so which
+// acknowledged writes can be lost if the machine crashes.
+type Durability int
+
+const (
+	// DurabilityNone never syncs the log, leaving it to the operating system.
+	// Writes survive the process crashing but not the machine.
+	DurabilityNone Durability = iota
+	// DurabilityEveryWrite syncs the log after every write, before it is acknowledged.
+	DurabilityEveryWrite
+	// DurabilityInterval syncs the log in the background at a fixed interval.
+	// A machine crash can lose the writes made since the last sync.
+	DurabilityInterval
+	// DurabilityGroupCommit makes every writer wait for a sync covering its
+	// write, but writers that arrive while a sync is in progress share the next one.
+	DurabilityGroupCommit
+)
+
+// Default interval between syncs for DurabilityInterval
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// ParseDurability converts a name as used on the command line to a Durability.
+func ParseDurability(name string) (Durability, error) {
+	switch name {
+	case "none":
+		return DurabilityNone, nil
+	case "write":
+		return DurabilityEveryWrite, nil
+	case "interval":
+		return DurabilityInterval, nil
+	case "group":
+		return DurabilityGroupCommit, nil
+	default:
+		return DurabilityNone, fmt.Errorf("unknown durability %q, expected none, write, interval or group", name)
+	}
+}
+
+type WAL struct {
+	mu          sync.Mutex // Guards the segment state against the background syncer
+	dir         string
+	segmentSize int64
+	segments    []uint64 // First sequence number of each segment, oldest first
+	file        *os.File // Segment currently being appended to
+	size        int64    // Size of the current segment
+	nextSeq     uint64
+	keys        *Keyring // Keys records are sealed with, or nil
+
+	// In a follower's log, every sequence number belongs to a record from the
+	// leader, so checkpoints do not take one of their own
+	replica bool
+
+	// Retain returns the first sequence number a follower still needs, if
+	// any, and checkpoints keep the segments holding it and everything after
+	Retain   func() (seq uint64, ok bool)
+	appended chan struct{} // Closed and replaced whenever records are appended
+
+	durability Durability
+	syncMu     sync.Mutex
+	syncCond   *sync.Cond // Signalled whenever a sync finishes
+	syncing    bool       // Whether a sync is in progress
+	syncedSeq  uint64     // Every record up to this sequence number is synced
+	syncs      uint64     // Number of syncs, updated atomically
+	stop       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewWAL opens the log in dir, creating it if needed. A torn record at the end
+// of the newest segment is cut off so that new records follow the last valid one.
+// For DurabilityInterval, the log is synced every syncInterval until it is closed.
+// With keys, records are encrypted, and records written before can be read
+// whether they are encrypted or not.
+func NewWAL(dir string, segmentSize int64, durability Durability, syncInterval time.Duration, keys *Keyring) (*WAL, error) {
+	w, err := openWAL(dir, segmentSize, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	w.durability = durability
+	w.syncCond = sync.NewCond(&w.syncMu)
+	w.syncedSeq = w.nextSeq - 1
+	w.stop = make(chan struct{})
+
+	if durability == DurabilityInterval {
+		go w.syncLoop(syncInterval)
+	}
+
+	return w, nil
+}
+
+func openWAL(dir string, segmentSize int64, keys *Keyring) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    segments,
+		nextSeq:     1,
+		keys:        keys,
+		appended:    make(chan struct{}),
+	}
+
+	if len(segments) == 0 {
+		if err := w.openSegment(w.nextSeq); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	// Find the end of the valid records in every segment
+	for i, first := range segments {
+		records, validSize, err := readWALSegment(w.segmentPath(first), keys)
+		if err == errWALTorn && i < len(segments)-1 {
+			return nil, fmt.Errorf("corrupt write-ahead log segment %s", w.segmentPath(first))
+		} else if err != nil && err != errWALTorn {
+			return nil, err
+		}
+
+		if len(records) > 0 {
+			w.nextSeq = records[len(records)-1].lastSeq() + 1
+		} else if first > w.nextSeq {
+			w.nextSeq = first
+		}
+
+		if i == len(segments)-1 {
+			file, err := os.OpenFile(w.segmentPath(first), os.O_RDWR, 0644)
+			if err != nil {
+				return nil, err
+			}
+			if err := file.Truncate(validSize); err != nil {
+				return nil, err
+			}
+			if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+				return nil, err
+			}
+			w.file = file
+			w.size = validSize
+		}
+	}
+
+	return w, nil
+}
+
+// listWALSegments returns the first sequence number of each segment in dir, in order.
+func listWALSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		var first uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, walSegmentExt), "%d", &first); err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (w *WAL) segmentPath(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, walSegmentExt))
+}
+
+// openSegment starts a new segment whose first record will have sequence number first.
+func (w *WAL) openSegment(first uint64) error {
+	file, err := os.OpenFile(w.segmentPath(first), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Sync the old segment before closing it, as a pending sync will find it closed
+	if w.file != nil {
+		if w.durability != DurabilityNone {
+			if err := w.file.Sync(); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		w.file.Close()
+	}
+	w.file = file
+	w.size = 0
+	if len(w.segments) == 0 || w.segments[len(w.segments)-1] != first {
+		w.segments = append(w.segments, first)
+	}
+
+	return nil
+}
+
+// Append logs the operations in a single record and stamps each with its
+// sequence number, so that either all of them are recovered or none are. With
+// DurabilityEveryWrite the log is synced before it returns.
+func (w *WAL) Append(ops []Operation) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.appendLocked(ops)
+}
+
+// appendLocked appends the operations as Append does, with the lock held.
+func (w *WAL) appendLocked(ops []Operation) error {
+	records := make([]walRecord, len(ops))
+	for i := range ops {
+		ops[i].Seq = w.nextSeq + uint64(i)
+
+		records[i] = walRecord{Seq: ops[i].Seq, Type: walSet, Key: ops[i].Key, Value: ops[i].Value, Time: ops[i].Time}
+		if ops[i].Deleted {
+			records[i].Type = walDelete
+		} else if ops[i].Expires != 0 {
+			records[i].Type, records[i].Expires = walSetExpiring, ops[i].Expires
+		}
+	}
+
+	var buf bytes.Buffer
+	if len(records) == 1 {
+		encodeWALRecord(&buf, &records[0], w.keys)
+	} else {
+		encodeWALRecord(&buf, &walRecord{Seq: w.nextSeq, Type: walBatch, Batch: records}, w.keys)
+	}
+
+	if err := w.write(buf.Bytes(), uint64(len(ops))); err != nil {
+		return err
+	}
+
+	if w.durability == DurabilityEveryWrite {
+		atomic.AddUint64(&w.syncs, 1)
+		return w.file.Sync()
+	}
+
+	return nil
+}
+
+// Commit waits until the record with sequence number seq is as durable as the
+// log's durability setting requires. Only DurabilityGroupCommit waits here: the
+// first writer to arrive starts a sync of everything appended so far, and writers
+// arriving while it runs wait for it to finish and then share the next one.
+func (w *WAL) Commit(seq uint64) error {
+	if w.durability != DurabilityGroupCommit {
+		return nil
+	}
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	for w.syncedSeq < seq {
+		if w.syncing {
+			w.syncCond.Wait()
+			continue
+		}
+
+		w.syncing = true
+		w.syncMu.Unlock()
+		upto, err := w.syncAll()
+		w.syncMu.Lock()
+		w.syncing = false
+		if err == nil && upto > w.syncedSeq {
+			w.syncedSeq = upto
+		}
+		w.syncCond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncAll syncs every record appended so far and returns the sequence number of
+// the last one. Appends can carry on while the sync runs.
+func (w *WAL) syncAll() (uint64, error) {
+	w.mu.Lock()
+	file := w.file
+	upto := w.nextSeq - 1
+	w.mu.Unlock()
+
+	// If the segment was rotated in the meantime it was synced before being closed
+	atomic.AddUint64(&w.syncs, 1)
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return 0, err
+	}
+
+	return upto, nil
+}
+
+// syncLoop syncs the log every interval until it is closed.
+func (w *WAL) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := w.syncAll(); err != nil {
+				fmt.Println("Error syncing write-ahead log:", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Checkpoint records that every operation up to and including sequence number
+// upto is durable on disk, and removes the segments that only hold such operations.
+func (w *WAL) Checkpoint(upto uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq, count := w.nextSeq, uint64(1)
+	if w.replica {
+		seq, count = w.nextSeq-1, 0
+	}
+	var buf bytes.Buffer
+	encodeWALRecord(&buf, &walRecord{Seq: seq, Type: walCheckpoint, Upto: upto}, w.keys)
+	if err := w.write(buf.Bytes(), count); err != nil {
+		return err
+	}
+
+	retained, retain := uint64(0), false
+	if w.Retain != nil {
+		retained, retain = w.Retain()
+	}
+
+	// A segment can go once the segment after it starts at or before upto+1,
+	// as every record in it then has a sequence number of at most upto,
+	// unless a follower has yet to read it
+	for len(w.segments) > 1 && w.segments[1] <= upto+1 && !(retain && retained < w.segments[1]) {
+		if err := os.Remove(w.segmentPath(w.segments[0])); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+
+	return nil
+}
+
+// write appends encoded records to the current segment, moving on to a new
+// segment once it is full.
+func (w *WAL) write(data []byte, count uint64) error {
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	w.nextSeq += count
+	close(w.appended)
+	w.appended = make(chan struct{})
+
+	if w.size >= w.segmentSize {
+		return w.openSegment(w.nextSeq)
+	}
+
+	return nil
+}
+
+// LastSeq returns the sequence number of the last record appended to the log.
+func (w *WAL) LastSeq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.nextSeq - 1
+}
+
+// Sync commits every record appended so far to stable storage.
+func (w *WAL) Sync() error {
+	_, err := w.syncAll()
+	return err
+}
+
+// Close stops the background syncer, syncs the log and closes the current segment.
+func (w *WAL) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+	})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// Pending returns the operations logged after the last checkpoint, in order.
+func (w *WAL) Pending() ([]Operation, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var ops []Operation
+	var upto uint64
+
+	for _, first := range w.segments {
+		records, _, err := readWALSegment(w.segmentPath(first), w.keys)
+		if err != nil && err != errWALTorn {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.Type == walCheckpoint {
+				if record.Upto > upto {
+					upto = record.Upto
+				}
+				continue
+			}
+			ops = append(ops, record.operations()...)
+		}
+	}
+
+	// Drop everything the last checkpoint says has reached the disk
+	pending := ops[:0]
+	for _, op := range ops {
+		if op.Seq > upto {
+			pending = append(pending, op)
+		}
+	}
+
+	return pending, nil
+}
+
+// Replay applies every operation logged after the last checkpoint to the disk,
+// syncs it and writes a new checkpoint. Operations that had already reached the
+// disk before a crash are applied again, which is harmless because the last
+// write wins. It returns the number of operations replayed.
+func (w *WAL) Replay(disk *Disk) (int, error) {
+	ops, err := w.Pending()
+	if err != nil {
+		return 0, err
+	}
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	if err := applyOperations(disk, ops); err != nil {
+		return 0, err
+	}
+
+	if err := disk.Sync(); err != nil {
+		return 0, err
+	}
+
+	return len(ops), w.Checkpoint(ops[len(ops)-1].Seq)
+}
+
+// applyOperations writes the operations to the disk in order.
+func applyOperations(disk *Disk, ops []Operation) error {
+	for _, op := range ops {
+		if err := disk.Write(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeWALRecord appends the framed record to buf, sealed with the keys if
+// they are not nil.
+func encodeWALRecord(buf *bytes.Buffer, record *walRecord, keys *Keyring) {
+	var payload []byte
+	payload = binary.BigEndian.AppendUint64(payload, record.Seq)
+	payload = append(payload, byte(record.encodedType()))
+
+	switch record.Type {
+	case walSet, walSetExpiring, walDelete:
+		payload = appendOperation(payload, record)
+	case walCheckpoint:
+		payload = binary.AppendUvarint(payload, record.Upto)
+	case walBatch:
+		payload = binary.AppendUvarint(payload, uint64(len(record.Batch)))
+		for i := range record.Batch {
+			payload = append(payload, byte(record.Batch[i].encodedType()))
+			payload = appendOperation(payload, &record.Batch[i])
+		}
+	}
+
+	if keys != nil {
+		header := append(binary.BigEndian.AppendUint64(nil, record.Seq), byte(walSealed))
+		payload = append(header, keys.seal(payload, header)...)
+	}
+
+	writeFrame(buf, payload)
+}
+
+// writeFrame appends the payload to buf, framed with its length and checksum.
+func writeFrame(buf *bytes.Buffer, payload []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, walCRCTable))
+	buf.Write(header[:])
+	buf.Write(payload)
+}
+
+// readFrame returns the payload of the frame at pos in data, and where the
+// frame after it starts. It returns errWALTorn if the frame is incomplete or
+// fails its checksum.
+func readFrame(data []byte, pos int64) ([]byte, int64, error) {
+	if int64(len(data))-pos < 8 {
+		return nil, pos, errWALTorn
+	}
+
+	length := binary.BigEndian.Uint32(data[pos : pos+4])
+	crc := binary.BigEndian.Uint32(data[pos+4 : pos+8])
+	if length > maxWALRecordSize || int64(len(data))-pos-8 < int64(length) {
+		return nil, pos, errWALTorn
+	}
+
+	payload := data[pos+8 : pos+8+int64(length)]
+	if crc32.Checksum(payload, walCRCTable) != crc {
+		return nil, pos, errWALTorn
+	}
+	return payload, pos + 8 + int64(length), nil
+}
+
+// appendOperation appends the fields of a set or delete record to dst.
+func appendOperation(dst []byte, record *walRecord) []byte {
+	dst = appendBytes(dst, []byte(record.Key))
+	if record.Type == walSet || record.Type == walSetExpiring {
+		dst = appendBytes(dst, record.Value)
+	}
+	if record.Time != 0 {
+		dst = binary.AppendVarint(dst, record.Time)
+	}
+	if record.Type == walSetExpiring {
+		dst = binary.AppendUvarint(dst, uint64(record.Expires))
+	}
+	return dst
+}
+
+// readOperation reads the fields of a set or delete record written by
+// appendOperation into the record, whose type must already be set. Timed
+// records are followed by the time they were applied.
+func readOperation(r *bytes.Reader, record *walRecord, timed bool) error {
+	key, err := readBytes(r)
+	if err != nil {
+		return err
+	}
+	record.Key = string(key)
+	if record.Type == walSet || record.Type == walSetExpiring {
+		if record.Value, err = readBytes(r); err != nil {
+			return err
+		}
+	}
+	if timed {
+		if record.Time, err = binary.ReadVarint(r); err != nil {
+			return err
+		}
+	}
+	if record.Type == walSetExpiring {
+		expires, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		record.Expires = int64(expires)
+	}
+	return nil
+}
+
+// appendBytes appends b to dst, prefixed with its length.
+func appendBytes(dst []byte, b []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// decodeWALRecord decodes a payload written by encodeWALRecord, opening it
+// with the keys if it is sealed.
+func decodeWALRecord(payload []byte, keys *Keyring) (*walRecord, error) {
+	if len(payload) < 9 {
+		return nil, errWALTorn
+	}
+
+	record := &walRecord{
+		Seq:  binary.BigEndian.Uint64(payload[0:8]),
+		Type: walRecordType(payload[8]) &^ walTimed,
+	}
+	timed := walRecordType(payload[8])&walTimed != 0
+	r := bytes.NewReader(payload[9:])
+
+	switch record.Type {
+	case walSet, walSetExpiring, walDelete:
+		if err := readOperation(r, record, timed); err != nil {
+			return nil, err
+		}
+	case walSealed:
+		if keys == nil {
+			return nil, ErrEncrypted
+		}
+		inner, err := keys.open(payload[9:], payload[:9])
+		if err != nil {
+			return nil, err
+		}
+		// A sealed record never holds another
+		return decodeWALRecord(inner, nil)
+	case walCheckpoint:
+		upto, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		record.Upto = upto
+	case walBatch:
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if count > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		record.Batch = make([]walRecord, count)
+		for i := range record.Batch {
+			op := &record.Batch[i]
+			t, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			op.Type = walRecordType(t) &^ walTimed
+			if op.Type != walSet && op.Type != walSetExpiring && op.Type != walDelete {
+				return nil, fmt.Errorf("unknown write-ahead log batch operation type %d", op.Type)
+			}
+			if err := readOperation(r, op, walRecordType(t)&walTimed != 0); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown write-ahead log record type %d", record.Type)
+	}
+
+	return record, nil
+}
+
+// readBytes reads a length-prefixed byte slice written by appendBytes.
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, n)
+	r.Read(b)
+	return b, nil
+}
+
+// readWALSegment returns the valid records in a segment, and the size of the
+// segment up to the end of the last one. It returns errWALTorn along with the
+// records read so far if the segment ends in an incomplete or corrupt record.
+func readWALSegment(path string, keys *Keyring) ([]*walRecord, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeWALFrames(data, keys)
+}
+
+// decodeWALFrames returns the valid records framed in data, as readWALSegment does.
+func decodeWALFrames(data []byte, keys *Keyring) ([]*walRecord, int64, error) {
+	var records []*walRecord
+	var pos int64
+	for pos < int64(len(data)) {
+		payload, next, err := readFrame(data, pos)
+		if err != nil {
+			return records, pos, err
+		}
+
+		record, err := decodeWALRecord(payload, keys)
+		if err != nil {
+			return records, pos, err
+		}
+
+		records = append(records, record)
+		pos = next
+	}
+
+	return records, pos, nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWALRecordRoundTrip(t *testing.T) {
+	tests := []walRecord{
+		{Seq: 1, Type: walSet, Key: "key", Value: []byte(`"value"`), Time: 1700000000000000000},
+		{Seq: 2, Type: walSet, Key: "key with spaces", Value: []byte("{\n  \"multi\": \"line\"\n}")},
+		{Seq: 3, Type: walSet, Key: "", Value: []byte{}},
+		{Seq: 4, Type: walDelete, Key: "deleted key", Time: 1700000000000000001},
+		{Seq: 5, Type: walSetExpiring, Key: "session", Value: []byte(`{}`), Expires: 1700000000000000000},
+		{Seq: 1 << 40, Type: walCheckpoint, Upto: 1<<40 - 1},
+		{Seq: 6, Type: walBatch, Batch: []walRecord{
+			{Type: walSet, Key: "a", Value: []byte("1"), Time: 2},
+			{Type: walDelete, Key: "b"},
+			{Type: walSetExpiring, Key: "c", Value: []byte("3"), Expires: 1},
+		}},
+	}
+
+	for _, record := range tests {
+		var buf bytes.Buffer
+		encodeWALRecord(&buf, &record, nil)
+
+		got, err := decodeWALRecord(buf.Bytes()[8:], nil)
+		assert.NoError(t, err)
+		assert.Equal(t, record.Seq, got.Seq)
+		assert.Equal(t, record.Type, got.Type)
+		assert.Equal(t, record.Key, got.Key)
+		assert.Equal(t, string(record.Value), string(got.Value))
+		assert.Equal(t, record.Time, got.Time)
+		assert.Equal(t, record.Expires, got.Expires)
+		assert.Equal(t, record.Upto, got.Upto)
+		assert.Equal(t, record.operations(), got.operations())
+	}
+}
+
+func TestWALPendingSkipsCheckpointedOperations(t *testing.T) {
+	wal, err := NewWAL(t.TempDir(), DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []Operation{{Key: "a", Value: json.RawMessage("1")}}
+	assert.NoError(t, wal.Append(ops))
+	assert.NoError(t, wal.Checkpoint(ops[0].Seq))
+	assert.NoError(t, wal.Append([]Operation{{Key: "b", Value: json.RawMessage("2")}, {Key: "a", Deleted: true}}))
+
+	pending, err := wal.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{
+		{Seq: 3, Key: "b", Value: json.RawMessage("2")},
+		{Seq: 4, Key: "a", Deleted: true},
+	}, pending)
+}
+
+func TestWALTornWriteIsCutOff(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, wal.Append([]Operation{{Key: "a", Value: json.RawMessage("1")}}))
+	assert.NoError(t, wal.Append([]Operation{{Key: "b", Value: json.RawMessage("2")}}))
+	wal.Close()
+
+	// Simulate a crash part way through writing the second record
+	path := wal.segmentPath(1)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-3], 0644)
+
+	wal, err = NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := wal.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{{Seq: 1, Key: "a", Value: json.RawMessage("1")}}, pending)
+
+	// New records follow the last valid one
+	ops := []Operation{{Key: "c", Value: json.RawMessage("3")}}
+	assert.NoError(t, wal.Append(ops))
+	assert.Equal(t, uint64(2), ops[0].Seq)
+
+	pending, err = wal.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+}
+
+func TestWALTornBatchIsDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, wal.Append([]Operation{{Key: "a", Value: json.RawMessage("1")}}))
+	assert.NoError(t, wal.Append([]Operation{{Key: "b", Value: json.RawMessage("2")}, {Key: "c", Value: json.RawMessage("3")}}))
+	wal.Close()
+
+	// A crash part way through the batch loses all of it, not just its last operation
+	path := wal.segmentPath(1)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-3], 0644)
+
+	wal, err = NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := wal.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{{Seq: 1, Key: "a", Value: json.RawMessage("1")}}, pending)
+
+	// A whole batch is replayed, and sequence numbers carry on after it
+	ops := []Operation{{Key: "b", Value: json.RawMessage("2")}, {Key: "c", Deleted: true}}
+	assert.NoError(t, wal.Append(ops))
+	wal.Close()
+	wal, err = NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err = wal.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{
+		{Seq: 1, Key: "a", Value: json.RawMessage("1")},
+		{Seq: 2, Key: "b", Value: json.RawMessage("2")},
+		{Seq: 3, Key: "c", Deleted: true},
+	}, pending)
+	ops = []Operation{{Key: "d", Value: json.RawMessage("4")}}
+	assert.NoError(t, wal.Append(ops))
+	assert.Equal(t, uint64(4), ops[0].Seq)
+}
+
+func TestWALChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, wal.Append([]Operation{{Key: "a", Value: json.RawMessage("1")}}))
+	assert.NoError(t, wal.Append([]Operation{{Key: "b", Value: json.RawMessage("2")}}))
+	wal.Close()
+
+	// Flip a bit in the value of the last record
+	path := wal.segmentPath(1)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0x01
+	os.WriteFile(path, data, 0644)
+
+	wal, err = NewWAL(dir, DefaultWALSegmentSize, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := wal.Pending()
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{{Seq: 1, Key: "a", Value: json.RawMessage("1")}}, pending)
+}
+
+func TestWALRotationAndTruncation(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := NewWAL(dir, 64, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint64
+	for i := 0; i < 20; i++ {
+		ops := []Operation{{Key: "key", Value: json.RawMessage(`"some value"`)}}
+		assert.NoError(t, wal.Append(ops))
+		last = ops[0].Seq
+	}
+
+	segments, _ := listWALSegments(dir)
+	assert.Greater(t, len(segments), 5)
+
+	// Everything is flushed, so only the segment being written to is kept
+	assert.NoError(t, wal.Checkpoint(last))
+	segments, _ = listWALSegments(dir)
+	assert.Len(t, segments, 1)
+
+	pending, err := wal.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Sequence numbers carry on from where they left off after reopening
+	wal.Close()
+	wal, err = NewWAL(dir, 64, DurabilityNone, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []Operation{{Key: "key", Value: json.RawMessage("1")}}
+	assert.NoError(t, wal.Append(ops))
+	assert.Equal(t, last+2, ops[0].Seq)
+}
+
+func TestReplayAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	// The writes stay in the write buffer, so nothing reaches the disk
+	kv := NewStore(100, filename, indexFilename)
+	kv.Set("key1", json.RawMessage(`"value1"`))
+	kv.Set("key2", json.RawMessage(`"value2"`))
+	kv.Delete("key1")
+	_, ok := kv.Buffer.Disk.Get("key2")
+	assert.False(t, ok)
+
+	// Opening the store again without a shutdown recovers the writes from the log
+	kv = NewStore(100, filename, indexFilename)
+	_, ok = kv.Buffer.Disk.Get("key1")
+	assert.False(t, ok)
+	got, ok := kv.Buffer.Disk.Get("key2")
+	assert.True(t, ok)
+	assert.Equal(t, `"value2"`, string(got))
+
+	// Recovery wrote a checkpoint, so there is nothing left to replay
+	ops, err := kv.WAL.Pending()
+	assert.NoError(t, err)
+	assert.Empty(t, ops)
+}
+
+func TestReplayKeepsWriteTimes(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	indexFilename := filepath.Join(dir, "test.idx")
+
+	kv := NewStore(100, filename, indexFilename, WithVersionRetention(time.Hour))
+	assert.NoError(t, kv.Set("key", json.RawMessage("1")))
+	assert.NoError(t, kv.Set("key", json.RawMessage("2")))
+	assert.NoError(t, kv.Delete("key"))
+	written, err := kv.History("key")
+	assert.NoError(t, err)
+	assert.Len(t, written, 3)
+
+	// The versions recovered from the log keep the times they were written at
+	time.Sleep(10 * time.Millisecond)
+	kv = NewStore(100, filename, indexFilename, WithVersionRetention(time.Hour))
+	replayed, err := kv.History("key")
+	assert.NoError(t, err)
+	assert.Len(t, replayed, 3)
+	for i := range replayed {
+		assert.Equal(t, written[i].Version, replayed[i].Version)
+		assert.True(t, written[i].Time.Equal(replayed[i].Time), "version %d written at %v, replayed at %v", written[i].Version, written[i].Time, replayed[i].Time)
+	}
+}
+
+func TestFlushWritesCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithWALDir(filepath.Join(dir, "log")))
+
+	entries := make([]StoreEntry, MaxBufferSize)
+	for i := range entries {
+		entries[i] = StoreEntry{Key: string(rune('a' + i%26)), Value: json.RawMessage("1")}
+	}
+	kv.BatchSet(entries)
+	kv.Set("pending", json.RawMessage("2"))
+
+	// Only the write after the flush still needs replaying
+	ops, err := kv.WAL.Pending()
+	assert.NoError(t, err)
+	if assert.Len(t, ops, 1) {
+		assert.NotZero(t, ops[0].Time)
+		ops[0].Time = 0
+	}
+	assert.Equal(t, []Operation{{Seq: MaxBufferSize + 2, Key: "pending", Value: json.RawMessage("2")}}, ops)
+
+	segments, _ := listWALSegments(filepath.Join(dir, "log"))
+	assert.NotEmpty(t, segments)
+}
+
+func TestReplayLegacyTextWAL(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	log := "Set \"a\" \"1\"\nCheckpoint\nSet \"key with spaces\" \"{\\n}\"\nDelete \"a\"\nSet \"c\" \"3" // Last line cut short
+	os.WriteFile(legacyWALPath(filename), []byte(log), 0644)
+
+	kv := NewStore(100, filename, filepath.Join(dir, "test.idx"))
+	got, ok := kv.Buffer.Disk.Get("key with spaces")
+	assert.True(t, ok)
+	assert.Equal(t, "{\n}", string(got))
+	_, ok = kv.Buffer.Disk.Get("c")
+	assert.False(t, ok)
+
+	// The text log is marked as applied so it is not replayed again
+	lines, err := readLegacyWAL(legacyWALPath(filename))
+	assert.NoError(t, err)
+	assert.Empty(t, lines)
+}
+
+func TestReplayBaselineTextWAL(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	log := "Set user:1 {\"name\": \"ann lee\"}\nSet count 42\n"
+	os.WriteFile(legacyWALPath(filename), []byte(log), 0644)
+
+	// Writes from the first version of the log, which did not quote them, are
+	// recovered too
+	kv := NewStore(100, filename, filepath.Join(dir, "test.idx"))
+	got, ok := kv.Buffer.Disk.Get("user:1")
+	assert.True(t, ok)
+	assert.Equal(t, `{"name": "ann lee"}`, string(got))
+	got, ok = kv.Buffer.Disk.Get("count")
+	assert.True(t, ok)
+	assert.Equal(t, "42", string(got))
+
+	// Keys may contain spaces and values may run over several lines. BatchSet
+	// logged the hash of each key, which is recovered from the rest of the log
+	// where it can be, and skipped where it can't rather than written under
+	// the hash
+	log = fmt.Sprintf("Set user 2 {\n  \"name\": \"bo lee\"\n}\nSet %d 7\nSet %d 8\n", hashKey("user 2"), hashKey("lost"))
+	os.WriteFile(legacyWALPath(filename), []byte(log), 0644)
+	n, err := replayLegacyWAL(legacyWALPath(filename), kv.Buffer.Disk)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	got, ok = kv.Buffer.Disk.Get("user 2")
+	assert.True(t, ok)
+	assert.Equal(t, "7", string(got))
+	_, ok = kv.Buffer.Disk.Get(fmt.Sprint(hashKey("lost")))
+	assert.False(t, ok)
+
+	// The store opens with any of them left to replay
+	kv.Close()
+	os.WriteFile(legacyWALPath(filename), []byte("Set user 3 {\n  \"a\": 1\n}\n"), 0644)
+	kv = NewStore(100, filename, filepath.Join(dir, "test.idx"))
+	defer kv.Close()
+	got, ok = kv.Buffer.Disk.Get("user 3")
+	assert.True(t, ok)
+	assert.Equal(t, "{\n  \"a\": 1\n}", string(got))
+
+	// An entry that cannot be read fails the replay rather than being dropped
+	for _, line := range []string{"Set key not json", "Set key", "Remove key", `Set "key" unquoted`} {
+		os.WriteFile(legacyWALPath(filename), []byte(line+"\n"), 0644)
+		_, err := replayLegacyWAL(legacyWALPath(filename), kv.Buffer.Disk)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestDurabilityEveryWrite(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithDurability(DurabilityEveryWrite))
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kv.Set("key", json.RawMessage(fmt.Sprint(i))))
+	}
+	assert.Equal(t, uint64(10), atomic.LoadUint64(&kv.WAL.syncs))
+}
+
+func TestDurabilityInterval(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"),
+		WithDurability(DurabilityInterval), WithSyncInterval(time.Millisecond))
+	defer kv.Close()
+
+	assert.NoError(t, kv.Set("key", json.RawMessage("1")))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadUint64(&kv.WAL.syncs) > 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestDurabilityGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithDurability(DurabilityGroupCommit))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				ops := []Operation{{Key: fmt.Sprintf("key%d-%d", i, j), Value: json.RawMessage("1")}}
+				assert.NoError(t, kv.apply(ops, nil))
+
+				// Once a write returns, the log has been synced past it
+				kv.WAL.syncMu.Lock()
+				assert.GreaterOrEqual(t, kv.WAL.syncedSeq, ops[0].Seq)
+				kv.WAL.syncMu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, atomic.LoadUint64(&kv.WAL.syncs), uint64(200))
+}
+
+func BenchmarkSetDurability(b *testing.B) {
+	modes := []struct {
+		name       string
+		durability Durability
+	}{
+		{"none", DurabilityNone},
+		{"write", DurabilityEveryWrite},
+		{"interval", DurabilityInterval},
+		{"group", DurabilityGroupCommit},
+	}
+
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			dir := b.TempDir()
+			kv := NewStore(100, filepath.Join(dir, "test.db"), filepath.Join(dir, "test.idx"), WithDurability(mode.durability))
+			defer kv.Close()
+
+			var n uint64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// Keep the key space small so the index stays the same size throughout
+					i := atomic.AddUint64(&n, 1)
+					kv.Set(fmt.Sprintf("key%d", i%1000), json.RawMessage(`{"value":"benchmark"}`))
+				}
+			})
+			b.StopTimer()
+
+			b.ReportMetric(float64(atomic.LoadUint64(&kv.WAL.syncs))/float64(b.N), "syncs/op")
+		})
+	}
+}